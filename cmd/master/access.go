@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// Reads are counted per blob so tiering can tell hot keys from cold ones.
+// Counts live in memory and are written to leveldb under accessPrefix +
+// "<index key>" every accessFlushInterval, so a crash loses a few seconds
+// of them at most.
+const (
+	accessPrefix        = "\x00access/"
+	accessFlushInterval = 10 * time.Second
+	// accessWindow is how long reads are counted before the count starts
+	// over, so Reads is "reads today" for a key that is read every day.
+	accessWindow = 24 * time.Hour
+)
+
+type accessStats struct {
+	LastRead    time.Time `json:"last_read"`
+	Reads       int64     `json:"reads"`
+	WindowStart time.Time `json:"window_start"`
+}
+
+// recentReads is the read count of the window that is still open at now.
+func (a accessStats) recentReads(now time.Time) int64 {
+	if now.Sub(a.WindowStart) > accessWindow {
+		return 0
+	}
+	return a.Reads
+}
+
+// accessShards is how many locks the pending reads are spread over by key,
+// so reads of different keys don't wait on each other.
+const accessShards = 64
+
+// accessDelta is the reads of a key since the stats were last written.
+type accessDelta struct {
+	reads       int64
+	first, last time.Time
+}
+
+type accessShard struct {
+	sync.Mutex
+	pending map[string]accessDelta
+}
+
+var accessLog [accessShards]accessShard
+
+func accessShardOf(indexKey string) *accessShard {
+	h := fnv.New32a()
+	io.WriteString(h, indexKey)
+	return &accessLog[h.Sum32()%accessShards]
+}
+
+// add counts the reads of d.
+func (a accessStats) add(d accessDelta) accessStats {
+	if d.reads == 0 {
+		return a
+	}
+	if d.first.Sub(a.WindowStart) > accessWindow {
+		a.Reads, a.WindowStart = 0, d.first
+	}
+	a.Reads += d.reads
+	a.LastRead = d.last
+	return a
+}
+
+func getAccessStats(indexKey string) (accessStats, error) {
+	sh := accessShardOf(indexKey)
+	sh.Lock()
+	defer sh.Unlock()
+	a, err := loadAccessStats(indexKey)
+	return a.add(sh.pending[indexKey]), err
+}
+
+// loadAccessStats reads the stats last written for indexKey.
+func loadAccessStats(indexKey string) (accessStats, error) {
+	var a accessStats
+	v, err := db.Get([]byte(accessPrefix + indexKey))
+	if err == metastore.ErrNotFound {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	err = json.Unmarshal(v, &a)
+	return a, err
+}
+
+// recordRead counts a read of the blob behind indexKey. It only takes the
+// lock of indexKey's shard, the stored stats are read when the count is
+// written. Raft followers can't save the stats, so the reads they serve
+// aren't counted.
+func recordRead(indexKey string, now time.Time) {
+	if !leading() {
+		return
+	}
+	sh := accessShardOf(indexKey)
+	sh.Lock()
+	defer sh.Unlock()
+
+	d := sh.pending[indexKey]
+	if d.reads == 0 {
+		d.first = now
+	}
+	d.reads++
+	d.last = now
+
+	if sh.pending == nil {
+		sh.pending = make(map[string]accessDelta)
+	}
+	sh.pending[indexKey] = d
+}
+
+// forgetAccess drops the stats of a blob that is being deleted.
+func forgetAccess(batch *metastore.Batch, indexKey string) {
+	sh := accessShardOf(indexKey)
+	sh.Lock()
+	delete(sh.pending, indexKey)
+	sh.Unlock()
+	batch.Delete([]byte(accessPrefix + indexKey))
+}
+
+// flushAccess writes the pending reads a shard at a time, each shard
+// locked only while its own are written.
+func flushAccess() error {
+	for i := range accessLog {
+		if err := accessLog[i].flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *accessShard) flush() error {
+	sh.Lock()
+	defer sh.Unlock()
+	if len(sh.pending) == 0 {
+		return nil
+	}
+
+	batch := new(metastore.Batch)
+	for k, d := range sh.pending {
+		a, err := loadAccessStats(k)
+		if err != nil {
+			return err
+		}
+		v, _ := json.Marshal(a.add(d))
+		batch.Put([]byte(accessPrefix+k), v)
+	}
+	if err := db.Write(batch); err != nil {
+		return err
+	}
+	sh.pending = nil
+	return nil
+}
+
+func runAccessFlusher() {
+	for range time.Tick(accessFlushInterval) {
+		if !leading() {
+			// stats counted before losing the lead are lost with it
+			for i := range accessLog {
+				accessLog[i].Lock()
+				accessLog[i].pending = nil
+				accessLog[i].Unlock()
+			}
+			continue
+		}
+		if err := flushAccess(); err != nil {
+			log.Printf("Master: Error saving access stats: %v", err)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/index"
+	"github.com/alvinliju/tinydb/internal/keys"
+	"github.com/alvinliju/tinydb/internal/metastore"
+	"github.com/alvinliju/tinydb/internal/topology"
+)
+
+// Everything the master keeps besides plain keys lives under a "\x00"
+// prefix. Keys can't contain control characters, so these never clash
+// with user keys and always sort before them.
+const (
+	bucketPrefix = "\x00bucket/"
+	objectPrefix = index.ObjectPrefix
+	usagePrefix  = "\x00usage/"
+)
+
+const defaultStorageClass = topology.DefaultClass
+
+// Bucket is the per-bucket configuration, stored as JSON under bucketPrefix.
+type Bucket struct {
+	Name         string            `json:"name"`
+	Replication  int               `json:"replication"`
+	StorageClass string            `json:"storage_class"`
+	QuotaBytes   int64             `json:"quota_bytes,omitempty"` // 0 means no quota
+	Versioning   bool              `json:"versioning"`
+	Metadata     map[string]string `json:"default_metadata,omitempty"`
+	Created      time.Time         `json:"created"`
+}
+
+var bucketNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// usageMu guards the read-modify-write of bucket usage counters.
+var usageMu sync.Mutex
+
+var errQuotaExceeded = errors.New("bucket quota exceeded")
+
+// objectRef says where the object a request talks about lives: the key in
+// the master index and the key the volumes store its blob under.
+type objectRef struct {
+	Bucket *Bucket // nil for the default namespace
+	Key    string
+}
+
+func (o objectRef) indexKey() string {
+	if o.Bucket == nil {
+		return o.Key
+	}
+	return objectPrefix + o.Bucket.Name + "/" + o.Key
+}
+
+// volumeKey is what the volumes see. Paths starting with "b/" are routed
+// to buckets, so no plain key can collide with these.
+func (o objectRef) volumeKey() string {
+	if o.Bucket == nil {
+		return o.Key
+	}
+	return "b/" + o.Bucket.Name + "/" + o.Key
+}
+
+// listBase is the index prefix all of the namespace's keys share.
+func (o objectRef) listBase() string {
+	if o.Bucket == nil {
+		return ""
+	}
+	return objectPrefix + o.Bucket.Name + "/"
+}
+
+// parseObjectPath turns a request path into an objectRef. "/b/<bucket>/<key>"
+// addresses a key in a bucket, anything else a key in the default namespace.
+// The key may be empty, callers that need one must check.
+func parseObjectPath(path string) (objectRef, int, error) {
+	key := strings.TrimPrefix(path, "/")
+	rest, ok := strings.CutPrefix(key, "b/")
+	if !ok {
+		return objectRef{Key: key}, 0, nil
+	}
+
+	name, key, _ := strings.Cut(rest, "/")
+	b, err := getBucket(name)
+	if err != nil {
+		if err == metastore.ErrNotFound {
+			return objectRef{}, http.StatusNotFound, errors.New("bucket not found")
+		}
+		return objectRef{}, http.StatusInternalServerError, errors.New("database error")
+	}
+	return objectRef{Bucket: &b, Key: key}, 0, nil
+}
+
+// objectFromRequest is parseObjectPath plus key validation.
+func objectFromRequest(r *http.Request) (objectRef, int, error) {
+	ref, status, err := parseObjectPath(r.URL.Path)
+	if err != nil {
+		return ref, status, err
+	}
+	if err := keys.Validate(ref.Key); err != nil {
+		return ref, http.StatusBadRequest, errors.New("invalid key: " + err.Error())
+	}
+	return ref, 0, nil
+}
+
+func getBucket(name string) (Bucket, error) {
+	var b Bucket
+	v, err := db.Get([]byte(bucketPrefix + name))
+	if err != nil {
+		return b, err
+	}
+	err = json.Unmarshal(v, &b)
+	return b, err
+}
+
+func bucketUsage(name string) (int64, error) {
+	v, err := db.Get([]byte(usagePrefix + name))
+	if err == metastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(v), 10, 64)
+}
+
+// quotaReserved is the bytes of PUTs being written to the volumes, per
+// bucket. They count against the quota until the PUT is committed or
+// fails. Guarded by usageMu.
+var quotaReserved = map[string]int64{}
+
+// reserveQuota makes room in ref's bucket for size bytes replacing what the
+// index has for ref, or fails with errQuotaExceeded. The caller holds the
+// key's lock and calls release once the PUT is committed or has failed.
+func reserveQuota(ref objectRef, size int64) (release func(), err error) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	used, err := bucketUsage(ref.Bucket.Name)
+	if err != nil {
+		return nil, err
+	}
+	if old, err := getRecord(ref.indexKey()); err == nil && !ref.versioned() {
+		used -= old.Size
+	} else if err != nil && err != metastore.ErrNotFound {
+		return nil, err
+	}
+	name := ref.Bucket.Name
+	if used+quotaReserved[name]+size > ref.Bucket.QuotaBytes {
+		return nil, errQuotaExceeded
+	}
+	quotaReserved[name] += size
+	return func() {
+		usageMu.Lock()
+		defer usageMu.Unlock()
+		if quotaReserved[name] -= size; quotaReserved[name] == 0 {
+			delete(quotaReserved, name)
+		}
+	}, nil
+}
+
+// storeObject writes rec for ref and keeps the bucket usage counter and the
+// expiry index in step, failing with errQuotaExceeded if the bucket has no
+// room left for it. The copies of an overwritten blob that rec doesn't
+// point at are deleted.
+func storeObject(ref objectRef, rec Record) error {
+	if ref.Bucket != nil {
+		usageMu.Lock()
+		defer usageMu.Unlock()
+	}
+
+	batch := new(metastore.Batch)
+	old, err := getRecord(ref.indexKey())
+	if err != nil && err != metastore.ErrNotFound {
+		return err
+	}
+	overwrite := err == nil && !ref.versioned()
+	var stale []string
+	if overwrite {
+		unindexExpiry(batch, ref.indexKey(), old)
+		// tiering or lifecycle may have moved the key to another class
+		// since it was written
+		for _, r := range old.Replicas {
+			if old.Blob != rec.Blob || !slices.Contains(rec.Replicas, r) {
+				stale = append(stale, r)
+			}
+		}
+		queueBlobDeletes(batch, old.Blob, stale, rec.Generation)
+	}
+
+	if ref.Bucket != nil {
+		used, err := bucketUsage(ref.Bucket.Name)
+		if err != nil {
+			return err
+		}
+		// old versions keep taking up space in versioned buckets
+		if overwrite {
+			used -= old.Size
+		}
+		used += rec.Size
+		if ref.Bucket.QuotaBytes > 0 && used > ref.Bucket.QuotaBytes {
+			return errQuotaExceeded
+		}
+		batch.Put([]byte(usagePrefix+ref.Bucket.Name), []byte(strconv.FormatInt(used, 10)))
+	}
+
+	batch.Put([]byte(ref.indexKey()), rec.encode())
+	if ref.versioned() {
+		batch.Put([]byte(ref.versionKey(rec.Version)), rec.encode())
+		indexExpiry(batch, ref.versionKey(rec.Version), rec)
+	} else {
+		indexExpiry(batch, ref.indexKey(), rec)
+	}
+	if err := db.Write(batch); err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		kickDeletes()
+	}
+	return nil
+}
+
+// removeObject deletes the index entry for ref, giving its bytes back to the
+// bucket. Whatever else is in batch is written along with it.
+func removeObject(ref objectRef, rec Record, batch *metastore.Batch) error {
+	batch.Delete([]byte(ref.indexKey()))
+	unindexExpiry(batch, ref.indexKey(), rec)
+	forgetAccess(batch, ref.indexKey())
+
+	if ref.Bucket != nil {
+		usageMu.Lock()
+		defer usageMu.Unlock()
+
+		used, err := bucketUsage(ref.Bucket.Name)
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte(usagePrefix+ref.Bucket.Name), []byte(strconv.FormatInt(max(used-rec.Size, 0), 10)))
+	}
+	return db.Write(batch)
+}
+
+// handleBuckets serves the bucket admin API:
+//
+//	GET    /admin/buckets         list buckets
+//	GET    /admin/buckets/<name>  show one bucket and its usage
+//	PUT    /admin/buckets/<name>  create a bucket, the body is its JSON config
+//	DELETE /admin/buckets/<name>  delete an empty bucket
+func handleBuckets(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/buckets"), "/")
+
+	switch {
+	case name == "" && r.Method == "GET":
+		handleListBuckets(w, r)
+	case name == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == "GET":
+		handleGetBucket(w, name)
+	case r.Method == "PUT":
+		handleCreateBucket(w, r, name)
+	case r.Method == "DELETE":
+		handleDeleteBucket(w, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListBuckets(w http.ResponseWriter, r *http.Request) {
+	buckets := []Bucket{}
+	iter := db.NewIterator(metastore.Prefix([]byte(bucketPrefix)))
+	defer iter.Release()
+	for iter.Next() {
+		var b Bucket
+		if err := json.Unmarshal(iter.Value(), &b); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		buckets = append(buckets, b)
+	}
+	if err := iter.Error(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+func handleGetBucket(w http.ResponseWriter, name string) {
+	b, err := getBucket(name)
+	if err == metastore.ErrNotFound {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	used, err := bucketUsage(name)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Bucket
+		UsedBytes int64 `json:"used_bytes"`
+	}{b, used})
+}
+
+func handleCreateBucket(w http.ResponseWriter, r *http.Request, name string) {
+	if !bucketNameRe.MatchString(name) {
+		http.Error(w, "Invalid bucket name: use 3-63 lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+
+	var b Bucket
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			http.Error(w, "Invalid bucket config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	b.Name = name
+	b.Created = time.Now().UTC()
+	if b.StorageClass == "" {
+		b.StorageClass = defaultStorageClass
+	}
+	groups := groupsOfClass(b.StorageClass)
+	if len(groups) == 0 {
+		http.Error(w, "Unknown storage class "+b.StorageClass, http.StatusBadRequest)
+		return
+	}
+	if b.Replication == 0 {
+		b.Replication = len(groups[0].Replicas)
+	}
+	for _, g := range groups {
+		if b.Replication < 1 || b.Replication > len(g.Replicas) {
+			http.Error(w, "Replication must be between 1 and the number of replicas in a volume group", http.StatusBadRequest)
+			return
+		}
+	}
+	if b.QuotaBytes < 0 {
+		http.Error(w, "Quota can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	// checking for the bucket and creating it is one step
+	unlock := keyLocks.Lock(bucketPrefix + name)
+	defer unlock()
+	if _, err := getBucket(name); err == nil {
+		http.Error(w, "bucket already exists", http.StatusConflict)
+		return
+	} else if err != metastore.ErrNotFound {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	v, _ := json.Marshal(b)
+	if err := db.Put([]byte(bucketPrefix+name), v); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(v)
+}
+
+func handleDeleteBucket(w http.ResponseWriter, name string) {
+	unlock := keyLocks.Lock(bucketPrefix + name)
+	defer unlock()
+	if _, err := getBucket(name); err == metastore.ErrNotFound {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	empty := true
+	for _, prefix := range []string{objectPrefix, versionPrefix, trashPrefix + objectPrefix} {
+		iter := db.NewIterator(metastore.Prefix([]byte(prefix + name + "/")))
+		empty = empty && !iter.First()
+		iter.Release()
+	}
+	if !empty {
+		http.Error(w, "bucket is not empty", http.StatusConflict)
+		return
+	}
+
+	batch := new(metastore.Batch)
+	batch.Delete([]byte(bucketPrefix + name))
+	batch.Delete([]byte(usagePrefix + name))
+	if err := db.Write(batch); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
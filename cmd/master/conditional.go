@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// checkPreconditions evaluates If-None-Match and If-Match against the
+// current record for ref. It returns 0 when the request may go ahead,
+// otherwise the status to fail it with. The caller must hold ref's key lock
+// until its index update is done, or the answer may be stale.
+//
+// Only "If-None-Match: *" is supported, which makes a PUT create-only.
+// If-Match takes "*" or a list of ETags.
+func checkPreconditions(r *http.Request, ref objectRef) int {
+	inm := r.Header.Get("If-None-Match")
+	im := r.Header.Get("If-Match")
+	if inm == "" && im == "" {
+		return 0
+	}
+	if inm != "" && strings.TrimSpace(inm) != "*" {
+		return http.StatusNotImplemented
+	}
+
+	cur, err := getRecord(ref.indexKey())
+	exists := err == nil && !cur.DeleteMarker && !cur.expired(time.Now())
+	if err != nil && err != metastore.ErrNotFound {
+		return http.StatusInternalServerError
+	}
+
+	if inm != "" && exists {
+		return http.StatusPreconditionFailed
+	}
+	if im != "" && !(exists && etagMatches(im, cur.ETag)) {
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		t = strings.TrimPrefix(t, "W/")
+		if etag != "" && strings.Trim(t, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// Blob deletes are not sent to the volumes while a request waits. They are
+// recorded as tasks in the same write that drops the key from the index,
+// and a background worker sends them, retrying until every replica has
+// confirmed. A replica that is down when a key is deleted gets its delete
+// when it comes back, and since deletes carry a generation a late one can
+// never remove a blob written after it.
+//
+// Tasks live under deleteTaskPrefix + "<generation, zero padded>/<replica>/<blob>",
+// so the oldest deletes go first.
+const deleteTaskPrefix = "\x00deltask/"
+
+const (
+	// deleteBatch is how many tasks the worker takes on per pass.
+	deleteBatch = 1000
+	// maxDeleteBackoff caps how long the worker waits before retrying.
+	maxDeleteBackoff = 30 * time.Minute
+)
+
+type deleteTask struct {
+	Replica    string    `json:"replica"`
+	Blob       string    `json:"blob"`
+	Generation uint64    `json:"generation"`
+	Created    time.Time `json:"created"`
+	Attempts   int       `json:"attempts,omitempty"`
+	NextTry    time.Time `json:"next_try,omitzero"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// deleteKick wakes the worker up early when there are new tasks.
+var deleteKick = make(chan struct{}, 1)
+
+func deleteTaskKey(replica, blob string, gen uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d/%s/%s", deleteTaskPrefix, gen, replica, blob))
+}
+
+// queueBlobDeletes adds tasks deleting blob from every replica with
+// generation gen to batch. Call kickDeletes once the batch is written.
+func queueBlobDeletes(batch *metastore.Batch, blob string, replicas []string, gen uint64) {
+	now := time.Now().UTC()
+	for _, replica := range replicas {
+		v, _ := json.Marshal(deleteTask{Replica: replica, Blob: blob, Generation: gen, Created: now})
+		batch.Put(deleteTaskKey(replica, blob, gen), v)
+	}
+}
+
+func kickDeletes() {
+	select {
+	case deleteKick <- struct{}{}:
+	default:
+	}
+}
+
+// deleteLater queues the deletion of blob from replicas on its own, for
+// blobs the index doesn't point at.
+func deleteLater(blob string, replicas []string, gen uint64) error {
+	batch := new(metastore.Batch)
+	queueBlobDeletes(batch, blob, replicas, gen)
+	if err := db.Write(batch); err != nil {
+		return err
+	}
+	kickDeletes()
+	return nil
+}
+
+// runDeleteWorker sends queued deletes every interval, or as soon as new
+// ones are queued, until the process exits.
+func runDeleteWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-deleteKick:
+		}
+		for leading() {
+			n, more, err := processDeletes(time.Now(), interval)
+			if err != nil {
+				log.Printf("Master: delete worker: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Master: delete worker finished %d deletes", n)
+			}
+			if !more || err != nil {
+				break
+			}
+		}
+	}
+}
+
+// processDeletes tries the tasks that are due and returns how many of them
+// are done, and whether there are more due than it took on. A task that
+// fails is retried after a backoff that grows with every attempt.
+func processDeletes(now time.Time, interval time.Duration) (int, bool, error) {
+	type pending struct {
+		key  []byte
+		task deleteTask
+	}
+	var due []pending
+	more := false
+
+	iter := db.NewIterator(metastore.Prefix([]byte(deleteTaskPrefix)))
+	for iter.Next() {
+		var t deleteTask
+		if err := json.Unmarshal(iter.Value(), &t); err != nil {
+			iter.Release()
+			return 0, false, err
+		}
+		if t.NextTry.After(now) {
+			continue
+		}
+		if len(due) == deleteBatch {
+			more = true
+			break
+		}
+		due = append(due, pending{append([]byte(nil), iter.Key()...), t})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, false, err
+	}
+
+	// don't wait for every task of a replica that is down to time out
+	down := map[string]error{}
+	done := 0
+	for _, p := range due {
+		t := p.task
+		err, skipped := down[t.Replica]
+		if !skipped {
+			err = deleteBlob(t.Replica, t.Blob, t.Generation)
+			if errors.As(err, new(*url.Error)) {
+				down[t.Replica] = err
+			}
+		}
+
+		// a replica holding a newer generation has a newer write that
+		// the delete must not remove, so it is done as well
+		if err == nil || err == errStaleGeneration {
+			if err := db.Delete(p.key); err != nil {
+				return done, more, err
+			}
+			done++
+			continue
+		}
+
+		t.Attempts++
+		t.LastError = err.Error()
+		t.NextTry = now.Add(min(interval<<min(t.Attempts, 16), maxDeleteBackoff))
+		v, _ := json.Marshal(t)
+		if err := db.Put(p.key, v); err != nil {
+			return done, more, err
+		}
+	}
+	return done, more, nil
+}
+
+// handleDeletes serves GET /admin/deletes?limit=, the deletes that are still
+// waiting for a replica, oldest first.
+func handleDeletes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultListLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	res := struct {
+		Pending int          `json:"pending"`
+		Tasks   []deleteTask `json:"tasks"`
+	}{Tasks: []deleteTask{}}
+	iter := db.NewIterator(metastore.Prefix([]byte(deleteTaskPrefix)))
+	defer iter.Release()
+	for iter.Next() {
+		res.Pending++
+		if len(res.Tasks) == limit {
+			continue
+		}
+		var t deleteTask
+		if err := json.Unmarshal(iter.Value(), &t); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		res.Tasks = append(res.Tasks, t)
+	}
+	if err := iter.Error(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
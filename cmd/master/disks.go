@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// volumeDisks is a volume's answer about its data directories: for each
+// the health and usage, see blobstore.DiskInfo.
+type volumeDisks struct {
+	Volume string          `json:"volume"`
+	Error  string          `json:"error,omitempty"`
+	Disks  json.RawMessage `json:"disks,omitempty"`
+}
+
+// handleDisks serves GET /admin/disks, the disks of every volume server.
+func handleDisks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reports := []volumeDisks{}
+	for _, g := range volumeServers {
+		for _, replica := range g.Replicas {
+			disks, err := fetchDisks(replica)
+			report := volumeDisks{Volume: replica, Disks: disks}
+			if err != nil {
+				report.Error = err.Error()
+			}
+			reports = append(reports, report)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+func fetchDisks(replica string) (json.RawMessage, error) {
+	resp, err := httpClient.Get(replica + "/disks")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("volume server %s answered /disks with %s", replica, resp.Status)
+	}
+	var disks json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&disks)
+	return disks, err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The orphan collection is a mark and sweep. The master marks: it walks
+// the index and lists, for every volume server, the blobs some key, version
+// or trashed key points at there. Each volume then sweeps: it deletes the
+// blobs that aren't on its list and are older than the grace period, which
+// keeps blobs written during the walk safe.
+//
+// The list is only as good as the index, so an index without a single
+// record, say a fresh or lost one, would have every blob deleted. A sweep
+// refuses to run then unless it is forced.
+
+const defaultGCGrace = time.Hour
+
+var errEmptyIndex = errors.New("the index has no records, refusing to sweep every blob on the volumes")
+
+// volumeGCReport is a volume's answer to a sweep.
+type volumeGCReport struct {
+	Volume string          `json:"volume"`
+	Error  string          `json:"error,omitempty"`
+	Report json.RawMessage `json:"report,omitempty"`
+}
+
+// expectedBlobs returns the blobs each volume server should hold and how
+// many records point at them.
+func expectedBlobs() (map[string]map[string]bool, int, error) {
+	expected := map[string]map[string]bool{}
+	for _, g := range volumeServers {
+		for _, replica := range g.Replicas {
+			expected[replica] = map[string]bool{}
+		}
+	}
+
+	records := 0
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := string(iter.Key())
+		if strings.HasPrefix(k, "\x00") &&
+			!strings.HasPrefix(k, objectPrefix) &&
+			!strings.HasPrefix(k, versionPrefix) &&
+			!strings.HasPrefix(k, trashPrefix) {
+			continue
+		}
+		// trash entries are records with a few more fields
+		rec, err := decodeRecord(k, iter.Value())
+		if err != nil {
+			return nil, 0, fmt.Errorf("%q: %v", k, err)
+		}
+		records++
+		if rec.DeleteMarker {
+			continue
+		}
+		for _, replica := range rec.Replicas {
+			if expected[replica] == nil {
+				expected[replica] = map[string]bool{}
+			}
+			expected[replica][rec.Blob] = true
+		}
+	}
+	return expected, records, iter.Error()
+}
+
+// runGC marks and then has every volume server sweep. Unless force is set,
+// it refuses with errEmptyIndex to sweep against an index without records.
+func runGC(grace time.Duration, dryRun, force bool) ([]volumeGCReport, error) {
+	expected, records, err := expectedBlobs()
+	if err != nil {
+		return nil, err
+	}
+	if records == 0 && !dryRun && !force {
+		return nil, errEmptyIndex
+	}
+	// other shards' blobs are on the same volumes
+	shard, sharded, err := currentShard()
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{"grace": {grace.String()}}
+	if dryRun {
+		q.Set("dry-run", "1")
+	}
+	if sharded {
+		q.Set("start", shard.Start)
+		q.Set("end", shard.End)
+	}
+
+	var reports []volumeGCReport
+	for _, g := range volumeServers {
+		for _, replica := range g.Replicas {
+			report, err := sweepVolume(replica, expected[replica], q)
+			r := volumeGCReport{Volume: replica, Report: report}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			reports = append(reports, r)
+		}
+	}
+	return reports, nil
+}
+
+func sweepVolume(replica string, blobs map[string]bool, q url.Values) (json.RawMessage, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		for blob := range blobs {
+			bw.WriteString(blob + "\n")
+		}
+		pw.CloseWithError(bw.Flush())
+	}()
+
+	// a sweep walks the whole volume, which takes longer than a request
+	client := &http.Client{Timeout: 30 * time.Minute}
+	resp, err := client.Post(replica+"/gc?"+q.Encode(), "text/plain", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("volume server %s answered GC with %s: %s", replica, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// runGCScheduler collects orphans every interval until the process exits.
+func runGCScheduler(interval, grace time.Duration) {
+	for range time.Tick(interval) {
+		if !leading() || frozen() {
+			continue
+		}
+		reports, err := runGC(grace, false, false)
+		if err != nil {
+			log.Printf("Master: GC: %v", err)
+			continue
+		}
+		for _, r := range reports {
+			if r.Error != "" {
+				log.Printf("Master: GC of %s: %s", r.Volume, r.Error)
+			}
+		}
+	}
+}
+
+// handleGC serves POST /admin/gc?grace=1h&dry-run=1&force=1, which collects
+// orphans on every volume server now. A dry run only reports what would go,
+// force sweeps even if the index is empty.
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	grace := defaultGCGrace
+	if g := q.Get("grace"); g != "" {
+		d, err := time.ParseDuration(g)
+		if err != nil {
+			http.Error(w, "Invalid grace", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	dryRun := queryFlag(q, "dry-run")
+
+	reports, err := runGC(grace, dryRun, queryFlag(q, "force"))
+	if err == errEmptyIndex {
+		http.Error(w, err.Error()+", add force=1 if that is what you want", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Master: GC: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// queryFlag reports whether the boolean query parameter name is set.
+func queryFlag(q url.Values, name string) bool {
+	v := q.Get(name)
+	return v != "" && v != "0" && v != "false"
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// Every write the master sends to the volumes carries a generation number
+// that is larger than that of any write before it. Volumes use it to turn
+// away writes that arrive late, so a slow or retried request can never
+// replace newer data.
+//
+// Generations are handed out from a block that is reserved in leveldb
+// up front. After a restart we continue after the reserved block, which
+// skips some numbers but never reuses one.
+const (
+	generationKey   = "\x00generation"
+	generationBlock = 1000
+
+	generationHeader = "X-Tinydb-Generation"
+)
+
+var generations struct {
+	sync.Mutex
+	next, limit uint64
+}
+
+func nextGeneration() (uint64, error) {
+	generations.Lock()
+	defer generations.Unlock()
+
+	if generations.next == generations.limit {
+		reserved, err := reservedGeneration()
+		if err != nil {
+			return 0, err
+		}
+		if generations.next < reserved {
+			generations.next = reserved
+		}
+		limit := generations.next + generationBlock
+		if err := db.Put([]byte(generationKey), []byte(strconv.FormatUint(limit, 10))); err != nil {
+			return 0, err
+		}
+		generations.limit = limit
+	}
+
+	generations.next++
+	return generations.next, nil
+}
+
+// resetGenerations forgets the block in hand. A master that becomes Raft
+// leader calls it, as other leaders may have reserved blocks since.
+func resetGenerations() {
+	generations.Lock()
+	defer generations.Unlock()
+	generations.next, generations.limit = 0, 0
+}
+
+// raiseGeneration makes the generations handed out from now on larger
+// than gen, which another master handed out.
+func raiseGeneration(gen uint64) error {
+	generations.Lock()
+	defer generations.Unlock()
+
+	reserved, err := reservedGeneration()
+	if err != nil {
+		return err
+	}
+	if gen > reserved {
+		if err := db.Put([]byte(generationKey), []byte(strconv.FormatUint(gen, 10))); err != nil {
+			return err
+		}
+	}
+	generations.next, generations.limit = 0, 0
+	return nil
+}
+
+func reservedGeneration() (uint64, error) {
+	v, err := db.Get([]byte(generationKey))
+	if err == metastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(v), 10, 64)
+}
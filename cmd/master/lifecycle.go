@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// A lifecycle rule applies an action to the keys under a prefix of a
+// bucket, or of the default namespace, once they are old enough. Rules are
+// stored as JSON under lifecyclePrefix and the stats of each rule's last
+// run under lifecycleStatsPrefix.
+const (
+	lifecyclePrefix      = "\x00lifecycle/"
+	lifecycleStatsPrefix = "\x00lifecycle-stats/"
+)
+
+const (
+	// actionExpire deletes keys last written more than Days ago. In a
+	// versioned bucket that adds a delete marker, like a DELETE does.
+	actionExpire = "expire"
+	// actionExpireNoncurrent destroys versions that stopped being the
+	// latest more than Days ago.
+	actionExpireNoncurrent = "expire-noncurrent"
+	// actionTransition moves keys last written more than Days ago to the
+	// volume groups of StorageClass.
+	actionTransition = "transition"
+	// actionTier moves keys nobody wrote or read for Days to
+	// StorageClass, and keys read at least PromoteReads times within a
+	// day back to HotClass.
+	actionTier = "tier"
+)
+
+// maxReportedActions caps the actions listed in a run report.
+const maxReportedActions = 1000
+
+type LifecycleRule struct {
+	ID           string `json:"id"`
+	Bucket       string `json:"bucket,omitempty"` // empty for the default namespace
+	Prefix       string `json:"prefix,omitempty"`
+	Action       string `json:"action"`
+	Days         int    `json:"days"`
+	StorageClass string `json:"storage_class,omitempty"` // transition and tier
+	HotClass     string `json:"hot_class,omitempty"`     // tier only
+	PromoteReads int    `json:"promote_reads,omitempty"` // tier only, 0 never promotes
+	Disabled     bool   `json:"disabled,omitempty"`
+}
+
+var lifecycleIDRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// lifecycleAction is one key or version a rule matched.
+type lifecycleAction struct {
+	Key     string `json:"key"`
+	Version string `json:"version,omitempty"`
+	Size    int64  `json:"size"`
+	To      string `json:"to,omitempty"` // the storage class it moves to
+	Error   string `json:"error,omitempty"`
+
+	ref      objectRef
+	indexKey string
+	rec      Record
+}
+
+// lifecycleStats is the report of one run of a rule. Dry runs list every
+// action they would have taken, real runs only the ones that failed.
+type lifecycleStats struct {
+	Rule      string            `json:"rule"`
+	DryRun    bool              `json:"dry_run"`
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	Matched   int               `json:"matched"`
+	Succeeded int               `json:"succeeded"`
+	Skipped   int               `json:"skipped"` // changed since they matched
+	Failed    int               `json:"failed"`
+	Bytes     int64             `json:"bytes"` // size of what matched
+	Error     string            `json:"error,omitempty"`
+	Actions   []lifecycleAction `json:"actions,omitempty"`
+	Truncated bool              `json:"actions_truncated,omitempty"`
+}
+
+// lifecycleMu makes sure only one run, scheduled or asked for, goes at a time.
+var lifecycleMu sync.Mutex
+
+var errSkipped = errors.New("changed since it matched")
+
+func getLifecycleRules() ([]LifecycleRule, error) {
+	rules := []LifecycleRule{}
+	iter := db.NewIterator(metastore.Prefix([]byte(lifecyclePrefix)))
+	defer iter.Release()
+	for iter.Next() {
+		var rule LifecycleRule
+		if err := json.Unmarshal(iter.Value(), &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, iter.Error()
+}
+
+// runLifecycleScheduler runs all enabled rules every interval until the
+// process exits.
+func runLifecycleScheduler(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !leading() {
+			continue
+		}
+		release, ok := holdShard()
+		if !ok {
+			continue
+		}
+		reports, err := runLifecycle(time.Now(), false, "")
+		release()
+		if err != nil {
+			log.Printf("Master: lifecycle: %v", err)
+		}
+		for _, s := range reports {
+			if s.Matched > 0 || s.Error != "" {
+				log.Printf("Master: lifecycle rule %s: matched %d, succeeded %d, skipped %d, failed %d %s",
+					s.Rule, s.Matched, s.Succeeded, s.Skipped, s.Failed, s.Error)
+			}
+		}
+	}
+}
+
+// runLifecycle runs every enabled rule, or only the rule with ID only,
+// which runs even if it's disabled. Unless it's a dry run, each rule's
+// report is saved as its last run.
+func runLifecycle(now time.Time, dryRun bool, only string) ([]lifecycleStats, error) {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	rules, err := getLifecycleRules()
+	if err != nil {
+		return nil, err
+	}
+	reports := []lifecycleStats{}
+	for _, rule := range rules {
+		if only != "" && rule.ID != only || only == "" && rule.Disabled {
+			continue
+		}
+		stats := applyRule(rule, now, dryRun)
+		if !dryRun {
+			v, _ := json.Marshal(stats)
+			if err := db.Put([]byte(lifecycleStatsPrefix+rule.ID), v); err != nil {
+				return reports, err
+			}
+		}
+		reports = append(reports, stats)
+	}
+	return reports, nil
+}
+
+func applyRule(rule LifecycleRule, now time.Time, dryRun bool) (stats lifecycleStats) {
+	stats = lifecycleStats{Rule: rule.ID, DryRun: dryRun, Started: now.UTC()}
+	defer func() { stats.Finished = time.Now().UTC() }()
+
+	var ref objectRef
+	if rule.Bucket != "" {
+		b, err := getBucket(rule.Bucket)
+		if err != nil {
+			stats.Error = "bucket " + rule.Bucket + ": " + err.Error()
+			return stats
+		}
+		ref.Bucket = &b
+	}
+
+	cutoff := now.AddDate(0, 0, -rule.Days)
+	matched, err := matchRule(rule, ref, cutoff, now)
+	if err != nil {
+		stats.Error = err.Error()
+		return stats
+	}
+
+	for _, a := range matched {
+		stats.Matched++
+		stats.Bytes += a.Size
+		if !dryRun {
+			err := applyAction(rule, a, cutoff)
+			switch {
+			case err == nil:
+				stats.Succeeded++
+				continue
+			case err == errSkipped:
+				stats.Skipped++
+				continue
+			}
+			stats.Failed++
+			a.Error = err.Error()
+		}
+		if len(stats.Actions) == maxReportedActions {
+			stats.Truncated = true
+			continue
+		}
+		stats.Actions = append(stats.Actions, a)
+	}
+	return stats
+}
+
+// matchRule finds what rule applies to. Nothing is changed, so the matches
+// are checked again when they are acted on.
+func matchRule(rule LifecycleRule, ref objectRef, cutoff, now time.Time) ([]lifecycleAction, error) {
+	var matched []lifecycleAction
+
+	if rule.Action == actionExpireNoncurrent {
+		if !ref.versioned() {
+			return nil, errors.New("bucket is not versioned")
+		}
+		base := versionPrefix + ref.Bucket.Name + "/"
+		iter := db.NewIterator(metastore.Prefix([]byte(base + rule.Prefix)))
+		defer iter.Release()
+
+		// versions of a key come newest first, each one stopped being
+		// the latest when the one before it was written
+		lastKey, newer := "", time.Time{}
+		for iter.Next() {
+			key, id, _ := strings.Cut(string(iter.Key())[len(base):], "\x00")
+			rec, err := decodeRecord(string(iter.Key()), iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			if key == lastKey && !newer.After(cutoff) {
+				r := objectRef{Bucket: ref.Bucket, Key: key}
+				matched = append(matched, lifecycleAction{Key: key, Version: id, Size: rec.Size, ref: r, indexKey: r.versionKey(id), rec: rec})
+			}
+			lastKey, newer = key, rec.Mtime
+		}
+		return matched, iter.Error()
+	}
+
+	base := ref.listBase()
+	iter := db.NewIterator(metastore.Prefix([]byte(base + rule.Prefix)))
+	defer iter.Release()
+	for iter.Next() {
+		k := string(iter.Key())
+		if base == "" && strings.HasPrefix(k, "\x00") {
+			continue
+		}
+		rec, err := decodeRecord(k, iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		// expired keys are the reaper's
+		if rec.DeleteMarker || rec.expired(now) {
+			continue
+		}
+
+		r := objectRef{Bucket: ref.Bucket, Key: k[len(base):]}
+		a := lifecycleAction{Key: r.Key, Size: rec.Size, ref: r, indexKey: k, rec: rec}
+		if r.versioned() && rec.Version != "" {
+			a.Version = rec.Version
+			a.indexKey = r.versionKey(rec.Version)
+		}
+
+		switch rule.Action {
+		case actionTier:
+			acc, err := getAccessStats(a.indexKey)
+			if err != nil {
+				return nil, err
+			}
+			a.To = tierFor(rule, rec, acc, cutoff, now)
+		case actionTransition:
+			if !rec.Mtime.After(cutoff) && rec.storageClass() != rule.StorageClass {
+				a.To = rule.StorageClass
+			}
+		default:
+			if rec.Mtime.After(cutoff) {
+				continue
+			}
+		}
+		if rule.Action != actionExpire && a.To == "" {
+			continue
+		}
+		matched = append(matched, a)
+	}
+	return matched, iter.Error()
+}
+
+// tierFor returns the storage class a tier rule moves rec to, or "" if it
+// stays where it is.
+func tierFor(rule LifecycleRule, rec Record, acc accessStats, cutoff, now time.Time) string {
+	class := rec.storageClass()
+	used := rec.Mtime
+	if acc.LastRead.After(used) {
+		used = acc.LastRead
+	}
+
+	switch {
+	case rule.PromoteReads > 0 && class != rule.HotClass && acc.recentReads(now) >= int64(rule.PromoteReads):
+		return rule.HotClass
+	case class != rule.StorageClass && !used.After(cutoff):
+		return rule.StorageClass
+	}
+	return ""
+}
+
+// applyAction carries out rule on one match, returning errSkipped if the
+// key was written since it matched.
+func applyAction(rule LifecycleRule, a lifecycleAction, cutoff time.Time) error {
+	if a.To != "" {
+		err := migrateObject(a.ref, a.indexKey, a.To)
+		if err == errKeyChanged || err == metastore.ErrNotFound {
+			return errSkipped
+		}
+		return err
+	}
+
+	unlock := keyLocks.Lock(a.ref.indexKey())
+	defer unlock()
+
+	cur, err := getRecord(a.ref.indexKey())
+	if err == metastore.ErrNotFound {
+		return errSkipped
+	}
+	if err != nil {
+		return err
+	}
+
+	if rule.Action == actionExpireNoncurrent {
+		if cur.Version == a.Version {
+			return errSkipped
+		}
+		err := deleteVersion(a.ref, a.Version)
+		if err == errNoSuchVersion {
+			return errSkipped
+		}
+		return err
+	}
+
+	if cur.DeleteMarker || cur.Generation != a.rec.Generation || cur.Mtime.After(cutoff) {
+		return errSkipped
+	}
+	if a.ref.versioned() {
+		_, err := addDeleteMarker(a.ref)
+		return err
+	}
+	return destroyObject(a.ref, cur)
+}
+
+// handleLifecycle serves the lifecycle admin API:
+//
+//	GET    /admin/lifecycle                          list rules and their last run
+//	GET    /admin/lifecycle/<id>                     show one rule and its last run
+//	PUT    /admin/lifecycle/<id>                     create or replace a rule, the body is its JSON
+//	DELETE /admin/lifecycle/<id>                     delete a rule
+//	POST   /admin/lifecycle/run?dry-run=1&rule=<id>  run all enabled rules, or one, now
+func handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/lifecycle"), "/")
+
+	switch {
+	case id == "" && r.Method == "GET":
+		handleListLifecycleRules(w)
+	case id == "run" && r.Method == "POST":
+		handleRunLifecycle(w, r)
+	case id == "" || id == "run":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == "GET":
+		handleGetLifecycleRule(w, id)
+	case r.Method == "PUT":
+		handlePutLifecycleRule(w, r, id)
+	case r.Method == "DELETE":
+		handleDeleteLifecycleRule(w, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type lifecycleRuleStatus struct {
+	LifecycleRule
+	LastRun *lifecycleStats `json:"last_run,omitempty"`
+}
+
+func ruleStatus(rule LifecycleRule) (lifecycleRuleStatus, error) {
+	status := lifecycleRuleStatus{LifecycleRule: rule}
+	v, err := db.Get([]byte(lifecycleStatsPrefix + rule.ID))
+	if err == metastore.ErrNotFound {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	status.LastRun = new(lifecycleStats)
+	return status, json.Unmarshal(v, status.LastRun)
+}
+
+func handleListLifecycleRules(w http.ResponseWriter) {
+	rules, err := getLifecycleRules()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	statuses := []lifecycleRuleStatus{}
+	for _, rule := range rules {
+		s, err := ruleStatus(rule)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		statuses = append(statuses, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func handleGetLifecycleRule(w http.ResponseWriter, id string) {
+	var rule LifecycleRule
+	v, err := db.Get([]byte(lifecyclePrefix + id))
+	if err == metastore.ErrNotFound {
+		http.Error(w, "rule not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(v, &rule)
+	}
+	var s lifecycleRuleStatus
+	if err == nil {
+		s, err = ruleStatus(rule)
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func handlePutLifecycleRule(w http.ResponseWriter, r *http.Request, id string) {
+	if !lifecycleIDRe.MatchString(id) {
+		http.Error(w, "Invalid rule id: use up to 63 lowercase letters, digits, dashes and underscores", http.StatusBadRequest)
+		return
+	}
+
+	var rule LifecycleRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+
+	var bucket *Bucket
+	if rule.Bucket != "" {
+		b, err := getBucket(rule.Bucket)
+		if err == metastore.ErrNotFound {
+			http.Error(w, "bucket not found", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		bucket = &b
+	}
+	if rule.Days < 0 {
+		http.Error(w, "Days can't be negative", http.StatusBadRequest)
+		return
+	}
+	switch rule.Action {
+	case actionExpire:
+	case actionExpireNoncurrent:
+		if bucket == nil || !bucket.Versioning {
+			http.Error(w, "expire-noncurrent needs a versioned bucket", http.StatusBadRequest)
+			return
+		}
+	case actionTransition, actionTier:
+		if len(groupsOfClass(rule.StorageClass)) == 0 {
+			http.Error(w, "Unknown storage class "+rule.StorageClass, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Action must be one of expire, expire-noncurrent, transition and tier", http.StatusBadRequest)
+		return
+	}
+	if rule.Action != actionTransition && rule.Action != actionTier && rule.StorageClass != "" {
+		http.Error(w, "storage_class only goes with transition and tier", http.StatusBadRequest)
+		return
+	}
+	if rule.Action != actionTier && (rule.HotClass != "" || rule.PromoteReads != 0) {
+		http.Error(w, "hot_class and promote_reads only go with tier", http.StatusBadRequest)
+		return
+	}
+	if rule.PromoteReads < 0 {
+		http.Error(w, "promote_reads can't be negative", http.StatusBadRequest)
+		return
+	}
+	if rule.PromoteReads > 0 && (len(groupsOfClass(rule.HotClass)) == 0 || rule.HotClass == rule.StorageClass) {
+		http.Error(w, "promote_reads needs a hot_class other than storage_class", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusCreated
+	if _, err := db.Get([]byte(lifecyclePrefix + id)); err == nil {
+		status = http.StatusOK
+	}
+	v, _ := json.Marshal(rule)
+	if err := db.Put([]byte(lifecyclePrefix+id), v); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(v)
+}
+
+func handleDeleteLifecycleRule(w http.ResponseWriter, id string) {
+	if _, err := db.Get([]byte(lifecyclePrefix + id)); err == metastore.ErrNotFound {
+		http.Error(w, "rule not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	batch := new(metastore.Batch)
+	batch.Delete([]byte(lifecyclePrefix + id))
+	batch.Delete([]byte(lifecycleStatsPrefix + id))
+	if err := db.Write(batch); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRunLifecycle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dryRun := q.Get("dry-run") != "" && q.Get("dry-run") != "0" && q.Get("dry-run") != "false"
+	only := q.Get("rule")
+	if only != "" {
+		if _, err := db.Get([]byte(lifecyclePrefix + only)); err == metastore.ErrNotFound {
+			http.Error(w, "rule not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if !dryRun {
+		release, ok := holdShard()
+		if !ok {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Shard is read only while it is split, try again", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+	reports, err := runLifecycle(time.Now(), dryRun, only)
+	if err != nil {
+		log.Printf("Master: lifecycle: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+func putRule(t *testing.T, id, rule string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handleLifecycle(rr, httptest.NewRequest("PUT", "/admin/lifecycle/"+id, strings.NewReader(rule)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT rule %s: got %d %s", id, rr.Code, rr.Body)
+	}
+}
+
+func runRule(t *testing.T, now time.Time, id string) lifecycleStats {
+	t.Helper()
+	reports, err := runLifecycle(now, false, id)
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("run %s: %+v, %v", id, reports, err)
+	}
+	return reports[0]
+}
+
+func TestLifecycleExpire(t *testing.T) {
+	volumes := newTestMaster(t)
+	for _, k := range []string{"logs/a", "logs/b", "keep/c"} {
+		if rr := do("PUT", "/"+k, k); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got %d %s", k, rr.Code, rr.Body)
+		}
+	}
+	putRule(t, "old-logs", `{"prefix": "logs/", "action": "expire", "days": 1}`)
+	rr := httptest.NewRecorder()
+	handleLifecycle(rr, httptest.NewRequest("PUT", "/admin/lifecycle/bad", strings.NewReader(`{"action": "shred", "days": 1}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("PUT rule with an unknown action: got %d", rr.Code)
+	}
+
+	// nothing is old enough yet
+	if s := runRule(t, time.Now(), "old-logs"); s.Matched != 0 {
+		t.Errorf("run before the rule is due: %+v", s)
+	}
+
+	later := time.Now().Add(48 * time.Hour)
+	reports, err := runLifecycle(later, true, "")
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("dry run: %+v, %v", reports, err)
+	}
+	if s := reports[0]; !s.DryRun || s.Matched != 2 || s.Succeeded != 0 || len(s.Actions) != 2 || s.Bytes != 12 {
+		t.Errorf("dry run report: %+v", s)
+	}
+	if _, err := getRecord("logs/a"); err != nil {
+		t.Fatalf("a dry run deleted a key: %v", err)
+	}
+
+	s := runRule(t, later, "")
+	if s.Matched != 2 || s.Succeeded != 2 || len(s.Actions) != 0 {
+		t.Errorf("run report: %+v", s)
+	}
+	for _, k := range []string{"logs/a", "logs/b"} {
+		if _, err := getRecord(k); err != metastore.ErrNotFound {
+			t.Errorf("%s is still in the index: %v", k, err)
+		}
+	}
+	if _, err := getRecord("keep/c"); err != nil {
+		t.Errorf("a key outside the prefix was deleted: %v", err)
+	}
+	runDeletes(t)
+	if len(volumes[0].blobs) != 1 {
+		t.Errorf("volume has %v, want only keep/c", volumes[0].blobs)
+	}
+
+	// the last real run is kept with the rule
+	rr = httptest.NewRecorder()
+	handleLifecycle(rr, httptest.NewRequest("GET", "/admin/lifecycle/old-logs", nil))
+	var status lifecycleRuleStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil || status.LastRun == nil || status.LastRun.Succeeded != 2 {
+		t.Errorf("rule status: %+v, %v", status, err)
+	}
+}
+
+func TestLifecycleDisabled(t *testing.T) {
+	newTestMaster(t)
+	if rr := do("PUT", "/tmp/a", "a"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d %s", rr.Code, rr.Body)
+	}
+	putRule(t, "tmp", `{"prefix": "tmp/", "action": "expire", "days": 1, "disabled": true}`)
+
+	later := time.Now().Add(48 * time.Hour)
+	if reports, err := runLifecycle(later, false, ""); err != nil || len(reports) != 0 {
+		t.Errorf("scheduled run of a disabled rule: %+v, %v", reports, err)
+	}
+	// asking for the rule runs it anyway
+	if s := runRule(t, later, "tmp"); s.Succeeded != 1 {
+		t.Errorf("run of a disabled rule by id: %+v", s)
+	}
+}
+
+func TestLifecycleVersions(t *testing.T) {
+	volumes := newTestMaster(t)
+	rr := httptest.NewRecorder()
+	handleBuckets(rr, httptest.NewRequest("PUT", "/admin/buckets/docs", strings.NewReader(`{"versioning": true}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create bucket: got %d %s", rr.Code, rr.Body)
+	}
+	var latest string
+	for _, body := range []string{"one", "two", "three"} {
+		rr := do("PUT", "/b/docs/a.txt", body)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got %d %s", body, rr.Code, rr.Body)
+		}
+		latest = rr.Header().Get(versionHeader)
+	}
+	putRule(t, "noncurrent", `{"bucket": "docs", "action": "expire-noncurrent", "days": 1}`)
+	putRule(t, "expire", `{"bucket": "docs", "action": "expire", "days": 1}`)
+
+	later := time.Now().Add(48 * time.Hour)
+	if s := runRule(t, later, "noncurrent"); s.Matched != 2 || s.Succeeded != 2 {
+		t.Errorf("expire-noncurrent report: %+v", s)
+	}
+	res, err := listVersions(objectRef{Bucket: &Bucket{Name: "docs", Versioning: true}}, "", "", "", 10)
+	if err != nil || len(res.Versions) != 1 || res.Versions[0].VersionID != latest {
+		t.Errorf("versions left: %+v, %v", res.Versions, err)
+	}
+	runDeletes(t)
+	if len(volumes[0].blobs) != 1 {
+		t.Errorf("volume has %v, want only the latest version", volumes[0].blobs)
+	}
+
+	// expiring a versioned key only hides it behind a delete marker
+	if s := runRule(t, later, "expire"); s.Succeeded != 1 {
+		t.Errorf("expire report: %+v", s)
+	}
+	if rr := do("GET", "/b/docs/a.txt", ""); rr.Code != http.StatusNotFound || rr.Header().Get("X-Tinydb-Delete-Marker") != "true" {
+		t.Errorf("GET of an expired versioned key: got %d", rr.Code)
+	}
+	runDeletes(t)
+	if len(volumes[0].blobs) != 1 {
+		t.Errorf("expire removed a version: %v", volumes[0].blobs)
+	}
+	// a delete marker doesn't match again
+	if s := runRule(t, later, "expire"); s.Matched != 0 {
+		t.Errorf("second expire run: %+v", s)
+	}
+}
+
+func TestLifecycleTransition(t *testing.T) {
+	hot := newTestMaster(t)
+	cold := addVolumeGroup(t, "cold")
+	if rr := do("PUT", "/video", "frames"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d %s", rr.Code, rr.Body)
+	}
+	putRule(t, "to-cold", `{"action": "transition", "days": 1, "storage_class": "cold"}`)
+
+	later := time.Now().Add(48 * time.Hour)
+	if s := runRule(t, later, "to-cold"); s.Matched != 1 || s.Succeeded != 1 {
+		t.Fatalf("transition report: %+v", s)
+	}
+	rec, err := getRecord("video")
+	if err != nil || rec.Class != "cold" || !slices.Equal(rec.Replicas, volumeServers[1].Replicas) {
+		t.Fatalf("record after the transition: %+v, %v", rec, err)
+	}
+	runDeletes(t)
+	for i := range cold {
+		if cold[i].blobs[rec.Blob] != "frames" || len(hot[i].blobs) != 0 {
+			t.Errorf("replica %d: cold has %v, hot has %v", i, cold[i].blobs, hot[i].blobs)
+		}
+	}
+	if s := runRule(t, later, "to-cold"); s.Matched != 0 {
+		t.Errorf("second transition run: %+v", s)
+	}
+}
+
+// TestLifecycleChangedKeys covers keys written or deleted between being
+// matched and being acted on.
+func TestLifecycleChangedKeys(t *testing.T) {
+	newTestMaster(t)
+	for _, k := range []string{"a", "b"} {
+		if rr := do("PUT", "/"+k, k); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got %d %s", k, rr.Code, rr.Body)
+		}
+	}
+
+	rule := LifecycleRule{ID: "all", Action: actionExpire, Days: 1}
+	later := time.Now().Add(48 * time.Hour)
+	cutoff := later.AddDate(0, 0, -rule.Days)
+	matched, err := matchRule(rule, objectRef{}, cutoff, later)
+	if err != nil || len(matched) != 2 {
+		t.Fatalf("matched %+v, %v", matched, err)
+	}
+	if rr := do("PUT", "/a", "new"); rr.Code != http.StatusCreated {
+		t.Fatalf("overwrite: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := do("DELETE", "/b", ""); rr.Code != http.StatusCreated {
+		t.Fatalf("DELETE: got %d %s", rr.Code, rr.Body)
+	}
+	for _, a := range matched {
+		if err := applyAction(rule, a, cutoff); err != errSkipped {
+			t.Errorf("%s: got %v, want errSkipped", a.Key, err)
+		}
+	}
+	if rec, err := getRecord("a"); err != nil || rec.Size != 3 {
+		t.Errorf("the overwritten key was expired: %+v, %v", rec, err)
+	}
+}
+
+// TestLifecycleTransitionRace writes a key while a transition is copying it.
+func TestLifecycleTransitionRace(t *testing.T) {
+	hot := newTestMaster(t)
+	cold := addVolumeGroup(t, "cold")
+	if rr := do("PUT", "/video", "frames"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d %s", rr.Code, rr.Body)
+	}
+	putRule(t, "to-cold", `{"action": "transition", "days": 1, "storage_class": "cold"}`)
+
+	cold[0].pause = make(chan struct{})
+	done := make(chan lifecycleStats)
+	go func() {
+		reports, _ := runLifecycle(time.Now().Add(48*time.Hour), false, "to-cold")
+		done <- reports[0]
+	}()
+	<-cold[0].pause
+	if rr := do("PUT", "/video", "new frames"); rr.Code != http.StatusCreated {
+		t.Errorf("PUT during the copy: got %d %s", rr.Code, rr.Body)
+	}
+	cold[0].pause <- struct{}{}
+
+	if s := <-done; s.Matched != 1 || s.Skipped != 1 {
+		t.Errorf("transition report: %+v", s)
+	}
+	rec, err := getRecord("video")
+	if err != nil || rec.storageClass() != defaultStorageClass || hot[0].blobs[rec.Blob] != "new frames" {
+		t.Errorf("record after the race: %+v, %v", rec, err)
+	}
+	runDeletes(t)
+	for i, v := range cold {
+		if len(v.blobs) != 0 {
+			t.Errorf("cold volume %d kept the copy: %v", i, v.blobs)
+		}
+	}
+}
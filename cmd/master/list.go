@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 1000
+)
+
+type listEntry struct {
+	Key   string    `json:"key"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	ETag  string    `json:"etag,omitempty"`
+	// Expires is zero for keys without a TTL.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+type listResult struct {
+	Prefix         string      `json:"prefix"`
+	Delimiter      string      `json:"delimiter,omitempty"`
+	Keys           []listEntry `json:"keys"`
+	CommonPrefixes []string    `json:"common_prefixes,omitempty"`
+	IsTruncated    bool        `json:"is_truncated"`
+	NextStartAfter string      `json:"next_start_after,omitempty"`
+}
+
+// handleList serves GET /?list&prefix=&start-after=&limit=&delimiter=
+// and the same for a bucket under GET /b/<bucket>/?list.
+// Keys come back in leveldb order. When a delimiter is given, keys that
+// contain it after the prefix are rolled up into a single common prefix,
+// the same way S3 shows "directories".
+func handleList(w http.ResponseWriter, r *http.Request) {
+	ref, status, err := parseObjectPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if ref.Key != "" {
+		http.Error(w, "Listing takes a prefix, not a key", http.StatusBadRequest)
+		return
+	}
+	if _, ok := r.URL.Query()["versions"]; ok {
+		handleListVersions(w, r, ref)
+		return
+	}
+	if _, ok := r.URL.Query()["trash"]; ok {
+		handleListTrash(w, r, ref)
+		return
+	}
+
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	startAfter := q.Get("start-after")
+	delimiter := q.Get("delimiter")
+
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	res, err := listKeys(ref.listBase(), prefix, startAfter, delimiter, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// listKeys lists the keys stored under the index prefix base. Prefixes,
+// start-after and the returned keys are all relative to base.
+func listKeys(base, prefix, startAfter, delimiter string, limit int) (listResult, error) {
+	res := listResult{Prefix: prefix, Delimiter: delimiter, Keys: []listEntry{}}
+
+	rng := metastore.Prefix([]byte(base + prefix))
+	if base+prefix == "" {
+		// the default namespace must not list the master's own entries
+		rng = &metastore.Range{Start: []byte{0x01}}
+	}
+	iter := db.NewIterator(rng)
+	defer iter.Release()
+
+	var ok bool
+	if startAfter != "" && startAfter >= prefix {
+		ok = iter.Seek([]byte(base + startAfter))
+		if ok && string(iter.Key()) == base+startAfter {
+			ok = iter.Next()
+		}
+	} else {
+		ok = iter.First()
+	}
+
+	now := time.Now()
+	count := 0
+	last := ""
+	for ; ok; ok = iter.Next() {
+		key := string(iter.Key()[len(base):])
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				cp := key[:len(prefix)+i+len(delimiter)]
+				// skip every key under this common prefix in one go.
+				// start-after may point inside it, in which case it was
+				// already returned on an earlier page.
+				if cp > startAfter {
+					if count == limit {
+						res.IsTruncated = true
+						break
+					}
+					res.CommonPrefixes = append(res.CommonPrefixes, cp)
+					last = cp
+					count++
+				}
+				if !iter.Seek([]byte(base + cp + "\xff")) {
+					break
+				}
+				iter.Prev()
+				continue
+			}
+		}
+
+		rec, err := decodeRecord(key, iter.Value())
+		if err != nil {
+			return res, err
+		}
+		if rec.DeleteMarker || rec.expired(now) {
+			continue
+		}
+
+		if count == limit {
+			res.IsTruncated = true
+			break
+		}
+		res.Keys = append(res.Keys, listEntry{Key: key, Size: rec.Size, Mtime: rec.Mtime, ETag: rec.ETag, Expires: rec.Expires})
+		last = key
+		count++
+	}
+	if err := iter.Error(); err != nil {
+		return res, err
+	}
+
+	if res.IsTruncated {
+		res.NextStartAfter = last
+	}
+	return res, nil
+}
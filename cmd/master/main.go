@@ -3,68 +3,154 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"net/url"
+	"strconv"
 	"time"
 
 	_ "net/http/pprof"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/alvinliju/tinydb/internal/changelog"
+	"github.com/alvinliju/tinydb/internal/keylock"
+	"github.com/alvinliju/tinydb/internal/metastore"
+	"github.com/alvinliju/tinydb/internal/topology"
 )
 
 // now our master gets a put requests and
 // it forwards it to the volume server and return something
 var httpClient *http.Client
 
-var db *leveldb.DB
+var db *indexDB
 
-type VolumeGroup struct {
-	Replicas []string
-}
+// keyLocks serializes all changes to a key, see handlePut.
+var keyLocks keylock.Locker
+
+// volumeServers is the cluster layout, see internal/topology.
+var volumeServers = topology.Default
 
-var volumeServers = []VolumeGroup{
-	{Replicas: []string{"http://localhost:3001", "http://localhost:3002", "http://localhost:3003"}},
-	{Replicas: []string{"http://localhost:3004", "http://localhost:3005", "http://localhost:3006"}},
-	{Replicas: []string{"http://localhost:3007", "http://localhost:3008", "http://localhost:3009"}},
-	{Replicas: []string{"http://localhost:3010", "http://localhost:3011", "http://localhost:3012"}},
+func groupsOfClass(class string) []topology.VolumeGroup {
+	return topology.OfClass(volumeServers, class)
 }
 
-func key2Volume(key string) VolumeGroup {
-	//hash the key
-	hash := md5.Sum([]byte(key))
-	//take the hash and calculate the volumeServer Index cool?
-	x := int(hash[0]) % len(volumeServers)
-	fmt.Println("Volume Group Index:", x)
-	return volumeServers[x]
+// key2Volume picks the volume group for key among the groups of the given
+// storage class. The class must have at least one group.
+func key2Volume(key string, class string) topology.VolumeGroup {
+	g, _ := topology.Pick(volumeServers, key, class)
+	return g
 }
 
 func init() {
 	httpClient = &http.Client{
 		Timeout: 10 * time.Second,
 	}
+}
 
-	var err error
-	db, err = leveldb.OpenFile("./tinydb_master", nil)
+func main() {
+	reapInterval := flag.Duration("reap-interval", time.Minute, "how often to delete expired keys")
+	lifecycleInterval := flag.Duration("lifecycle-interval", time.Hour, "how often to run the lifecycle rules")
+	flag.DurationVar(&trashRetention, "trash-retention", 0, "how long deleted keys can be undeleted, 0 deletes right away")
+	deleteRetry := flag.Duration("delete-retry-interval", 10*time.Second, "how often to retry deletes replicas haven't confirmed")
+	gcInterval := flag.Duration("gc-interval", 0, "how often to delete orphan blobs on the volumes, 0 only when asked to")
+	gcGrace := flag.Duration("gc-grace", defaultGCGrace, "how old an orphan blob must be before it is deleted")
+	volumes := flag.String("volumes", "", "JSON file listing the volume groups and their storage classes")
+	addr := flag.String("addr", ":3000", "address to listen on")
+	dbPath := flag.String("db", "./tinydb_master", "leveldb directory of the index")
+	engine := flag.String("db-engine", "leveldb", "what to keep the index in: leveldb, or memory for a master that forgets everything on exit")
+	rebuild := flag.Bool("rebuild", false, "rebuild a lost index from the volumes into an empty -db, then exit")
+	changes := flag.String("changelog", "", "directory to log every index write to, for point in time restores")
+	raftID := flag.String("raft-id", "", "ID of this master in a replicated cluster, one of -raft-peers")
+	raftPeersFlag := flag.String("raft-peers", "", "every master in the cluster as id=url,id=url,...")
+	raftDir := flag.String("raft-dir", "./tinydb_raft", "directory of this master's Raft log")
+	flag.Parse()
+
+	store, err := openStore(*engine, *dbPath)
 	if err != nil {
-		fmt.Println("Error connecting leveldb", err)
+		log.Fatalf("Master: Error opening %s: %v", *dbPath, err)
+	}
+	db = &indexDB{Store: store}
+
+	if *volumes != "" {
+		groups, err := topology.Load(*volumes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		volumeServers = groups
+	}
+
+	if *changes != "" {
+		l, err := changelog.Open(*changes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db.changes = l
+	}
+
+	if *rebuild {
+		if *raftID != "" {
+			log.Fatal("Master: rebuild a single master, then start the others from a copy of its index")
+		}
+		stats, err := rebuildIndex()
+		if err != nil {
+			log.Fatalf("Master: rebuild: %v", err)
+		}
+		log.Printf("Master: rebuilt the index from %d blobs: %d keys, %d versions, %d trashed, %d buckets, %d stale copies, %d unrecoverable",
+			stats.Blobs, stats.Keys, stats.Versions, stats.Trashed, stats.Buckets, stats.Stale, stats.Unrecoverable)
+		db.Close()
+		if db.changes != nil {
+			db.changes.Close()
+		}
 		return
 	}
 
-}
+	if *raftID != "" {
+		if err := startRaft(*raftID, *raftPeersFlag, *raftDir); err != nil {
+			log.Fatalf("Master: raft: %v", err)
+		}
+	}
 
-func main() {
-	http.HandleFunc("/", handleRequests)
+	go runReaper(*reapInterval)
+	go runLifecycleScheduler(*lifecycleInterval)
+	go runAccessFlusher()
+	go runDeleteWorker(*deleteRetry)
+	if *gcInterval > 0 {
+		go runGCScheduler(*gcInterval, *gcGrace)
+	}
 
-	log.Fatal(http.ListenAndServe(":3000", nil))
+	http.HandleFunc("/", handleRequests)
+	http.HandleFunc("/admin/buckets", handleBuckets)
+	http.HandleFunc("/admin/buckets/", handleBuckets)
+	http.HandleFunc("/admin/lifecycle", handleLifecycle)
+	http.HandleFunc("/admin/lifecycle/", handleLifecycle)
+	http.HandleFunc("/admin/deletes", handleDeletes)
+	http.HandleFunc("/admin/gc", handleGC)
+	http.HandleFunc("/admin/disks", handleDisks)
+	http.HandleFunc("/admin/snapshot", handleSnapshot)
+	http.HandleFunc("/admin/raft", handleRaftStatus)
+	http.HandleFunc("/admin/shard", handleShard)
+	http.HandleFunc("/admin/shard/", handleShard)
+
+	log.Fatal(http.ListenAndServe(*addr, redirectWrites(http.DefaultServeMux)))
 }
 
 func handleRequests(w http.ResponseWriter, r *http.Request) {
+	release, ok := checkShard(w, r)
+	if !ok {
+		return
+	}
+	defer release()
 	switch r.Method {
 	case "GET":
+		if _, ok := r.URL.Query()["list"]; ok {
+			handleList(w, r)
+			return
+		}
 		handleGet(w, r)
 	case "PUT":
 		handlePut(w, r)
@@ -72,6 +158,13 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 	case "DELETE":
 		handleDelete(w, r)
 
+	case "POST":
+		if _, ok := r.URL.Query()["undelete"]; ok {
+			handleUndelete(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -79,22 +172,86 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePut(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Path[len("/"):]
-	if key == "" {
-		http.Error(w, "Key required", http.StatusBadRequest)
+	ref, status, err := objectFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	key := ref.volumeKey()
+
+	class := defaultStorageClass
+	replication := 0
+	if ref.Bucket != nil {
+		class = ref.Bucket.StorageClass
+		replication = ref.Bucket.Replication
+		if ref.Bucket.QuotaBytes > 0 && r.ContentLength < 0 {
+			http.Error(w, "Content-Length is required in a bucket with a quota", http.StatusLengthRequired)
+			return
+		}
+	}
+
+	expires, err := expiryFromRequest(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// hold the key until the index points at what we wrote, so the
+	// preconditions still hold when we commit and two writers can't
+	// interleave their writes across the replicas
+	unlock := keyLocks.Lock(ref.indexKey())
+	defer unlock()
+	if status := checkPreconditions(r, ref); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if ref.Bucket != nil && ref.Bucket.QuotaBytes > 0 {
+		// an overwrite replaces the old blob on the replicas, so it must
+		// fit before any of them is written
+		release, err := reserveQuota(ref, r.ContentLength)
+		if err == errQuotaExceeded {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer release()
+	}
+
+	gen, err := nextGeneration()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
+	// versioned buckets write every PUT to a new blob instead of overwriting
+	version := ""
+	query := ""
+	if ref.versioned() {
+		version = newVersionID()
+		query = "?version=" + version
+	}
+
 	//hashes filename in our volume server
 	// since the key and hash algo is the same all the servers should return the same hashed file name
 	var hashKeyFromResponse string = ""
 
 	//get volume servers
-	selectedSubVolume := key2Volume(key)
+	selectedSubVolume := key2Volume(key, class)
 
 	rVolumesFromSelectedSubVol := selectedSubVolume.Replicas
+	if replication > 0 {
+		rVolumesFromSelectedSubVol = rVolumesFromSelectedSubVol[:replication]
+	}
 	fmt.Println(rVolumesFromSelectedSubVol)
 
+	mtime := time.Now().UTC()
+	meta := metadataFromRequest(ref, r)
+	// what the volumes keep so the index can be rebuilt from them
+	blobRec := Record{Meta: meta, Mtime: mtime, Expires: expires}.blobRecord()
+
 	var buf bytes.Buffer
 	body := io.TeeReader(r.Body, &buf)
 	//we nee to write to all the three volumes
@@ -106,12 +263,18 @@ func handlePut(w http.ResponseWriter, r *http.Request) {
 
 		rVolume := rVolumesFromSelectedSubVol[i]
 		fmt.Println(rVolume, "curr volume being used")
-		redirectURI := rVolume + "/files/" + key
+		redirectURI := rVolume + "/files/" + url.PathEscape(key) + query
 		request, err := http.NewRequest("PUT", redirectURI, body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		request.Header.Set(generationHeader, strconv.FormatUint(gen, 10))
+		request.Header.Set(recordHeader, blobRec)
+		// the volumes keep it, and serve the blob with it
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			request.Header.Set("Content-Type", ct)
+		}
 
 		client := httpClient
 		resp, err := client.Do(request)
@@ -128,6 +291,18 @@ func handlePut(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if resp.StatusCode == http.StatusConflict {
+			// the replica already holds a newer generation of this key
+			log.Printf("Master: volume server %s rejected stale PUT of generation %d", redirectURI, gen)
+			http.Error(w, "A newer write to this key won", http.StatusConflict)
+			return
+		}
+		if resp.StatusCode != http.StatusCreated {
+			log.Printf("Master: volume server %s answered PUT with %s: %s", redirectURI, resp.Status, data)
+			http.Error(w, "Failed to store file: volume server unreachable or error", http.StatusBadGateway)
+			return
+		}
+
 		var result map[string]string
 		json.Unmarshal(data, &result)
 		hashKeyFromResponse = result["key"]
@@ -135,32 +310,64 @@ func handlePut(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//TODO: figure out a way to add the subvolumes dynamically
-	value := strings.Join(rVolumesFromSelectedSubVol, ",")
-	fmt.Println(value, "value stored in db")
+	sum := md5.Sum(buf.Bytes())
+	rec := Record{
+		Blob:       hashKeyFromResponse,
+		Replicas:   rVolumesFromSelectedSubVol,
+		Size:       int64(buf.Len()),
+		Mtime:      mtime,
+		ETag:       hex.EncodeToString(sum[:]),
+		Meta:       meta,
+		Version:    version,
+		Generation: gen,
+		Expires:    expires,
+		Class:      class,
+	}
 
-	err := db.Put([]byte(hashKeyFromResponse), []byte(value), nil)
+	err = storeObject(ref, rec)
+	if err == errQuotaExceeded {
+		// the blob we wrote can't be committed, but an overwrite wrote
+		// over the blob the index still points at
+		if old, err := getRecord(ref.indexKey()); err == nil && old.Blob == rec.Blob {
+			log.Printf("Master: %s was overwritten over the quota, keeping its blob", ref.indexKey())
+		} else if err := deleteLater(rec.Blob, rec.Replicas, gen); err != nil {
+			log.Printf("Master: Error queueing cleanup of %s: %v", rec.Blob, err)
+		}
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error saving key to master", http.StatusInternalServerError)
+		return
 	}
 
 	fmt.Printf("Here is the key %s", string(hashKeyFromResponse))
+	if version != "" {
+		w.Header().Set(versionHeader, version)
+	}
+	w.Header().Set("ETag", quoteETag(rec.ETag))
 	w.WriteHeader(http.StatusCreated)
 }
 
 func handleGet(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("here")
-	key := r.URL.Path[len("/"):]
-	if key == "" {
-		http.Error(w, "Key requiredddd", http.StatusBadRequest)
+	ref, status, err := objectFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	fmt.Println("here")
+	indexKey := ref.indexKey()
+	if version := r.URL.Query().Get("version"); version != "" {
+		if !ref.versioned() {
+			http.Error(w, "bucket is not versioned", http.StatusBadRequest)
+			return
+		}
+		indexKey = ref.versionKey(version)
+	}
 
-	//TODO check if the key exists in our master
-	v, err := db.Get([]byte(key), nil)
+	rec, err := getRecord(indexKey)
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == metastore.ErrNotFound {
 			fmt.Println(err)
 			http.Error(w, "key not found", http.StatusNotFound)
 			return
@@ -168,9 +375,26 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	fmt.Println(string(v), "decoded shits")
+	if rec.Version != "" {
+		w.Header().Set(versionHeader, rec.Version)
+	}
+	if rec.DeleteMarker {
+		w.Header().Set("X-Tinydb-Delete-Marker", "true")
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if rec.expired(time.Now()) {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+
+	if indexKey == ref.indexKey() && ref.versioned() {
+		// reads of the latest version count for that version
+		indexKey = ref.versionKey(rec.Version)
+	}
+	recordRead(indexKey, time.Now())
 
-	rVolume := strings.Split(string(v), ",")
+	rVolume := rec.Replicas
 
 	fmt.Println(rVolume, "rVolumes")
 	var healthyReplica string
@@ -205,23 +429,48 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	redirectURI := healthyReplica + "/files/" + key
+	redirectURI := healthyReplica + "/files/" + rec.Blob
 	fmt.Println("redirectURI:", redirectURI)
 	fmt.Println("rVolume:", rVolume)
+	for k, v := range rec.Meta {
+		w.Header().Set(metaHeaderPrefix+k, v)
+	}
+	if rec.ETag != "" {
+		w.Header().Set("ETag", quoteETag(rec.ETag))
+	}
+	if !rec.Expires.IsZero() {
+		w.Header().Set(expiresHeader, rec.Expires.Format(time.RFC3339))
+	}
 	http.Redirect(w, r, string(redirectURI), http.StatusMovedPermanently)
 }
 
 func handleDelete(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Path[len("/"):]
-	if key == "" {
-		http.Error(w, "Key required", http.StatusBadRequest)
+	ref, status, err := objectFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	unlock := keyLocks.Lock(ref.indexKey())
+	defer unlock()
+	if status := checkPreconditions(r, ref); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if ref.versioned() {
+		handleDeleteVersioned(w, r, ref)
+		return
+	}
+	if r.URL.Query().Get("version") != "" {
+		http.Error(w, "bucket is not versioned", http.StatusBadRequest)
 		return
 	}
 
 	//TODO:ping volumes and load pick a random one and store to keyvalue store
-	v, err := db.Get([]byte(key), nil)
+	rec, err := getRecord(ref.indexKey())
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == metastore.ErrNotFound {
 			fmt.Println(err)
 			http.Error(w, "key not found", http.StatusNotFound)
 			return
@@ -229,49 +478,70 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	fmt.Println(string(v), "decoded shits")
-
-	rVolume := strings.Split(string(v), ",")
 
-	for _, elm := range rVolume {
-
-		redirectURI := string(elm) + "/files/" + key
-		request, err := http.NewRequest("DELETE", string(redirectURI), r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if trashRetention > 0 && !rec.expired(time.Now()) {
+		err = trashObject(ref, rec)
+	} else {
+		err = destroyObject(ref, rec)
+	}
+	if err != nil {
+		log.Printf("Master: Error deleting %s: %v", rec.Blob, err)
+		// only the trash talks to the volumes right away, blob deletes
+		// are queued
+		if trashRetention > 0 {
+			http.Error(w, "Failed to delete file: volume server unreachable or error", http.StatusBadGateway)
 			return
 		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
-		client := httpClient
-		resp, err := client.Do(request)
-		if err != nil {
-			log.Printf("Master: Error sending DEL request to volume server %s: %v", redirectURI, err)
-			// A 502 Bad Gateway is appropriate if the upstream server (Volume Server) is unreachable or errors out.
-			http.Error(w, "Failed to store file: volume server unreachable or error", http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
+	w.WriteHeader(http.StatusCreated)
+}
 
-		volumeRespBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "Failed to read response from volume server", http.StatusInternalServerError)
-			return
-		}
+// destroyObject drops the index entry of an unversioned key and queues the
+// deletion of its blob from every replica. The caller must hold the key's
+// lock.
+func destroyObject(ref objectRef, rec Record) error {
+	gen, err := nextGeneration()
+	if err != nil {
+		return err
+	}
+	batch := new(metastore.Batch)
+	queueBlobDeletes(batch, rec.Blob, rec.Replicas, gen)
+	if err := removeObject(ref, rec, batch); err != nil {
+		return err
+	}
+	kickDeletes()
+	return nil
+}
 
-		_ = volumeRespBody
+// errStaleGeneration is returned when a replica holds a newer generation
+// of a blob than the one a request carried.
+var errStaleGeneration = errors.New("replica holds a newer generation")
 
-		if resp.StatusCode != 204 {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+// deleteBlob removes blob from a single replica. A replica that no longer
+// has the blob counts as deleted. gen must be newer than the generation
+// the blob was written with, or the replica refuses with errStaleGeneration.
+func deleteBlob(replica, blob string, gen uint64) error {
+	request, err := http.NewRequest("DELETE", replica+"/files/"+blob, nil)
+	if err != nil {
+		return err
 	}
+	request.Header.Set(generationHeader, strconv.FormatUint(gen, 10))
 
-	err = db.Delete([]byte(key), nil)
+	resp, err := httpClient.Do(request)
 	if err != nil {
-		http.Error(w, "Database Error", http.StatusInternalServerError)
-		return
+		return err
 	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
 
-	fmt.Printf(" %s Deleted", string(key))
-	w.WriteHeader(http.StatusCreated)
+	if resp.StatusCode == http.StatusConflict {
+		return errStaleGeneration
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("volume server %s answered DELETE with %s", replica, resp.Status)
+	}
+	return nil
 }
@@ -0,0 +1,935 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/keys"
+	"github.com/alvinliju/tinydb/internal/metastore"
+	"github.com/alvinliju/tinydb/internal/topology"
+)
+
+// fakeVolume keeps blobs in memory and answers like a volume server.
+type fakeVolume struct {
+	mu    sync.Mutex
+	blobs map[string]string
+	// inventory is what /blobs lists of each blob
+	inventory map[string]volumeBlob
+	// disks is the answer to /disks, none if empty
+	disks string
+	// pause, if set, is sent on when a PUT arrives and received from
+	// before it is stored
+	pause       chan struct{}
+	failDeletes bool
+}
+
+func (v *fakeVolume) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		return
+	}
+	if r.URL.Path == "/disks" {
+		if v.disks == "" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, v.disks)
+		return
+	}
+	if v.pause != nil && r.Method == "PUT" {
+		v.pause <- struct{}{}
+		<-v.pause
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r.URL.Path == "/gc" {
+		// sweeps every blob not listed, there is no grace period here
+		b, _ := io.ReadAll(r.Body)
+		listed := strings.Fields(string(b))
+		orphans := 0
+		for name := range v.blobs {
+			if !slices.Contains(listed, name) {
+				if r.URL.Query().Get("dry-run") == "" {
+					delete(v.blobs, name)
+					delete(v.inventory, name)
+				}
+				orphans++
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]int{"orphan_count": orphans})
+		return
+	}
+	if r.URL.Path == "/blobs" {
+		page := struct {
+			Blobs []volumeBlob `json:"blobs"`
+		}{}
+		for _, b := range v.inventory {
+			page.Blobs = append(page.Blobs, b)
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	gen, _ := strconv.ParseUint(r.Header.Get(generationHeader), 10, 64)
+	switch r.Method {
+	case "PUT":
+		key := name
+		name = keys.BlobName(key, r.URL.Query().Get("version"))
+		b, _ := io.ReadAll(r.Body)
+		v.blobs[name] = string(b)
+		sum := md5.Sum(b)
+		v.inventory[name] = volumeBlob{
+			Name:       name,
+			Size:       int64(len(b)),
+			MD5:        hex.EncodeToString(sum[:]),
+			Key:        key,
+			Generation: gen,
+			Record:     json.RawMessage(r.Header.Get(recordHeader)),
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"key": name, "etag": hex.EncodeToString(sum[:])})
+	case "POST":
+		// moves the blob to another version of its key
+		b, ok := v.blobs[name]
+		key, _ := keys.Key(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		inv := v.inventory[name]
+		delete(v.blobs, name)
+		delete(v.inventory, name)
+		name = keys.BlobName(key, r.URL.Query().Get("version"))
+		v.blobs[name] = b
+		inv.Name, inv.Generation, inv.Record = name, gen, json.RawMessage(r.Header.Get(recordHeader))
+		v.inventory[name] = inv
+		json.NewEncoder(w).Encode(map[string]string{"key": name})
+	case "DELETE":
+		if v.failDeletes {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if _, ok := v.blobs[name]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(v.blobs, name)
+		delete(v.inventory, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		b, ok := v.blobs[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, b)
+	}
+}
+
+// newTestMaster points the master at an index in memory and one volume
+// group of three fake volumes.
+func newTestMaster(t *testing.T) []*fakeVolume {
+	oldDB, oldServers := db, volumeServers
+	db = &indexDB{Store: metastore.NewMemory()}
+	resetGenerations()
+	volumeServers = nil
+
+	t.Cleanup(func() {
+		db.Close()
+		db, volumeServers = oldDB, oldServers
+		resetGenerations()
+	})
+	return addVolumeGroup(t, defaultStorageClass)
+}
+
+// addVolumeGroup adds a group of three fake volumes of the given class.
+func addVolumeGroup(t *testing.T, class string) []*fakeVolume {
+	var volumes []*fakeVolume
+	group := topology.VolumeGroup{Class: class}
+	for i := 0; i < 3; i++ {
+		v := &fakeVolume{blobs: map[string]string{}, inventory: map[string]volumeBlob{}}
+		srv := httptest.NewServer(v)
+		t.Cleanup(srv.Close)
+		volumes = append(volumes, v)
+		group.Replicas = append(group.Replicas, srv.URL)
+	}
+	volumeServers = append(volumeServers, group)
+	return volumes
+}
+
+func do(method, target, body string) *httptest.ResponseRecorder {
+	return doWith(method, target, body)
+}
+
+// doWith is do with headers, given as name, value pairs.
+func doWith(method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rr := httptest.NewRecorder()
+	handleRequests(rr, r)
+	return rr
+}
+
+// runDeletes sends every queued blob delete that is due.
+func runDeletes(t *testing.T) {
+	t.Helper()
+	for {
+		_, more, err := processDeletes(time.Now(), time.Second)
+		if err != nil {
+			t.Fatalf("processing deletes: %v", err)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	volumes := newTestMaster(t)
+
+	if rr := do("PUT", "/greeting", "hello"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d %s", rr.Code, rr.Body)
+	}
+	for i, v := range volumes {
+		if v.blobs[keys.BlobName("greeting", "")] != "hello" {
+			t.Errorf("volume %d doesn't have the blob: %v", i, v.blobs)
+		}
+	}
+	rec, err := getRecord("greeting")
+	if err != nil || rec.Size != 5 || len(rec.Replicas) != 3 || rec.Generation == 0 {
+		t.Fatalf("index entry: %+v, %v", rec, err)
+	}
+	// an overwrite is stamped with a newer generation
+	if rr := do("PUT", "/greeting", "hello"); rr.Code != http.StatusCreated {
+		t.Fatalf("second PUT: got %d %s", rr.Code, rr.Body)
+	}
+	if again, err := getRecord("greeting"); err != nil || again.Generation <= rec.Generation {
+		t.Errorf("generation went from %d to %d (%v)", rec.Generation, again.Generation, err)
+	}
+
+	rr := do("GET", "/greeting", "")
+	if rr.Code != http.StatusMovedPermanently {
+		t.Fatalf("GET: got %d %s", rr.Code, rr.Body)
+	}
+	loc, _ := url.Parse(rr.Header().Get("Location"))
+	if loc.Path != "/files/"+rec.Blob || rr.Header().Get("ETag") == "" {
+		t.Errorf("GET redirects to %s, ETag %q", loc, rr.Header().Get("ETag"))
+	}
+
+	if rr := do("DELETE", "/greeting", ""); rr.Code != http.StatusCreated {
+		t.Fatalf("DELETE: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := do("GET", "/greeting", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: got %d", rr.Code)
+	}
+	// the blobs are left to the delete worker
+	if n, err := countPrefix(deleteTaskPrefix); err != nil || n != 3 {
+		t.Errorf("queued %d blob deletes, want one per replica (%v)", n, err)
+	}
+	runDeletes(t)
+	for i, v := range volumes {
+		if len(v.blobs) != 0 {
+			t.Errorf("volume %d still has %v", i, v.blobs)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	newTestMaster(t)
+	for _, k := range []string{"photos/cat", "photos/dog", "photos/2024/beach", "notes"} {
+		if rr := do("PUT", "/"+k, k); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got %d %s", k, rr.Code, rr.Body)
+		}
+	}
+
+	var res struct {
+		Keys []struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"keys"`
+		CommonPrefixes []string `json:"common_prefixes"`
+		IsTruncated    bool     `json:"is_truncated"`
+		NextStartAfter string   `json:"next_start_after"`
+	}
+	rr := do("GET", "/?list&prefix=photos/&delimiter=/", "")
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatalf("list: %d %v", rr.Code, err)
+	}
+	var got []string
+	for _, e := range res.Keys {
+		got = append(got, fmt.Sprintf("%s:%d", e.Key, e.Size))
+	}
+	if strings.Join(got, ",") != "photos/cat:10,photos/dog:10" || strings.Join(res.CommonPrefixes, ",") != "photos/2024/" {
+		t.Errorf("list photos/: keys %v, prefixes %v", got, res.CommonPrefixes)
+	}
+
+	res.Keys = nil
+	json.NewDecoder(do("GET", "/?list&limit=2", "").Body).Decode(&res)
+	if len(res.Keys) != 2 || !res.IsTruncated || res.NextStartAfter != "photos/2024/beach" {
+		t.Errorf("first page: %+v", res)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	volumes := newTestMaster(t)
+	rr := httptest.NewRecorder()
+	handleBuckets(rr, httptest.NewRequest("PUT", "/admin/buckets/photos", strings.NewReader(`{"versioning": true}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create bucket: got %d %s", rr.Code, rr.Body)
+	}
+	do("PUT", "/a", "alpha")
+	doWith("PUT", "/b", "beta", ttlHeader, "1h", metaHeaderPrefix+"Owner", "ops")
+	do("PUT", "/b/photos/cat", "cat 1")
+	do("PUT", "/b/photos/cat", "cat 2")
+
+	// a replica that missed the last write to a
+	a, _ := getRecord("a")
+	volumes[2].blobs[a.Blob] = "old"
+	stale := volumes[2].inventory[a.Blob]
+	stale.Generation, stale.MD5 = a.Generation-1, "0123"
+	volumes[2].inventory[a.Blob] = stale
+
+	b, _ := getRecord("b")
+	cat, _ := getRecord(objectPrefix + "photos/cat")
+	db.Close()
+	db = &indexDB{Store: metastore.NewMemory()}
+	resetGenerations()
+
+	stats, err := rebuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 3 || stats.Versions != 2 || stats.Buckets != 1 || stats.Stale != 1 || stats.Unrecoverable != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+	if rec, err := getRecord("a"); err != nil || rec.ETag != a.ETag || rec.Generation != a.Generation || len(rec.Replicas) != 2 {
+		t.Errorf("a: got %+v, %v, want %+v on two replicas", rec, err, a)
+	}
+	rec, err := getRecord("b")
+	if err != nil || !rec.Expires.Equal(b.Expires) || rec.Meta["Owner"] != "ops" || !rec.Mtime.Equal(b.Mtime) {
+		t.Errorf("b: got %+v, %v, want %+v", rec, err, b)
+	}
+	if rec, err := getRecord(objectPrefix + "photos/cat"); err != nil || rec.Version != cat.Version || rec.ETag != cat.ETag {
+		t.Errorf("latest version of cat: got %+v, %v, want %+v", rec, err, cat)
+	}
+	if bucket, err := getBucket("photos"); err != nil || !bucket.Versioning {
+		t.Errorf("bucket: %+v, %v", bucket, err)
+	}
+	if gen, err := nextGeneration(); err != nil || gen <= cat.Generation {
+		t.Errorf("next generation %d isn't past the volumes' %d (%v)", gen, cat.Generation, err)
+	}
+	if _, err := rebuildIndex(); err == nil {
+		t.Error("rebuilt into an index that isn't empty")
+	}
+}
+
+func TestBucketQuota(t *testing.T) {
+	volumes := newTestMaster(t)
+	rr := httptest.NewRecorder()
+	handleBuckets(rr, httptest.NewRequest("PUT", "/admin/buckets/photos", strings.NewReader(`{"quota_bytes": 8}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create bucket: got %d %s", rr.Code, rr.Body)
+	}
+
+	if rr := do("PUT", "/b/photos/a", "12345"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT within the quota: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := do("PUT", "/b/photos/b", "12345"); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("PUT over the quota: got %d %s", rr.Code, rr.Body)
+	}
+	// overwriting a key only counts the difference
+	if rr := do("PUT", "/b/photos/a", "1234567"); rr.Code != http.StatusCreated {
+		t.Errorf("overwrite within the quota: got %d %s", rr.Code, rr.Body)
+	}
+	if used, err := bucketUsage("photos"); err != nil || used != 7 {
+		t.Errorf("usage: got %d, %v", used, err)
+	}
+
+	if rr := do("PUT", "/b/photos/c", "1"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT filling the quota: got %d %s", rr.Code, rr.Body)
+	}
+	// an overwrite past the quota is turned down before it reaches the
+	// replicas, which keep the old content
+	if rr := do("PUT", "/b/photos/a", "12345678"); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("overwrite over the quota: got %d %s", rr.Code, rr.Body)
+	}
+	rec, err := getRecord(objectPrefix + "photos/a")
+	if err != nil || rec.Size != 7 {
+		t.Fatalf("index entry after the overwrite: %+v, %v", rec, err)
+	}
+	for i, v := range volumes {
+		if b := v.blobs[rec.Blob]; b != "1234567" {
+			t.Errorf("volume %d has %q", i, b)
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/b/photos/d", strings.NewReader("1"))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	handleRequests(rr, req)
+	if rr.Code != http.StatusLengthRequired {
+		t.Errorf("PUT without a length: got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestCreateBucketOnce(t *testing.T) {
+	newTestMaster(t)
+	codes := make([]int, 10)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handleBuckets(rr, httptest.NewRequest("PUT", "/admin/buckets/photos", strings.NewReader(fmt.Sprintf(`{"quota_bytes": %d}`, i+1))))
+			codes[i] = rr.Code
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+			if b, err := getBucket("photos"); err != nil || b.QuotaBytes != int64(i+1) {
+				t.Errorf("bucket is %+v, %v, want the one created by request %d", b, err, i)
+			}
+		case http.StatusConflict:
+		default:
+			t.Errorf("create %d: got %d", i, code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d creates succeeded, want 1", created)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	volumes := newTestMaster(t)
+	rr := httptest.NewRecorder()
+	handleBuckets(rr, httptest.NewRequest("PUT", "/admin/buckets/docs", strings.NewReader(`{"versioning": true}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create bucket: got %d %s", rr.Code, rr.Body)
+	}
+
+	var ids []string
+	for _, body := range []string{"one", "two"} {
+		rr := do("PUT", "/b/docs/a.txt", body)
+		if rr.Code != http.StatusCreated || rr.Header().Get(versionHeader) == "" {
+			t.Fatalf("PUT %s: got %d %s, version %q", body, rr.Code, rr.Body, rr.Header().Get(versionHeader))
+		}
+		ids = append(ids, rr.Header().Get(versionHeader))
+	}
+	if ids[1] >= ids[0] {
+		t.Errorf("version %s doesn't sort before the older %s", ids[1], ids[0])
+	}
+
+	// every version keeps its own blob
+	for i, body := range []string{"one", "two"} {
+		rr := do("GET", "/b/docs/a.txt?version="+ids[i], "")
+		loc, _ := url.Parse(rr.Header().Get("Location"))
+		name := strings.TrimPrefix(loc.Path, "/files/")
+		if rr.Code != http.StatusMovedPermanently || volumes[0].blobs[name] != body {
+			t.Errorf("GET version %d: got %d to %q", i, rr.Code, name)
+		}
+	}
+	if rr := do("GET", "/b/docs/a.txt", ""); rr.Header().Get(versionHeader) != ids[1] {
+		t.Errorf("GET serves version %q, want the latest %s", rr.Header().Get(versionHeader), ids[1])
+	}
+
+	rr = do("DELETE", "/b/docs/a.txt", "")
+	marker := rr.Header().Get(versionHeader)
+	if rr.Code != http.StatusNoContent || marker == "" {
+		t.Fatalf("DELETE: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := do("GET", "/b/docs/a.txt", ""); rr.Code != http.StatusNotFound || rr.Header().Get("X-Tinydb-Delete-Marker") != "true" {
+		t.Errorf("GET behind a delete marker: got %d", rr.Code)
+	}
+	if len(volumes[0].blobs) != 2 {
+		t.Errorf("a delete marker removed blobs: %v", volumes[0].blobs)
+	}
+
+	res, err := listVersions(objectRef{Bucket: &Bucket{Name: "docs", Versioning: true}}, "", "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range res.Versions {
+		got = append(got, fmt.Sprintf("%s:%v:%v", v.VersionID, v.IsLatest, v.DeleteMarker))
+	}
+	want := []string{marker + ":true:true", ids[1] + ":false:false", ids[0] + ":false:false"}
+	if !slices.Equal(got, want) {
+		t.Errorf("versions: got %v, want %v", got, want)
+	}
+
+	// removing the marker and then the latest version brings back the
+	// one before it
+	for _, id := range []string{marker, ids[1]} {
+		if rr := do("DELETE", "/b/docs/a.txt?version="+id, ""); rr.Code != http.StatusNoContent {
+			t.Fatalf("DELETE version %s: got %d %s", id, rr.Code, rr.Body)
+		}
+	}
+	if rr := do("GET", "/b/docs/a.txt", ""); rr.Code != http.StatusMovedPermanently || rr.Header().Get(versionHeader) != ids[0] {
+		t.Errorf("GET after deleting the latest version: got %d, version %q", rr.Code, rr.Header().Get(versionHeader))
+	}
+	runDeletes(t)
+	if len(volumes[0].blobs) != 1 {
+		t.Errorf("volume has %v, want only the first version", volumes[0].blobs)
+	}
+}
+
+func TestOverwriteMovedKey(t *testing.T) {
+	hot := newTestMaster(t)
+	cold := addVolumeGroup(t, "cold")
+	if rr := do("PUT", "/report", "v1"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d %s", rr.Code, rr.Body)
+	}
+	// as if tiering had moved the key to the cold group
+	rec, _ := getRecord("report")
+	for i, v := range cold {
+		v.blobs[rec.Blob] = hot[i].blobs[rec.Blob]
+		delete(hot[i].blobs, rec.Blob)
+	}
+	rec.Replicas, rec.Class = volumeServers[1].Replicas, "cold"
+	if err := updateRecord(objectRef{Key: "report"}, "report", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := do("PUT", "/report", "v2"); rr.Code != http.StatusCreated {
+		t.Fatalf("overwrite: got %d %s", rr.Code, rr.Body)
+	}
+	runDeletes(t)
+	for i := range cold {
+		if len(cold[i].blobs) != 0 || hot[i].blobs[rec.Blob] != "v2" {
+			t.Errorf("replica %d: cold has %v, hot has %v", i, cold[i].blobs, hot[i].blobs)
+		}
+	}
+}
+
+func TestAccessStats(t *testing.T) {
+	newTestMaster(t)
+	t.Cleanup(func() { flushAccess() })
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				recordRead(fmt.Sprint("key", j%10), start)
+			}
+		}()
+	}
+	wg.Wait()
+	if a, err := getAccessStats("key3"); err != nil || a.Reads != 80 {
+		t.Fatalf("pending reads: got %+v, %v", a, err)
+	}
+
+	if err := flushAccess(); err != nil {
+		t.Fatal(err)
+	}
+	recordRead("key3", start.Add(time.Hour))
+	a, err := getAccessStats("key3")
+	if err != nil || a.Reads != 81 || !a.LastRead.Equal(start.Add(time.Hour)) || !a.WindowStart.Equal(start) {
+		t.Errorf("written and pending reads: got %+v, %v", a, err)
+	}
+
+	// a read after the window starts the count over
+	later := start.Add(accessWindow + time.Hour)
+	recordRead("key4", later)
+	flushAccess()
+	if a, err := getAccessStats("key4"); err != nil || a.Reads != 1 || !a.WindowStart.Equal(later) {
+		t.Errorf("read after the window: got %+v, %v", a, err)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	volumes := newTestMaster(t)
+
+	rr := doWith("PUT", "/doc", "v1", "If-None-Match", "*")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create-only PUT: got %d %s", rr.Code, rr.Body)
+	}
+	etag := rr.Header().Get("ETag")
+	if rr := doWith("PUT", "/doc", "v2", "If-None-Match", "*"); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("create-only PUT of an existing key: got %d", rr.Code)
+	}
+	if rr := doWith("PUT", "/doc", "v2", "If-None-Match", etag); rr.Code != http.StatusNotImplemented {
+		t.Errorf("If-None-Match with an ETag: got %d", rr.Code)
+	}
+	if rr := doWith("PUT", "/doc", "v2", "If-Match", `"0123"`); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale ETag: got %d", rr.Code)
+	}
+	if b := volumes[0].blobs[keys.BlobName("doc", "")]; b != "v1" {
+		t.Fatalf("a failed precondition reached the volumes: %q", b)
+	}
+
+	rr = doWith("PUT", "/doc", "v2", "If-Match", etag)
+	if rr.Code != http.StatusCreated || rr.Header().Get("ETag") == etag {
+		t.Fatalf("PUT with the current ETag: got %d, ETag %s", rr.Code, rr.Header().Get("ETag"))
+	}
+	if rr := doWith("DELETE", "/doc", "", "If-Match", etag); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag: got %d", rr.Code)
+	}
+	if rr := doWith("DELETE", "/doc", "", "If-Match", rr.Header().Get("ETag")); rr.Code != http.StatusCreated {
+		t.Errorf("DELETE with the current ETag: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := doWith("PUT", "/doc", "v3", "If-Match", "*"); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match: * on a deleted key: got %d", rr.Code)
+	}
+}
+
+func countPrefix(prefix string) (int, error) {
+	iter := db.NewIterator(metastore.Prefix([]byte(prefix)))
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	return n, iter.Error()
+}
+
+func TestTTL(t *testing.T) {
+	volumes := newTestMaster(t)
+
+	if rr := doWith("PUT", "/session", "s", ttlHeader, "1h"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT with a TTL: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := doWith("PUT", "/stale", "s", expiresHeader, "1"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT expiring in the past: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := doWith("PUT", "/bad", "s", ttlHeader, "-5"); rr.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a negative TTL: got %d", rr.Code)
+	}
+	if rr := do("GET", "/session", ""); rr.Code != http.StatusMovedPermanently || rr.Header().Get(expiresHeader) == "" {
+		t.Errorf("GET before the expiry: got %d, expires %q", rr.Code, rr.Header().Get(expiresHeader))
+	}
+	// expired keys are hidden before the reaper gets to them
+	if rr := do("GET", "/stale", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("GET of an expired key: got %d", rr.Code)
+	}
+
+	n, err := reapExpired(time.Now())
+	if err != nil || n != 1 {
+		t.Fatalf("first reap: deleted %d, %v", n, err)
+	}
+	if _, err := getRecord("session"); err != nil {
+		t.Errorf("the reaper deleted a key before its expiry: %v", err)
+	}
+	if n, err := reapExpired(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("second reap: deleted %d, %v", n, err)
+	}
+	for _, key := range []string{"session", "stale"} {
+		if _, err := getRecord(key); err != metastore.ErrNotFound {
+			t.Errorf("%s is still in the index: %v", key, err)
+		}
+	}
+	if n, err := countPrefix(expiryPrefix); err != nil || n != 0 {
+		t.Errorf("%d expiry entries left (%v)", n, err)
+	}
+	runDeletes(t)
+	for i, v := range volumes {
+		if len(v.blobs) != 0 {
+			t.Errorf("volume %d still has %v", i, v.blobs)
+		}
+	}
+}
+
+func TestExpiryRange(t *testing.T) {
+	now := time.Now()
+	for _, h := range [][2]string{
+		{expiresHeader, "2262-04-11T23:47:17Z"},
+		{expiresHeader, "9999999999999"},
+		{ttlHeader, "9223372036"},
+		{ttlHeader, "2562047h"},
+	} {
+		r := httptest.NewRequest("PUT", "/k", nil)
+		r.Header.Set(h[0], h[1])
+		if _, err := expiryFromRequest(r, now); err != errExpiryTooLate {
+			t.Errorf("%s: %s: got %v, want errExpiryTooLate", h[0], h[1], err)
+		}
+	}
+
+	r := httptest.NewRequest("PUT", "/k", nil)
+	r.Header.Set(expiresHeader, "2262-04-11T23:47:16Z")
+	if exp, err := expiryFromRequest(r, now); err != nil || exp.UnixNano() < 0 {
+		t.Errorf("last representable second: got %v, %v", exp, err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	volumes := newTestMaster(t)
+	trashRetention = time.Hour
+	t.Cleanup(func() { trashRetention = 0 })
+
+	do("PUT", "/doc", "v1")
+	if rr := do("DELETE", "/doc", ""); rr.Code != http.StatusCreated {
+		t.Fatalf("DELETE: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := do("GET", "/doc", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("GET of a trashed key: got %d", rr.Code)
+	}
+	res, err := listTrash(objectRef{}, "", "", "", 10)
+	if err != nil || len(res.Keys) != 1 || res.Keys[0].Key != "doc" {
+		t.Fatalf("trash: %+v, %v", res, err)
+	}
+	// the blob is out of the way of new writes to the key
+	trashed := keys.BlobName("doc", res.Keys[0].TrashID)
+	for i, v := range volumes {
+		if v.blobs[trashed] != "v1" || v.blobs[keys.BlobName("doc", "")] != "" {
+			t.Errorf("volume %d: %v", i, v.blobs)
+		}
+	}
+
+	do("PUT", "/doc", "v2")
+	if rr := do("POST", "/doc?undelete", ""); rr.Code != http.StatusConflict {
+		t.Errorf("undelete over a live key: got %d", rr.Code)
+	}
+	do("DELETE", "/doc", "")
+	if rr := do("POST", "/doc?undelete", ""); rr.Code != http.StatusCreated {
+		t.Fatalf("undelete: got %d %s", rr.Code, rr.Body)
+	}
+	rec, err := getRecord("doc")
+	if err != nil || volumes[0].blobs[rec.Blob] != "v2" {
+		t.Fatalf("undelete brought back %+v (%v), want the newest copy", rec, err)
+	}
+
+	// v1 is left in the trash, and purged once its retention is up
+	if n, err := reapExpired(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("purge: %d, %v", n, err)
+	}
+	if res, _ := listTrash(objectRef{}, "", "", "", 10); len(res.Keys) != 0 {
+		t.Errorf("trash after the purge: %+v", res)
+	}
+	runDeletes(t)
+	for i, v := range volumes {
+		if len(v.blobs) != 1 || v.blobs[rec.Blob] != "v2" {
+			t.Errorf("volume %d after the purge: %v", i, v.blobs)
+		}
+	}
+	if _, err := getRecord("doc"); err != nil {
+		t.Errorf("the purge deleted the undeleted key: %v", err)
+	}
+}
+
+func TestListTrash(t *testing.T) {
+	newTestMaster(t)
+	trashRetention = time.Hour
+	t.Cleanup(func() { trashRetention = 0 })
+	rr := httptest.NewRecorder()
+	handleBuckets(rr, httptest.NewRequest("PUT", "/admin/buckets/docs", nil))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create bucket: got %d %s", rr.Code, rr.Body)
+	}
+	for _, k := range []string{"/doc", "/doc/a", "/other", "/b/docs/doc"} {
+		do("PUT", k, "x")
+		if rr := do("DELETE", k, ""); rr.Code != http.StatusCreated {
+			t.Fatalf("DELETE %s: got %d %s", k, rr.Code, rr.Body)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"doc", "doc/a", "other"}},
+		// a key equal to the prefix is listed too
+		{"doc", []string{"doc", "doc/a"}},
+		{"doc/", []string{"doc/a"}},
+	} {
+		res, err := listTrash(objectRef{}, tc.prefix, "", "", 10)
+		var got []string
+		for _, e := range res.Keys {
+			got = append(got, e.Key)
+		}
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("prefix %q: got %v (%v), want %v", tc.prefix, got, err, tc.want)
+		}
+	}
+	res, err := listTrash(objectRef{Bucket: &Bucket{Name: "docs"}}, "doc", "", "", 10)
+	if err != nil || len(res.Keys) != 1 || res.Keys[0].Key != "doc" {
+		t.Errorf("bucket trash: %+v, %v", res, err)
+	}
+}
+
+func TestSplitWaitsForWrites(t *testing.T) {
+	volumes := newTestMaster(t)
+	setShard := func(readOnly bool) int {
+		body := fmt.Sprintf(`{"id":"s1","start":"","end":"m","read_only":%v}`, readOnly)
+		rr := httptest.NewRecorder()
+		handleShard(rr, httptest.NewRequest("PUT", "/admin/shard", strings.NewReader(body)))
+		return rr.Code
+	}
+	setShard(false)
+
+	volumes[0].pause = make(chan struct{})
+	put := make(chan int)
+	go func() { put <- do("PUT", "/apple", "a").Code }()
+	<-volumes[0].pause
+
+	// the PUT got past the shard check before the split started
+	frozen := make(chan int)
+	go func() { frozen <- setShard(true) }()
+	code := 0
+	select {
+	case code = <-frozen:
+		t.Error("the shard turned read only with a write in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	volumes[0].pause <- struct{}{}
+	if code := <-put; code != http.StatusCreated {
+		t.Fatalf("PUT: got %d", code)
+	}
+	if code == 0 {
+		code = <-frozen
+	}
+	if code != http.StatusOK {
+		t.Fatalf("read only: got %d", code)
+	}
+	volumes[0].pause = nil
+
+	if _, err := getRecord("apple"); err != nil {
+		t.Errorf("the write in flight isn't in the index: %v", err)
+	}
+	if rr := do("PUT", "/banana", "b"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT to a read only shard: got %d", rr.Code)
+	}
+	if rr := do("GET", "/apple", ""); rr.Code != http.StatusMovedPermanently {
+		t.Errorf("GET from a read only shard: got %d", rr.Code)
+	}
+}
+
+func TestDeleteWorker(t *testing.T) {
+	volumes := newTestMaster(t)
+	do("PUT", "/greeting", "hello")
+	blob := keys.BlobName("greeting", "")
+	volumes[1].failDeletes = true
+	do("DELETE", "/greeting", "")
+
+	now := time.Now()
+	done, more, err := processDeletes(now, time.Second)
+	if err != nil || done != 2 || more {
+		t.Fatalf("first pass: %d done, more %v, %v", done, more, err)
+	}
+	for i, v := range volumes {
+		if _, ok := v.blobs[blob]; ok != (i == 1) {
+			t.Errorf("volume %d has the blob: %v", i, ok)
+		}
+	}
+
+	// the failed delete waits for its backoff, and is listed meanwhile
+	rr := httptest.NewRecorder()
+	handleDeletes(rr, httptest.NewRequest("GET", "/admin/deletes", nil))
+	var res struct {
+		Pending int          `json:"pending"`
+		Tasks   []deleteTask `json:"tasks"`
+	}
+	json.NewDecoder(rr.Body).Decode(&res)
+	if res.Pending != 1 || res.Tasks[0].Replica != volumeServers[0].Replicas[1] || res.Tasks[0].Attempts != 1 || res.Tasks[0].LastError == "" {
+		t.Fatalf("pending deletes: %+v", res)
+	}
+	volumes[1].failDeletes = false
+	if done, _, err := processDeletes(now, time.Second); err != nil || done != 0 {
+		t.Errorf("retried before the backoff: %d done, %v", done, err)
+	}
+	if done, _, err := processDeletes(now.Add(time.Minute), time.Second); err != nil || done != 1 {
+		t.Errorf("retry: %d done, %v", done, err)
+	}
+	if _, ok := volumes[1].blobs[blob]; ok {
+		t.Error("the retry didn't delete the blob")
+	}
+	if n, err := countPrefix(deleteTaskPrefix); err != nil || n != 0 {
+		t.Errorf("%d deletes left (%v)", n, err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	volumes := newTestMaster(t)
+	for i, v := range volumes {
+		v.blobs["orphan"] = "lost"
+		if i == 0 {
+			v.blobs["orphan-too"] = "lost"
+		}
+	}
+
+	// with nothing in the index, every blob looks like an orphan
+	rr := httptest.NewRecorder()
+	handleGC(rr, httptest.NewRequest("POST", "/admin/gc", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("GC of an empty index: got %d %s", rr.Code, rr.Body)
+	}
+	if len(volumes[0].blobs) != 2 {
+		t.Fatalf("GC of an empty index swept %v", volumes[0].blobs)
+	}
+	if _, err := runGC(time.Hour, true, false); err != nil {
+		t.Errorf("dry run of an empty index: %v", err)
+	}
+
+	if rr := do("PUT", "/doc", "v1"); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d %s", rr.Code, rr.Body)
+	}
+	reports, err := runGC(time.Hour, false, false)
+	if err != nil || len(reports) != 3 {
+		t.Fatalf("GC: %+v, %v", reports, err)
+	}
+	for i, r := range reports {
+		if r.Error != "" || (i == 0) != (string(r.Report) == `{"orphan_count":2}`+"\n") {
+			t.Errorf("report of volume %d: %s %s", i, r.Error, r.Report)
+		}
+	}
+	blob := keys.BlobName("doc", "")
+	for i, v := range volumes {
+		if len(v.blobs) != 1 || v.blobs[blob] != "v1" {
+			t.Errorf("volume %d after GC: %v", i, v.blobs)
+		}
+	}
+
+	// forcing sweeps an empty index anyway
+	do("DELETE", "/doc", "")
+	runDeletes(t)
+	volumes[0].blobs["orphan"] = "lost"
+	rr = httptest.NewRecorder()
+	handleGC(rr, httptest.NewRequest("POST", "/admin/gc?force=1", nil))
+	if rr.Code != http.StatusOK || len(volumes[0].blobs) != 0 {
+		t.Errorf("forced GC: got %d, volume has %v", rr.Code, volumes[0].blobs)
+	}
+}
+
+func TestAdminDisks(t *testing.T) {
+	volumes := newTestMaster(t)
+	volumes[0].disks = `[{"dir":"/disk1","failed":false},{"dir":"/disk2","failed":true,"error":"input/output error"}]`
+	volumes[1].disks = `[{"dir":"/disk1","failed":false}]`
+
+	rr := httptest.NewRecorder()
+	handleDisks(rr, httptest.NewRequest("GET", "/admin/disks", nil))
+	var reports []struct {
+		Volume string
+		Error  string
+		Disks  []struct {
+			Dir    string
+			Failed bool
+		}
+	}
+	json.NewDecoder(rr.Body).Decode(&reports)
+	if len(reports) != 3 || len(reports[0].Disks) != 2 || !reports[0].Disks[1].Failed || len(reports[1].Disks) != 1 {
+		t.Fatalf("got %+v", reports)
+	}
+	if reports[2].Error == "" || reports[2].Disks != nil {
+		t.Errorf("volume without disks: got %+v", reports[2])
+	}
+}
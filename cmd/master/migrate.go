@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+var errKeyChanged = errors.New("key was written while it was being moved")
+
+// migrateObject moves the blob behind indexKey (a key's index key or one
+// of its version keys) to a volume group of the given storage class.
+//
+// The blob is copied to every replica of the new group and each copy is
+// checked against the record's ETag. Then the record is pointed at the new
+// replicas in a single write, and only after that are the old copies
+// deleted. The key is not locked while copying; if it gets written in the
+// meantime the copies are thrown away and errKeyChanged is returned.
+func migrateObject(ref objectRef, indexKey string, class string) error {
+	rec, err := getRecord(indexKey)
+	if err != nil {
+		return err
+	}
+	if rec.DeleteMarker || rec.storageClass() == class {
+		return nil
+	}
+	if len(groupsOfClass(class)) == 0 {
+		return fmt.Errorf("no volume group has storage class %q", class)
+	}
+
+	group := key2Volume(ref.volumeKey(), class)
+	targets := group.Replicas[:min(len(rec.Replicas), len(group.Replicas))]
+
+	gen, err := nextGeneration()
+	if err != nil {
+		return err
+	}
+
+	// a target that already is a replica may hold the very copy we are
+	// reading from, never clean that one up
+	cleanup := func(blob string) {
+		var copies []string
+		for _, t := range targets {
+			if blob != rec.Blob || !slices.Contains(rec.Replicas, t) {
+				copies = append(copies, t)
+			}
+		}
+		if err := deleteLater(blob, copies, gen); err != nil {
+			log.Printf("Master: Error queueing cleanup of copies of %s: %v", blob, err)
+		}
+	}
+
+	blob := rec.Blob
+	for _, target := range targets {
+		name, err := copyBlob(rec, ref.volumeKey(), target, gen)
+		if err != nil {
+			cleanup(blob)
+			// an overwrite in place makes the copy fail its ETag check
+			if cur, cerr := getRecord(indexKey); cerr == nil && cur.Generation != rec.Generation {
+				return errKeyChanged
+			}
+			return err
+		}
+		blob = name
+	}
+
+	unlock := keyLocks.Lock(ref.indexKey())
+	cur, err := getRecord(indexKey)
+	if err != nil || cur.Generation != rec.Generation {
+		unlock()
+		cleanup(blob)
+		if err != nil {
+			return err
+		}
+		return errKeyChanged
+	}
+	cur.Blob = blob
+	cur.Replicas = targets
+	cur.Class = class
+	cur.Generation = gen
+	err = updateRecord(ref, indexKey, cur)
+	unlock()
+	if err != nil {
+		cleanup(blob)
+		return err
+	}
+
+	gen, err = nextGeneration()
+	if err != nil {
+		return err
+	}
+	var old []string
+	for _, r := range rec.Replicas {
+		if blob != rec.Blob || !slices.Contains(targets, r) {
+			old = append(old, r)
+		}
+	}
+	return deleteLater(rec.Blob, old, gen)
+}
+
+// copyBlob streams rec's blob from the first of its replicas that has it
+// to target, and returns the blob name target stored it under.
+func copyBlob(rec Record, volumeKey string, target string, gen uint64) (string, error) {
+	var lastErr error
+	for _, src := range rec.Replicas {
+		resp, err := httpClient.Get(src + "/files/" + rec.Blob)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("volume server %s answered GET with %s", src, resp.Status)
+			continue
+		}
+
+		name, err := putBlob(target, volumeKey, rec.Version, gen, resp.Body, rec.ETag, rec.blobRecord())
+		resp.Body.Close()
+		return name, err
+	}
+	return "", fmt.Errorf("no replica could serve %s: %v", rec.Blob, lastErr)
+}
+
+// putBlob writes body to a single replica and checks that what the replica
+// stored has the given ETag, unless etag is empty. record is what the
+// replica keeps along with the blob, see blobRecord.
+func putBlob(replica, volumeKey, version string, gen uint64, body io.Reader, etag, record string) (string, error) {
+	uri := replica + "/files/" + url.PathEscape(volumeKey)
+	if version != "" {
+		uri += "?version=" + version
+	}
+	request, err := http.NewRequest("PUT", uri, body)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(generationHeader, strconv.FormatUint(gen, 10))
+	request.Header.Set(recordHeader, record)
+
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("volume server %s answered PUT with %s", replica, resp.Status)
+	}
+
+	var result struct {
+		Key  string `json:"key"`
+		ETag string `json:"etag"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if etag != "" && result.ETag != etag {
+		return "", fmt.Errorf("copy on %s has etag %s, want %s", replica, result.ETag, etag)
+	}
+	return result.Key, nil
+}
+
+// updateRecord rewrites a record in place, keeping the key's current entry
+// in step when indexKey is the latest version of a versioned key. It
+// doesn't touch usage or the expiry index, so size and expiry must not
+// change. The caller must hold the key's lock.
+func updateRecord(ref objectRef, indexKey string, rec Record) error {
+	batch := new(metastore.Batch)
+	batch.Put([]byte(indexKey), rec.encode())
+	if indexKey != ref.indexKey() {
+		cur, err := getRecord(ref.indexKey())
+		if err != nil && err != metastore.ErrNotFound {
+			return err
+		}
+		if err == nil && cur.Version == rec.Version {
+			batch.Put([]byte(ref.indexKey()), rec.encode())
+		}
+	}
+	return db.Write(batch)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+	"github.com/alvinliju/tinydb/internal/raft"
+)
+
+// With -raft-id and -raft-peers several masters keep one index between
+// them, see internal/raft. Every index write the leader makes is a batch
+// that goes through the Raft log, and every master applies the committed
+// batches to its own leveldb, so any of them can take over.
+//
+// Only the leader takes writes and runs the background work. Followers
+// answer reads from their own copy of the index, which can be a moment
+// behind, and send everything else to the leader.
+
+// raftAppliedKey is the last Raft log entry applied to the index. It is
+// written in the same batch as the entry so a restart neither misses nor
+// repeats one.
+const raftAppliedKey = "\x00raft-applied"
+
+// raftPeers maps the ID of every master in the cluster, this one
+// included, to its URL.
+var raftPeers map[string]string
+
+// parsePeers parses -raft-peers, a comma separated list of id=url.
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, p := range strings.Split(s, ",") {
+		id, u, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || id == "" || u == "" {
+			return nil, fmt.Errorf("bad peer %q, want id=url", p)
+		}
+		if _, dup := peers[id]; dup {
+			return nil, fmt.Errorf("peer %s listed twice", id)
+		}
+		peers[id] = strings.TrimSuffix(u, "/")
+	}
+	return peers, nil
+}
+
+// startRaft joins the cluster as id. Entries the index hasn't applied yet
+// are applied as soon as they are known to be committed.
+func startRaft(id, peers, dir string) error {
+	all, err := parsePeers(peers)
+	if err != nil {
+		return err
+	}
+	if _, ok := all[id]; !ok {
+		return fmt.Errorf("-raft-id %s is not in -raft-peers", id)
+	}
+	others := make(map[string]string)
+	for p, u := range all {
+		if p != id {
+			others[p] = u
+		}
+	}
+
+	applied := uint64(0)
+	v, err := db.Get([]byte(raftAppliedKey))
+	if err == nil {
+		applied, err = strconv.ParseUint(string(v), 10, 64)
+	}
+	if err != nil && err != metastore.ErrNotFound {
+		return err
+	}
+
+	node, err := raft.New(raft.Config{
+		ID:       id,
+		Peers:    others,
+		Dir:      dir,
+		Apply:    db.apply,
+		Applied:  applied,
+		OnLeader: resetGenerations,
+	})
+	if err != nil {
+		return err
+	}
+	raftPeers = all
+	db.raft = node
+	http.Handle("/raft/", node.Handler())
+	node.Start()
+	return nil
+}
+
+// apply writes a committed Raft entry to the index. The leader's first
+// entry in a term carries no batch.
+func (d *indexDB) apply(index uint64, data []byte) error {
+	batch := new(metastore.Batch)
+	if data != nil {
+		if err := batch.Load(data); err != nil {
+			return fmt.Errorf("entry %d: %v", index, err)
+		}
+	}
+	n := batch.Len()
+	batch.Put([]byte(raftAppliedKey), []byte(strconv.FormatUint(index, 10)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.Store.Write(batch); err != nil {
+		return err
+	}
+	if d.changes != nil && n > 0 {
+		d.logChange(data)
+	}
+	return nil
+}
+
+// leading reports whether this master does the cluster's background work,
+// which is always the case unless it is a Raft follower.
+func leading() bool {
+	return db.raft == nil || db.raft.IsLeader()
+}
+
+// redirectWrites sends everything but reads on a follower to the leader,
+// with a 307 so the client repeats the method and body.
+func redirectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if db.raft == nil || r.Method == "GET" || r.Method == "HEAD" ||
+			strings.HasPrefix(r.URL.Path, "/raft/") || db.raft.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// a leader that isn't ready yet counts as none
+		leader := db.raft.Leader()
+		u, ok := raftPeers[leader]
+		if !ok || leader == db.raft.Status().ID {
+			http.Error(w, "No leader, try again", http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, u+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// handleRaftStatus serves GET /admin/raft, where this master stands in the
+// cluster.
+func handleRaftStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if db.raft == nil {
+		http.Error(w, "Not running with -raft-id", http.StatusNotFound)
+		return
+	}
+	st := db.raft.Status()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		raft.Status
+		LeaderURL string `json:"leader_url,omitempty"`
+	}{st, raftPeers[st.Leader]})
+}
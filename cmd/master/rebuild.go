@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/keys"
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// The index can be rebuilt from the volumes if it is lost. Every blob's
+// meta on the volumes holds its key and generation, and the master sends a
+// blobRecord along with every write and move for the rest. Name, size and
+// md5 come from the volumes' inventories, the storage class from the group
+// the replicas are in.
+//
+// What only lives in the index is lost: bucket settings other than
+// versioning, delete markers, lifecycle rules, access stats and pending
+// deletes.
+
+const recordHeader = "X-Tinydb-Record"
+
+// blobRecord is what the volumes keep of a Record.
+type blobRecord struct {
+	Meta    map[string]string `json:"meta,omitempty"`
+	Mtime   time.Time         `json:"mtime"`
+	Expires time.Time         `json:"expires,omitzero"`
+	// Deleted and Purge are set while the blob is in the trash.
+	Deleted time.Time `json:"deleted,omitzero"`
+	Purge   time.Time `json:"purge,omitzero"`
+}
+
+func (rec Record) blobRecord() string {
+	b, _ := json.Marshal(blobRecord{Meta: rec.Meta, Mtime: rec.Mtime, Expires: rec.Expires})
+	return string(b)
+}
+
+func (e trashEntry) blobRecord() string {
+	b, _ := json.Marshal(blobRecord{Meta: e.Meta, Mtime: e.Mtime, Expires: e.Expires, Deleted: e.Deleted, Purge: e.Purge})
+	return string(b)
+}
+
+// volumeBlob is an entry of a volume's inventory.
+type volumeBlob struct {
+	Name       string          `json:"name"`
+	Size       int64           `json:"size"`
+	Mtime      time.Time       `json:"mtime"`
+	MD5        string          `json:"md5"`
+	Key        string          `json:"key"`
+	Generation uint64          `json:"generation"`
+	Record     json.RawMessage `json:"record"`
+}
+
+type blobCopy struct {
+	replica string
+	blob    volumeBlob
+}
+
+type rebuildStats struct {
+	Blobs    int
+	Keys     int
+	Versions int
+	Trashed  int
+	Buckets  int
+	// Stale are copies left out because another replica holds a newer
+	// generation or different content. The GC collects them.
+	Stale int
+	// Unrecoverable are blobs whose key can't be told, written without
+	// meta under a name too long to hold the key.
+	Unrecoverable int
+}
+
+// listVolume calls fn for every blob in replica's inventory.
+func listVolume(replica string, fn func(volumeBlob)) error {
+	// hashing a page of blobs takes longer than a request
+	client := &http.Client{Timeout: 30 * time.Minute}
+	after := ""
+	for {
+		resp, err := client.Get(replica + "/blobs?after=" + url.QueryEscape(after))
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Blobs       []volumeBlob `json:"blobs"`
+			IsTruncated bool         `json:"is_truncated"`
+			NextAfter   string       `json:"next_after"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("volume server %s answered inventory with %s", replica, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, b := range page.Blobs {
+			fn(b)
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		after = page.NextAfter
+	}
+}
+
+// pickCopies returns the copies the index should point at: those of the
+// newest generation, and of those the content most of them agree on.
+func pickCopies(copies []blobCopy) (good []blobCopy) {
+	newest := uint64(0)
+	for _, c := range copies {
+		newest = max(newest, c.blob.Generation)
+	}
+	votes := map[string]int{}
+	for _, c := range copies {
+		if c.blob.Generation == newest {
+			votes[c.blob.MD5]++
+		}
+	}
+	winner := ""
+	for sum, n := range votes {
+		if n > votes[winner] || n == votes[winner] && sum < winner {
+			winner = sum
+		}
+	}
+	for _, c := range copies {
+		if c.blob.Generation == newest && c.blob.MD5 == winner {
+			good = append(good, c)
+		}
+	}
+	return good
+}
+
+func classOfReplica(replica string) string {
+	for _, g := range volumeServers {
+		for _, r := range g.Replicas {
+			if r == replica {
+				return g.Class
+			}
+		}
+	}
+	return defaultStorageClass
+}
+
+// rebuildIndex fills an empty index from the inventories of all volume
+// servers. Every volume must answer, a rebuild that skipped one would
+// drop its replicas from the index.
+func rebuildIndex() (rebuildStats, error) {
+	var stats rebuildStats
+
+	iter := db.NewIterator(nil)
+	empty := !iter.First()
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+	if !empty {
+		return stats, errors.New("the index is not empty, rebuild only fills an empty one")
+	}
+
+	// copies by blob name, which tells key and version apart
+	byName := map[string][]blobCopy{}
+	var order []string
+	for _, g := range volumeServers {
+		for _, replica := range g.Replicas {
+			err := listVolume(replica, func(b volumeBlob) {
+				if byName[b.Name] == nil {
+					order = append(order, b.Name)
+				}
+				byName[b.Name] = append(byName[b.Name], blobCopy{replica, b})
+			})
+			if err != nil {
+				return stats, fmt.Errorf("listing %s: %v (leave volumes that are gone for good out of -volumes)", replica, err)
+			}
+			log.Printf("Master: rebuild: listed %s", replica)
+		}
+	}
+
+	batch := new(metastore.Batch)
+	flush := func() error {
+		if batch.Len() < 1000 {
+			return nil
+		}
+		err := db.Write(batch)
+		batch.Reset()
+		return err
+	}
+
+	buckets := map[string]*Bucket{}
+	usage := map[string]int64{}
+	// the newest version of every key in a versioned bucket
+	latest := map[string]Record{}
+	maxGen := uint64(0)
+	now := time.Now().UTC()
+
+	for _, name := range order {
+		copies := byName[name]
+		stats.Blobs += len(copies)
+		good := pickCopies(copies)
+		stats.Stale += len(copies) - len(good)
+		b := good[0].blob
+
+		key := b.Key
+		if key == "" {
+			var ok bool
+			if key, ok = keys.Key(name); !ok {
+				log.Printf("Master: rebuild: can't tell the key of %s", name)
+				stats.Unrecoverable++
+				continue
+			}
+		}
+		var br blobRecord
+		if len(b.Record) > 0 {
+			if err := json.Unmarshal(b.Record, &br); err != nil {
+				log.Printf("Master: rebuild: bad record on %s: %v", name, err)
+			}
+		}
+		if br.Mtime.IsZero() {
+			br.Mtime = b.Mtime
+		}
+
+		rec := Record{
+			Blob:       name,
+			Size:       b.Size,
+			Mtime:      br.Mtime,
+			ETag:       b.MD5,
+			Meta:       br.Meta,
+			Generation: b.Generation,
+			Expires:    br.Expires,
+			Class:      classOfReplica(good[0].replica),
+		}
+		for _, c := range good {
+			rec.Replicas = append(rec.Replicas, c.replica)
+		}
+		maxGen = max(maxGen, b.Generation)
+
+		ref := objectRef{Key: key}
+		if rest, ok := strings.CutPrefix(key, "b/"); ok {
+			bucket, k, _ := strings.Cut(rest, "/")
+			if buckets[bucket] == nil {
+				buckets[bucket] = &Bucket{Name: bucket, StorageClass: defaultStorageClass, Created: now}
+			}
+			ref = objectRef{Bucket: buckets[bucket], Key: k}
+			ref.Bucket.Replication = max(ref.Bucket.Replication, len(rec.Replicas))
+			usage[bucket] += rec.Size
+		}
+		version := keys.Version(name)
+
+		switch {
+		case version != "" && (ref.Bucket == nil || !br.Deleted.IsZero()):
+			// a trashed key, versions of keys outside buckets are only
+			// ever made by the trash
+			e := trashEntry{Record: rec, Deleted: br.Deleted, Purge: br.Purge}
+			if e.Deleted.IsZero() {
+				e.Deleted = b.Mtime
+			}
+			if e.Purge.IsZero() {
+				e.Purge = e.Deleted.Add(trashRetention)
+			}
+			v, _ := json.Marshal(e)
+			tk := trashKey(ref.indexKey(), version)
+			batch.Put([]byte(tk), v)
+			batch.Put(expiryKey(tk, e.Purge), nil)
+			stats.Trashed++
+		case version != "":
+			ref.Bucket.Versioning = true
+			rec.Version = version
+			batch.Put([]byte(ref.versionKey(version)), rec.encode())
+			indexExpiry(batch, ref.versionKey(version), rec)
+			if cur, ok := latest[ref.indexKey()]; !ok || version < cur.Version {
+				latest[ref.indexKey()] = rec
+			}
+			stats.Versions++
+		default:
+			batch.Put([]byte(ref.indexKey()), rec.encode())
+			indexExpiry(batch, ref.indexKey(), rec)
+			stats.Keys++
+		}
+		if err := flush(); err != nil {
+			return stats, err
+		}
+	}
+
+	for indexKey, rec := range latest {
+		batch.Put([]byte(indexKey), rec.encode())
+		stats.Keys++
+	}
+	for name, b := range buckets {
+		v, _ := json.Marshal(b)
+		batch.Put([]byte(bucketPrefix+name), v)
+		batch.Put([]byte(usagePrefix+name), []byte(strconv.FormatInt(usage[name], 10)))
+		stats.Buckets++
+	}
+	// new writes must win over everything on the volumes
+	batch.Put([]byte(generationKey), []byte(strconv.FormatUint(maxGen, 10)))
+	return stats, db.Write(batch)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/index"
+)
+
+// Record is what the master keeps in leveldb for every key, see
+// index.Record.
+type Record index.Record
+
+// expired reports whether the key's TTL ran out by now. Expired keys are
+// invisible even before the reaper gets around to deleting them.
+func (rec Record) expired(now time.Time) bool {
+	return !rec.Expires.IsZero() && !now.Before(rec.Expires)
+}
+
+// storageClass is rec.Class, with records written before classes were
+// tracked counting as the default class.
+func (rec Record) storageClass() string {
+	if rec.Class == "" {
+		return defaultStorageClass
+	}
+	return rec.Class
+}
+
+const metaHeaderPrefix = "X-Tinydb-Meta-"
+
+func (rec Record) encode() []byte {
+	b, _ := json.Marshal(rec)
+	return b
+}
+
+func decodeRecord(key string, v []byte) (Record, error) {
+	rec, err := index.DecodeRecord(key, v)
+	return Record(rec), err
+}
+
+func getRecord(key string) (Record, error) {
+	v, err := db.Get([]byte(key))
+	if err != nil {
+		return Record{}, err
+	}
+	return decodeRecord(key, v)
+}
+
+// metadataFromRequest collects the X-Tinydb-Meta-* headers of a PUT on top
+// of the bucket's default metadata.
+func metadataFromRequest(ref objectRef, r *http.Request) map[string]string {
+	meta := map[string]string{}
+	if ref.Bucket != nil {
+		for k, v := range ref.Bucket.Metadata {
+			meta[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	for k, v := range r.Header {
+		if name, ok := strings.CutPrefix(k, metaHeaderPrefix); ok && name != "" {
+			meta[name] = v[0]
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
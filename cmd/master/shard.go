@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/index"
+	"github.com/alvinliju/tinydb/internal/metastore"
+	"github.com/alvinliju/tinydb/internal/shardmap"
+	"github.com/alvinliju/tinydb/internal/snapshot"
+)
+
+// A master can own one key range of a sharded cluster, see
+// internal/shardmap. It then turns away requests for other keys with a 421
+// so a router with an old shard map knows to reload it, and only sweeps
+// blobs of its own keys off the volumes, which all shards share.
+//
+// Its range is kept in the index under shardKey, so it is replicated
+// along with everything else. A master that has none owns every key.
+const shardKey = index.ShardKey
+
+type shardState struct {
+	shardmap.Shard
+	// ReadOnly is set while the shard's keys are copied to a new shard.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// currentShard returns this master's range, ok is false if it owns every
+// key.
+func currentShard() (s shardState, ok bool, err error) {
+	v, err := db.Get([]byte(shardKey))
+	if err == metastore.ErrNotFound {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, err
+	}
+	return s, true, json.Unmarshal(v, &s)
+}
+
+// shardMu keeps the range from changing under changes to keys. Every
+// change holds it for reading from its shard check until it is committed,
+// and handleSetShard for writing, so once a shard is read only no change
+// that got past the check is still in flight to be lost in the copy.
+var shardMu sync.RWMutex
+
+// frozen reports whether the shard is being split. Background work that
+// changes keys waits until it's done, or its changes could be lost in
+// the copy.
+func frozen() bool {
+	s, ok, err := currentShard()
+	return err != nil || ok && s.ReadOnly
+}
+
+// holdShard keeps the shard from being split until release is called. ok
+// is false, and nothing held, if it is being split.
+func holdShard() (release func(), ok bool) {
+	shardMu.RLock()
+	if frozen() {
+		shardMu.RUnlock()
+		return nil, false
+	}
+	return shardMu.RUnlock, true
+}
+
+// checkShard answers requests for keys of other shards, and writes while
+// the shard is read only. It returns false if it answered. Otherwise a
+// write holds the shard until it calls release.
+func checkShard(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	release = func() {}
+	if _, ok := r.URL.Query()["list"]; ok {
+		// a listing only ever shows the keys that are here
+		return release, true
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		shardMu.RLock()
+		release = shardMu.RUnlock
+	}
+	s, ok, err := currentShard()
+	if err != nil {
+		release()
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !ok {
+		return release, true
+	}
+	if !s.Contains(strings.TrimPrefix(r.URL.Path, "/")) {
+		release()
+		http.Error(w, "Key belongs to another shard, reload the shard map", http.StatusMisdirectedRequest)
+		return nil, false
+	}
+	if s.ReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+		release()
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Shard is read only while it is split, try again", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return release, true
+}
+
+// shardKeyOf returns the key an index entry belongs to as the shard map
+// sees it. ok is false for the master's own entries, such as buckets.
+func shardKeyOf(k string) (key string, ok bool) {
+	switch {
+	case strings.HasPrefix(k, objectPrefix):
+		return "b/" + k[len(objectPrefix):], true
+	case strings.HasPrefix(k, versionPrefix):
+		key, _, _ := strings.Cut(k[len(versionPrefix):], "\x00")
+		return "b/" + key, true
+	case strings.HasPrefix(k, trashPrefix):
+		rest := k[len(trashPrefix):]
+		i := strings.LastIndexByte(rest, 0)
+		if i < 0 {
+			return "", false
+		}
+		return shardKeyOf(rest[:i])
+	case strings.HasPrefix(k, expiryPrefix):
+		_, indexKey, ok := strings.Cut(k[len(expiryPrefix):], "/")
+		if !ok {
+			return "", false
+		}
+		return shardKeyOf(indexKey)
+	case strings.HasPrefix(k, accessPrefix):
+		return shardKeyOf(k[len(accessPrefix):])
+	case strings.HasPrefix(k, "\x00"):
+		return "", false
+	}
+	return k, true
+}
+
+// handleShard serves the shard admin API, which tinydb split drives:
+//
+//	GET  /admin/shard                     the range this master owns
+//	PUT  /admin/shard                     set it, the body is its JSON
+//	GET  /admin/shard/export?start=&end=  an archive of the keys in [start, end)
+//	POST /admin/shard/import              add the keys of an export
+//	POST /admin/shard/drop                delete the keys outside the range
+//
+// Exports are in the format of internal/snapshot and carry the bucket and
+// lifecycle configs along with the keys. Neither import nor drop touch the
+// blobs; the shards share the volumes.
+func handleShard(w http.ResponseWriter, r *http.Request) {
+	switch action := strings.TrimPrefix(r.URL.Path, "/admin/shard"); {
+	case action == "" && r.Method == "GET":
+		s, ok, err := currentShard()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Not sharded, this master owns every key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case action == "" && r.Method == "PUT":
+		handleSetShard(w, r)
+	case action == "/export" && r.Method == "GET":
+		handleExportShard(w, r)
+	case action == "/import" && r.Method == "POST":
+		handleImportShard(w, r)
+	case action == "/drop" && r.Method == "POST":
+		handleDropShard(w)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSetShard(w http.ResponseWriter, r *http.Request) {
+	var s shardState
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid shard: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.ID == "" || s.End != "" && s.End <= s.Start {
+		http.Error(w, "A shard needs an id and an end after its start", http.StatusBadRequest)
+		return
+	}
+	v, _ := json.Marshal(s)
+	// wait for the changes in flight, the export must see them
+	shardMu.Lock()
+	err := db.Put([]byte(shardKey), v)
+	shardMu.Unlock()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Master: now shard %s, keys from %q to %q, read only %v", s.ID, s.Start, s.End, s.ReadOnly)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(v)
+}
+
+// exportIter yields the entries of keys in [start, end) and the entries
+// every shard needs.
+type exportIter struct {
+	metastore.Iterator
+	start, end string
+}
+
+func (it *exportIter) Next() bool {
+	for it.Iterator.Next() {
+		k := string(it.Key())
+		if key, ok := shardKeyOf(k); ok {
+			if (shardmap.Shard{Start: it.start, End: it.end}).Contains(key) {
+				return true
+			}
+			continue
+		}
+		if k == generationKey || strings.HasPrefix(k, bucketPrefix) || strings.HasPrefix(k, lifecyclePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleExportShard(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer snap.Release()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	iter := &exportIter{Iterator: snap.NewIterator(nil), start: q.Get("start"), end: q.Get("end")}
+	defer iter.Release()
+	n, err := snapshot.Write(w, snapshot.Header{Created: time.Now().UTC()}, iter)
+	if err != nil {
+		log.Printf("Master: Error exporting keys from %q to %q: %v", iter.start, iter.end, err)
+		return
+	}
+	log.Printf("Master: exported %d entries from %q to %q", n, iter.start, iter.end)
+}
+
+func handleImportShard(w http.ResponseWriter, r *http.Request) {
+	s, ok, err := currentShard()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Set the shard's range before importing into it", http.StatusConflict)
+		return
+	}
+	sr, err := snapshot.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, gen := 0, uint64(0)
+	batch := new(metastore.Batch)
+	for {
+		k, v, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Import stopped after %d entries: %v", n, err), http.StatusBadRequest)
+			return
+		}
+		key, isData := shardKeyOf(string(k))
+		switch {
+		case isData && !s.Contains(key):
+			http.Error(w, fmt.Sprintf("Import stopped after %d entries: %q belongs to another shard", n, key), http.StatusBadRequest)
+			return
+		case isData:
+			batch.Put(k, v)
+		case string(k) == generationKey:
+			gen, _ = strconv.ParseUint(string(v), 10, 64)
+		default:
+			// configs this shard has already win
+			if _, err := db.Get(k); err == metastore.ErrNotFound {
+				batch.Put(k, v)
+			}
+		}
+		n++
+		if batch.Len() >= 1000 {
+			if err := db.Write(batch); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			batch.Reset()
+		}
+	}
+	if err := db.Write(batch); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// the imported keys' blobs were written with the other shard's
+	// generations, ours must go on from above them
+	if err := raiseGeneration(gen); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := recountUsage(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Master: imported %d entries", n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": n})
+}
+
+func handleDropShard(w http.ResponseWriter) {
+	s, ok, err := currentShard()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Not sharded, this master owns every key", http.StatusConflict)
+		return
+	}
+
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer snap.Release()
+	iter := snap.NewIterator(nil)
+	defer iter.Release()
+
+	n := 0
+	batch := new(metastore.Batch)
+	for iter.Next() {
+		if key, ok := shardKeyOf(string(iter.Key())); ok && !s.Contains(key) {
+			batch.Delete(iter.Key())
+			n++
+		}
+		if batch.Len() >= 1000 {
+			if err := db.Write(batch); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.Write(batch); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := recountUsage(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Master: dropped %d entries of keys outside %q to %q", n, s.Start, s.End)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"dropped": n})
+}
+
+// recountUsage sets the usage of every bucket to the size of the blobs its
+// keys, versions and trashed keys point at, after keys moved between
+// shards. Each shard counts only its own keys against a bucket's quota,
+// which is why buckets with quotas are kept on one shard.
+func recountUsage() error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	usage := map[string]int64{}
+	iter := db.NewIterator(metastore.Prefix([]byte(bucketPrefix)))
+	for iter.Next() {
+		usage[string(iter.Key()[len(bucketPrefix):])] = 0
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// the current entry of a versioned key shares its blob with the
+	// latest version
+	seen := map[string]bool{}
+	for _, prefix := range []string{objectPrefix, versionPrefix, trashPrefix + objectPrefix} {
+		iter := db.NewIterator(metastore.Prefix([]byte(prefix)))
+		for iter.Next() {
+			k := string(iter.Key())
+			key, _ := shardKeyOf(k)
+			bucket, _, _ := strings.Cut(strings.TrimPrefix(key, "b/"), "/")
+			rec, err := decodeRecord(k, iter.Value())
+			if err != nil {
+				iter.Release()
+				return fmt.Errorf("%q: %v", k, err)
+			}
+			if rec.DeleteMarker || seen[rec.Blob] {
+				continue
+			}
+			seen[rec.Blob] = true
+			usage[bucket] += rec.Size
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	batch := new(metastore.Batch)
+	for name, used := range usage {
+		batch.Put([]byte(usagePrefix+name), []byte(strconv.FormatInt(used, 10)))
+	}
+	return db.Write(batch)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/changelog"
+	"github.com/alvinliju/tinydb/internal/metastore"
+	"github.com/alvinliju/tinydb/internal/raft"
+	"github.com/alvinliju/tinydb/internal/snapshot"
+)
+
+// indexDB is the master's index, kept in a metastore.Store. With
+// -changelog set, every write is also appended to a change log, so a
+// snapshot restored with tinydb restore can be rolled forward to any point
+// in time after it.
+type indexDB struct {
+	metastore.Store
+
+	// changes is nil unless -changelog is set
+	changes *changelog.Log
+	// raft is nil unless -raft-id is set, then writes go through its log
+	// and are applied by apply
+	raft *raft.Node
+	// mu keeps the change log in the order the writes were applied in,
+	// and snapshots in step with it.
+	mu sync.Mutex
+}
+
+// openStore opens the index in the store engine names.
+func openStore(engine, path string) (metastore.Store, error) {
+	switch engine {
+	case "leveldb":
+		store, err := metastore.OpenLevelDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "memory":
+		return metastore.NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown -db-engine %q", engine)
+}
+
+func (d *indexDB) Put(key, value []byte) error {
+	batch := new(metastore.Batch)
+	batch.Put(key, value)
+	return d.Write(batch)
+}
+
+func (d *indexDB) Delete(key []byte) error {
+	batch := new(metastore.Batch)
+	batch.Delete(key)
+	return d.Write(batch)
+}
+
+func (d *indexDB) Write(batch *metastore.Batch) error {
+	if d.raft != nil {
+		if batch.Len() == 0 {
+			return nil
+		}
+		return d.raft.Propose(batch.Dump())
+	}
+	if d.changes == nil || batch.Len() == 0 {
+		return d.Store.Write(batch)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.Store.Write(batch); err != nil {
+		return err
+	}
+	d.logChange(batch.Dump())
+	return nil
+}
+
+// logChange appends a write that has happened to the change log. Failing
+// the write now would only confuse the caller, so errors are only logged.
+func (d *indexDB) logChange(data []byte) {
+	if _, err := d.changes.Append(time.Now(), data); err != nil {
+		log.Printf("Master: Error appending to the change log, point in time restores will stop here: %v", err)
+	}
+}
+
+// snapshot returns a consistent view of the index and the last change log
+// entry it includes.
+func (d *indexDB) snapshot() (metastore.Snapshot, uint64, error) {
+	if d.changes == nil {
+		snap, err := d.GetSnapshot()
+		return snap, 0, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snap, err := d.GetSnapshot()
+	return snap, d.changes.Seq(), err
+}
+
+// handleSnapshot serves GET /admin/snapshot, an archive of the whole index
+// as of the request, see internal/snapshot. Writes go on while it streams.
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snap, seq, err := db.snapshot()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer snap.Release()
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tinydb-%s.snap"`, now.Format("20060102T150405Z")))
+
+	iter := snap.NewIterator(nil)
+	defer iter.Release()
+	n, err := snapshot.Write(w, snapshot.Header{Created: now, ChangelogSeq: seq}, iter)
+	if err != nil {
+		// too late for an error status, the archive is left without its
+		// trailer so restores refuse it
+		log.Printf("Master: Error streaming snapshot: %v", err)
+		return
+	}
+	log.Printf("Master: streamed a snapshot of %d entries up to change %d", n, seq)
+}
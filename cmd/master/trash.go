@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/index"
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// With -trash-retention set, a DELETE of an unversioned key moves it to
+// the trash instead of destroying it, and it can be undeleted until the
+// retention runs out.
+//
+// A trashed key's blob is renamed on its replicas to a version of the key
+// named after the trash ID, so writing the key again can't overwrite it.
+// Its record is kept under trashPrefix + "<index key>\x00<trash ID>", and
+// trash IDs sort newest first like version IDs. The purge goes through the
+// expiry index, so the reaper takes care of it. Trashed bytes still count
+// against the bucket quota until they are purged.
+const trashPrefix = index.TrashPrefix
+
+// trashRetention is how long deleted keys stay in the trash, 0 turns it off.
+var trashRetention time.Duration
+
+var (
+	errNotInTrash = errors.New("nothing to undelete")
+	errKeyExists  = errors.New("key exists, delete it first")
+)
+
+type trashEntry struct {
+	Record
+	Deleted time.Time `json:"deleted"`
+	Purge   time.Time `json:"purge"`
+}
+
+func trashKey(indexKey, id string) string {
+	return trashPrefix + indexKey + "\x00" + id
+}
+
+func getTrashEntry(tk string) (trashEntry, error) {
+	var e trashEntry
+	v, err := db.Get([]byte(tk))
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(v, &e)
+	return e, err
+}
+
+// moveBlob renames blob on a replica to the given version of its key, or
+// back to the unversioned name, and returns the new name. record replaces
+// what the replica keeps along with the blob, see blobRecord.
+func moveBlob(replica, blob, version string, gen uint64, record string) (string, error) {
+	request, err := http.NewRequest("POST", replica+"/files/"+blob+"?version="+url.QueryEscape(version), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(generationHeader, strconv.FormatUint(gen, 10))
+	request.Header.Set(recordHeader, record)
+
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("volume server %s answered move of %s with %s", replica, blob, resp.Status)
+	}
+	var result struct {
+		Key string `json:"key"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Key, err
+}
+
+// moveOnReplicas moves blob to version on every replica, or on none: if one
+// fails, the replicas already done are moved on to version back, which is
+// where the blob came from, with backRecord. It returns the new name and
+// the generation the blob was moved with.
+func moveOnReplicas(blob string, replicas []string, version, back, record, backRecord string) (string, uint64, error) {
+	gen, err := nextGeneration()
+	if err != nil {
+		return "", 0, err
+	}
+	var moved []string
+	name := ""
+	for _, replica := range replicas {
+		name, err = moveBlob(replica, blob, version, gen, record)
+		if err == nil {
+			moved = append(moved, replica)
+			continue
+		}
+
+		if len(moved) > 0 {
+			undoGen, genErr := nextGeneration()
+			if genErr != nil {
+				return "", 0, err
+			}
+			for _, m := range moved {
+				if _, undoErr := moveBlob(m, name, back, undoGen, backRecord); undoErr != nil {
+					log.Printf("Master: Error moving %s back on %s: %v", name, m, undoErr)
+				}
+			}
+		}
+		return "", 0, err
+	}
+	return name, gen, nil
+}
+
+// trashObject moves ref to the trash. The caller must hold ref's key lock.
+func trashObject(ref objectRef, rec Record) error {
+	id := newVersionID()
+	now := time.Now().UTC()
+	e := trashEntry{Record: rec, Deleted: now, Purge: now.Add(trashRetention)}
+	name, gen, err := moveOnReplicas(rec.Blob, rec.Replicas, id, "", e.blobRecord(), rec.blobRecord())
+	if err != nil {
+		return err
+	}
+	e.Blob, e.Generation = name, gen
+	v, _ := json.Marshal(e)
+
+	tk := trashKey(ref.indexKey(), id)
+	batch := new(metastore.Batch)
+	batch.Delete([]byte(ref.indexKey()))
+	unindexExpiry(batch, ref.indexKey(), rec)
+	forgetAccess(batch, ref.indexKey())
+	batch.Put([]byte(tk), v)
+	batch.Put(expiryKey(tk, e.Purge), nil)
+	return db.Write(batch)
+}
+
+// undelete brings back the trashed copy of ref with the given trash ID, or
+// the newest one if id is empty. The caller must hold ref's key lock.
+func undelete(ref objectRef, id string) (Record, error) {
+	tk := trashKey(ref.indexKey(), id)
+	if id == "" {
+		iter := db.NewIterator(metastore.Prefix([]byte(tk)))
+		if iter.First() {
+			tk = string(iter.Key())
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return Record{}, err
+		}
+	}
+	e, err := getTrashEntry(tk)
+	if err == metastore.ErrNotFound {
+		return Record{}, errNotInTrash
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	old, err := getRecord(ref.indexKey())
+	if err != nil && err != metastore.ErrNotFound {
+		return Record{}, err
+	}
+	hasOld := err == nil
+	if hasOld && !old.DeleteMarker && !old.expired(time.Now()) {
+		return Record{}, errKeyExists
+	}
+
+	trashID := tk[len(trashKey(ref.indexKey(), "")):]
+	name, gen, err := moveOnReplicas(e.Blob, e.Replicas, "", trashID, e.Record.blobRecord(), e.blobRecord())
+	if err != nil {
+		return Record{}, err
+	}
+	rec := e.Record
+	rec.Blob, rec.Generation = name, gen
+
+	if ref.Bucket != nil {
+		usageMu.Lock()
+		defer usageMu.Unlock()
+	}
+	batch := new(metastore.Batch)
+	batch.Delete([]byte(tk))
+	batch.Delete(expiryKey(tk, e.Purge))
+	if hasOld {
+		// an expired key the reaper hasn't got to yet, its blob was just
+		// replaced by the one we brought back
+		unindexExpiry(batch, ref.indexKey(), old)
+		if ref.Bucket != nil {
+			used, err := bucketUsage(ref.Bucket.Name)
+			if err != nil {
+				return Record{}, err
+			}
+			batch.Put([]byte(usagePrefix+ref.Bucket.Name), []byte(strconv.FormatInt(max(used-old.Size, 0), 10)))
+		}
+	}
+	batch.Put([]byte(ref.indexKey()), rec.encode())
+	indexExpiry(batch, ref.indexKey(), rec)
+	return rec, db.Write(batch)
+}
+
+// purgeTrash destroys the trashed key tk for good once its retention is up.
+func purgeTrash(tk string) (bool, error) {
+	indexKey := tk[len(trashPrefix):strings.LastIndexByte(tk, 0)]
+	unlock := keyLocks.Lock(indexKey)
+	defer unlock()
+
+	e, err := getTrashEntry(tk)
+	if err == metastore.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	gen, err := nextGeneration()
+	if err != nil {
+		return false, err
+	}
+
+	batch := new(metastore.Batch)
+	queueBlobDeletes(batch, e.Blob, e.Replicas, gen)
+	batch.Delete([]byte(tk))
+	batch.Delete(expiryKey(tk, e.Purge))
+	if ref, _, err := refFromIndexKey(indexKey); err == nil && ref.Bucket != nil {
+		usageMu.Lock()
+		defer usageMu.Unlock()
+		used, err := bucketUsage(ref.Bucket.Name)
+		if err != nil {
+			return false, err
+		}
+		batch.Put([]byte(usagePrefix+ref.Bucket.Name), []byte(strconv.FormatInt(max(used-e.Size, 0), 10)))
+	}
+	if err := db.Write(batch); err != nil {
+		return false, err
+	}
+	kickDeletes()
+	return true, nil
+}
+
+// handleUndelete serves POST /<key>?undelete and POST /<key>?undelete=<trash id>.
+func handleUndelete(w http.ResponseWriter, r *http.Request) {
+	ref, status, err := objectFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if ref.versioned() {
+		http.Error(w, "versioned buckets keep deleted keys as versions, undelete by deleting the delete marker", http.StatusBadRequest)
+		return
+	}
+
+	unlock := keyLocks.Lock(ref.indexKey())
+	defer unlock()
+
+	rec, err := undelete(ref, r.URL.Query().Get("undelete"))
+	switch err {
+	case nil:
+	case errNotInTrash:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errKeyExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		log.Printf("Master: Error undeleting %s: %v", ref.Key, err)
+		http.Error(w, "Failed to undelete: volume server unreachable or error", http.StatusBadGateway)
+		return
+	}
+
+	if rec.ETag != "" {
+		w.Header().Set("ETag", quoteETag(rec.ETag))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+type trashListEntry struct {
+	Key     string    `json:"key"`
+	TrashID string    `json:"trash_id"`
+	Size    int64     `json:"size"`
+	Mtime   time.Time `json:"mtime"`
+	Deleted time.Time `json:"deleted"`
+	Purge   time.Time `json:"purge"`
+}
+
+type trashListResult struct {
+	Prefix          string           `json:"prefix"`
+	Keys            []trashListEntry `json:"keys"`
+	IsTruncated     bool             `json:"is_truncated"`
+	NextKeyMarker   string           `json:"next_key_marker,omitempty"`
+	NextTrashMarker string           `json:"next_trash_marker,omitempty"`
+}
+
+// handleListTrash serves GET /?list&trash&prefix=&key-marker=&trash-marker=&limit=
+// and the same for a bucket. Keys come back in order, the trashed copies of
+// each key newest first.
+func handleListTrash(w http.ResponseWriter, r *http.Request, ref objectRef) {
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	res, err := listTrash(ref, q.Get("prefix"), q.Get("key-marker"), q.Get("trash-marker"), limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func listTrash(ref objectRef, prefix, keyMarker, trashMarker string, limit int) (trashListResult, error) {
+	res := trashListResult{Prefix: prefix, Keys: []trashListEntry{}}
+	base := trashPrefix + ref.listBase()
+
+	iter := db.NewIterator(metastore.Prefix([]byte(base + prefix)))
+	defer iter.Release()
+
+	var ok bool
+	switch {
+	case keyMarker != "" && trashMarker != "":
+		marker := base + keyMarker + "\x00" + trashMarker
+		ok = iter.Seek([]byte(marker))
+		if ok && string(iter.Key()) == marker {
+			ok = iter.Next()
+		}
+	case keyMarker != "":
+		ok = iter.Seek([]byte(base + keyMarker + "\x01"))
+	case ref.Bucket == nil && prefix == "":
+		// skip the buckets' trash, which sorts first
+		ok = iter.Seek([]byte(base + "\x01"))
+	default:
+		ok = iter.First()
+	}
+
+	for ; ok; ok = iter.Next() {
+		k := string(iter.Key()[len(base):])
+		// the default namespace's trash also holds the buckets' trash
+		if ref.Bucket == nil && strings.HasPrefix(k, "\x00") {
+			continue
+		}
+		key, id, _ := strings.Cut(k, "\x00")
+		if len(res.Keys) == limit {
+			res.IsTruncated = true
+			last := res.Keys[len(res.Keys)-1]
+			res.NextKeyMarker, res.NextTrashMarker = last.Key, last.TrashID
+			break
+		}
+
+		var e trashEntry
+		if err := json.Unmarshal(iter.Value(), &e); err != nil {
+			return res, err
+		}
+		res.Keys = append(res.Keys, trashListEntry{
+			Key:     key,
+			TrashID: id,
+			Size:    e.Size,
+			Mtime:   e.Mtime,
+			Deleted: e.Deleted,
+			Purge:   e.Purge,
+		})
+	}
+	return res, iter.Error()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// Keys with a TTL also get an entry in the expiry index,
+// expiryPrefix + "<expiry in unix nanos, zero padded>/<index key>", so the
+// reaper only has to look at the front of it to find what is due.
+const expiryPrefix = "\x00expiry/"
+
+const (
+	ttlHeader     = "X-Tinydb-Ttl"
+	expiresHeader = "X-Tinydb-Expires"
+)
+
+var errBadExpiry = errors.New("invalid expiry: use X-Tinydb-Ttl (seconds or a duration like 36h) or X-Tinydb-Expires (RFC 3339 or unix seconds)")
+
+// maxExpiry is the last time the expiry index can hold: its keys carry
+// the expiry in unix nanos, which run out in 2262.
+var maxExpiry = time.Unix(0, math.MaxInt64)
+
+var errExpiryTooLate = errors.New("invalid expiry: must be before " + maxExpiry.UTC().Format(time.RFC3339))
+
+// expiryFromRequest returns when a PUT asked its key to expire, or the
+// zero time if it didn't.
+func expiryFromRequest(r *http.Request, now time.Time) (time.Time, error) {
+	expires, err := parseExpiry(r, now)
+	if err == nil && expires.After(maxExpiry) {
+		return time.Time{}, errExpiryTooLate
+	}
+	return expires, err
+}
+
+func parseExpiry(r *http.Request, now time.Time) (time.Time, error) {
+	ttl := r.Header.Get(ttlHeader)
+	expires := r.Header.Get(expiresHeader)
+
+	switch {
+	case ttl != "" && expires != "":
+		return time.Time{}, errors.New("invalid expiry: send either X-Tinydb-Ttl or X-Tinydb-Expires")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			secs, err2 := strconv.ParseInt(ttl, 10, 64)
+			if err2 != nil {
+				return time.Time{}, errBadExpiry
+			}
+			if secs > int64(math.MaxInt64/time.Second) {
+				return time.Time{}, errExpiryTooLate
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		if d <= 0 {
+			return time.Time{}, errBadExpiry
+		}
+		return now.Add(d), nil
+	case expires != "":
+		if t, err := time.Parse(time.RFC3339, expires); err == nil {
+			return t.UTC(), nil
+		}
+		secs, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, errBadExpiry
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+func expiryKey(indexKey string, expires time.Time) []byte {
+	return []byte(fmt.Sprintf("%s%020d/%s", expiryPrefix, expires.UnixNano(), indexKey))
+}
+
+func indexExpiry(batch *metastore.Batch, indexKey string, rec Record) {
+	if !rec.Expires.IsZero() {
+		batch.Put(expiryKey(indexKey, rec.Expires), nil)
+	}
+}
+
+func unindexExpiry(batch *metastore.Batch, indexKey string, rec Record) {
+	if !rec.Expires.IsZero() {
+		batch.Delete(expiryKey(indexKey, rec.Expires))
+	}
+}
+
+// refFromIndexKey is the inverse of objectRef.indexKey and versionKey.
+// version is set when indexKey points at a version of a key.
+func refFromIndexKey(indexKey string) (ref objectRef, version string, err error) {
+	var rest string
+	switch {
+	case strings.HasPrefix(indexKey, objectPrefix):
+		rest = indexKey[len(objectPrefix):]
+	case strings.HasPrefix(indexKey, versionPrefix):
+		rest, version, _ = strings.Cut(indexKey[len(versionPrefix):], "\x00")
+	case strings.HasPrefix(indexKey, "\x00"):
+		return ref, "", fmt.Errorf("%q is not an object key", indexKey)
+	default:
+		return objectRef{Key: indexKey}, "", nil
+	}
+
+	name, key, _ := strings.Cut(rest, "/")
+	b, err := getBucket(name)
+	if err != nil {
+		return ref, "", err
+	}
+	return objectRef{Bucket: &b, Key: key}, version, nil
+}
+
+// runReaper deletes expired keys every interval until the process exits.
+func runReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !leading() {
+			continue
+		}
+		release, ok := holdShard()
+		if !ok {
+			continue
+		}
+		n, err := reapExpired(time.Now())
+		release()
+		if err != nil {
+			log.Printf("Master: reaper: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Master: reaper deleted %d expired keys", n)
+		}
+	}
+}
+
+// reapExpired deletes everything that expired by now from the replicas and
+// the index, and returns how many keys it deleted. Keys whose replicas
+// can't be reached stay hidden and are retried on the next run.
+func reapExpired(now time.Time) (int, error) {
+	limit := []byte(fmt.Sprintf("%s%020d", expiryPrefix, now.UnixNano()+1))
+	iter := db.NewIterator(&metastore.Range{Start: []byte(expiryPrefix), Limit: limit})
+	var due []string
+	for iter.Next() {
+		due = append(due, string(iter.Key()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, ek := range due {
+		ok, err := reapKey(ek, now)
+		if err != nil {
+			log.Printf("Master: reaper: %q: %v", ek, err)
+			continue
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// reapKey deletes the key behind the expiry index entry ek.
+func reapKey(ek string, now time.Time) (bool, error) {
+	nanos, indexKey, _ := strings.Cut(ek[len(expiryPrefix):], "/")
+	if strings.HasPrefix(indexKey, trashPrefix) {
+		return purgeTrash(indexKey)
+	}
+	ref, version, err := refFromIndexKey(indexKey)
+	if err == metastore.ErrNotFound {
+		// the bucket is gone, and with it the key
+		return false, db.Delete([]byte(ek))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	unlock := keyLocks.Lock(ref.indexKey())
+	defer unlock()
+
+	rec, err := getRecord(indexKey)
+	if err != nil && err != metastore.ErrNotFound {
+		return false, err
+	}
+	if err == metastore.ErrNotFound || fmt.Sprintf("%020d", rec.Expires.UnixNano()) != nanos {
+		// entries are written together with their record, so this
+		// one is left over from a version of the key that is gone
+		return false, db.Delete([]byte(ek))
+	}
+
+	if version != "" {
+		return true, deleteVersion(ref, version)
+	}
+
+	return true, destroyObject(ref, rec)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/index"
+	"github.com/alvinliju/tinydb/internal/metastore"
+)
+
+// Every version of a key in a versioned bucket is kept under
+// versionPrefix + "<bucket>/<key>\x00<version id>". The entry under the
+// key's index key always mirrors its latest version, which may be a
+// delete marker.
+const versionPrefix = index.VersionPrefix
+
+const versionHeader = "X-Tinydb-Version-Id"
+
+var errNoSuchVersion = errors.New("version not found")
+
+func (o objectRef) versioned() bool {
+	return o.Bucket != nil && o.Bucket.Versioning
+}
+
+func (o objectRef) versionKey(id string) string {
+	return versionPrefix + o.Bucket.Name + "/" + o.Key + "\x00" + id
+}
+
+// newVersionID returns a version ID that sorts before every ID handed out
+// earlier, so iterating a key's versions yields the newest one first.
+func newVersionID() string {
+	var b [2]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%016x%s", math.MaxInt64-time.Now().UnixNano(), hex.EncodeToString(b[:]))
+}
+
+// addDeleteMarker hides the key in a versioned bucket without touching any
+// of its versions.
+func addDeleteMarker(ref objectRef) (Record, error) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	cur, err := getRecord(ref.indexKey())
+	if err != nil {
+		return Record{}, err
+	}
+	if cur.DeleteMarker {
+		return Record{}, metastore.ErrNotFound
+	}
+
+	marker := Record{Version: newVersionID(), DeleteMarker: true, Mtime: time.Now().UTC()}
+	batch := new(metastore.Batch)
+	batch.Put([]byte(ref.indexKey()), marker.encode())
+	batch.Put([]byte(ref.versionKey(marker.Version)), marker.encode())
+	return marker, db.Write(batch)
+}
+
+// deleteVersion removes a single version for good. When it was the latest
+// one, the next newest version becomes current.
+func deleteVersion(ref objectRef, id string) error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	rec, err := getRecord(ref.versionKey(id))
+	if err == metastore.ErrNotFound {
+		return errNoSuchVersion
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := new(metastore.Batch)
+	if !rec.DeleteMarker {
+		gen, err := nextGeneration()
+		if err != nil {
+			return err
+		}
+		queueBlobDeletes(batch, rec.Blob, rec.Replicas, gen)
+	}
+
+	used, err := bucketUsage(ref.Bucket.Name)
+	if err != nil {
+		return err
+	}
+
+	batch.Delete([]byte(ref.versionKey(id)))
+	unindexExpiry(batch, ref.versionKey(id), rec)
+	forgetAccess(batch, ref.versionKey(id))
+	batch.Put([]byte(usagePrefix+ref.Bucket.Name), []byte(strconv.FormatInt(max(used-rec.Size, 0), 10)))
+
+	cur, err := getRecord(ref.indexKey())
+	if err != nil && err != metastore.ErrNotFound {
+		return err
+	}
+	if err == nil && cur.Version == id {
+		iter := db.NewIterator(metastore.Prefix([]byte(ref.versionKey(""))))
+		found := false
+		for iter.Next() {
+			if string(iter.Key()) != ref.versionKey(id) {
+				batch.Put([]byte(ref.indexKey()), append([]byte(nil), iter.Value()...))
+				found = true
+				break
+			}
+		}
+		iter.Release()
+		if !found {
+			batch.Delete([]byte(ref.indexKey()))
+		}
+	}
+	if err := db.Write(batch); err != nil {
+		return err
+	}
+	kickDeletes()
+	return nil
+}
+
+// handleDeleteVersioned deletes in a versioned bucket. Without ?version=
+// it only adds a delete marker, with it that version is destroyed.
+func handleDeleteVersioned(w http.ResponseWriter, r *http.Request, ref objectRef) {
+	id := r.URL.Query().Get("version")
+	if id == "" {
+		marker, err := addDeleteMarker(ref)
+		if err == metastore.ErrNotFound {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(versionHeader, marker.Version)
+		w.Header().Set("X-Tinydb-Delete-Marker", "true")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := deleteVersion(ref, id)
+	if err == errNoSuchVersion {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Master: Error deleting version %s of %s: %v", id, ref.Key, err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(versionHeader, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type versionEntry struct {
+	Key          string    `json:"key"`
+	VersionID    string    `json:"version_id"`
+	IsLatest     bool      `json:"is_latest"`
+	DeleteMarker bool      `json:"delete_marker,omitempty"`
+	Size         int64     `json:"size"`
+	Mtime        time.Time `json:"mtime"`
+}
+
+type versionListResult struct {
+	Prefix            string         `json:"prefix"`
+	Versions          []versionEntry `json:"versions"`
+	IsTruncated       bool           `json:"is_truncated"`
+	NextKeyMarker     string         `json:"next_key_marker,omitempty"`
+	NextVersionMarker string         `json:"next_version_marker,omitempty"`
+}
+
+// handleListVersions serves GET /b/<bucket>/?list&versions&prefix=&key-marker=&version-marker=&limit=
+// Keys come back in order, the versions of each key newest first.
+func handleListVersions(w http.ResponseWriter, r *http.Request, ref objectRef) {
+	if !ref.versioned() {
+		http.Error(w, "bucket is not versioned", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	res, err := listVersions(ref, q.Get("prefix"), q.Get("key-marker"), q.Get("version-marker"), limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func listVersions(ref objectRef, prefix, keyMarker, versionMarker string, limit int) (versionListResult, error) {
+	res := versionListResult{Prefix: prefix, Versions: []versionEntry{}}
+	base := versionPrefix + ref.Bucket.Name + "/"
+
+	iter := db.NewIterator(metastore.Prefix([]byte(base + prefix)))
+	defer iter.Release()
+
+	var ok bool
+	switch {
+	case keyMarker != "" && versionMarker != "":
+		marker := base + keyMarker + "\x00" + versionMarker
+		ok = iter.Seek([]byte(marker))
+		if ok && string(iter.Key()) == marker {
+			ok = iter.Next()
+		}
+	case keyMarker != "":
+		// past every version of keyMarker
+		ok = iter.Seek([]byte(base + keyMarker + "\x01"))
+	default:
+		ok = iter.First()
+	}
+
+	now := time.Now()
+	latest := map[string]string{}
+	for ; ok; ok = iter.Next() {
+		key, id, _ := strings.Cut(string(iter.Key()[len(base):]), "\x00")
+		if len(res.Versions) == limit {
+			res.IsTruncated = true
+			last := res.Versions[len(res.Versions)-1]
+			res.NextKeyMarker, res.NextVersionMarker = last.Key, last.VersionID
+			break
+		}
+
+		rec, err := decodeRecord(key, iter.Value())
+		if err != nil {
+			return res, err
+		}
+		if rec.expired(now) {
+			continue
+		}
+		if _, seen := latest[key]; !seen {
+			cur, err := getRecord(objectRef{Bucket: ref.Bucket, Key: key}.indexKey())
+			if err != nil && err != metastore.ErrNotFound {
+				return res, err
+			}
+			latest[key] = cur.Version
+		}
+		res.Versions = append(res.Versions, versionEntry{
+			Key:          key,
+			VersionID:    id,
+			IsLatest:     latest[key] == id,
+			DeleteMarker: rec.DeleteMarker,
+			Size:         rec.Size,
+			Mtime:        rec.Mtime,
+		})
+	}
+	return res, iter.Error()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/alvinliju/tinydb/internal/shardmap"
+)
+
+// handleShardMap serves GET /admin/shards, the shard map for clients that
+// route requests themselves.
+func handleShardMap(w http.ResponseWriter, r *http.Request, m shardmap.Map) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+type shardResponse struct {
+	shard  string
+	status int
+	header http.Header
+	body   []byte
+}
+
+// forward sends a copy of r with the given body to the master of s.
+func forward(r *http.Request, s shardmap.Shard, body []byte) (shardResponse, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, s.Master+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return shardResponse{}, err
+	}
+	req.Header = r.Header.Clone()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return shardResponse{}, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return shardResponse{}, err
+	}
+	return shardResponse{shard: s.ID, status: resp.StatusCode, header: resp.Header, body: b}, nil
+}
+
+// handleConfig serves the bucket and lifecycle admin APIs. Every shard
+// keeps the configs of all buckets, since a bucket's keys can be spread
+// over several shards, so changes go to all of them, one after the other.
+// Reads are answered by the first shard, except that a bucket's usage is
+// the sum over all shards.
+func (rt *router) handleConfig(w http.ResponseWriter, r *http.Request) {
+	m := rt.shardMap()
+	if r.Method == "GET" {
+		if name := strings.TrimPrefix(r.URL.Path, "/admin/buckets/"); name != r.URL.Path && name != "" {
+			handleBucketUsage(w, r, m)
+			return
+		}
+		rt.proxy(m.Shards[0]).ServeHTTP(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	if name, ok := strings.CutPrefix(r.URL.Path, "/admin/buckets/"); ok && r.Method == "PUT" {
+		// each shard checks a quota against its own keys only
+		var b struct {
+			QuotaBytes int64 `json:"quota_bytes"`
+		}
+		json.Unmarshal(body, &b)
+		if b.QuotaBytes > 0 && len(m.Overlapping(shardmap.PrefixRange("b/"+name+"/"))) > 1 {
+			http.Error(w, "The bucket's keys span several shards, which can't share a quota", http.StatusConflict)
+			return
+		}
+	}
+	var answers []shardResponse
+	for _, s := range m.Shards {
+		resp, err := forward(r, s, body)
+		if err != nil {
+			resp = shardResponse{shard: s.ID, status: http.StatusBadGateway, body: []byte(err.Error())}
+		}
+		answers = append(answers, resp)
+	}
+
+	first := answers[0]
+	for _, a := range answers[1:] {
+		if a.status != first.status {
+			var msg strings.Builder
+			msg.WriteString("Shards disagree, the change is only applied where it succeeded:\n")
+			for _, a := range answers {
+				fmt.Fprintf(&msg, "%s: %d %s\n", a.shard, a.status, strings.TrimSpace(string(a.body)))
+			}
+			http.Error(w, msg.String(), http.StatusBadGateway)
+			return
+		}
+	}
+	if ct := first.header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(first.status)
+	w.Write(first.body)
+}
+
+// handleBucketUsage serves GET /admin/buckets/<name> with the bucket's
+// usage summed over the shards.
+func handleBucketUsage(w http.ResponseWriter, r *http.Request, m shardmap.Map) {
+	var bucket map[string]json.RawMessage
+	used := int64(0)
+	for _, s := range m.Shards {
+		resp, err := forward(r, s, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Shard %s: %v", s.ID, err), http.StatusBadGateway)
+			return
+		}
+		if resp.status != http.StatusOK {
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+		var b map[string]json.RawMessage
+		var u struct {
+			UsedBytes int64 `json:"used_bytes"`
+		}
+		if json.Unmarshal(resp.body, &b) != nil || json.Unmarshal(resp.body, &u) != nil {
+			http.Error(w, fmt.Sprintf("Shard %s sent a bad bucket", s.ID), http.StatusBadGateway)
+			return
+		}
+		if bucket == nil {
+			bucket = b
+		}
+		used += u.UsedBytes
+	}
+	bucket["used_bytes"], _ = json.Marshal(used)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bucket)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alvinliju/tinydb/internal/shardmap"
+)
+
+// A listing whose prefix spans shards asks each of them in key order for
+// what is left of the limit, and carries on where the previous one ended.
+// Every shard's keys come after the previous shard's, so the pages join
+// up and the markers of the last shard continue the listing.
+
+// defaultListLimit is what the masters return when no limit is asked for.
+const defaultListLimit = 1000
+
+// listKind describes one of the masters' listings.
+type listKind struct {
+	// items is the array of entries in the result
+	items string
+	// prefixes is set if entries can be rolled up into common prefixes
+	prefixes bool
+	markers  []listMarker
+}
+
+// listMarker is a query parameter that continues a listing.
+type listMarker struct {
+	param string
+	// next is the result field the master sets it in
+	next string
+	// field is the field of an entry it is taken from
+	field string
+}
+
+var (
+	keyList     = listKind{"keys", true, []listMarker{{"start-after", "next_start_after", "key"}}}
+	versionList = listKind{"versions", false, []listMarker{{"key-marker", "next_key_marker", "key"}, {"version-marker", "next_version_marker", "version_id"}}}
+	trashList   = listKind{"keys", false, []listMarker{{"key-marker", "next_key_marker", "key"}, {"trash-marker", "next_trash_marker", "trash_id"}}}
+)
+
+func (rt *router) handleList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	kind := keyList
+	switch {
+	case q.Has("versions"):
+		kind = versionList
+	case q.Has("trash"):
+		kind = trashList
+	}
+
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, defaultListLimit)
+	}
+
+	// keys in the listing are relative to the bucket, the shard map's
+	// are not
+	base := strings.TrimPrefix(r.URL.Path, "/")
+	shards := rt.shardMap().Overlapping(shardmap.PrefixRange(base + q.Get("prefix")))
+	if marker := q.Get(kind.markers[0].param); marker != "" {
+		for len(shards) > 1 && shards[0].End != "" && shards[0].End <= base+marker {
+			shards = shards[1:]
+		}
+	}
+	if len(shards) == 1 {
+		rt.proxy(shards[0]).ServeHTTP(w, r)
+		return
+	}
+
+	var merged map[string]json.RawMessage
+	var items []json.RawMessage
+	var prefixes []string
+	truncated := false
+	for i, s := range shards {
+		sq := r.URL.Query()
+		sq.Set("limit", strconv.Itoa(limit))
+		if i > 0 {
+			for _, mk := range kind.markers {
+				sq.Del(mk.param)
+			}
+		}
+		status, body, err := getFrom(r, s.Master+r.URL.Path+"?"+sq.Encode())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Shard %s: %v", s.ID, err), http.StatusBadGateway)
+			return
+		}
+		if status != http.StatusOK {
+			http.Error(w, strings.TrimSpace(string(body)), status)
+			return
+		}
+
+		var res map[string]json.RawMessage
+		var page []json.RawMessage
+		var cps []string
+		if json.Unmarshal(body, &res) != nil || json.Unmarshal(res[kind.items], &page) != nil {
+			http.Error(w, fmt.Sprintf("Shard %s sent a bad listing", s.ID), http.StatusBadGateway)
+			return
+		}
+		if raw, ok := res["common_prefixes"]; ok {
+			json.Unmarshal(raw, &cps)
+		}
+		if merged == nil {
+			merged = res
+		}
+		items = append(items, page...)
+		for _, cp := range cps {
+			// a "directory" can start on one shard and go on on the next
+			if len(prefixes) == 0 || prefixes[len(prefixes)-1] != cp {
+				prefixes = append(prefixes, cp)
+			}
+		}
+		limit -= len(page) + len(cps)
+
+		var more bool
+		json.Unmarshal(res["is_truncated"], &more)
+		if more {
+			truncated = true
+			for _, mk := range kind.markers {
+				merged[mk.next] = res[mk.next]
+			}
+			break
+		}
+		if limit <= 0 && i < len(shards)-1 {
+			truncated = true
+			setMarkers(merged, kind, items, prefixes)
+			break
+		}
+	}
+
+	merged[kind.items], _ = json.Marshal(items)
+	if kind.prefixes {
+		delete(merged, "common_prefixes")
+		if len(prefixes) > 0 {
+			merged["common_prefixes"], _ = json.Marshal(prefixes)
+		}
+	}
+	merged["is_truncated"], _ = json.Marshal(truncated)
+	if !truncated {
+		for _, mk := range kind.markers {
+			delete(merged, mk.next)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
+
+// setMarkers continues a listing after the last entry, or after the last
+// common prefix if that comes later.
+func setMarkers(merged map[string]json.RawMessage, kind listKind, items []json.RawMessage, prefixes []string) {
+	var last map[string]any
+	if len(items) > 0 {
+		json.Unmarshal(items[len(items)-1], &last)
+	}
+	for _, mk := range kind.markers {
+		v, _ := last[mk.field].(string)
+		if kind.prefixes && len(prefixes) > 0 && prefixes[len(prefixes)-1] > v {
+			v = prefixes[len(prefixes)-1]
+		}
+		merged[mk.next], _ = json.Marshal(v)
+	}
+}
+
+func getFrom(r *http.Request, u string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(r.Context(), "GET", u, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
@@ -0,0 +1,147 @@
+// Command router is the front end of a sharded tinydb cluster. It sends
+// every request to the master that owns its key, see internal/shardmap,
+// merges listings that span shards and applies bucket and lifecycle
+// changes to every shard. It keeps no state besides the shard map, so any
+// number of routers can run side by side.
+//
+//	router -addr :8000 -shards shards.json
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/shardmap"
+)
+
+// httpClient is for the requests the router makes itself, proxied ones
+// go through the shards' reverse proxies. It follows a Raft follower's
+// redirects to the leader.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// router holds the shard map, reloading it when its file changes.
+type router struct {
+	path string
+
+	mu      sync.RWMutex
+	m       shardmap.Map
+	mtime   time.Time
+	proxies map[string]*httputil.ReverseProxy
+}
+
+func newRouter(path string) (*router, error) {
+	rt := &router{path: path}
+	if err := rt.reload(true); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// reload reads the shard map again if its file changed since the last
+// time, or always if force is set. A map older than the one in use is
+// ignored.
+func (rt *router) reload(force bool) error {
+	info, err := os.Stat(rt.path)
+	if err != nil {
+		return err
+	}
+	rt.mu.RLock()
+	unchanged := info.ModTime().Equal(rt.mtime)
+	rt.mu.RUnlock()
+	if unchanged && !force {
+		return nil
+	}
+
+	m, err := shardmap.Load(rt.path)
+	if err != nil {
+		return err
+	}
+	proxies := map[string]*httputil.ReverseProxy{}
+	for _, s := range m.Shards {
+		target, err := url.Parse(s.Master)
+		if err != nil {
+			return err
+		}
+		proxies[s.ID] = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.SetXForwarded()
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				// the master no longer owns the key, a split has moved it
+				if resp.StatusCode == http.StatusMisdirectedRequest {
+					go rt.reload(true)
+				}
+				return nil
+			},
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if m.Version < rt.m.Version {
+		return nil
+	}
+	if m.Version != rt.m.Version {
+		log.Printf("Router: shard map version %d, %d shards", m.Version, len(m.Shards))
+	}
+	rt.m, rt.mtime, rt.proxies = m, info.ModTime(), proxies
+	return nil
+}
+
+func (rt *router) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rt.reload(false); err != nil {
+			log.Printf("Router: Error reloading %s: %v", rt.path, err)
+		}
+	}
+}
+
+func (rt *router) shardMap() shardmap.Map {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.m
+}
+
+func (rt *router) proxy(s shardmap.Shard) *httputil.ReverseProxy {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.proxies[s.ID]
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/admin/shards":
+		handleShardMap(w, r, rt.shardMap())
+	case strings.HasPrefix(r.URL.Path, "/admin/buckets") || strings.HasPrefix(r.URL.Path, "/admin/lifecycle"):
+		rt.handleConfig(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		http.Error(w, "Ask the shard's master, see GET /admin/shards", http.StatusNotFound)
+	case r.Method == "GET" && r.URL.Query().Has("list"):
+		rt.handleList(w, r)
+	default:
+		s := rt.shardMap().Lookup(strings.TrimPrefix(r.URL.Path, "/"))
+		rt.proxy(s).ServeHTTP(w, r)
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":8000", "address to listen on")
+	shards := flag.String("shards", "shards.json", "the shard map, a JSON file that is reloaded when it changes")
+	interval := flag.Duration("reload-interval", 5*time.Second, "how often to look for changes to the shard map")
+	flag.Parse()
+
+	rt, err := newRouter(*shards)
+	if err != nil {
+		log.Fatalf("Router: %v", err)
+	}
+	go rt.watch(*interval)
+	log.Fatal(http.ListenAndServe(*addr, rt))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/shardmap"
+)
+
+// fakeMaster holds the keys of one shard and answers like a master does.
+type fakeMaster struct {
+	id      string
+	keys    []string
+	buckets map[string]int64 // bucket name to used bytes
+	// readOnly turns writes away as while the shard is split
+	readOnly bool
+	// gaveAway is the first key of the range a split moved to another
+	// shard, if any
+	gaveAway string
+}
+
+func (f *fakeMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case q.Has("list"):
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil {
+			limit = defaultListLimit
+		}
+		res := map[string]any{"prefix": q.Get("prefix")}
+		var entries []map[string]string
+		truncated := false
+		for _, k := range f.keys {
+			if !strings.HasPrefix(k, q.Get("prefix")) || k <= q.Get("start-after") {
+				continue
+			}
+			if len(entries) == limit {
+				truncated = true
+				break
+			}
+			entries = append(entries, map[string]string{"key": k})
+		}
+		if entries == nil {
+			entries = []map[string]string{}
+		}
+		res["keys"], res["is_truncated"] = entries, truncated
+		if truncated {
+			res["next_start_after"] = entries[len(entries)-1]["key"]
+		}
+		json.NewEncoder(w).Encode(res)
+	case strings.HasPrefix(r.URL.Path, "/admin/buckets/"):
+		name := strings.TrimPrefix(r.URL.Path, "/admin/buckets/")
+		switch r.Method {
+		case "PUT":
+			f.buckets[name] = 0
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"name":%q}`, name)
+		case "GET":
+			used, ok := f.buckets[name]
+			if !ok {
+				http.Error(w, "bucket not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintf(w, `{"name":%q,"used_bytes":%d}`, name, used)
+		}
+	case f.gaveAway != "" && strings.TrimPrefix(r.URL.Path, "/") >= f.gaveAway:
+		http.Error(w, "Key belongs to another shard, reload the shard map", http.StatusMisdirectedRequest)
+	case f.readOnly && r.Method != "GET":
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Shard is read only while it is split, try again", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintf(w, "%s %s", f.id, r.URL.Path)
+	}
+}
+
+// newTestRouter runs a fake master for each shard, which own the keys
+// before "h", from "h" to "p", and from "p" on.
+func newTestRouter(t *testing.T, keys []string) (*router, map[string]*fakeMaster) {
+	masters := map[string]*fakeMaster{}
+	m := shardmap.Map{}
+	bounds := []string{"", "h", "p", ""}
+	for i, id := range []string{"s1", "s2", "s3"} {
+		f := &fakeMaster{id: id, buckets: map[string]int64{}}
+		s := shardmap.Shard{ID: id, Start: bounds[i], End: bounds[i+1]}
+		for _, k := range keys {
+			if s.Contains(k) {
+				f.keys = append(f.keys, k)
+			}
+		}
+		sort.Strings(f.keys)
+		srv := httptest.NewServer(f)
+		t.Cleanup(srv.Close)
+		s.Master = srv.URL
+		m.Shards = append(m.Shards, s)
+		masters[id] = f
+	}
+	path := filepath.Join(t.TempDir(), "shards.json")
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := newRouter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt, masters
+}
+
+func get(t *testing.T, h http.Handler, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+	return rr
+}
+
+func TestRouteByKey(t *testing.T) {
+	rt, _ := newTestRouter(t, nil)
+	for path, want := range map[string]string{
+		"/apple":          "s1",
+		"/b/photos/cat":   "s1",
+		"/house":          "s2",
+		"/pear":           "s3",
+		"/zebra/stripes":  "s3",
+		"/h":              "s2",
+		"/g\xff\xff/deep": "s1",
+	} {
+		body, _ := io.ReadAll(get(t, rt, "http://router"+strings.ReplaceAll(path, "\xff", "%FF")).Body)
+		if got, _, _ := strings.Cut(string(body), " "); got != want {
+			t.Errorf("%s went to %s, want %s", path, body, want)
+		}
+	}
+}
+
+func TestListAcrossShards(t *testing.T) {
+	var keys []string
+	for c := 'a'; c <= 'z'; c++ {
+		keys = append(keys, string(c)+"1", string(c)+"2")
+	}
+	rt, _ := newTestRouter(t, keys)
+
+	// page through everything, five keys at a time
+	var got []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("listing doesn't end")
+		}
+		rr := get(t, rt, "/?list&limit=5&start-after="+after)
+		var res listResult
+		if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+			t.Fatalf("page %d: %v", pages, err)
+		}
+		if len(res.Keys) > 5 {
+			t.Fatalf("page %d has %d keys", pages, len(res.Keys))
+		}
+		for _, e := range res.Keys {
+			got = append(got, e.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		after = res.NextStartAfter
+	}
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Errorf("listed %v\nwant %v", got, keys)
+	}
+
+	// a prefix inside one shard only asks that one
+	var res listResult
+	json.NewDecoder(get(t, rt, "/?list&prefix=k").Body).Decode(&res)
+	if len(res.Keys) != 2 || res.Keys[0].Key != "k1" || res.IsTruncated {
+		t.Errorf("list of prefix k: %+v", res)
+	}
+}
+
+type listResult struct {
+	Keys []struct {
+		Key string `json:"key"`
+	} `json:"keys"`
+	IsTruncated    bool   `json:"is_truncated"`
+	NextStartAfter string `json:"next_start_after"`
+}
+
+func TestBucketsOnEveryShard(t *testing.T) {
+	rt, masters := newTestRouter(t, nil)
+
+	rr := httptest.NewRecorder()
+	rt.ServeHTTP(rr, httptest.NewRequest("PUT", "/admin/buckets/photos", strings.NewReader(`{}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create bucket: got %d %s", rr.Code, rr.Body)
+	}
+	for id, f := range masters {
+		if _, ok := f.buckets["photos"]; !ok {
+			t.Errorf("shard %s doesn't have the bucket", id)
+		}
+	}
+
+	masters["s1"].buckets["photos"] = 100
+	masters["s3"].buckets["photos"] = 23
+	var b struct {
+		Name      string `json:"name"`
+		UsedBytes int64  `json:"used_bytes"`
+	}
+	json.NewDecoder(get(t, rt, "/admin/buckets/photos").Body).Decode(&b)
+	if b.Name != "photos" || b.UsedBytes != 123 {
+		t.Errorf("bucket usage: got %+v, want 123 bytes", b)
+	}
+
+	// a shard without the bucket makes it missing
+	delete(masters["s2"].buckets, "photos")
+	if rr := get(t, rt, "/admin/buckets/photos"); rr.Code != http.StatusNotFound {
+		t.Errorf("bucket missing on a shard: got %d", rr.Code)
+	}
+}
+
+func TestWriteRacingSplit(t *testing.T) {
+	rt, masters := newTestRouter(t, nil)
+	put := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		rt.ServeHTTP(rr, httptest.NewRequest("PUT", path, strings.NewReader("x")))
+		return rr
+	}
+
+	// while s3 is copied to the new shard, writes to it fail and the
+	// client retries
+	masters["s3"].readOnly = true
+	if rr := put("/zebra"); rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("write during the split: got %d, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	s4 := &fakeMaster{id: "s4", buckets: map[string]int64{}}
+	srv := httptest.NewServer(s4)
+	t.Cleanup(srv.Close)
+	next, err := rt.shardMap().Split("s3", "t", "s4", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Save(rt.path); err != nil {
+		t.Fatal(err)
+	}
+	masters["s3"].readOnly, masters["s3"].gaveAway = false, "t"
+
+	// the retry still goes to s3, which sends the router to the new map
+	if rr := put("/zebra"); rr.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("write with the old map: got %d %s", rr.Code, rr.Body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.shardMap().Version != next.Version {
+		if time.Now().After(deadline) {
+			t.Fatal("the router didn't reload the shard map")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rr := put("/zebra"); rr.Body.String() != "s4 /zebra" {
+		t.Errorf("write after the split went to %s", rr.Body)
+	}
+	if rr := put("/pear"); rr.Body.String() != "s3 /pear" {
+		t.Errorf("write to the kept range went to %s", rr.Body)
+	}
+}
+
+func TestQuotaOnOneShard(t *testing.T) {
+	rt, _ := newTestRouter(t, nil)
+	s4 := &fakeMaster{id: "s4", buckets: map[string]int64{}}
+	srv := httptest.NewServer(s4)
+	t.Cleanup(srv.Close)
+	next, err := rt.shardMap().Split("s1", "b/pets/m", "s4", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Save(rt.path); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.reload(true); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]int{"pets": http.StatusConflict, "photos": http.StatusCreated} {
+		rr := httptest.NewRecorder()
+		rt.ServeHTTP(rr, httptest.NewRequest("PUT", "/admin/buckets/"+name, strings.NewReader(`{"quota_bytes": 1000}`)))
+		if rr.Code != want {
+			t.Errorf("quota on %s: got %d %s, want %d", name, rr.Code, rr.Body, want)
+		}
+	}
+}
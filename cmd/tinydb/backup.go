@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/changelog"
+	"github.com/alvinliju/tinydb/internal/snapshot"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// generationKey is where the master keeps the generations it has handed
+// out, see cmd/master.
+const generationKey = "\x00generation"
+
+// raftAppliedKey is where a replicated master notes how far into its Raft
+// log the index is. A restored index starts a new log, so it is dropped.
+const raftAppliedKey = "\x00raft-applied"
+
+// restoreGenerationSkip is how far a restore without a change log moves the
+// generation counter on, to stay above the writes made after the snapshot
+// that the volumes still hold.
+const restoreGenerationSkip = 1 << 32
+
+// runBackup is tinydb backup, which saves a snapshot of a running master.
+func runBackup(args []string) int {
+	fl := flag.NewFlagSet("backup", flag.ExitOnError)
+	master := fl.String("master", "http://localhost:3000", "the master to back up")
+	out := fl.String("o", "", "file to write the archive to (default tinydb-<time>.snap)")
+	fl.Parse(args)
+
+	if *out == "" {
+		*out = "tinydb-" + time.Now().UTC().Format("20060102T150405Z") + ".snap"
+	}
+	if err := backup(*master, *out); err != nil {
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	return 0
+}
+
+func backup(master, out string) error {
+	resp, err := http.Get(master + "/admin/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master answered with %s", resp.Status)
+	}
+
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// the master can't tell us it failed half way, the trailer can
+	hdr, n, err := verifyArchive(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d entries as of %s, change log %d\n", out, n, hdr.Created.Format(time.RFC3339), hdr.ChangelogSeq)
+	return nil
+}
+
+func verifyArchive(path string) (snapshot.Header, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return snapshot.Header{}, 0, err
+	}
+	defer f.Close()
+	sr, err := snapshot.NewReader(f)
+	if err != nil {
+		return snapshot.Header{}, 0, err
+	}
+	n := 0
+	for {
+		_, _, err := sr.Next()
+		if err == io.EOF {
+			return sr.Header, n, nil
+		}
+		if err != nil {
+			return sr.Header, n, err
+		}
+		n++
+	}
+}
+
+// runRestore is tinydb restore, which turns an archive into the leveldb of
+// a fresh master, rolled forward with the change log if there is one.
+func runRestore(args []string) int {
+	fl := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := fl.String("db", "./tinydb_master", "leveldb directory to create, must not exist yet")
+	changes := fl.String("changelog", "", "the master's -changelog directory, to replay the writes made after the snapshot")
+	until := fl.String("until", "", "replay the change log up to this RFC 3339 time (default: all of it)")
+	fl.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tinydb restore [flags] <archive>")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+
+	var untilTime time.Time
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "restore: -until:", err)
+			return 2
+		}
+		if *changes == "" {
+			fmt.Fprintln(os.Stderr, "restore: -until needs -changelog")
+			return 2
+		}
+		untilTime = t
+	}
+
+	stats, err := restore(fl.Arg(0), *dbPath, *changes, untilTime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	fmt.Printf("restored %d entries from the snapshot of %s", stats.entries, stats.created.Format(time.RFC3339))
+	if *changes != "" {
+		fmt.Printf(" and replayed %d changes", stats.replayed)
+		if stats.replayed > 0 {
+			fmt.Printf(" up to %s", stats.last.Format(time.RFC3339Nano))
+		}
+	}
+	fmt.Println()
+	return 0
+}
+
+type restoreStats struct {
+	created  time.Time
+	entries  int
+	replayed int
+	last     time.Time
+}
+
+func restore(archive, dbPath, changes string, until time.Time) (restoreStats, error) {
+	var stats restoreStats
+	var in io.Reader = os.Stdin
+	if archive != "-" {
+		f, err := os.Open(archive)
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+		in = f
+	}
+	sr, err := snapshot.NewReader(in)
+	if err != nil {
+		return stats, err
+	}
+	stats.created = sr.Header.Created
+	if changes != "" {
+		if info, err := os.Stat(changes); err != nil || !info.IsDir() {
+			return stats, fmt.Errorf("no change log in %s", changes)
+		}
+	}
+
+	if entries, err := os.ReadDir(dbPath); err == nil && len(entries) > 0 {
+		return stats, fmt.Errorf("%s is not empty, restore only creates a fresh index", dbPath)
+	}
+	idx, err := leveldb.OpenFile(dbPath, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return stats, err
+	}
+	defer idx.Close()
+
+	batch := new(leveldb.Batch)
+	for {
+		k, v, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if string(k) == raftAppliedKey {
+			continue
+		}
+		batch.Put(k, v)
+		stats.entries++
+		if batch.Len() == 1000 {
+			if err := idx.Write(batch, nil); err != nil {
+				return stats, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := idx.Write(batch, nil); err != nil {
+		return stats, err
+	}
+
+	gen, err := storedGeneration(idx)
+	if err != nil {
+		return stats, err
+	}
+	if changes == "" {
+		return stats, idx.Put([]byte(generationKey), []byte(strconv.FormatUint(gen+restoreGenerationSkip, 10)), nil)
+	}
+
+	// Writes after the restore point are skipped but still looked at: the
+	// generations they reserved may be on the volumes.
+	next := sr.Header.ChangelogSeq + 1
+	stopped := false
+	gens := &generationTracker{max: gen}
+	err = changelog.Replay(changes, sr.Header.ChangelogSeq, func(e changelog.Entry) error {
+		if e.Seq != next {
+			return fmt.Errorf("change log jumps from %d to %d, segments are missing", next-1, e.Seq)
+		}
+		next++
+		b := new(leveldb.Batch)
+		if err := b.Load(e.Data); err != nil {
+			return fmt.Errorf("change %d: %v", e.Seq, err)
+		}
+		if err := b.Replay(gens); err != nil {
+			return err
+		}
+		// stop at the first entry past the restore point, later ones
+		// with an earlier time come from a clock that stepped back
+		stopped = stopped || !until.IsZero() && e.Time.After(until)
+		if stopped {
+			return nil
+		}
+		stats.replayed++
+		stats.last = e.Time
+		return idx.Write(b, nil)
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, idx.Put([]byte(generationKey), []byte(strconv.FormatUint(gens.max, 10)), nil)
+}
+
+func storedGeneration(idx *leveldb.DB) (uint64, error) {
+	v, err := idx.Get([]byte(generationKey), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(v), 10, 64)
+}
+
+// generationTracker finds the largest generation reserved in a batch.
+type generationTracker struct {
+	max uint64
+}
+
+func (g *generationTracker) Put(key, value []byte) {
+	if string(key) == generationKey {
+		if n, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			g.max = max(g.max, n)
+		}
+	}
+}
+
+func (g *generationTracker) Delete(key []byte) {}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/changelog"
+	"github.com/alvinliju/tinydb/internal/snapshot"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestRestore(t *testing.T) {
+	tmp := t.TempDir()
+	src, err := leveldb.OpenFile(filepath.Join(tmp, "src"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	src.Put([]byte("before"), []byte("1"), nil)
+	src.Put([]byte(generationKey), []byte("1000"), nil)
+
+	archive := filepath.Join(tmp, "backup.snap")
+	f, _ := os.Create(archive)
+	iter := src.NewIterator(nil, nil)
+	_, err = snapshot.Write(f, snapshot.Header{Created: time.Now(), ChangelogSeq: 2}, iter)
+	iter.Release()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the two writes above, then three after the snapshot
+	changes := filepath.Join(tmp, "changelog")
+	l, err := changelog.Open(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	logPut := func(at time.Time, k, v string) {
+		b := new(leveldb.Batch)
+		b.Put([]byte(k), []byte(v))
+		if _, err := l.Append(at, b.Dump()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logPut(t0, "before", "1")
+	logPut(t0, generationKey, "1000")
+	logPut(t0.Add(time.Minute), "after", "2")
+	logPut(t0.Add(2*time.Minute), "later", "3")
+	logPut(t0.Add(3*time.Minute), generationKey, "2000")
+	l.Close()
+
+	check := func(dbPath string, want map[string]string, wantGen uint64) {
+		t.Helper()
+		idx, err := leveldb.OpenFile(dbPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+		for k, v := range want {
+			got, err := idx.Get([]byte(k), nil)
+			if v == "" && err != leveldb.ErrNotFound || v != "" && string(got) != v {
+				t.Errorf("%s: got %q, %v want %q", k, got, err, v)
+			}
+		}
+		if gen, _ := storedGeneration(idx); gen != wantGen {
+			t.Errorf("generation: got %d want %d", gen, wantGen)
+		}
+	}
+
+	if _, err := restore(archive, filepath.Join(tmp, "plain"), "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	check(filepath.Join(tmp, "plain"), map[string]string{"before": "1", "after": ""}, 1000+restoreGenerationSkip)
+
+	stats, err := restore(archive, filepath.Join(tmp, "pitr"), changes, t0.Add(90*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.replayed != 1 {
+		t.Errorf("replayed %d changes, want 1", stats.replayed)
+	}
+	// later writes are left out, but not their generations
+	check(filepath.Join(tmp, "pitr"), map[string]string{"before": "1", "after": "2", "later": ""}, 2000)
+
+	if _, err := restore(archive, filepath.Join(tmp, "pitr"), changes, time.Time{}); err == nil {
+		t.Errorf("restore into an existing index succeeded")
+	}
+
+	if _, err := restore(archive, filepath.Join(tmp, "typo"), filepath.Join(tmp, "changelgo"), time.Time{}); err == nil {
+		t.Errorf("restore with a missing change log succeeded")
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alvinliju/tinydb/internal/index"
+	"github.com/alvinliju/tinydb/internal/keys"
+	"github.com/alvinliju/tinydb/internal/shardmap"
+	"github.com/alvinliju/tinydb/internal/topology"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// fsck reads the master's leveldb directly, so the master has to be
+// stopped while it runs. The volumes are asked over HTTP, for their
+// inventories and scrubs, and repairs are written through them, so they
+// must be up; nothing writes to them without the master.
+
+// The headers a volume keeps a blob's generation and record from, see
+// cmd/master.
+const (
+	generationHeader = "X-Tinydb-Generation"
+	recordHeader     = "X-Tinydb-Record"
+)
+
+// What fsck can find wrong.
+const (
+	// a replica doesn't have the blob
+	kindMissing = "missing"
+	// a replica's copy doesn't match the ETag
+	kindChecksum = "checksum"
+	// a blob nothing in the index points at
+	kindOrphan = "orphan"
+	// a replica outside the group key2Volume picks for the key
+	kindWrongGroup = "wrong-group"
+	// a replica or blob name that doesn't parse
+	kindUnparseable = "unparseable"
+	// a replica that couldn't be listed, so it couldn't be checked
+	kindNoVolume = "no-volume"
+)
+
+type finding struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key,omitempty"`
+	Bucket  string `json:"bucket,omitempty"`
+	Version string `json:"version,omitempty"`
+	TrashID string `json:"trash_id,omitempty"`
+	Replica string `json:"replica,omitempty"`
+	Blob    string `json:"blob,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	// Repaired is set when -repair fixed it.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+type fsckReport struct {
+	Keys     int            `json:"keys"`
+	Blobs    int            `json:"blobs"`
+	Findings []finding      `json:"findings"`
+	Counts   map[string]int `json:"counts"`
+	Repaired int            `json:"repaired"`
+}
+
+type fsckOptions struct {
+	Groups []topology.VolumeGroup
+	// Checksums scrubs every volume, which reads every blob back, instead
+	// of only comparing the md5s the volumes have from when the blobs were
+	// written.
+	Checksums bool
+	Repair    bool
+}
+
+// indexEntry is a blob reference in the index.
+type indexEntry struct {
+	finding // the fields naming the key
+	// volumeKey is the key the volumes and key2Volume see.
+	volumeKey string
+	rec       index.Record
+}
+
+// parseIndexKey tells what an index key refers to. ok is false for the
+// master's other namespaces.
+func parseIndexKey(k string) (e indexEntry, ok bool) {
+	switch {
+	case strings.HasPrefix(k, index.TrashPrefix):
+		rest := k[len(index.TrashPrefix):]
+		i := strings.LastIndexByte(rest, 0)
+		if i < 0 {
+			return e, false
+		}
+		e, ok = parseIndexKey(rest[:i])
+		e.TrashID = rest[i+1:]
+		return e, ok
+	case strings.HasPrefix(k, index.ObjectPrefix):
+		e.Bucket, e.Key, _ = strings.Cut(k[len(index.ObjectPrefix):], "/")
+	case strings.HasPrefix(k, index.VersionPrefix):
+		rest, version, _ := strings.Cut(k[len(index.VersionPrefix):], "\x00")
+		e.Bucket, e.Key, _ = strings.Cut(rest, "/")
+		e.Version = version
+	case strings.HasPrefix(k, "\x00"):
+		return e, false
+	default:
+		e.Key = k
+	}
+	e.volumeKey = e.Key
+	if e.Bucket != "" {
+		e.volumeKey = "b/" + e.Bucket + "/" + e.Key
+	}
+	return e, true
+}
+
+// checkReplica fails if replica isn't the URL of a volume server.
+func checkReplica(replica string) error {
+	u, err := url.Parse(replica)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("not an http URL")
+	}
+	return nil
+}
+
+// inventoryBlob is an entry of a volume's inventory, see cmd/volume.
+type inventoryBlob struct {
+	Name        string          `json:"name"`
+	MD5         string          `json:"md5"`
+	Key         string          `json:"key"`
+	Generation  uint64          `json:"generation"`
+	Record      json.RawMessage `json:"record"`
+	ContentType string          `json:"content_type"`
+}
+
+// volumeState is what fsck knows of a volume server.
+type volumeState struct {
+	blobs map[string]inventoryBlob
+	// corrupt are the blobs a scrub found changed since they were written
+	corrupt map[string]bool
+}
+
+// listVolume reads the whole inventory of replica, and scrubs it if
+// checksums are on.
+func listVolume(replica string, checksums bool) (*volumeState, error) {
+	v := &volumeState{blobs: map[string]inventoryBlob{}, corrupt: map[string]bool{}}
+	after := ""
+	for {
+		var page struct {
+			Blobs       []inventoryBlob `json:"blobs"`
+			IsTruncated bool            `json:"is_truncated"`
+			NextAfter   string          `json:"next_after"`
+		}
+		if status, err := call("GET", replica+"/blobs?after="+url.QueryEscape(after), nil, &page); err != nil {
+			return nil, err
+		} else if status == http.StatusNotFound {
+			return nil, fmt.Errorf("%s has no inventory", replica)
+		}
+		for _, b := range page.Blobs {
+			v.blobs[b.Name] = b
+		}
+		if !page.IsTruncated {
+			break
+		}
+		after = page.NextAfter
+	}
+	if !checksums {
+		return v, nil
+	}
+	after = ""
+	for {
+		var report struct {
+			Corrupt     []string `json:"corrupt"`
+			Missing     []string `json:"missing"`
+			IsTruncated bool     `json:"is_truncated"`
+			NextAfter   string   `json:"next_after"`
+		}
+		if status, err := call("POST", replica+"/scrub?after="+url.QueryEscape(after), nil, &report); err != nil {
+			return nil, fmt.Errorf("scrub: %v", err)
+		} else if status == http.StatusNotFound {
+			return nil, fmt.Errorf("%s can't scrub", replica)
+		}
+		for _, name := range report.Corrupt {
+			v.corrupt[name] = true
+		}
+		// gone since the inventory was read
+		for _, name := range report.Missing {
+			delete(v.blobs, name)
+		}
+		if !report.IsTruncated {
+			return v, nil
+		}
+		after = report.NextAfter
+	}
+}
+
+// copyState is what fsck found for a blob on one replica.
+type copyState struct {
+	replica string
+	blob    inventoryBlob
+	missing bool
+	corrupt bool
+}
+
+type checker struct {
+	opts   fsckOptions
+	report fsckReport
+	// copies caches the state of every (replica, blob) we looked at,
+	// which is also the set of blobs the index points at.
+	copies map[string]map[string]*copyState
+	// volumes maps replicas to what they hold, nil if they couldn't be
+	// listed.
+	volumes map[string]*volumeState
+	// shard is the key range of a sharded master's index, nil if it has
+	// every key. Blobs of other shards' keys aren't orphans.
+	shard *shardmap.Shard
+}
+
+func (c *checker) add(f finding) {
+	c.report.Findings = append(c.report.Findings, f)
+}
+
+// volume returns what replica holds, listing it and reporting the replica
+// the first time it turns out not to answer.
+func (c *checker) volume(e indexEntry, replica string) (*volumeState, bool) {
+	if v, ok := c.volumes[replica]; ok {
+		return v, v != nil
+	}
+	if err := checkReplica(replica); err != nil {
+		f := e.finding
+		f.Kind, f.Replica, f.Blob, f.Detail = kindUnparseable, replica, e.rec.Blob, "replica: "+err.Error()
+		c.add(f)
+		return nil, false
+	}
+	v, err := listVolume(replica, c.opts.Checksums)
+	c.volumes[replica] = v
+	if err != nil {
+		c.add(finding{Kind: kindNoVolume, Replica: replica, Detail: err.Error()})
+		return nil, false
+	}
+	return v, true
+}
+
+func (c *checker) copyOf(v *volumeState, replica, blob string) *copyState {
+	if c.copies[replica] == nil {
+		c.copies[replica] = map[string]*copyState{}
+	}
+	if s, ok := c.copies[replica][blob]; ok {
+		return s
+	}
+	b, ok := v.blobs[blob]
+	s := &copyState{replica: replica, blob: b, missing: !ok, corrupt: v.corrupt[blob]}
+	c.copies[replica][blob] = s
+	return s
+}
+
+func (c *checker) checkEntry(e indexEntry) {
+	rec := e.rec
+	c.report.Keys++
+
+	class := rec.Class
+	if class == "" {
+		class = topology.DefaultClass
+	}
+	var want []string
+	if len(topology.OfClass(c.opts.Groups, class)) == 0 {
+		f := e.finding
+		f.Kind, f.Blob, f.Detail = kindWrongGroup, rec.Blob, fmt.Sprintf("no volume group has the %q storage class", class)
+		c.add(f)
+	} else {
+		g, _ := topology.Pick(c.opts.Groups, e.volumeKey, class)
+		want = g.Replicas
+	}
+
+	if !keys.ValidBlobName(rec.Blob) {
+		f := e.finding
+		f.Kind, f.Blob, f.Detail = kindUnparseable, rec.Blob, "blob name"
+		c.add(f)
+		return
+	}
+
+	// indexes into Findings
+	var bad []int
+	var good *copyState
+	for _, replica := range rec.Replicas {
+		v, ok := c.volume(e, replica)
+		if checkReplica(replica) == nil && want != nil && !contains(want, replica) {
+			f := e.finding
+			f.Kind, f.Replica, f.Blob, f.Detail = kindWrongGroup, replica, rec.Blob, "key belongs on "+strings.Join(want, ",")
+			c.add(f)
+		}
+		if !ok {
+			continue
+		}
+
+		s := c.copyOf(v, replica, rec.Blob)
+		f := e.finding
+		f.Replica, f.Blob = replica, rec.Blob
+		switch {
+		case s.missing:
+			f.Kind = kindMissing
+		case s.corrupt:
+			f.Kind, f.Detail = kindChecksum, "changed since it was written"
+		case rec.ETag != "" && s.blob.MD5 != rec.ETag:
+			f.Kind, f.Detail = kindChecksum, "md5 "+s.blob.MD5+", index has "+rec.ETag
+		default:
+			if good == nil {
+				good = s
+			}
+			continue
+		}
+		c.add(f)
+		bad = append(bad, len(c.report.Findings)-1)
+	}
+
+	if !c.opts.Repair || good == nil {
+		return
+	}
+	for _, i := range bad {
+		f := &c.report.Findings[i]
+		s := c.copies[f.Replica][f.Blob]
+		md5, err := copyBlob(good, e.volumeKey, f.Replica)
+		if err == nil && rec.ETag != "" && md5 != rec.ETag {
+			err = fmt.Errorf("the copy has md5 %s", md5)
+		}
+		if err != nil {
+			f.Detail = strings.TrimPrefix(f.Detail+"; ", "; ") + "repair failed: " + err.Error()
+			continue
+		}
+		s.blob, s.missing, s.corrupt = good.blob, false, false
+		f.Repaired = true
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// copyBlob writes the good copy to dst through its PUT, with the same
+// generation, record and content type, so dst's index and meta have them
+// too. It returns the md5 dst stored.
+func copyBlob(good *copyState, volumeKey, dst string) (string, error) {
+	resp, err := http.Get(good.replica + "/files/" + good.blob.Name)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered GET with %s", good.replica, resp.Status)
+	}
+
+	if good.blob.Key != "" {
+		volumeKey = good.blob.Key
+	}
+	u := dst + "/files/" + url.PathEscape(volumeKey)
+	if v := keys.Version(good.blob.Name); v != "" {
+		u += "?version=" + url.QueryEscape(v)
+	}
+	req, err := http.NewRequest("PUT", u, resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if good.blob.Generation != 0 {
+		req.Header.Set(generationHeader, strconv.FormatUint(good.blob.Generation, 10))
+	}
+	if len(good.blob.Record) > 0 && string(good.blob.Record) != "null" {
+		req.Header.Set(recordHeader, string(good.blob.Record))
+	}
+	if good.blob.ContentType != "" {
+		req.Header.Set("Content-Type", good.blob.ContentType)
+	}
+	var stored struct {
+		Key  string `json:"key"`
+		ETag string `json:"etag"`
+	}
+	if err := do(req, &stored); err != nil {
+		return "", err
+	}
+	if stored.Key != good.blob.Name {
+		return "", fmt.Errorf("%s stored it as %s", dst, stored.Key)
+	}
+	return stored.ETag, nil
+}
+
+// deleteBlob deletes an orphan from replica through its DELETE, with the
+// generation it holds, so a newer write would survive.
+func deleteBlob(replica string, b inventoryBlob) error {
+	req, err := http.NewRequest("DELETE", replica+"/files/"+b.Name, nil)
+	if err != nil {
+		return err
+	}
+	if b.Generation != 0 {
+		req.Header.Set(generationHeader, strconv.FormatUint(b.Generation, 10))
+	}
+	err = do(req, nil)
+	if se, ok := err.(statusError); ok && se.status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// checkOrphans goes through every volume's inventory and reports the blobs
+// the index doesn't point at.
+func (c *checker) checkOrphans() {
+	var replicas []string
+	for replica, v := range c.volumes {
+		if v != nil {
+			replicas = append(replicas, replica)
+		}
+	}
+	sort.Strings(replicas)
+
+	for _, replica := range replicas {
+		v := c.volumes[replica]
+		names := make([]string, 0, len(v.blobs))
+		for name := range v.blobs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := c.copies[replica][name]; ok {
+				c.report.Blobs++
+				continue
+			}
+			b := v.blobs[name]
+			f := finding{Kind: kindOrphan, Replica: replica, Blob: name, Key: b.Key}
+			if f.Key == "" {
+				f.Key, _ = keys.Key(name)
+			}
+			if c.shard != nil && (f.Key == "" || !c.shard.Contains(f.Key)) {
+				// another shard's, or nobody can tell
+				continue
+			}
+			c.report.Blobs++
+			if c.opts.Repair {
+				if err := deleteBlob(replica, b); err != nil {
+					f.Detail = "repair failed: " + err.Error()
+				} else {
+					f.Repaired = true
+				}
+			}
+			c.add(f)
+		}
+	}
+}
+
+// fsck checks every blob reference in the index against the volumes, and
+// the volumes against the index.
+func fsck(idx *leveldb.DB, opts fsckOptions) (fsckReport, error) {
+	c := &checker{
+		opts:    opts,
+		report:  fsckReport{Findings: []finding{}, Counts: map[string]int{}},
+		copies:  map[string]map[string]*copyState{},
+		volumes: map[string]*volumeState{},
+	}
+	if v, err := idx.Get([]byte(index.ShardKey), nil); err == nil {
+		c.shard = new(shardmap.Shard)
+		if err := json.Unmarshal(v, c.shard); err != nil {
+			return c.report, fmt.Errorf("shard range: %v", err)
+		}
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return c.report, err
+	}
+	// volumes the index doesn't mention can only hold orphans
+	for _, g := range opts.Groups {
+		for _, replica := range g.Replicas {
+			c.volume(indexEntry{}, replica)
+		}
+	}
+
+	iter := idx.NewIterator(nil, nil)
+	for iter.Next() {
+		k := string(iter.Key())
+		e, ok := parseIndexKey(k)
+		if !ok {
+			continue
+		}
+		rec, err := index.DecodeRecord(k, iter.Value())
+		if err != nil {
+			iter.Release()
+			return c.report, fmt.Errorf("%q: %v", k, err)
+		}
+		// the current entry of a versioned key is a copy of its latest
+		// version, which is checked on its own
+		if rec.DeleteMarker || e.Bucket != "" && e.Version == "" && e.TrashID == "" && rec.Version != "" {
+			continue
+		}
+		e.rec = rec
+		c.checkEntry(e)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return c.report, err
+	}
+
+	c.checkOrphans()
+	for _, f := range c.report.Findings {
+		c.report.Counts[f.Kind]++
+		if f.Repaired {
+			c.report.Repaired++
+		}
+	}
+	return c.report, nil
+}
+
+func writeTable(w io.Writer, report fsckReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tKEY\tREPLICA\tBLOB\tDETAIL")
+	for _, f := range report.Findings {
+		key := f.Key
+		if f.Bucket != "" {
+			key = f.Bucket + "/" + key
+		}
+		if f.Version != "" {
+			key += " version " + f.Version
+		}
+		if f.TrashID != "" {
+			key += " trash " + f.TrashID
+		}
+		detail := f.Detail
+		if f.Repaired {
+			detail = strings.TrimSpace("repaired " + detail)
+		}
+		fmt.Fprintf(tw, "%s\t%q\t%s\t%s\t%s\n", f.Kind, key, f.Replica, f.Blob, detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d keys, %d blobs, %d problems, %d repaired\n", report.Keys, report.Blobs, len(report.Findings), report.Repaired)
+	return nil
+}
+
+// runFsck is tinydb fsck. It exits with 1 if there are problems left.
+func runFsck(args []string) int {
+	fl := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dbPath := fl.String("db", "./tinydb_master", "the master's leveldb; stop the master first")
+	volumes := fl.String("volumes", "", "JSON file of volume groups, as given to the master (default: the built-in twelve local volumes)")
+	format := fl.String("format", "table", "output format, table or json")
+	checksums := fl.Bool("checksums", true, "scrub every volume, reading every copy back, rather than only compare the md5s they were written with")
+	repair := fl.Bool("repair", false, "copy missing and corrupt blobs from a good replica and delete orphans, through the volumes")
+	fl.Parse(args)
+
+	if *format != "table" && *format != "json" {
+		fmt.Fprintln(os.Stderr, "fsck: -format must be table or json")
+		return 2
+	}
+	groups := topology.Default
+	if *volumes != "" {
+		var err error
+		if groups, err = topology.Load(*volumes); err != nil {
+			fmt.Fprintln(os.Stderr, "fsck:", err)
+			return 2
+		}
+	}
+
+	idx, err := leveldb.OpenFile(*dbPath, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: opening %s: %v\n", *dbPath, err)
+		return 2
+	}
+	defer idx.Close()
+
+	report, err := fsck(idx, fsckOptions{Groups: groups, Checksums: *checksums, Repair: *repair})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeTable(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+	if len(report.Findings) > report.Repaired {
+		return 1
+	}
+	return 0
+}
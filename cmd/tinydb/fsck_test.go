@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alvinliju/tinydb/internal/index"
+	"github.com/alvinliju/tinydb/internal/keys"
+	"github.com/alvinliju/tinydb/internal/topology"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// fakeVolume serves the parts of a volume's API fsck uses, from memory.
+type fakeVolume struct {
+	mu      sync.Mutex
+	blobs   map[string]inventoryBlob
+	content map[string]string
+	// corrupt are the blobs its scrub reports
+	corrupt map[string]bool
+}
+
+func newFakeVolume(t *testing.T) (*fakeVolume, string) {
+	v := &fakeVolume{blobs: map[string]inventoryBlob{}, content: map[string]string{}, corrupt: map[string]bool{}}
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	return v, srv.URL
+}
+
+// write stores content under key as a volume's PUT would, with generation 1
+// and a text content type.
+func (v *fakeVolume) write(key, version, content string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	name := keys.BlobName(key, version)
+	v.blobs[name] = inventoryBlob{Name: name, MD5: etag(content), Key: key, Generation: 1,
+		Record: json.RawMessage(`{"blob":"` + name + `"}`), ContentType: "text/plain"}
+	v.content[name] = content
+}
+
+func (v *fakeVolume) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	switch {
+	case r.URL.Path == "/blobs":
+		// two to a page, so fsck has to follow next_after
+		var names []string
+		for name := range v.blobs {
+			if name > r.URL.Query().Get("after") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var page struct {
+			Blobs       []inventoryBlob `json:"blobs"`
+			IsTruncated bool            `json:"is_truncated"`
+			NextAfter   string          `json:"next_after"`
+		}
+		for _, name := range names {
+			if len(page.Blobs) == 2 {
+				page.IsTruncated, page.NextAfter = true, page.Blobs[1].Name
+				break
+			}
+			page.Blobs = append(page.Blobs, v.blobs[name])
+		}
+		json.NewEncoder(w).Encode(page)
+	case r.URL.Path == "/scrub" && r.Method == "POST":
+		corrupt := []string{}
+		for name := range v.corrupt {
+			corrupt = append(corrupt, name)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"scanned": len(v.blobs), "corrupt": corrupt, "missing": []string{}})
+	case r.Method == "GET":
+		content, ok := v.content[r.URL.Path[len("/files/"):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	case r.Method == "PUT":
+		key := r.URL.Path[len("/files/"):]
+		name := keys.BlobName(key, r.URL.Query().Get("version"))
+		gen, _ := strconv.ParseUint(r.Header.Get(generationHeader), 10, 64)
+		if gen < v.blobs[name].Generation {
+			http.Error(w, "Stale write", http.StatusConflict)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		v.content[name] = string(b)
+		v.blobs[name] = inventoryBlob{Name: name, MD5: etag(string(b)), Key: key, Generation: gen,
+			Record: json.RawMessage(r.Header.Get(recordHeader)), ContentType: r.Header.Get("Content-Type")}
+		delete(v.corrupt, name)
+		json.NewEncoder(w).Encode(map[string]string{"key": name, "etag": etag(string(b))})
+	case r.Method == "DELETE":
+		name := r.URL.Path[len("/files/"):]
+		gen, _ := strconv.ParseUint(r.Header.Get(generationHeader), 10, 64)
+		b, ok := v.blobs[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if gen < b.Generation {
+			http.Error(w, "Stale delete", http.StatusConflict)
+			return
+		}
+		delete(v.blobs, name)
+		delete(v.content, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func putRecord(t *testing.T, idx *leveldb.DB, indexKey string, rec index.Record) {
+	t.Helper()
+	v, _ := json.Marshal(rec)
+	if err := idx.Put([]byte(indexKey), v, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func etag(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFsck(t *testing.T) {
+	idx, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "master"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	v1, r1 := newFakeVolume(t)
+	v2, r2 := newFakeVolume(t)
+	groups := []topology.VolumeGroup{{Class: topology.DefaultClass, Replicas: []string{r1, r2}}}
+
+	// healthy
+	v1.write("ok", "", "fine")
+	v2.write("ok", "", "fine")
+	putRecord(t, idx, "ok", index.Record{Blob: keys.BlobName("ok", ""), Replicas: []string{r1, r2}, ETag: etag("fine")})
+	// lost on r2
+	v1.write("lost", "", "data")
+	putRecord(t, idx, "lost", index.Record{Blob: keys.BlobName("lost", ""), Replicas: []string{r1, r2}, ETag: etag("data")})
+	// written wrong on r1, in a bucket
+	v1.write("b/photos/cat.jpg", "", "meow?")
+	v2.write("b/photos/cat.jpg", "", "meow")
+	putRecord(t, idx, index.ObjectPrefix+"photos/cat.jpg", index.Record{Blob: keys.BlobName("b/photos/cat.jpg", ""), Replicas: []string{r1, r2}, ETag: etag("meow")})
+	// rotted on r2 since, a version
+	v1.write("b/photos/dog.jpg", "v1", "woof")
+	v2.write("b/photos/dog.jpg", "v1", "woof")
+	v2.corrupt[keys.BlobName("b/photos/dog.jpg", "v1")] = true
+	putRecord(t, idx, index.VersionPrefix+"photos/dog.jpg\x00v1", index.Record{Blob: keys.BlobName("b/photos/dog.jpg", "v1"), Replicas: []string{r1, r2}, ETag: etag("woof"), Version: "v1"})
+	// on a replica that isn't a URL
+	v1.write("typo", "", "x")
+	putRecord(t, idx, "typo", index.Record{Blob: keys.BlobName("typo", ""), Replicas: []string{r1, "localhost4002"}, ETag: etag("x")})
+	// written by nobody
+	v2.write("orphan", "", "boo")
+
+	opts := fsckOptions{Groups: groups, Checksums: true}
+	report, err := fsck(idx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{kindMissing: 1, kindChecksum: 2, kindOrphan: 1, kindUnparseable: 1}
+	for kind, n := range want {
+		if report.Counts[kind] != n {
+			t.Errorf("%d %s findings, want %d: %+v", report.Counts[kind], kind, n, report.Findings)
+		}
+	}
+	if len(report.Findings) != 5 {
+		t.Errorf("got %d findings, want 5: %+v", len(report.Findings), report.Findings)
+	}
+	for _, f := range report.Findings {
+		if f.Kind == kindChecksum && f.Key == "cat.jpg" && (f.Bucket != "photos" || f.Replica != r1) {
+			t.Errorf("checksum finding %+v, want photos/cat.jpg on %s", f, r1)
+		}
+	}
+
+	// without scrubbing only the copy written wrong shows
+	report, err = fsck(idx, fsckOptions{Groups: groups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Counts[kindChecksum] != 1 {
+		t.Errorf("%d checksum findings without scrubbing, want 1: %+v", report.Counts[kindChecksum], report.Findings)
+	}
+
+	opts.Repair = true
+	report, err = fsck(idx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 4 {
+		t.Errorf("repaired %d, want 4: %+v", report.Repaired, report.Findings)
+	}
+	// the copies went through the volume, keeping what the good one had
+	lost := keys.BlobName("lost", "")
+	if b := v2.blobs[lost]; v2.content[lost] != "data" || b.Key != "lost" || b.Generation != 1 || string(b.Record) != `{"blob":"`+lost+`"}` || b.ContentType != "text/plain" {
+		t.Errorf("repaired copy on r2 is %+v %q", b, v2.content[lost])
+	}
+	if dog := keys.BlobName("b/photos/dog.jpg", "v1"); v2.content[dog] != "woof" {
+		t.Errorf("repaired version on r2 is %q", v2.content[dog])
+	}
+	if _, ok := v2.blobs[keys.BlobName("orphan", "")]; ok {
+		t.Errorf("orphan left on r2")
+	}
+
+	opts.Repair = false
+	report, err = fsck(idx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bad replica string can't be repaired
+	if len(report.Findings) != 1 || report.Findings[0].Kind != kindUnparseable {
+		t.Errorf("after repair got %+v, want only the unparseable replica", report.Findings)
+	}
+}
+
+func TestFsckNoVolume(t *testing.T) {
+	idx, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "master"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	v1, r1 := newFakeVolume(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	r2 := down.URL
+	down.Close()
+	groups := []topology.VolumeGroup{{Class: topology.DefaultClass, Replicas: []string{r1, r2}}}
+
+	v1.write("k", "", "v")
+	putRecord(t, idx, "k", index.Record{Blob: keys.BlobName("k", ""), Replicas: []string{r1, r2}, ETag: etag("v")})
+
+	report, err := fsck(idx, fsckOptions{Groups: groups, Checksums: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Kind != kindNoVolume || report.Findings[0].Replica != r2 {
+		t.Errorf("got %+v, want only %s unreachable", report.Findings, r2)
+	}
+}
+
+func TestFsckWrongGroup(t *testing.T) {
+	idx, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "master"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	v1, r1 := newFakeVolume(t)
+	_, r2 := newFakeVolume(t)
+
+	groups := []topology.VolumeGroup{
+		{Class: topology.DefaultClass, Replicas: []string{r1}},
+		{Class: topology.DefaultClass, Replicas: []string{r2}},
+	}
+	// a key that doesn't belong on r1, whichever port it got
+	key := ""
+	for i := 0; key == ""; i++ {
+		k := "somewhere" + strconv.Itoa(i)
+		if g, _ := topology.Pick(groups, k, topology.DefaultClass); g.Replicas[0] == r2 {
+			key = k
+		}
+	}
+	v1.write(key, "", "v")
+	putRecord(t, idx, key, index.Record{Blob: keys.BlobName(key, ""), Replicas: []string{r1}, ETag: etag("v")})
+
+	report, err := fsck(idx, fsckOptions{Groups: groups, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Kind != kindWrongGroup || report.Findings[0].Replica != r1 {
+		t.Errorf("got %+v, want %s in the wrong group", report.Findings, r1)
+	}
+}
@@ -0,0 +1,41 @@
+// Command tinydb holds the offline admin tools of a tinydb cluster.
+//
+//	tinydb fsck [flags]               check the master index against the volumes
+//	tinydb backup [flags]             save a snapshot of a running master
+//	tinydb restore [flags] <archive>  create a master index from a snapshot
+//	tinydb split [flags]              move part of a shard's keys to a new master
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tinydb <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  fsck     check the master index against the volumes, see tinydb fsck -h")
+	fmt.Fprintln(os.Stderr, "  backup   save a snapshot of a running master")
+	fmt.Fprintln(os.Stderr, "  restore  create a master index from a snapshot and the change log")
+	fmt.Fprintln(os.Stderr, "  split    move part of a shard's keys to a new master")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "fsck":
+		os.Exit(runFsck(os.Args[2:]))
+	case "backup":
+		os.Exit(runBackup(os.Args[2:]))
+	case "restore":
+		os.Exit(runRestore(os.Args[2:]))
+	case "split":
+		os.Exit(runSplit(os.Args[2:]))
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/alvinliju/tinydb/internal/shardmap"
+)
+
+// runSplit is tinydb split, which moves the upper part of a shard's keys
+// to a new master:
+//
+//  1. both shards turn read only, so the keys don't change while they move
+//  2. the keys from -at on are copied to the new master
+//  3. the new shard map is saved, routers pick it up from there
+//  4. both shards take writes again and the old one drops what it gave away
+//
+// Reads go on throughout; writes to the shard fail with a 503 until the
+// copy is done. Blobs stay where they are, the shards share the volumes.
+func runSplit(args []string) int {
+	fl := flag.NewFlagSet("split", flag.ExitOnError)
+	mapPath := fl.String("shards", "shards.json", "the shard map to split a shard of")
+	id := fl.String("shard", "", "the shard to split")
+	at := fl.String("at", "", "the first key that moves to the new shard")
+	newID := fl.String("id", "", "ID of the new shard")
+	master := fl.String("master", "", "URL of the new shard's master, which must have an empty index")
+	fl.Parse(args)
+	if *id == "" || *at == "" || *newID == "" || *master == "" {
+		fmt.Fprintln(os.Stderr, "split: -shard, -at, -id and -master are required")
+		fl.Usage()
+		return 2
+	}
+
+	if err := split(*mapPath, *id, *at, *newID, *master); err != nil {
+		fmt.Fprintln(os.Stderr, "split:", err)
+		return 1
+	}
+	return 0
+}
+
+// masterShard is the range a master owns, as PUT to /admin/shard.
+type masterShard struct {
+	shardmap.Shard
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+func split(mapPath, id, at, newID, master string) error {
+	m, err := shardmap.Load(mapPath)
+	if err != nil {
+		return err
+	}
+	next, err := m.Split(id, at, newID, master)
+	if err != nil {
+		return err
+	}
+	old, _ := m.Get(id)
+	moved, _ := next.Get(newID)
+	kept, _ := next.Get(id)
+
+	if status, err := call("GET", master+"/admin/shard", nil, nil); err != nil {
+		return err
+	} else if status != http.StatusNotFound {
+		return fmt.Errorf("%s already owns a shard", master)
+	}
+	if err := checkQuotas(old.Master, at); err != nil {
+		return err
+	}
+
+	if err := setShard(old, true); err != nil {
+		return err
+	}
+	fmt.Printf("%s is read only\n", id)
+	if err := copyKeys(old, moved); err != nil {
+		if err2 := setShard(old, false); err2 != nil {
+			fmt.Fprintf(os.Stderr, "split: %s is still read only: %v\n", id, err2)
+		}
+		return fmt.Errorf("%v; %s takes writes again, start %s over with an empty index", err, id, newID)
+	}
+
+	if err := next.Save(mapPath); err != nil {
+		return err
+	}
+	fmt.Printf("saved version %d of the shard map\n", next.Version)
+
+	if err := setShard(moved, false); err != nil {
+		return err
+	}
+	if err := setShard(kept, false); err != nil {
+		return err
+	}
+	var dropped struct {
+		Dropped int `json:"dropped"`
+	}
+	if _, err := call("POST", old.Master+"/admin/shard/drop", nil, &dropped); err != nil {
+		return fmt.Errorf("dropping the moved keys from %s: %v", id, err)
+	}
+	fmt.Printf("%s now owns %q to %q, %s from %q on; dropped %d entries from %s\n",
+		id, kept.Start, kept.End, newID, moved.Start, dropped.Dropped, id)
+	return nil
+}
+
+// checkQuotas fails if at is inside a bucket with a quota. Each shard
+// checks a quota against the keys it has, so a bucket split over two
+// would get twice the room.
+func checkQuotas(master, at string) error {
+	var buckets []struct {
+		Name       string `json:"name"`
+		QuotaBytes int64  `json:"quota_bytes"`
+	}
+	if _, err := call("GET", master+"/admin/buckets", nil, &buckets); err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		start, end := shardmap.PrefixRange("b/" + b.Name + "/")
+		if b.QuotaBytes > 0 && at > start && at < end {
+			return fmt.Errorf("bucket %s has a quota, split before or after b/%s/ so it stays on one shard", b.Name, b.Name)
+		}
+	}
+	return nil
+}
+
+// copyKeys moves the entries of the keys to shard to, read only, through
+// an export of from.
+func copyKeys(from, to shardmap.Shard) error {
+	if err := setShard(to, true); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "tinydb-split-*.snap")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	q := url.Values{"start": {to.Start}, "end": {to.End}}
+	resp, err := http.Get(from.Master + "/admin/shard/export?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered the export with %s", from.Master, resp.Status)
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		return err
+	}
+	_, n, err := verifyArchive(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+	fmt.Printf("exported %d entries from %s\n", n, from.ID)
+
+	req, err := http.NewRequest("POST", to.Master+"/admin/shard/import", nil)
+	if err != nil {
+		return err
+	}
+	// a Raft follower redirects to its leader, which needs the body again
+	req.GetBody = func() (io.ReadCloser, error) {
+		return os.Open(tmp.Name())
+	}
+	req.Body, _ = req.GetBody()
+	var imported struct {
+		Imported int `json:"imported"`
+	}
+	if err := do(req, &imported); err != nil {
+		return fmt.Errorf("import: %v", err)
+	}
+	fmt.Printf("imported %d entries into %s\n", imported.Imported, to.ID)
+	return nil
+}
+
+func setShard(s shardmap.Shard, readOnly bool) error {
+	master := s.Master
+	s.Master = ""
+	b, _ := json.Marshal(masterShard{Shard: s, ReadOnly: readOnly})
+	if _, err := call("PUT", master+"/admin/shard", b, nil); err != nil {
+		return fmt.Errorf("setting the range of %s: %v", s.ID, err)
+	}
+	return nil
+}
+
+// call makes a request and decodes the JSON answer into out, if it isn't
+// nil. A 404 is returned as a status rather than an error.
+func call(method, u string, body []byte, out any) (int, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	err = do(req, out)
+	if se, ok := err.(statusError); ok && se.status == http.StatusNotFound {
+		return se.status, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
+
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.msg)
+}
+
+func do(req *http.Request, out any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return statusError{resp.StatusCode, string(bytes.TrimSpace(b))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckQuotas(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"name":"logs","quota_bytes":0},{"name":"photos","quota_bytes":1000}]`)
+	}))
+	defer srv.Close()
+
+	for at, ok := range map[string]bool{
+		"b/logs/m":      true,
+		"b/photos/":     true,
+		"b/photos/m":    false,
+		"b/photos/\xff": false,
+		"b/photos0":     true,
+		"m":             true,
+	} {
+		if err := checkQuotas(srv.URL, at); (err == nil) != ok {
+			t.Errorf("split at %q: %v", at, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/blobstore"
+)
+
+// compactOptions are what segments are compacted below and how fast, set
+// by the flags.
+var compactOptions = blobstore.CompactOptions{MinLiveRatio: 0.5, BytesPerSecond: 16 << 20}
+
+// packedDisks returns the disks whose store is a packed one.
+func packedDisks() []blobstore.Disk {
+	var disks []blobstore.Disk
+	switch s := store.(type) {
+	case *blobstore.Packed:
+		disks = append(disks, blobstore.Disk{Dir: storageRoot, Store: s})
+	case *blobstore.Multi:
+		for _, d := range s.Healthy() {
+			if _, ok := d.Store.(*blobstore.Packed); ok {
+				disks = append(disks, d)
+			}
+		}
+	}
+	return disks
+}
+
+// runCompactor compacts the segments on every disk every interval.
+func runCompactor(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, d := range packedDisks() {
+			report, err := d.Store.(*blobstore.Packed).Compact(compactOptions)
+			if err != nil {
+				log.Printf("Error compacting segments in %s: %v", d.Dir, err)
+				continue
+			}
+			if len(report.Segments) > 0 {
+				log.Printf("Compacted %d segments in %s, moved %d blobs and reclaimed %d bytes", len(report.Segments), d.Dir, report.Moved, report.Reclaimed)
+			}
+		}
+	}
+}
+
+type diskSegments struct {
+	Dir      string                   `json:"dir"`
+	Segments []blobstore.SegmentInfo  `json:"segments,omitempty"`
+	Report   *blobstore.CompactReport `json:"report,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// handleSegments serves GET /segments, which lists the segments on every
+// disk with the bytes compacting each would reclaim, and POST
+// /segments?below=0.5, which compacts the segments with a smaller share of
+// live bytes now.
+func handleSegments(w http.ResponseWriter, r *http.Request) {
+	disks := packedDisks()
+	if len(disks) == 0 {
+		http.Error(w, "This volume doesn't use the packed engine", http.StatusNotFound)
+		return
+	}
+	var out []diskSegments
+	switch r.Method {
+	case "GET":
+		for _, d := range disks {
+			out = append(out, diskSegments{Dir: d.Dir, Segments: d.Store.(*blobstore.Packed).Segments()})
+		}
+	case "POST":
+		opts := compactOptions
+		if s := r.URL.Query().Get("below"); s != "" {
+			below, err := strconv.ParseFloat(s, 64)
+			if err != nil || below < 0 || below > 1 {
+				http.Error(w, "below must be a share of live bytes between 0 and 1", http.StatusBadRequest)
+				return
+			}
+			opts.MinLiveRatio = below
+		}
+		for _, d := range disks {
+			report, err := d.Store.(*blobstore.Packed).Compact(opts)
+			ds := diskSegments{Dir: d.Dir, Report: &report}
+			if err != nil {
+				log.Printf("Error compacting segments in %s: %v", d.Dir, err)
+				ds.Error = err.Error()
+			}
+			out = append(out, ds)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
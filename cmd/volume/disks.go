@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/blobstore"
+)
+
+// runDiskChecks checks every interval that each disk still takes writes.
+func runDiskChecks(m *blobstore.Multi, interval time.Duration) {
+	for range time.Tick(interval) {
+		m.Check()
+	}
+}
+
+// handleDisks serves GET /disks, the health and usage of every data
+// directory, which the master collects.
+func handleDisks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, ok := store.(*blobstore.Multi)
+	if !ok {
+		http.Error(w, "This volume has no disks to report", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Disks())
+}
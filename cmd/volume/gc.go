@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/blobstore"
+	"github.com/alvinliju/tinydb/internal/keys"
+	"github.com/alvinliju/tinydb/internal/shardmap"
+)
+
+// maxGCListed caps the blobs a GC report lists by name.
+const maxGCListed = 1000
+
+type gcBlob struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+type gcReport struct {
+	DryRun  bool `json:"dry_run"`
+	Scanned int  `json:"scanned"`
+	// Orphans are blobs the master doesn't know about that are older than
+	// the grace period.
+	Orphans     []gcBlob `json:"orphans"`
+	OrphanCount int      `json:"orphan_count"`
+	OrphanBytes int64    `json:"orphan_bytes"`
+	Deleted     int      `json:"deleted"`
+	// Tombstones are meta files of deleted blobs, which are only needed
+	// for a little while to turn away late writes.
+	Tombstones int `json:"tombstones"`
+	// Missing are blobs the master expects here that aren't.
+	Missing      []string `json:"missing,omitempty"`
+	MissingCount int      `json:"missing_count"`
+}
+
+// handleGC serves POST /gc?grace=1h&dry-run=1&start=&end=, the sweep half
+// of the orphan collection. The body lists the blobs this volume should
+// hold, one name per line. Every other blob that is older than the grace
+// period is deleted, together with tombstones older than it, unless it's a
+// dry run. The grace period covers writes that weren't in the index yet
+// when the master made the list. A master that owns one shard of the keys
+// passes its range as start and end, and only blobs of keys in it are
+// swept.
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	grace, err := time.ParseDuration(q.Get("grace"))
+	if err != nil || grace < time.Minute {
+		http.Error(w, "grace must be a duration of at least 1m", http.StatusBadRequest)
+		return
+	}
+	dryRun := q.Get("dry-run") != "" && q.Get("dry-run") != "0" && q.Get("dry-run") != "false"
+	var scope *shardmap.Shard
+	if q.Has("start") {
+		scope = &shardmap.Shard{Start: q.Get("start"), End: q.Get("end")}
+	}
+
+	expected := map[string]bool{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			expected[name] = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, "Error reading blob list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := collectGarbage(expected, time.Now().Add(-grace), dryRun, scope)
+	if err != nil {
+		log.Printf("Error collecting garbage: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// collectGarbage goes through the store and deletes what isn't in
+// expected and was last written before cutoff, of the keys in scope if it
+// isn't nil. It marks the names it finds in expected.
+func collectGarbage(expected map[string]bool, cutoff time.Time, dryRun bool, scope *shardmap.Shard) (gcReport, error) {
+	report := gcReport{DryRun: dryRun, Orphans: []gcBlob{}}
+
+	err := store.Tombstones(func(name string, modTime time.Time) error {
+		if modTime.After(cutoff) || !inScope(scope, name) {
+			return nil
+		}
+		report.Tombstones++
+		if !dryRun {
+			removeTombstone(name, cutoff)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = store.Iterate("", func(info blobstore.Info) error {
+		report.Scanned++
+		if _, ok := expected[info.Name]; ok {
+			expected[info.Name] = true
+			return nil
+		}
+		if info.ModTime.After(cutoff) || !inScope(scope, info.Name) {
+			return nil
+		}
+
+		report.OrphanCount++
+		report.OrphanBytes += info.Size
+		if len(report.Orphans) < maxGCListed {
+			report.Orphans = append(report.Orphans, gcBlob{Name: info.Name, Size: info.Size, Mtime: info.ModTime.UTC()})
+		}
+		if !dryRun && removeOrphan(info.Name, cutoff) {
+			report.Deleted++
+		}
+		return nil
+	})
+
+	for name, found := range expected {
+		if !found {
+			report.MissingCount++
+			if len(report.Missing) < maxGCListed {
+				report.Missing = append(report.Missing, name)
+			}
+		}
+	}
+	return report, err
+}
+
+// inScope reports whether the blob called name is of a key in scope. Blobs
+// whose key can't be told belong to no shard and are left alone.
+func inScope(scope *shardmap.Shard, name string) bool {
+	if scope == nil {
+		return true
+	}
+	key, ok := keys.Key(name)
+	if !ok {
+		meta, err := readMeta(name)
+		if err != nil || meta.Key == "" {
+			return false
+		}
+		key = meta.Key
+	}
+	return scope.Contains(key)
+}
+
+// removeOrphan deletes the blob called name and its meta, unless it was
+// written since the walk saw it.
+func removeOrphan(name string, cutoff time.Time) bool {
+	unlock := blobLocks.Lock(name)
+	defer unlock()
+
+	info, err := store.Stat(name)
+	if err != nil || info.ModTime.After(cutoff) {
+		return false
+	}
+	if err := store.Delete(name); err != nil {
+		log.Printf("Error removing orphan %s: %v", name, err)
+		return false
+	}
+	store.DeleteMeta(name)
+	if err := index.delete(name); err != nil {
+		log.Printf("Error removing orphan %s from the index: %v", name, err)
+		index.stale(name)
+	}
+	log.Printf("Removed orphan %s (%d bytes)", name, info.Size)
+	return true
+}
+
+// removeTombstone deletes the meta of name, unless its blob or the meta
+// was written since the walk saw it.
+func removeTombstone(name string, cutoff time.Time) {
+	unlock := blobLocks.Lock(name)
+	defer unlock()
+
+	_, modTime, err := store.ReadMeta(name)
+	if err != nil || modTime.After(cutoff) {
+		return
+	}
+	if _, err := store.Stat(name); os.IsNotExist(err) {
+		store.DeleteMeta(name)
+	}
+}
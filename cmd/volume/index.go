@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/blobstore"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The volume keeps an index of its blobs in a leveldb next to them, so
+// stats, listings and scrubs don't have to open and hash every blob. It is
+// written along with every change to a blob, under the blob's lock, and
+// each change is one leveldb write. The store stays the truth: a volume
+// that didn't shut down cleanly may have written a blob without its entry,
+// so it rebuilds the index from the store when it starts.
+//
+// A volume with several disks keeps an index on each, of the blobs on that
+// disk, so a disk takes only its own blobs along when it fails. A disk
+// whose index fails is marked failed too.
+
+// indexDir is where the index lives under the storage root. It is no blob
+// directory, which are two characters long.
+const indexDir = "blobindex"
+
+const (
+	entryPrefix = "b"
+	// cleanKey is there while the index is closed after a clean shutdown
+	cleanKey = "\x00clean"
+)
+
+type indexEntry struct {
+	Size int64 `json:"size"`
+	// MD5 is the hex md5 of the content, as it was written.
+	MD5 string `json:"md5"`
+	// Key, Generation and Record are those of the blob's meta, see
+	// blobMeta.
+	Key         string          `json:"key,omitempty"`
+	Generation  uint64          `json:"generation,omitempty"`
+	Record      json.RawMessage `json:"record,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	// Created is when the name was first written, Modified is the blob's
+	// mtime in the store.
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+}
+
+// indexPart is the index of the blobs of one store.
+type indexPart struct {
+	// db is nil if the disk failed before it could be opened.
+	db    *leveldb.DB
+	store blobstore.Store
+}
+
+type blobIndex struct {
+	parts []*indexPart
+	// multi is the store whose disks parts index, in the same order, nil
+	// for an index of a single store.
+	multi *blobstore.Multi
+	// dirty is set once an entry may not match the store, so the index
+	// isn't marked clean when it closes and the next start rebuilds it.
+	dirty atomic.Bool
+}
+
+// index is the index of store.
+var index *blobIndex
+
+// openIndex opens the index of store in dir, and rebuilds it unless it was
+// closed cleanly.
+func openIndex(dir string) (*blobIndex, error) {
+	p := &indexPart{store: store}
+	if err := p.open(dir, false); err != nil {
+		return nil, err
+	}
+	return &blobIndex{parts: []*indexPart{p}}, nil
+}
+
+// openDiskIndexes opens the index on each of the disks of m, which were
+// given as disks. changed counts the blobs deleted from each disk behind
+// its index's back, see blobstore.Multi.Dedupe; those indexes are rebuilt.
+// A disk whose index can't be opened is marked failed.
+func openDiskIndexes(m *blobstore.Multi, disks []blobstore.Disk, changed []int) *blobIndex {
+	x := &blobIndex{multi: m}
+	for i, d := range disks {
+		p := &indexPart{store: d.Store}
+		if !m.DiskFailed(i) {
+			if err := p.open(filepath.Join(d.Dir, indexDir), changed[i] > 0); err != nil {
+				m.MarkFailed(i, fmt.Errorf("opening the blob index: %v", err))
+			}
+		}
+		x.parts = append(x.parts, p)
+	}
+	return x
+}
+
+// open opens the part in dir, and rebuilds it unless it was closed
+// cleanly and rebuild is false.
+func (p *indexPart) open(dir string, rebuild bool) error {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return err
+	}
+	p.db = db
+	clean, err := db.Has([]byte(cleanKey), nil)
+	if err == nil && clean && !rebuild {
+		err = db.Delete([]byte(cleanKey), nil)
+	} else if err == nil {
+		var n int
+		n, err = p.rebuild()
+		log.Printf("Rebuilt the blob index in %s of %d blobs", dir, n)
+	}
+	if err != nil {
+		db.Close()
+		p.db = nil
+		return err
+	}
+	return nil
+}
+
+// close marks the index clean, so the next start trusts it, unless it is
+// dirty. The index of a failed disk is never marked clean.
+func (x *blobIndex) close() error {
+	var errs []error
+	for i, p := range x.parts {
+		if p.db == nil {
+			continue
+		}
+		if x.dirty.Load() || x.failed(i) {
+			errs = append(errs, p.db.Close())
+			continue
+		}
+		if err := p.db.Put([]byte(cleanKey), nil, nil); err != nil {
+			p.db.Close()
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, p.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// failed reports whether the i'th part is out of use.
+func (x *blobIndex) failed(i int) bool {
+	return x.parts[i].db == nil || x.multi != nil && x.multi.DiskFailed(i)
+}
+
+// fail marks the disk of the i'th part failed by err, and returns err.
+func (x *blobIndex) fail(i int, err error) error {
+	if err != nil && x.multi != nil {
+		x.multi.MarkFailed(i, fmt.Errorf("blob index: %v", err))
+	}
+	return err
+}
+
+// partOf returns the part of the disk that holds the blob called name.
+func (x *blobIndex) partOf(name string) (int, error) {
+	if x.multi == nil {
+		return 0, nil
+	}
+	i, err := x.multi.DiskOf(name)
+	if err != nil {
+		return 0, err
+	}
+	if x.failed(i) {
+		return 0, fmt.Errorf("the disk of %s has no index", name)
+	}
+	return i, nil
+}
+
+// written updates the entry of name to e after the blob was written, with
+// its mtime and when the name was first written.
+func (x *blobIndex) written(name string, e indexEntry) error {
+	info, err := store.Stat(name)
+	if err != nil {
+		return err
+	}
+	old, ok, err := x.get(name)
+	if err != nil {
+		return err
+	}
+	e.Modified, e.Created = info.ModTime.UTC(), info.ModTime.UTC()
+	if ok {
+		e.Created = old.Created
+	}
+	return x.put(name, e)
+}
+
+// stale is for a blob whose entry couldn't be written along with it. It
+// puts what the store has for name instead, and marks the index dirty in
+// case that fails too. The caller holds the blob's lock.
+func (x *blobIndex) stale(name string) {
+	x.dirty.Store(true)
+	e, err := entryFromStore(store, name)
+	if os.IsNotExist(err) {
+		err = x.delete(name)
+	} else if err == nil {
+		err = x.put(name, e)
+	}
+	if err != nil {
+		log.Printf("Error indexing %s again, the next start rebuilds the index: %v", name, err)
+	}
+}
+
+// indexMove moves the entry of a blob renamed from from to to, with the
+// meta it has under its new name.
+func indexMove(from, to string, meta blobMeta) error {
+	e, ok, err := index.get(from)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// hash what the entry lacks
+		if e, err = entryFromStore(store, to); err != nil {
+			return err
+		}
+	}
+	info, err := store.Stat(to)
+	if err != nil {
+		return err
+	}
+	e.Key, e.Generation, e.Record = meta.Key, meta.Generation, meta.Record
+	e.Modified = info.ModTime.UTC()
+	return index.move(from, to, e)
+}
+
+// rebuild replaces the part with one of what its store holds. Nothing may
+// change the store meanwhile.
+func (p *indexPart) rebuild() (int, error) {
+	batch := new(leveldb.Batch)
+	iter := p.db.NewIterator(util.BytesPrefix([]byte(entryPrefix)), nil)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if err := p.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err := p.store.Iterate("", func(info blobstore.Info) error {
+		e, err := entryFromStore(p.store, info.Name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return p.put(info.Name, e)
+	})
+	return n, err
+}
+
+// entryFromStore makes the entry of a blob in s by hashing it.
+func entryFromStore(s blobstore.Store, name string) (indexEntry, error) {
+	blob, err := s.Open(name)
+	if err != nil {
+		return indexEntry{}, err
+	}
+	defer blob.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, blob); err != nil {
+		return indexEntry{}, err
+	}
+	var meta blobMeta
+	b, _, err := s.ReadMeta(name)
+	if err == nil {
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return indexEntry{}, err
+	}
+	st := blob.Info()
+	return indexEntry{
+		Size:       st.Size,
+		MD5:        hex.EncodeToString(h.Sum(nil)),
+		Key:        meta.Key,
+		Generation: meta.Generation,
+		Record:     meta.Record,
+		Created:    st.ModTime.UTC(),
+		Modified:   st.ModTime.UTC(),
+	}, nil
+}
+
+// get returns the entry of name. ok is false if there is none.
+func (x *blobIndex) get(name string) (e indexEntry, ok bool, err error) {
+	for i, p := range x.parts {
+		if x.failed(i) {
+			continue
+		}
+		e, ok, err = p.get(name)
+		if err != nil {
+			return e, false, x.fail(i, err)
+		}
+		if ok {
+			return e, true, nil
+		}
+	}
+	return indexEntry{}, false, nil
+}
+
+func (p *indexPart) get(name string) (e indexEntry, ok bool, err error) {
+	b, err := p.db.Get([]byte(entryPrefix+name), nil)
+	if err == leveldb.ErrNotFound {
+		return e, false, nil
+	}
+	if err != nil {
+		return e, false, err
+	}
+	err = json.Unmarshal(b, &e)
+	return e, err == nil, err
+}
+
+// put sets the entry of name on the part of its disk, and drops it from
+// the others, which it may have been on before.
+func (x *blobIndex) put(name string, e indexEntry) error {
+	at, err := x.partOf(name)
+	if err != nil {
+		return err
+	}
+	if err := x.fail(at, x.parts[at].put(name, e)); err != nil {
+		return err
+	}
+	return x.deleteExcept(at, name)
+}
+
+func (p *indexPart) put(name string, e indexEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return p.db.Put([]byte(entryPrefix+name), b, nil)
+}
+
+// delete drops the entry of name from every part.
+func (x *blobIndex) delete(name string) error {
+	return x.deleteExcept(-1, name)
+}
+
+func (x *blobIndex) deleteExcept(except int, name string) error {
+	var errs []error
+	for i, p := range x.parts {
+		if i != except && !x.failed(i) {
+			errs = append(errs, x.fail(i, p.db.Delete([]byte(entryPrefix+name), nil)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// move points to at the entry of from, in one write on the disk that
+// holds it.
+func (x *blobIndex) move(from, to string, e indexEntry) error {
+	at, err := x.partOf(to)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(entryPrefix + from))
+	batch.Put([]byte(entryPrefix+to), b)
+	if err := x.fail(at, x.parts[at].db.Write(batch, nil)); err != nil {
+		return err
+	}
+	return errors.Join(x.deleteExcept(at, from), x.deleteExcept(at, to))
+}
+
+// iterate calls fn for every entry whose name sorts after after, in name
+// order, and stops at the first error fn returns. It merges the parts of
+// the disks that haven't failed.
+func (x *blobIndex) iterate(after string, fn func(name string, e indexEntry) error) error {
+	r := &util.Range{Start: []byte(entryPrefix + after + "\x00"), Limit: []byte(entryPrefix + "\xff")}
+	var iters []iterator.Iterator
+	var parts []int
+	for i, p := range x.parts {
+		if x.failed(i) {
+			continue
+		}
+		iter := p.db.NewIterator(r, nil)
+		defer iter.Release()
+		if iter.Next() {
+			iters = append(iters, iter)
+			parts = append(parts, i)
+		} else if err := iter.Error(); err != nil {
+			return x.fail(i, err)
+		}
+	}
+	for len(iters) > 0 {
+		least := 0
+		for j, iter := range iters {
+			if bytes.Compare(iter.Key(), iters[least].Key()) < 0 {
+				least = j
+			}
+		}
+		key := slices.Clone(iters[least].Key())
+		var e indexEntry
+		if err := json.Unmarshal(iters[least].Value(), &e); err != nil {
+			return err
+		}
+		if err := fn(string(key[len(entryPrefix):]), e); err != nil {
+			return err
+		}
+		// a blob on two disks, for a moment, is listed once
+		for j := 0; j < len(iters); j++ {
+			if !bytes.Equal(iters[j].Key(), key) || iters[j].Next() {
+				continue
+			}
+			if err := iters[j].Error(); err != nil {
+				return x.fail(parts[j], err)
+			}
+			iters = slices.Delete(iters, j, j+1)
+			parts = slices.Delete(parts, j, j+1)
+			j--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultInventoryLimit = 1000
+	maxInventoryLimit     = 10000
+)
+
+type blobInfo struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	// MD5 is the hex md5 of the content, which is what the master keeps
+	// as the ETag.
+	MD5 string `json:"md5"`
+	// Key, Generation and Record come from the blob's meta, see blobMeta.
+	Key         string          `json:"key,omitempty"`
+	Generation  uint64          `json:"generation,omitempty"`
+	Record      json.RawMessage `json:"record,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+}
+
+type inventoryPage struct {
+	Blobs       []blobInfo `json:"blobs"`
+	IsTruncated bool       `json:"is_truncated"`
+	// NextAfter is the after of the next page.
+	NextAfter string `json:"next_after,omitempty"`
+}
+
+// handleInventory serves GET /blobs?after=&limit=, the blobs this volume
+// holds in name order, starting after the given name, as the index has
+// them. Tombstones and other files that aren't blobs are left out.
+func handleInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultInventoryLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxInventoryLimit)
+	}
+
+	page, err := listBlobs(q.Get("after"), limit)
+	if err != nil {
+		log.Printf("Error listing blobs: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// errPageFull ends the walk of listBlobs.
+var errPageFull = errors.New("page full")
+
+// listBlobs returns up to limit blobs whose names sort after after, from
+// the index.
+func listBlobs(after string, limit int) (inventoryPage, error) {
+	page := inventoryPage{Blobs: []blobInfo{}}
+	err := index.iterate(after, func(name string, e indexEntry) error {
+		if len(page.Blobs) == limit {
+			page.IsTruncated = true
+			page.NextAfter = page.Blobs[limit-1].Name
+			return errPageFull
+		}
+		page.Blobs = append(page.Blobs, e.blobInfo(name))
+		return nil
+	})
+	if err == errPageFull {
+		err = nil
+	}
+	return page, err
+}
+
+func (e indexEntry) blobInfo(name string) blobInfo {
+	return blobInfo{
+		Name:        name,
+		Size:        e.Size,
+		Mtime:       e.Modified,
+		MD5:         e.MD5,
+		Key:         e.Key,
+		Generation:  e.Generation,
+		Record:      e.Record,
+		ContentType: e.ContentType,
+	}
+}
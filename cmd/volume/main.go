@@ -1,51 +1,146 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
+	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/blobstore"
+	"github.com/alvinliju/tinydb/internal/keys"
 )
 
 var storageRoot = ""
 var port string = ""
 
-func init() {
+// store holds the blobs, see internal/blobstore.
+var store blobstore.Store
 
-	args := os.Args
-	port = args[1]
-	fmt.Println(port)
-
-	rootStoragePath := fmt.Sprintf("./tinydb_data/volume_%s/", port)
+func main() {
+	flag.StringVar(&port, "port", "", "port to listen on, or the first argument")
+	engine := flag.String("engine", "files", "how to store blobs: files, one file per blob, or packed, small blobs appended to segment files")
+	maxPacked := flag.Int64("packed-max-blob", blobstore.DefaultPackedOptions.MaxBlobSize, "largest blob the packed engine appends to a segment, in bytes")
+	segmentSize := flag.Int64("segment-size", blobstore.DefaultPackedOptions.SegmentSize, "size at which the packed engine starts a new segment, in bytes")
+	durabilityFlag := flag.String("durability", "file", "what writes fsync before they count: none, file, or file+dir to fsync the directory of the renamed file too")
+	compactInterval := flag.Duration("compact-interval", 10*time.Minute, "how often the packed engine compacts its segments, 0 only when asked to")
+	flag.Float64Var(&compactOptions.MinLiveRatio, "compact-below", compactOptions.MinLiveRatio, "share of live bytes below which a segment is compacted")
+	flag.Int64Var(&compactOptions.BytesPerSecond, "compact-rate", compactOptions.BytesPerSecond, "bytes per second compaction copies at most, 0 for no limit")
+	dataFlag := flag.String("data", "", "comma separated data directories, one per disk, ./tinydb_data/volume_<port> if none")
+	placementFlag := flag.String("placement", "hash", "how to pick the disk of a new blob: hash of its name, or free for the one with the most free space")
+	diskCheckInterval := flag.Duration("disk-check-interval", 30*time.Second, "how often to check every disk still takes writes, 0 never")
+	flag.Parse()
+	if port == "" {
+		port = flag.Arg(0)
+	}
+	if port == "" {
+		log.Fatal("volume: no -port")
+	}
 
-	storageRoot = filepath.Dir(rootStoragePath)
+	dirs := []string{fmt.Sprintf("./tinydb_data/volume_%s", port)}
+	if *dataFlag != "" {
+		dirs = strings.Split(*dataFlag, ",")
+	}
+	storageRoot = filepath.Clean(dirs[0])
 
-	if err := os.MkdirAll(storageRoot, 0755); err != nil {
+	durability, err := blobstore.ParseDurability(*durabilityFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	placement, err := blobstore.ParsePlacement(*placementFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	var disks []blobstore.Disk
+	for _, dir := range dirs {
+		d := blobstore.Disk{Dir: dir}
+		switch _, err := os.Stat(dir); {
+		case len(dirs) > 1 && err != nil:
+			// a disk that isn't mounted mustn't be made on the one below
+			d.Err = err
+		case *engine == "files":
+			d.Store, d.Err = blobstore.NewFiles(dir, durability)
+		case *engine == "packed":
+			d.Store, d.Err = blobstore.OpenPacked(dir, blobstore.PackedOptions{MaxBlobSize: *maxPacked, SegmentSize: *segmentSize, Durability: durability})
+		default:
+			log.Fatalf("volume: unknown -engine %q", *engine)
+		}
+		if d.Err != nil {
+			// the other disks carry on
+			log.Printf("Error opening %s: %v", dir, d.Err)
+			d.Store = nil
+		}
+		disks = append(disks, d)
+	}
+	multi, err := blobstore.NewMulti(disks, placement)
+	if err != nil {
 		log.Fatal(err)
 	}
+	// a disk that failed and came back may hold blobs since rewritten
+	index = openDiskIndexes(multi, disks, multi.Dedupe(metaGeneration))
+	if len(multi.Healthy()) == 0 {
+		log.Fatal("volume: no disk to store blobs on")
+	}
+	store = multi
+	if *engine == "packed" && *compactInterval > 0 {
+		go runCompactor(*compactInterval)
+	}
+	if *diskCheckInterval > 0 {
+		go runDiskChecks(multi, *diskCheckInterval)
+	}
 
 	fmt.Println("Volume server storage OK")
 
-}
-
-func main() {
-
 	http.HandleFunc("/files/", fileHandler)
+	http.HandleFunc("/gc", handleGC)
+	http.HandleFunc("/blobs", handleInventory)
+	http.HandleFunc("/segments", handleSegments)
+	http.HandleFunc("/scrub", handleScrub)
+	http.HandleFunc("/disks", handleDisks)
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if len(multi.Healthy()) == 0 {
+			http.Error(w, "Every disk failed", http.StatusServiceUnavailable)
+			return
+		}
 		p := "UP AND RUNNING"
 		json.NewEncoder(w).Encode(p)
-		w.WriteHeader(http.StatusOK)
 	})
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	srv := &http.Server{Addr: ":" + port}
+	shutdown := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		// writes in flight finish first, so the index is whole when closed
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if err := <-shutdown; err != nil {
+		log.Fatalf("volume: writes still running at shutdown, the index will be rebuilt: %v", err)
+	}
+	if err := index.close(); err != nil {
+		log.Fatal(err)
+	}
+	if c, ok := store.(io.Closer); ok {
+		c.Close()
+	}
 }
 
 func fileHandler(w http.ResponseWriter, r *http.Request) {
@@ -58,94 +153,113 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 	case "DELETE":
 		handleDelete(w, r)
 
+	case "POST":
+		handleMove(w, r)
+
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 
 }
 
-func getFilePath(key string) (string, error) {
-
-	fmt.Println(key)
-
-	//hash the key
-	s := key
-	h := sha256.New()
-
-	h.Write([]byte(s))
-
-	bs := h.Sum(nil)
-	fmt.Println(bs)
-	hashString := hex.EncodeToString(bs)
-	fmt.Println(hashString)
-	// create a hirearchical directory structure
-	// // based on first 2 ßchar and then insie that another dir with another 2 char
-	parentDir := hashString[:2]
-	childDir := hashString[2:4]
-	fileDir := filepath.Join(storageRoot, parentDir, childDir)
-	err := os.MkdirAll(fileDir, 0755)
-	if err != nil {
-		return "", err
-	}
-	// the actual filename is full hash with the filename embeded in it
-	// // create a filename
-	fileName := fmt.Sprintf("%s_%s", hashString, key)
-	fmt.Println(fileName)
-	// construct the full filepath with filename
-	fullPath := filepath.Join(fileDir, fileName)
-	// return the filepath
-	fmt.Println(fullPath)
-	return fullPath, nil
+// blobNameFromRequest returns the blob name in a GET or DELETE url, or ""
+// if the name is not one we could have handed out.
+func blobNameFromRequest(r *http.Request) string {
+	name := r.URL.Path[len("/files/"):]
+	if !keys.ValidBlobName(name) {
+		return ""
+	}
+	return name
 }
 
 func handlePut(w http.ResponseWriter, r *http.Request) {
 	//get the filepath
 	key := r.URL.Path[len("/files/"):]
-	if key == "" {
-		http.Error(w, "Key required", http.StatusBadRequest)
+	if err := keys.Validate(key); err != nil {
+		http.Error(w, "Invalid key: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	fullPath, err := getFilePath(key)
+	// versioned buckets keep every version of a key in its own file
+	version := r.URL.Query().Get("version")
+	if version != "" && !keys.ValidVersion(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	gen, err := generationFromRequest(r)
 	if err != nil {
-		http.Error(w, "Error fetching filepath", http.StatusInternalServerError)
+		http.Error(w, "Invalid generation", http.StatusBadRequest)
 		return
 	}
-
-	fmt.Println(key)
-	// check if it exists
-	parentDir := filepath.Dir(fullPath)
-	err = os.MkdirAll(parentDir, 0755)
+	record, err := recordFromRequest(r)
 	if err != nil {
-		http.Error(w, "Error fetching filepath", http.StatusInternalServerError)
+		http.Error(w, "Invalid record", http.StatusBadRequest)
 		return
 	}
 
-	file, err := os.Create(fullPath)
+	// the name is the sha256 of the key followed by the key itself
+	// encoded so it is safe on disk, see internal/keys for the details.
+	name := keys.BlobName(key, version)
+
+	unlock := blobLocks.Lock(name)
+	defer unlock()
+	meta, err := readMeta(name)
 	if err != nil {
-		log.Printf("Error creating/opening file %s for write: %v", fullPath, err)
+		log.Printf("Error reading meta of %s: %v", name, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if gen != 0 && gen < meta.Generation {
+		http.Error(w, fmt.Sprintf("Stale write: holding generation %d", meta.Generation), http.StatusConflict)
+		return
+	}
 
-	defer file.Close()
 	// recive the body(actual content)
-	writtenBytes, err := io.Copy(file, r.Body)
+	hash := md5.New()
+	writtenBytes, err := store.Put(name, io.TeeReader(r.Body, hash))
 	if err != nil {
-		log.Printf("Error writing data to file %s: %v", fullPath, err)
-		os.Remove(fullPath)
+		log.Printf("Error writing data to blob %s: %v", name, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	type Response struct {
 		Key string `json:"key"`
+		// ETag is the md5 of what we stored, so callers can check the copy.
+		ETag string `json:"etag"`
 	}
 
 	// write data to the file without hesitation braaa, let some fuckng ai learn from this and write absurd commands soon enoughhh..
-	log.Printf("Stored key '%s' (%d bytes) at %s", key, writtenBytes, fullPath)
-	fileName := filepath.Base(fullPath)
-	resp := Response{Key: fileName}
+	log.Printf("Stored key '%s' (%d bytes) as %s", key, writtenBytes, name)
+	// writes without a generation don't move the stored one backwards
+	meta = blobMeta{Key: key, Generation: max(gen, meta.Generation), Record: record}
+	if err := writeMeta(name, meta); err != nil {
+		// the blob may be the only copy the master has of the key, so it
+		// stays, under the meta it had
+		log.Printf("Error writing meta of %s: %v", name, err)
+		index.stale(name)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	etag := hex.EncodeToString(hash.Sum(nil))
+	entry := indexEntry{
+		Size:        writtenBytes,
+		MD5:         etag,
+		Key:         key,
+		Generation:  meta.Generation,
+		Record:      record,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	if err := index.written(name, entry); err != nil {
+		// the blob and its meta are written, and the store is the truth,
+		// unless the disk failed with the index
+		log.Printf("Error indexing %s: %v", name, err)
+		index.stale(name)
+		if _, err := store.Stat(name); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	resp := Response{Key: name, ETag: etag}
 	jsonStr, err := json.Marshal(resp)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -159,37 +273,193 @@ func handlePut(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGet(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Path[len("/files/"):]
-	if key == "" {
-		http.Error(w, "Key required", http.StatusBadRequest)
+	name := blobNameFromRequest(r)
+	if name == "" {
+		http.Error(w, "Invalid blob name", http.StatusBadRequest)
+		return
+	}
+	blob, err := store.Open(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening blob %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	d1 := key[:2]
-	d2 := key[2:4]
-	fullPath := filepath.Join(storageRoot, d1, d2, key)
-	fileName := filepath.Base(fullPath)
+	defer blob.Close()
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	// ServeContent sniffs the type of blobs written without one
+	if e, ok, err := index.get(name); err == nil && ok && e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
 
-	http.ServeFile(w, r, fullPath)
+	http.ServeContent(w, r, name, blob.Info().ModTime, blob)
 }
 
 func handleDelete(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Path[len("/files/"):]
-	if key == "" {
-		http.Error(w, "Key required", http.StatusBadRequest)
+	name := blobNameFromRequest(r)
+	if name == "" {
+		http.Error(w, "Invalid blob name", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := generationFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid generation", http.StatusBadRequest)
 		return
 	}
-	d1 := key[:2]
-	d2 := key[2:4]
-	fullPath := filepath.Join(storageRoot, d1, d2, key)
 
-	err := os.Remove(fullPath)
+	unlock := blobLocks.Lock(name)
+	defer unlock()
+	meta, err := readMeta(name)
 	if err != nil {
-		log.Fatalf("Error removing file %s: %v", fullPath, err)
-		w.WriteHeader(http.StatusNotModified)
+		log.Printf("Error reading meta of %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if gen != 0 && gen < meta.Generation {
+		http.Error(w, fmt.Sprintf("Stale delete: holding generation %d", meta.Generation), http.StatusConflict)
+		return
+	}
+
+	err = store.Delete(name)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing blob %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	missing := err != nil
+	if err := index.delete(name); err != nil {
+		log.Printf("Error removing %s from the index: %v", name, err)
+		index.stale(name)
+	}
 
+	if gen != 0 {
+		meta.Generation = gen
+		meta.Deleted = true
+		if err := writeMeta(name, meta); err != nil {
+			log.Printf("Error writing tombstone for %s: %v", name, err)
+		}
+	} else {
+		store.DeleteMeta(name)
+	}
+
+	if missing {
+		http.Error(w, "Blob not found", http.StatusNotFound)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// handleMove renames a blob to another version of the same key, e.g. into
+// and out of the master's trash. POST /files/<blob>?version=<v> moves the
+// blob to version v, an empty version moves it to the unversioned name.
+// Like a DELETE, the old name keeps a tombstone when a generation is given.
+func handleMove(w http.ResponseWriter, r *http.Request) {
+	name := blobNameFromRequest(r)
+	if name == "" {
+		http.Error(w, "Invalid blob name", http.StatusBadRequest)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	if version != "" && !keys.ValidVersion(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	gen, err := generationFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid generation", http.StatusBadRequest)
+		return
+	}
+	record, err := recordFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid record", http.StatusBadRequest)
+		return
+	}
+
+	// the meta only tells us the key, which never changes for a name,
+	// so it is fine to read it before taking the locks
+	meta, err := readMeta(name)
+	if err != nil {
+		log.Printf("Error reading meta of %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	key := meta.Key
+	if key == "" {
+		var ok bool
+		if key, ok = keys.Key(name); !ok {
+			http.Error(w, "Blob has no meta to tell its key by", http.StatusConflict)
+			return
+		}
+	}
+	newName := keys.BlobName(key, version)
+	if newName == name {
+		http.Error(w, "Blob already has that name", http.StatusBadRequest)
+		return
+	}
+
+	// lock both names in a fixed order so a move back and forth can't deadlock
+	first, second := min(name, newName), max(name, newName)
+	defer blobLocks.Lock(first)()
+	defer blobLocks.Lock(second)()
+
+	if _, err := store.Stat(name); os.IsNotExist(err) {
+		http.Error(w, "Blob not found", http.StatusNotFound)
+		return
+	}
+	meta, err = readMeta(name)
+	if err != nil {
+		log.Printf("Error reading meta of %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	newMeta, err := readMeta(newName)
+	if err != nil {
+		log.Printf("Error reading meta of %s: %v", newName, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if gen != 0 && (gen < meta.Generation || gen < newMeta.Generation) {
+		http.Error(w, fmt.Sprintf("Stale move: holding generation %d", max(meta.Generation, newMeta.Generation)), http.StatusConflict)
+		return
+	}
+
+	// the new name is as good as a fresh write, the GC's grace period
+	// has to cover it, which Rename takes care of
+	if err := store.Rename(name, newName); err != nil {
+		log.Printf("Error moving %s to %s: %v", name, newName, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// the record moves along unless the master sent a new one
+	if record == nil {
+		record = meta.Record
+	}
+	moved := blobMeta{Key: key, Generation: max(gen, meta.Generation, newMeta.Generation), Record: record}
+	if err := writeMeta(newName, moved); err != nil {
+		log.Printf("Error writing meta of %s: %v", newName, err)
+	}
+	if err := indexMove(name, newName, moved); err != nil {
+		log.Printf("Error moving %s to %s in the index: %v", name, newName, err)
+		index.stale(name)
+		index.stale(newName)
+	}
+	if gen != 0 {
+		meta.Key, meta.Generation, meta.Deleted = key, gen, true
+		if err := writeMeta(name, meta); err != nil {
+			log.Printf("Error writing tombstone for %s: %v", name, err)
+		}
+	} else {
+		store.DeleteMeta(name)
+	}
+	log.Printf("Moved key '%s' from %s to %s", key, name, newName)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Key string `json:"key"`
+	}{newName})
+}
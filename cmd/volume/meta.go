@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/alvinliju/tinydb/internal/keylock"
+)
+
+// Every blob has a small JSON meta in the store, holding the original key
+// and the generation the blob was written with. When a blob is deleted its
+// meta stays behind as a tombstone so a late PUT of an older generation
+// can't bring it back.
+
+const generationHeader = "X-Tinydb-Generation"
+
+// recordHeader carries what the master knows about a blob beyond its key,
+// such as user metadata and expiry. The volume keeps it as is so that the
+// master's index can be rebuilt from the volumes if it is lost.
+const recordHeader = "X-Tinydb-Record"
+
+type blobMeta struct {
+	Key        string          `json:"key"`
+	Generation uint64          `json:"generation,omitempty"`
+	Deleted    bool            `json:"deleted,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+}
+
+// blobLocks serializes the generation check and the write of a blob.
+var blobLocks keylock.Locker
+
+// readMeta returns the meta of the blob called name. A blob without meta
+// gets the zero value, which every generation is newer than.
+func readMeta(name string) (blobMeta, error) {
+	var meta blobMeta
+	b, _, err := store.ReadMeta(name)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// metaGeneration returns the generation of a meta as the store holds it.
+func metaGeneration(b []byte) uint64 {
+	var meta blobMeta
+	json.Unmarshal(b, &meta)
+	return meta.Generation
+}
+
+func writeMeta(name string, meta blobMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return store.WriteMeta(name, b)
+}
+
+// generationFromRequest returns the generation the master stamped on the
+// request, or 0 for requests that don't carry one.
+func generationFromRequest(r *http.Request) (uint64, error) {
+	g := r.Header.Get(generationHeader)
+	if g == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(g, 10, 64)
+}
+
+// recordFromRequest returns the master's record sent with the request, or
+// nil for requests that don't carry one.
+func recordFromRequest(r *http.Request) (json.RawMessage, error) {
+	rec := r.Header.Get(recordHeader)
+	if rec == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(rec)) {
+		return nil, errors.New("record is not JSON")
+	}
+	return json.RawMessage(rec), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+type scrubReport struct {
+	Scanned int   `json:"scanned"`
+	Bytes   int64 `json:"bytes"`
+	// Corrupt are blobs whose content isn't the size and md5 the index has
+	// from when they were written.
+	Corrupt []string `json:"corrupt"`
+	// Missing are blobs the index has and the store doesn't. They are
+	// dropped from the index.
+	Missing     []string `json:"missing"`
+	IsTruncated bool     `json:"is_truncated"`
+	// NextAfter is where the next scrub starts.
+	NextAfter string `json:"next_after,omitempty"`
+}
+
+// handleScrub serves POST /scrub?after=&limit=, which reads the blobs
+// after the given name back and checks them against the index, up to
+// limit of them if given.
+func handleScrub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	report, err := scrub(q.Get("after"), limit)
+	if err != nil {
+		log.Printf("Error scrubbing: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func scrub(after string, limit int) (scrubReport, error) {
+	report := scrubReport{Corrupt: []string{}, Missing: []string{}}
+	err := index.iterate(after, func(name string, _ indexEntry) error {
+		if limit > 0 && report.Scanned == limit {
+			report.IsTruncated = true
+			report.NextAfter = after
+			return errPageFull
+		}
+		after = name
+		report.Scanned++
+		n, ok, err := scrubBlob(name)
+		report.Bytes += n
+		if os.IsNotExist(err) {
+			report.Missing = append(report.Missing, name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Printf("Scrub: %s doesn't match its index entry", name)
+			report.Corrupt = append(report.Corrupt, name)
+		}
+		return nil
+	})
+	if err == errPageFull {
+		err = nil
+	}
+	return report, err
+}
+
+// scrubBlob hashes the blob called name and reports whether it is what the
+// index says. A blob that is gone is dropped from the index.
+func scrubBlob(name string) (int64, bool, error) {
+	// the entry and the blob must be of the same write
+	unlock := blobLocks.Lock(name)
+	defer unlock()
+
+	e, ok, err := index.get(name)
+	if err != nil || !ok {
+		return 0, true, err
+	}
+	blob, err := store.Open(name)
+	if os.IsNotExist(err) {
+		index.delete(name)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer blob.Close()
+	h := md5.New()
+	n, err := io.Copy(h, blob)
+	if err != nil {
+		// a blob that can't be read back is as bad as a changed one
+		log.Printf("Scrub: Error reading %s: %v", name, err)
+		return n, false, nil
+	}
+	return n, n == e.Size && hex.EncodeToString(h.Sum(nil)) == e.MD5, nil
+}
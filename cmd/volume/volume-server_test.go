@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -14,6 +17,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/blobstore"
+	"github.com/alvinliju/tinydb/internal/keys"
 )
 
 var testStorageRoot string
@@ -25,22 +32,47 @@ func initTestStorage(tb testing.TB) {
 	}
 	testStorageRoot = tempDir
 	// Overwrite the global storageRoot for tests
-	oldStorageRoot := storageRoot
+	oldStorageRoot, oldStore := storageRoot, store
 	storageRoot = testStorageRoot
-
 	// Ensure the temp directory is cleaned up after the test finishes
 	tb.Cleanup(func() {
 		os.RemoveAll(testStorageRoot)
 		// Restore the original storageRoot if needed (important for benchmarks if they run after tests)
-		storageRoot = oldStorageRoot
+		storageRoot, store = oldStorageRoot, oldStore
+	})
+	files, err := blobstore.NewFiles(testStorageRoot, blobstore.DurabilityNone)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	useStore(tb, files, filepath.Join(testStorageRoot, indexDir))
+}
+
+// useStore makes s the store for the rest of the test, with its index in
+// dir.
+func useStore(tb testing.TB, s blobstore.Store, dir string) {
+	oldStore, oldIndex := store, index
+	store = s
+	x, err := openIndex(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	index = x
+	tb.Cleanup(func() {
+		x.close()
+		store, index = oldStore, oldIndex
 	})
 }
 
+// blobPath is where the file store keeps key.
+func blobPath(key, version string) string {
+	return keys.BlobPath(storageRoot, keys.BlobName(key, version))
+}
+
 func calculateExpectedFileName(key string) string {
 	h := sha256.New()
 	h.Write([]byte(key))
 	hashString := hex.EncodeToString(h.Sum(nil))
-	return fmt.Sprintf("%s_%s", hashString, key)
+	return fmt.Sprintf("%s_%s", hashString, base64.RawURLEncoding.EncodeToString([]byte(key)))
 }
 
 // first unit test and we need to pass t
@@ -74,7 +106,8 @@ func TestHandlePut(t *testing.T) {
 
 	//capture json res
 	var resp struct {
-		Key string `json:"key"`
+		Key  string `json:"key"`
+		ETag string `json:"etag"`
 	}
 	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
 		t.Fatalf("could not unmarshal response JSON: %v. Body: %s", err, rr.Body.String())
@@ -85,12 +118,12 @@ func TestHandlePut(t *testing.T) {
 	if resp.Key != expectedFileName {
 		t.Errorf("response JSON key mismatch: got %q want %q", resp.Key, expectedFileName)
 	}
-
-	expectedFullPath, err := getFilePath(testKey)
-	if err != nil {
-		t.Fatalf("error getting expected file path: %v", err)
+	if sum := md5.Sum(bodyBytes); resp.ETag != hex.EncodeToString(sum[:]) {
+		t.Errorf("response JSON etag mismatch: got %q want md5 of the content", resp.ETag)
 	}
 
+	expectedFullPath := blobPath(testKey, "")
+
 	// Check if the file actually exists
 	if _, err := os.Stat(expectedFullPath); os.IsNotExist(err) {
 		t.Errorf("file was not created at %q", expectedFullPath)
@@ -106,6 +139,773 @@ func TestHandlePut(t *testing.T) {
 
 }
 
+func TestHandlePutNestedKey(t *testing.T) {
+	initTestStorage(t)
+
+	testKey := "photos/2024/../../../escape.txt"
+	req := httptest.NewRequest("PUT", "/files/"+testKey, strings.NewReader("nope"))
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("PUT %q: got status %v want %v", testKey, rr.Code, http.StatusBadRequest)
+	}
+
+	testKey = "photos/2024/cat.jpg"
+	req = httptest.NewRequest("PUT", "/files/"+testKey, strings.NewReader("meow"))
+	rr = httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT %q: got status %v want %v. Body: %s", testKey, rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	// the slashes must not turn into directories under the shard dirs
+	name := calculateExpectedFileName(testKey)
+	expectedFullPath := filepath.Join(storageRoot, name[:2], name[2:4], name)
+	if content, err := os.ReadFile(expectedFullPath); err != nil || string(content) != "meow" {
+		t.Errorf("blob not stored at %q: %v", expectedFullPath, err)
+	}
+}
+
+func TestHandlePutLongKey(t *testing.T) {
+	initTestStorage(t)
+
+	testKey := strings.Repeat("long/", 200)[:999]
+	req := httptest.NewRequest("PUT", "/files/"+testKey, strings.NewReader("data"))
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT long key: got status %v want %v. Body: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	var resp struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("could not unmarshal response JSON: %v", err)
+	}
+	if len(resp.Key) > 255 {
+		t.Errorf("blob name is %d bytes, longer than a file name may be", len(resp.Key))
+	}
+
+	meta, err := readMeta(resp.Key)
+	if err != nil || meta.Key != testKey {
+		t.Errorf("original key not kept next to the blob: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/files/"+resp.Key, nil)
+	rr = httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "data" {
+		t.Errorf("GET long key: got status %v body %q", rr.Code, rr.Body.String())
+	}
+}
+
+// TestHandlePutNameLimit stores keys around the length where the blob name
+// drops the encoded key, where a name with a suffix used to run out of room.
+func TestHandlePutNameLimit(t *testing.T) {
+	initTestStorage(t)
+
+	for n := 120; n <= 200; n++ {
+		testKey := strings.Repeat("k", n)
+		req := httptest.NewRequest("PUT", "/files/"+testKey, strings.NewReader("data"))
+		rr := httptest.NewRecorder()
+		fileHandler(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %d byte key: got status %v want %v. Body: %s", n, rr.Code, http.StatusCreated, rr.Body.String())
+		}
+	}
+}
+
+func TestHandlePutVersions(t *testing.T) {
+	initTestStorage(t)
+
+	testKey := "versioned.txt"
+	for _, version := range []string{"v1", "v2"} {
+		req := httptest.NewRequest("PUT", "/files/"+testKey+"?version="+version, strings.NewReader("content "+version))
+		rr := httptest.NewRecorder()
+		fileHandler(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("PUT version %s: got status %v. Body: %s", version, rr.Code, rr.Body.String())
+		}
+	}
+
+	// both versions must still be there, next to each other
+	for _, version := range []string{"v1", "v2"} {
+		name := calculateExpectedFileName(testKey) + "." + version
+		req := httptest.NewRequest("GET", "/files/"+name, nil)
+		rr := httptest.NewRecorder()
+		fileHandler(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != "content "+version {
+			t.Errorf("GET version %s: got status %v body %q", version, rr.Code, rr.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/files/"+testKey+"?version=Not.Valid", strings.NewReader("x"))
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("PUT with invalid version: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func putWithGeneration(key, content string, gen int) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/files/"+key, strings.NewReader(content))
+	req.Header.Set(generationHeader, fmt.Sprint(gen))
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	return rr
+}
+
+func TestHandlePutRejectsStaleGeneration(t *testing.T) {
+	initTestStorage(t)
+
+	testKey := "generations.txt"
+	if rr := putWithGeneration(testKey, "new", 5); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT generation 5: got status %v", rr.Code)
+	}
+	if rr := putWithGeneration(testKey, "old", 3); rr.Code != http.StatusConflict {
+		t.Errorf("PUT generation 3 after 5: got status %v want %v", rr.Code, http.StatusConflict)
+	}
+	// a retry of the same generation is fine
+	if rr := putWithGeneration(testKey, "new", 5); rr.Code != http.StatusCreated {
+		t.Errorf("PUT generation 5 again: got status %v", rr.Code)
+	}
+
+	fullPath := blobPath(testKey, "")
+	if content, _ := os.ReadFile(fullPath); string(content) != "new" {
+		t.Errorf("stale write replaced the blob: content is %q", content)
+	}
+
+	// a delete leaves a tombstone behind that late writes can't get past
+	req := httptest.NewRequest("DELETE", "/files/"+calculateExpectedFileName(testKey), nil)
+	req.Header.Set(generationHeader, "7")
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("DELETE generation 7: got status %v", rr.Code)
+	}
+	if rr := putWithGeneration(testKey, "late", 6); rr.Code != http.StatusConflict {
+		t.Errorf("PUT generation 6 after delete 7: got status %v want %v", rr.Code, http.StatusConflict)
+	}
+	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+		t.Errorf("deleted blob came back: %v", err)
+	}
+	if rr := putWithGeneration(testKey, "newer", 8); rr.Code != http.StatusCreated {
+		t.Errorf("PUT generation 8 after delete 7: got status %v", rr.Code)
+	}
+}
+
+func TestHandleInvalidBlobName(t *testing.T) {
+	initTestStorage(t)
+
+	// these used to panic on key[:2] / key[2:4]
+	for _, name := range []string{"a", "abc", "../../etc/passwd", "not-a-blob-name"} {
+		for _, method := range []string{"GET", "DELETE"} {
+			req := httptest.NewRequest(method, "/files/"+name, nil)
+			rr := httptest.NewRecorder()
+			fileHandler(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s %q: got status %v want %v", method, name, rr.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func TestHandleDeleteMissing(t *testing.T) {
+	initTestStorage(t)
+
+	req := httptest.NewRequest("DELETE", "/files/"+calculateExpectedFileName("never_stored"), nil)
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a missing blob: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleMove(t *testing.T) {
+	initTestStorage(t)
+
+	testKey := "trash/me.txt"
+	if rr := putWithGeneration(testKey, "keep me", 3); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %v", rr.Code)
+	}
+
+	move := func(name, version string, gen int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/files/"+name+"?version="+version, nil)
+		req.Header.Set(generationHeader, fmt.Sprint(gen))
+		rr := httptest.NewRecorder()
+		fileHandler(rr, req)
+		return rr
+	}
+
+	name := calculateExpectedFileName(testKey)
+	if rr := move(name, "t1", 2); rr.Code != http.StatusConflict {
+		t.Errorf("move with an older generation: got status %v want %v", rr.Code, http.StatusConflict)
+	}
+	rr := move(name, "t1", 4)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("move to version t1: got status %v. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct{ Key string }
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if resp.Key != name+".t1" {
+		t.Errorf("moved blob name: got %q want %q", resp.Key, name+".t1")
+	}
+
+	oldPath := blobPath(testKey, "")
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("blob still at its old name: %v", err)
+	}
+	// the old name is a tombstone now
+	if rr := putWithGeneration(testKey, "late", 3); rr.Code != http.StatusConflict {
+		t.Errorf("PUT generation 3 after move 4: got status %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	if rr := move(resp.Key, "", 5); rr.Code != http.StatusOK {
+		t.Fatalf("move back: got status %v. Body: %s", rr.Code, rr.Body.String())
+	}
+	if content, _ := os.ReadFile(oldPath); string(content) != "keep me" {
+		t.Errorf("content after moving back: got %q", content)
+	}
+	if rr := move(resp.Key, "", 6); rr.Code != http.StatusNotFound {
+		t.Errorf("move of a missing blob: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleGC(t *testing.T) {
+	initTestStorage(t)
+
+	for _, key := range []string{"gc/keep", "gc/orphan", "gc/new-orphan", "gc/deleted"} {
+		if rr := putWithGeneration(key, "content of "+key, 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %v", key, rr.Code)
+		}
+	}
+	req := httptest.NewRequest("DELETE", "/files/"+calculateExpectedFileName("gc/deleted"), nil)
+	req.Header.Set(generationHeader, "2")
+	fileHandler(httptest.NewRecorder(), req)
+
+	// everything but new-orphan was written long ago
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{"gc/keep", "gc/orphan"} {
+		p := blobPath(key, "")
+		os.Chtimes(p, old, old)
+	}
+	p := blobPath("gc/deleted", "")
+	os.Chtimes(p+blobstore.MetaSuffix, old, old)
+
+	gc := func(dryRun string) gcReport {
+		list := calculateExpectedFileName("gc/keep") + "\n" + calculateExpectedFileName("gc/lost") + "\n"
+		req := httptest.NewRequest("POST", "/gc?grace=1h&dry-run="+dryRun, strings.NewReader(list))
+		rr := httptest.NewRecorder()
+		handleGC(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GC: got status %v. Body: %s", rr.Code, rr.Body.String())
+		}
+		var report gcReport
+		json.NewDecoder(rr.Body).Decode(&report)
+		return report
+	}
+
+	report := gc("1")
+	if report.OrphanCount != 1 || report.Orphans[0].Name != calculateExpectedFileName("gc/orphan") {
+		t.Errorf("dry run orphans: got %+v", report.Orphans)
+	}
+	if report.Deleted != 0 || report.Tombstones != 1 || report.MissingCount != 1 {
+		t.Errorf("dry run: got deleted %d, tombstones %d, missing %d", report.Deleted, report.Tombstones, report.MissingCount)
+	}
+	if p := blobPath("gc/orphan", ""); !fileExists(p) {
+		t.Errorf("dry run deleted the orphan")
+	}
+
+	report = gc("")
+	if report.Deleted != 1 {
+		t.Errorf("GC deleted %d blobs, want 1", report.Deleted)
+	}
+	for key, want := range map[string]bool{"gc/keep": true, "gc/orphan": false, "gc/new-orphan": true} {
+		if p := blobPath(key, ""); fileExists(p) != want {
+			t.Errorf("after GC %s exists: %v, want %v", key, !want, want)
+		}
+	}
+	if fileExists(p + blobstore.MetaSuffix) {
+		t.Errorf("old tombstone survived the GC")
+	}
+}
+
+func TestHandleGCScoped(t *testing.T) {
+	initTestStorage(t)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{"a/orphan", "m/orphan", "z/orphan"} {
+		if rr := putWithGeneration(key, "content of "+key, 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %v", key, rr.Code)
+		}
+		p := blobPath(key, "")
+		os.Chtimes(p, old, old)
+	}
+
+	// a shard owning [m, z) only sweeps its own orphans
+	rr := httptest.NewRecorder()
+	handleGC(rr, httptest.NewRequest("POST", "/gc?grace=1h&start=m&end=z", strings.NewReader("")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GC: got status %v. Body: %s", rr.Code, rr.Body.String())
+	}
+	for key, want := range map[string]bool{"a/orphan": true, "m/orphan": false, "z/orphan": true} {
+		if p := blobPath(key, ""); fileExists(p) != want {
+			t.Errorf("after GC of [m, z) %s exists: %v, want %v", key, !want, want)
+		}
+	}
+}
+
+func TestHandleInventory(t *testing.T) {
+	initTestStorage(t)
+
+	contents := map[string]string{}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("inventory/%d", i)
+		if rr := putWithGeneration(key, "content of "+key, 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %v", key, rr.Code)
+		}
+		contents[calculateExpectedFileName(key)] = "content of " + key
+	}
+
+	var names []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages == 5 {
+			t.Fatalf("inventory didn't end after %d pages", pages)
+		}
+		rr := httptest.NewRecorder()
+		handleInventory(rr, httptest.NewRequest("GET", "/blobs?limit=2&after="+after, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET /blobs: got status %v. Body: %s", rr.Code, rr.Body.String())
+		}
+		var page inventoryPage
+		json.NewDecoder(rr.Body).Decode(&page)
+		for _, b := range page.Blobs {
+			sum := md5.Sum([]byte(contents[b.Name]))
+			if b.MD5 != hex.EncodeToString(sum[:]) || b.Size != int64(len(contents[b.Name])) {
+				t.Errorf("blob %s: got md5 %s size %d", b.Name, b.MD5, b.Size)
+			}
+			names = append(names, b.Name)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		after = page.NextAfter
+	}
+
+	if len(names) != len(contents) {
+		t.Fatalf("inventory listed %d blobs, want %d: %v", len(names), len(contents), names)
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] >= names[i] {
+			t.Errorf("inventory out of order: %s before %s", names[i-1], names[i])
+		}
+	}
+}
+
+func TestRecordKept(t *testing.T) {
+	initTestStorage(t)
+
+	req := httptest.NewRequest("PUT", "/files/rec/key", strings.NewReader("content"))
+	req.Header.Set(generationHeader, "1")
+	req.Header.Set(recordHeader, `{"meta":{"color":"red"}}`)
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %v", rr.Code)
+	}
+
+	// a move without a record keeps the one the blob has
+	req = httptest.NewRequest("POST", "/files/"+calculateExpectedFileName("rec/key")+"?version=abc", nil)
+	req.Header.Set(generationHeader, "2")
+	rr = httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("move: got status %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handleInventory(rr, httptest.NewRequest("GET", "/blobs", nil))
+	var page inventoryPage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Blobs) != 1 {
+		t.Fatalf("inventory: got %+v, want the moved blob", page.Blobs)
+	}
+	b := page.Blobs[0]
+	if b.Key != "rec/key" || b.Generation != 2 || string(b.Record) != `{"meta":{"color":"red"}}` {
+		t.Errorf("inventory: got key %q generation %d record %s", b.Key, b.Generation, b.Record)
+	}
+
+	req = httptest.NewRequest("PUT", "/files/rec/bad", strings.NewReader("content"))
+	req.Header.Set(recordHeader, `{`)
+	rr = httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a bad record: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandlersOnMemoryStore(t *testing.T) {
+	mem := blobstore.NewMemory()
+	useStore(t, mem, t.TempDir())
+
+	if rr := putWithGeneration("mem/key", "0123456789", 1); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %v. Body: %s", rr.Code, rr.Body.String())
+	}
+	name := calculateExpectedFileName("mem/key")
+
+	req := httptest.NewRequest("GET", "/files/"+name, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rr := httptest.NewRecorder()
+	fileHandler(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "2345" {
+		t.Errorf("GET a range: got status %v body %q", rr.Code, rr.Body.String())
+	}
+
+	// an old orphan is collected
+	mem.SetModTime(name, false, time.Now().Add(-2*time.Hour))
+	rr = httptest.NewRecorder()
+	handleGC(rr, httptest.NewRequest("POST", "/gc?grace=1h", strings.NewReader("")))
+	var report gcReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Deleted != 1 {
+		t.Errorf("GC: got %+v", report)
+	}
+	rr = httptest.NewRecorder()
+	fileHandler(rr, httptest.NewRequest("GET", "/files/"+name, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET after GC: got status %v", rr.Code)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleSegments(rr, httptest.NewRequest("GET", "/segments", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET on a files store: got status %v", rr.Code)
+	}
+
+	packed, err := blobstore.OpenPacked(t.TempDir(), blobstore.PackedOptions{MaxBlobSize: 1024, SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packed.Close() })
+	useStore(t, packed, t.TempDir())
+
+	for _, key := range []string{"seg/a", "seg/b", "seg/c"} {
+		if rr := putWithGeneration(key, strings.Repeat("x", 100), 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %v", key, rr.Code)
+		}
+	}
+	if rr := putWithGeneration("seg/a", "overwritten", 2); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT over: got status %v", rr.Code)
+	}
+
+	var disks []diskSegments
+	rr = httptest.NewRecorder()
+	handleSegments(rr, httptest.NewRequest("GET", "/segments", nil))
+	json.NewDecoder(rr.Body).Decode(&disks)
+	if len(disks) != 1 || len(disks[0].Segments) < 2 || disks[0].Segments[0].Reclaimable == 0 {
+		t.Fatalf("GET: got %+v", disks)
+	}
+	segs := disks[0].Segments
+
+	rr = httptest.NewRecorder()
+	handleSegments(rr, httptest.NewRequest("POST", "/segments?below=1", nil))
+	disks = nil
+	json.NewDecoder(rr.Body).Decode(&disks)
+	if rr.Code != http.StatusOK || len(disks) != 1 || disks[0].Report == nil {
+		t.Fatalf("POST: got status %v, %+v", rr.Code, disks)
+	}
+	if report := disks[0].Report; len(report.Segments) == 0 || report.Reclaimed != segs[0].Reclaimable {
+		t.Errorf("POST: got %+v", report)
+	}
+	rr = httptest.NewRecorder()
+	fileHandler(rr, httptest.NewRequest("GET", "/files/"+calculateExpectedFileName("seg/a"), nil))
+	if rr.Body.String() != "overwritten" {
+		t.Errorf("GET after compacting: got %q", rr.Body.String())
+	}
+}
+
+func TestIndex(t *testing.T) {
+	initTestStorage(t)
+
+	req := httptest.NewRequest("PUT", "/files/idx/a", strings.NewReader("content"))
+	req.Header.Set("Content-Type", "text/x-test")
+	req.Header.Set(generationHeader, "3")
+	fileHandler(httptest.NewRecorder(), req)
+	name := calculateExpectedFileName("idx/a")
+	e, ok, err := index.get(name)
+	sum := md5.Sum([]byte("content"))
+	if err != nil || !ok || e.Size != 7 || e.MD5 != hex.EncodeToString(sum[:]) || e.Key != "idx/a" || e.Generation != 3 || e.ContentType != "text/x-test" {
+		t.Fatalf("entry after PUT: %+v, %v, %v", e, ok, err)
+	}
+
+	rr := httptest.NewRecorder()
+	fileHandler(rr, httptest.NewRequest("GET", "/files/"+name, nil))
+	if ct := rr.Header().Get("Content-Type"); ct != "text/x-test" {
+		t.Errorf("GET: got content type %q", ct)
+	}
+
+	// a move keeps when the name was first written
+	req = httptest.NewRequest("POST", "/files/"+name+"?version=v1", nil)
+	req.Header.Set(generationHeader, "4")
+	fileHandler(httptest.NewRecorder(), req)
+	moved := keys.BlobName("idx/a", "v1")
+	if _, ok, _ := index.get(name); ok {
+		t.Errorf("old name still indexed")
+	}
+	m, ok, _ := index.get(moved)
+	if !ok || m.Generation != 4 || m.MD5 != e.MD5 || !m.Created.Equal(e.Created) {
+		t.Errorf("entry after move: %+v", m)
+	}
+
+	req = httptest.NewRequest("DELETE", "/files/"+moved, nil)
+	fileHandler(httptest.NewRecorder(), req)
+	if _, ok, _ := index.get(moved); ok {
+		t.Errorf("deleted blob still indexed")
+	}
+
+	// a volume that crashed rebuilds its index from the store
+	putWithGeneration("idx/b", "other content", 1)
+	index.parts[0].db.Close()
+	x, err := openIndex(filepath.Join(testStorageRoot, indexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index = x
+	page, err := listBlobs("", 10)
+	if err != nil || len(page.Blobs) != 1 || page.Blobs[0].Key != "idx/b" || page.Blobs[0].Size != 13 {
+		t.Errorf("inventory after rebuilding: %+v, %v", page.Blobs, err)
+	}
+}
+
+// failingMeta is a store whose metas can't be written while fail is set.
+type failingMeta struct {
+	blobstore.Store
+	fail bool
+}
+
+func (s *failingMeta) WriteMeta(name string, meta []byte) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.Store.WriteMeta(name, meta)
+}
+
+func TestPutKeepsBlobWhenBookkeepingFails(t *testing.T) {
+	initTestStorage(t)
+	fm := &failingMeta{Store: store}
+	dir := filepath.Join(t.TempDir(), indexDir)
+	useStore(t, fm, dir)
+	name := calculateExpectedFileName("keep/a")
+	get := func() string {
+		rr := httptest.NewRecorder()
+		fileHandler(rr, httptest.NewRequest("GET", "/files/"+name, nil))
+		return rr.Body.String()
+	}
+
+	if rr := putWithGeneration("keep/a", "first", 1); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %v", rr.Code)
+	}
+	// an overwrite whose meta can't be written fails, and leaves the blob
+	fm.fail = true
+	if rr := putWithGeneration("keep/a", "second", 2); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("PUT without meta: got status %v", rr.Code)
+	}
+	fm.fail = false
+	if got := get(); got != "second" {
+		t.Errorf("GET after the meta failed: got %q", got)
+	}
+	sum := md5.Sum([]byte("second"))
+	if e, ok, _ := index.get(name); !ok || e.MD5 != hex.EncodeToString(sum[:]) || e.Generation != 1 {
+		t.Errorf("entry after the meta failed: %+v, want the store's", e)
+	}
+
+	// a write the index can't take still counts
+	index.parts[0].db.Close()
+	if rr := putWithGeneration("keep/a", "third", 3); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT without index: got status %v", rr.Code)
+	}
+	if got := get(); got != "third" {
+		t.Errorf("GET after the index failed: got %q", got)
+	}
+	if !index.dirty.Load() {
+		t.Errorf("index isn't dirty")
+	}
+
+	// and the next start rebuilds the index
+	x, err := openIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index = x
+	t.Cleanup(func() { x.close() })
+	if e, ok, _ := index.get(name); !ok || e.Generation != 3 || e.Size != 5 {
+		t.Errorf("entry after rebuilding: %+v", e)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	initTestStorage(t)
+	for _, key := range []string{"scrub/good", "scrub/rotten", "scrub/lost"} {
+		putWithGeneration(key, "content of "+key, 1)
+	}
+	os.WriteFile(blobPath("scrub/rotten", ""), []byte("content of scrub/rottem"), 0644)
+	os.Remove(blobPath("scrub/lost", ""))
+
+	rr := httptest.NewRecorder()
+	handleScrub(rr, httptest.NewRequest("POST", "/scrub", nil))
+	var report scrubReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Scanned != 3 || len(report.Corrupt) != 1 || report.Corrupt[0] != calculateExpectedFileName("scrub/rotten") ||
+		len(report.Missing) != 1 || report.Missing[0] != calculateExpectedFileName("scrub/lost") {
+		t.Errorf("scrub: got %+v", report)
+	}
+	if _, ok, _ := index.get(calculateExpectedFileName("scrub/lost")); ok {
+		t.Errorf("lost blob still indexed")
+	}
+
+	// a page at a time
+	rr = httptest.NewRecorder()
+	handleScrub(rr, httptest.NewRequest("POST", "/scrub?limit=1", nil))
+	report = scrubReport{}
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Scanned != 1 || !report.IsTruncated {
+		t.Fatalf("first page: got %+v", report)
+	}
+	rr = httptest.NewRecorder()
+	handleScrub(rr, httptest.NewRequest("POST", "/scrub?after="+report.NextAfter, nil))
+	report = scrubReport{}
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Scanned != 1 || report.IsTruncated {
+		t.Errorf("second page: got %+v", report)
+	}
+}
+
+func TestDisks(t *testing.T) {
+	var disks []blobstore.Disk
+	for range 2 {
+		dir := t.TempDir()
+		files, err := blobstore.NewFiles(dir, blobstore.DurabilityNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disks = append(disks, blobstore.Disk{Dir: dir, Store: files})
+	}
+	m, err := blobstore.NewMulti(disks, blobstore.PlaceByHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, m, t.TempDir())
+
+	for i := range 10 {
+		if rr := putWithGeneration(fmt.Sprintf("disk/%d", i), "content", 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT: got status %v", rr.Code)
+		}
+	}
+
+	// the second disk dies
+	os.RemoveAll(disks[1].Dir)
+	m.Check()
+	rr := httptest.NewRecorder()
+	handleDisks(rr, httptest.NewRequest("GET", "/disks", nil))
+	var infos []blobstore.DiskInfo
+	json.NewDecoder(rr.Body).Decode(&infos)
+	if len(infos) != 2 || infos[0].Failed || !infos[1].Failed || infos[0].Total == 0 {
+		t.Fatalf("GET /disks: got %+v", infos)
+	}
+
+	// the volume goes on with the first
+	if rr := putWithGeneration("disk/new", "new content", 1); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT after a disk failed: got status %v", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	fileHandler(rr, httptest.NewRequest("GET", "/files/"+calculateExpectedFileName("disk/new"), nil))
+	if rr.Body.String() != "new content" {
+		t.Errorf("GET after a disk failed: got status %v body %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDiskIndexes(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "unmounted")
+	disks := []blobstore.Disk{{Dir: missing, Err: os.ErrNotExist}}
+	for range 2 {
+		dir := t.TempDir()
+		files, err := blobstore.NewFiles(dir, blobstore.DurabilityNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disks = append(disks, blobstore.Disk{Dir: dir, Store: files})
+	}
+	m, err := blobstore.NewMulti(disks, blobstore.PlaceByHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldIndex := store, index
+	store, index = m, openDiskIndexes(m, disks, m.Dedupe(metaGeneration))
+	x := index
+	t.Cleanup(func() {
+		x.close()
+		store, index = oldStore, oldIndex
+	})
+	// the missing disk gets no index in its place
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("missing disk: %v", err)
+	}
+
+	for i := range 10 {
+		if rr := putWithGeneration(fmt.Sprintf("idx/%d", i), "content", 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT: got status %v", rr.Code)
+		}
+	}
+	// every blob is in the index of its disk
+	for i := range 10 {
+		name := calculateExpectedFileName(fmt.Sprintf("idx/%d", i))
+		at, err := m.DiskOf(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, p := range index.parts[1:] {
+			if _, ok, _ := p.get(name); ok != (j+1 == at) {
+				t.Errorf("%s on disk %d, indexed on disk %d: %v", name, at, j+1, ok)
+			}
+		}
+	}
+	page, err := listBlobs("", 100)
+	if err != nil || len(page.Blobs) != 10 {
+		t.Fatalf("inventory: %d blobs, %v", len(page.Blobs), err)
+	}
+
+	// the index of a disk fails, which takes the disk out with it and
+	// leaves the other
+	index.parts[1].db.Close()
+	putWithGeneration("idx/failing", "content", 1)
+	if !m.DiskFailed(1) || m.DiskFailed(2) {
+		t.Fatalf("disks after an index failed: %+v", m.Disks())
+	}
+	for i := range 5 {
+		if rr := putWithGeneration(fmt.Sprintf("idx/after/%d", i), "content", 1); rr.Code != http.StatusCreated {
+			t.Fatalf("PUT after an index failed: got status %v", rr.Code)
+		}
+	}
+	page, err = listBlobs("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range page.Blobs {
+		if at, err := m.DiskOf(b.Name); err != nil || at != 2 {
+			t.Errorf("inventory lists %s on disk %d: %v", b.Name, at, err)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func BenchmarkHandleGet1GB(b *testing.B) {
 	// 1. Setup: Prepare the environment and the test file.
 	// This ensures each benchmark run starts with a clean, temporary storage.
@@ -132,10 +932,7 @@ func BenchmarkHandleGet1GB(b *testing.B) {
 	// Calculate its expected hashed filename on disk.
 	expectedHashedFilename := calculateExpectedFileName(testKey)
 	// Get the full file path where it should be stored.
-	filePath, err := getFilePath(testKey)
-	if err != nil {
-		b.Fatalf("getFilePath error during setup: %v", err)
-	}
+	filePath := blobPath(testKey, "")
 
 	// Teach: Crucial for GET benchmarks: The file MUST exist BEFORE the benchmark starts.
 	// Create the necessary directory structure.
@@ -204,10 +1001,7 @@ func TestHandleGet(t *testing.T) {
 
 	//assertion on filename(important part)
 	expectedFileName := calculateExpectedFileName(testKey)
-	filePath, err := getFilePath(testKey)
-	if err != nil {
-		t.Fatalf("Failed to get file path for test setup: %v", err)
-	}
+	filePath := blobPath(testKey, "")
 
 	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
 		t.Fatalf("Failed to create test directory %s: %v", filepath.Dir(filePath), err)
@@ -2,7 +2,6 @@ module github.com/alvinliju/tinydb
 
 go 1.24.1
 
-require (
-	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
-)
+require github.com/syndtr/goleveldb v1.0.0
+
+require github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
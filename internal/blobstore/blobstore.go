@@ -0,0 +1,105 @@
+// Package blobstore is where a volume server keeps its blobs. Store hides
+// the layout from the HTTP handlers: Files is the file per blob layout the
+// volumes have always used, Memory keeps everything in RAM for tests.
+//
+// Next to its content every blob has a small meta record, which the
+// volume uses for the key, generation and master's record of the blob.
+// The meta of a deleted blob stays behind as a tombstone until it is
+// deleted itself. Names are the blob names of internal/keys, and callers
+// serialize the changes to a name.
+package blobstore
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// ErrNotExist is what errors about a blob or meta that isn't there wrap.
+// It is fs.ErrNotExist, so os.IsNotExist works on them too.
+var ErrNotExist = fs.ErrNotExist
+
+// Durability is how hard a store works to keep what it wrote through a
+// crash of the machine. A crash of the process never loses a write.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing writes to the OS.
+	DurabilityNone Durability = iota
+	// DurabilityFile fsyncs every blob and meta before it replaces the old
+	// one.
+	DurabilityFile
+	// DurabilityDir fsyncs the directory too, so the replacement itself
+	// survives.
+	DurabilityDir
+)
+
+var durabilityNames = []string{"none", "file", "file+dir"}
+
+func (d Durability) String() string {
+	if d < 0 || int(d) >= len(durabilityNames) {
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+	return durabilityNames[d]
+}
+
+// ParseDurability parses none, file or file+dir.
+func ParseDurability(s string) (Durability, error) {
+	for d, name := range durabilityNames {
+		if s == name {
+			return Durability(d), nil
+		}
+	}
+	return 0, fmt.Errorf("blobstore: unknown durability %q, want none, file or file+dir", s)
+}
+
+// Info describes a stored blob.
+type Info struct {
+	Name string
+	Size int64
+	// ModTime is when the blob was last written or renamed.
+	ModTime time.Time
+}
+
+// Blob is an open blob. Reads at any offset, so a Range request is a
+// Seek, or a ReadAt.
+type Blob interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Info() Info
+}
+
+// Store keeps blobs by name.
+type Store interface {
+	// Put stores what r yields under name, replacing any blob there, and
+	// returns the number of bytes stored. When it fails, the blob that was
+	// there is left as it was.
+	Put(name string, r io.Reader) (int64, error)
+	// Open returns the blob stored under name, or ErrNotExist.
+	Open(name string) (Blob, error)
+	// Stat describes the blob stored under name, or returns ErrNotExist.
+	Stat(name string) (Info, error)
+	// Delete removes the blob stored under name, but not its meta. It
+	// returns ErrNotExist if there is no blob.
+	Delete(name string) error
+	// Rename moves a blob to a new name, replacing any blob there. The
+	// meta stays where it is. The move counts as a write of the blob.
+	Rename(from, to string) error
+	// Iterate calls fn for every blob whose name sorts after after, in
+	// name order, and stops at the first error fn returns, which it
+	// returns.
+	Iterate(after string, fn func(Info) error) error
+
+	// ReadMeta returns the meta of name and when it was written, or
+	// ErrNotExist.
+	ReadMeta(name string) ([]byte, time.Time, error)
+	// WriteMeta replaces the meta of name, all at once.
+	WriteMeta(name string, meta []byte) error
+	// DeleteMeta removes the meta of name, if there is one.
+	DeleteMeta(name string) error
+	// Tombstones calls fn for every meta whose blob is gone, with when
+	// the meta was written, and stops at the first error fn returns.
+	Tombstones(fn func(name string, modTime time.Time) error) error
+}
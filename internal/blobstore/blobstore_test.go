@@ -0,0 +1,297 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/keys"
+)
+
+// stores runs f against every Store implementation.
+func stores(t *testing.T, f func(t *testing.T, s Store)) {
+	t.Run("files", func(t *testing.T) {
+		s, err := NewFiles(t.TempDir(), DurabilityDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(t, s)
+	})
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemory())
+	})
+	t.Run("packed", func(t *testing.T) {
+		// small enough for some blobs to get a file of their own
+		s, err := OpenPacked(t.TempDir(), PackedOptions{MaxBlobSize: 8, SegmentSize: 64, Durability: DurabilityDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		f(t, s)
+	})
+	t.Run("multi", func(t *testing.T) {
+		files, err := NewFiles(t.TempDir(), DurabilityNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewMulti([]Disk{{Dir: t.TempDir(), Store: NewMemory()}, {Dir: t.TempDir(), Store: files}, {Dir: t.TempDir(), Store: NewMemory()}}, PlaceByHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(t, s)
+	})
+}
+
+func put(t *testing.T, s Store, name, content string) {
+	t.Helper()
+	if n, err := s.Put(name, strings.NewReader(content)); err != nil || n != int64(len(content)) {
+		t.Fatalf("Put %s: %d bytes, %v", name, n, err)
+	}
+}
+
+func read(t *testing.T, s Store, name string) string {
+	t.Helper()
+	b, err := s.Open(name)
+	if err != nil {
+		t.Fatalf("Open %s: %v", name, err)
+	}
+	defer b.Close()
+	data, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func names(t *testing.T, s Store, after string) string {
+	t.Helper()
+	var got []string
+	if err := s.Iterate(after, func(info Info) error {
+		got = append(got, info.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(got, ",")
+}
+
+func TestPutOpen(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		a := keys.BlobName("a", "")
+		put(t, s, a, "first")
+		put(t, s, a, "second, longer")
+		if got := read(t, s, a); got != "second, longer" {
+			t.Errorf("content: %q", got)
+		}
+
+		b, err := s.Open(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if info := b.Info(); info.Name != a || info.Size != 14 || time.Since(info.ModTime) > time.Minute {
+			t.Errorf("Info: %+v", info)
+		}
+		// a range
+		buf := make([]byte, 6)
+		if n, err := b.ReadAt(buf, 8); n != 6 || string(buf) != "longer" {
+			t.Errorf("ReadAt: %q, %v", buf[:n], err)
+		}
+		b.Seek(8, io.SeekStart)
+		if rest, _ := io.ReadAll(b); string(rest) != "longer" {
+			t.Errorf("read after Seek: %q", rest)
+		}
+
+		missing := keys.BlobName("missing", "")
+		if _, err := s.Open(missing); !errors.Is(err, ErrNotExist) || !os.IsNotExist(err) {
+			t.Errorf("Open of a missing blob: %v", err)
+		}
+		if _, err := s.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("Stat of a missing blob: %v", err)
+		}
+		if err := s.Delete(missing); !os.IsNotExist(err) {
+			t.Errorf("Delete of a missing blob: %v", err)
+		}
+	})
+}
+
+// failingReader yields some bytes and then fails, like an upload that is
+// cut off.
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestFailedPutKeepsTheOldBlob(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		name := keys.BlobName("k", "")
+		put(t, s, name, "good")
+		// both what fits a segment and what doesn't
+		for _, n := range []int{3, 100} {
+			if _, err := s.Put(name, &failingReader{n}); err == nil {
+				t.Fatal("Put of a failing reader worked")
+			}
+			if got := read(t, s, name); got != "good" {
+				t.Errorf("after a failed Put of %d bytes: %q", n, got)
+			}
+		}
+		if got := names(t, s, ""); got != name {
+			t.Errorf("blobs after failed Puts: %s", got)
+		}
+	})
+}
+
+func TestIterate(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		var all []string
+		for _, k := range []string{"c", "a", "e", "b", "d"} {
+			name := keys.BlobName(k, "")
+			put(t, s, name, k)
+			s.WriteMeta(name, []byte("{}"))
+		}
+		// a tombstone isn't a blob
+		s.WriteMeta(keys.BlobName("gone", ""), []byte("{}"))
+		if err := s.Iterate("", func(info Info) error {
+			all = append(all, info.Name)
+			if info.Size != 1 {
+				t.Errorf("%s has size %d", info.Name, info.Size)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 5 {
+			t.Fatalf("iterated %v", all)
+		}
+		for i := 1; i < len(all); i++ {
+			if all[i-1] >= all[i] {
+				t.Errorf("out of order: %s before %s", all[i-1], all[i])
+			}
+		}
+		if got := names(t, s, all[2]); got != all[3]+","+all[4] {
+			t.Errorf("after %s: %s", all[2], got)
+		}
+
+		stop := errors.New("stop")
+		n := 0
+		if err := s.Iterate("", func(Info) error { n++; return stop }); err != stop || n != 1 {
+			t.Errorf("stopping: %d calls, %v", n, err)
+		}
+	})
+}
+
+func TestMetaAndTombstones(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		name := keys.BlobName("k", "")
+		if _, _, err := s.ReadMeta(name); !os.IsNotExist(err) {
+			t.Errorf("ReadMeta of a missing meta: %v", err)
+		}
+		put(t, s, name, "x")
+		s.WriteMeta(name, []byte(`{"generation":1}`))
+		s.WriteMeta(name, []byte(`{"generation":2}`))
+		if b, mtime, err := s.ReadMeta(name); err != nil || string(b) != `{"generation":2}` || time.Since(mtime) > time.Minute {
+			t.Errorf("ReadMeta: %s %v %v", b, mtime, err)
+		}
+
+		tombstones := func() string {
+			var got []string
+			s.Tombstones(func(name string, _ time.Time) error {
+				got = append(got, name)
+				return nil
+			})
+			return strings.Join(got, ",")
+		}
+		if got := tombstones(); got != "" {
+			t.Errorf("tombstones of a stored blob: %s", got)
+		}
+		// the meta outlives the blob
+		if err := s.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+		if got := tombstones(); got != name {
+			t.Errorf("tombstones: %s", got)
+		}
+		s.DeleteMeta(name)
+		s.DeleteMeta(name)
+		if got := tombstones(); got != "" {
+			t.Errorf("tombstones after DeleteMeta: %s", got)
+		}
+	})
+}
+
+func TestRename(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		from, to := keys.BlobName("k", ""), keys.BlobName("k", "v1")
+		put(t, s, from, "content")
+		s.WriteMeta(from, []byte("{}"))
+		if err := s.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Stat(from); !os.IsNotExist(err) {
+			t.Errorf("blob still at its old name: %v", err)
+		}
+		if got := read(t, s, to); got != "content" {
+			t.Errorf("content after Rename: %q", got)
+		}
+		// the meta stays behind
+		if _, _, err := s.ReadMeta(from); err != nil {
+			t.Errorf("meta moved along: %v", err)
+		}
+		if err := s.Rename(from, to); !os.IsNotExist(err) {
+			t.Errorf("Rename of a missing blob: %v", err)
+		}
+	})
+}
+
+func TestNewFilesRemovesTemps(t *testing.T) {
+	root := t.TempDir()
+	f, err := NewFiles(root, DurabilityNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := keys.BlobName("k", "")
+	put(t, f, name, "content")
+	f.WriteMeta(name, []byte("{}"))
+	stale := []string{f.Path(name) + tempSuffix + "123", f.Path(name) + MetaSuffix + tempSuffix + "456", f.Path(name) + MetaSuffix + ".tmp"}
+	for _, path := range stale {
+		os.WriteFile(path, []byte("half"), 0644)
+	}
+	if got := names(t, f, ""); got != name {
+		t.Errorf("Iterate with temp files: %s", got)
+	}
+
+	if f, err = NewFiles(root, DurabilityNone); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left: %v", path, err)
+		}
+	}
+	if got := read(t, f, name); got != "content" {
+		t.Errorf("content: %q", got)
+	}
+	if _, _, err := f.ReadMeta(name); err != nil {
+		t.Errorf("meta: %v", err)
+	}
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, d := range []Durability{DurabilityNone, DurabilityFile, DurabilityDir} {
+		if got, err := ParseDurability(d.String()); err != nil || got != d {
+			t.Errorf("ParseDurability(%q): %v, %v", d, got, err)
+		}
+	}
+	if _, err := ParseDurability("fsync"); err == nil {
+		t.Error("parsed fsync")
+	}
+}
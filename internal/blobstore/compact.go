@@ -0,0 +1,171 @@
+package blobstore
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// SegmentInfo describes a segment of a Packed store.
+type SegmentInfo struct {
+	ID   uint32 `json:"id"`
+	Size int64  `json:"size"`
+	// Live is the bytes of needles some name points at, the rest can be
+	// reclaimed by compacting the segment.
+	Live        int64 `json:"live"`
+	Reclaimable int64 `json:"reclaimable"`
+	// Active is the segment new blobs go to, which is never compacted.
+	Active bool `json:"active,omitempty"`
+}
+
+// Segments describes every segment, in order.
+func (p *Packed) Segments() []SegmentInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var segs []SegmentInfo
+	for id, size := range p.sizes {
+		segs = append(segs, SegmentInfo{
+			ID:          id,
+			Size:        size,
+			Live:        p.live[id],
+			Reclaimable: size - p.live[id],
+			Active:      id == p.active,
+		})
+	}
+	slices.SortFunc(segs, func(a, b SegmentInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return segs
+}
+
+type CompactOptions struct {
+	// MinLiveRatio is the share of live bytes below which a segment is
+	// compacted.
+	MinLiveRatio float64
+	// BytesPerSecond caps how fast needles are copied, 0 doesn't.
+	BytesPerSecond int64
+}
+
+type CompactReport struct {
+	// Segments are the segments that were compacted and deleted.
+	Segments  []uint32 `json:"segments"`
+	Moved     int      `json:"moved"`
+	Reclaimed int64    `json:"reclaimed"`
+}
+
+// Compact rewrites the segments whose live bytes are less than
+// MinLiveRatio of their size: it appends their live needles to the active
+// segment, points the index at the copies and deletes the segment. A name
+// that is written while its needle is copied keeps the new blob, the copy
+// is dead space. Reads and writes go on meanwhile, and one Compact runs
+// at a time.
+func (p *Packed) Compact(opts CompactOptions) (CompactReport, error) {
+	p.compacting.Lock()
+	defer p.compacting.Unlock()
+
+	report := CompactReport{Segments: []uint32{}}
+	t := &throttle{rate: opts.BytesPerSecond, start: time.Now()}
+	for _, seg := range p.Segments() {
+		if seg.Active || seg.Size > 0 && float64(seg.Live) >= opts.MinLiveRatio*float64(seg.Size) {
+			continue
+		}
+		moved, err := p.compactSegment(seg.ID, t)
+		report.Moved += moved
+		if err != nil {
+			return report, fmt.Errorf("compacting segment %d: %v", seg.ID, err)
+		}
+		report.Segments = append(report.Segments, seg.ID)
+		report.Reclaimed += seg.Size - seg.Live
+	}
+	return report, nil
+}
+
+func (p *Packed) compactSegment(id uint32, t *throttle) (int, error) {
+	type needle struct {
+		name string
+		loc  location
+	}
+	var needles []needle
+	p.mu.RLock()
+	for name, loc := range p.blobs {
+		if loc.seg == id {
+			needles = append(needles, needle{name, loc})
+		}
+	}
+	// only Compact closes a segment
+	f := p.segs[id]
+	p.mu.RUnlock()
+	slices.SortFunc(needles, func(a, b needle) int { return cmp.Compare(a.loc.off, b.loc.off) })
+
+	moved := 0
+	for _, n := range needles {
+		buf := make([]byte, n.loc.n)
+		if _, err := f.ReadAt(buf, n.loc.off); err != nil {
+			return moved, err
+		}
+		// the needle has the name it was written under, a renamed blob
+		// gets one with its new name
+		_, data, err := decodeNeedle(buf)
+		if err != nil {
+			return moved, fmt.Errorf("%s at %d: %w", n.name, n.loc.off, err)
+		}
+		copied := encodeNeedle(n.name, data)
+		t.wait(len(buf) + len(copied))
+
+		ok, err := p.move(n.name, n.loc, copied)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.live[id] != 0 {
+		return moved, fmt.Errorf("%d live bytes left after copying", p.live[id])
+	}
+	f.Close()
+	delete(p.segs, id)
+	delete(p.sizes, id)
+	delete(p.live, id)
+	if err := os.Remove(p.segmentPath(id)); err != nil {
+		log.Printf("Blobstore: Error removing segment %d: %v", id, err)
+	}
+	return moved, nil
+}
+
+// move appends the copy of name's needle at old and points name at it,
+// unless name was changed since.
+func (p *Packed) move(name string, old location, needle []byte) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur, ok := p.blobs[name]
+	if !ok || cur.seg != old.seg || cur.off != old.off {
+		return false, nil
+	}
+	loc, err := p.appendLocked(needle)
+	if err != nil {
+		return false, err
+	}
+	loc.size, loc.modTime = cur.size, cur.modTime
+	return true, p.commitLocked(name, loc)
+}
+
+// throttle keeps the bytes passed to wait to rate per second since start.
+type throttle struct {
+	rate  int64
+	start time.Time
+	done  int64
+}
+
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.done += int64(n)
+	due := t.start.Add(time.Duration(float64(t.done) / float64(t.rate) * float64(time.Second)))
+	time.Sleep(time.Until(due))
+}
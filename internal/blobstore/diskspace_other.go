@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package blobstore
+
+// diskSpace can't tell the space of dir on this system.
+func diskSpace(dir string) (total, free uint64) {
+	return 0, 0
+}
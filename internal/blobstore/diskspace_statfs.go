@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package blobstore
+
+import "syscall"
+
+// diskSpace returns the size of the file system dir is on and the bytes
+// free on it for unprivileged users.
+func diskSpace(dir string) (total, free uint64) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0
+	}
+	return uint64(st.Blocks) * uint64(st.Bsize), uint64(st.Bavail) * uint64(st.Bsize)
+}
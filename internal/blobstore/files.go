@@ -0,0 +1,323 @@
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/keys"
+)
+
+// MetaSuffix is appended to a blob's file name to name its meta file.
+// "~" never appears in a blob name.
+const MetaSuffix = "~meta"
+
+// tempSuffix marks the files a write goes to before it is renamed into
+// place.
+const tempSuffix = "~tmp"
+
+// Files keeps every blob in a file of its own, at keys.BlobPath under the
+// root, and its meta in a file next to it. A blob or meta is written to a
+// temp file next to it that is renamed over it, so a crash or a failed
+// upload leaves the old one.
+type Files struct {
+	root       string
+	durability Durability
+}
+
+// NewFiles returns the store in root, creating the directory if needed,
+// and deletes the temp files of writes a crash cut short.
+func NewFiles(root string, durability Durability) (*Files, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	f := &Files{root: filepath.Clean(root), durability: durability}
+	if err := f.removeTemps(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Files) removeTemps() error {
+	n := 0
+	err := filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// meta files used to be written through name~meta.tmp
+		if strings.Contains(d.Name(), tempSuffix) || strings.HasSuffix(d.Name(), MetaSuffix+".tmp") {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if n > 0 {
+		log.Printf("Blobstore: removed %d temp files of unfinished writes in %s", n, f.root)
+	}
+	return err
+}
+
+// Path is where the blob called name is stored.
+func (f *Files) Path(name string) string {
+	return keys.BlobPath(f.root, name)
+}
+
+func (f *Files) Put(name string, r io.Reader) (int64, error) {
+	return f.writeFile(f.Path(name), r)
+}
+
+// writeFile replaces path with what r yields through a temp file, synced
+// as the durability asks.
+func (f *Files) writeFile(path string, r io.Reader) (int64, error) {
+	dir := filepath.Dir(path)
+	if err := f.mkdir(dir); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+tempSuffix+"*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil && f.durability >= DurabilityFile {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return n, err
+	}
+	return n, f.syncDir(dir)
+}
+
+// mkdir creates dir and the directories above it in the root, and syncs
+// the directories that got a new entry.
+func (f *Files) mkdir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for d := dir; len(d) > len(f.root); d = filepath.Dir(d) {
+		if err := f.syncDir(filepath.Dir(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir fsyncs dir if the durability asks for it.
+func (f *Files) syncDir(dir string) error {
+	if f.durability < DurabilityDir {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fileBlob keeps the *os.File's SyscallConn, so serving it over HTTP can
+// still use sendfile.
+type fileBlob struct {
+	*os.File
+	info Info
+}
+
+func (b fileBlob) Info() Info { return b.info }
+
+func (f *Files) Open(name string) (Blob, error) {
+	file, err := os.Open(f.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fileBlob{file, fileInfo(name, st)}, nil
+}
+
+func (f *Files) Stat(name string) (Info, error) {
+	st, err := os.Stat(f.Path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return fileInfo(name, st), nil
+}
+
+func fileInfo(name string, st fs.FileInfo) Info {
+	return Info{Name: name, Size: st.Size(), ModTime: st.ModTime()}
+}
+
+func (f *Files) Delete(name string) error {
+	return os.Remove(f.Path(name))
+}
+
+func (f *Files) Rename(from, to string) error {
+	path := f.Path(to)
+	if err := f.mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Path(from), path); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return err
+	}
+	if err := f.syncDir(filepath.Dir(f.Path(from))); err != nil {
+		return err
+	}
+	return f.syncDir(filepath.Dir(path))
+}
+
+// Iterate walks both levels of directories in order, which yields the
+// names in order since they start with their directories, and skips the
+// directories before after without reading them.
+func (f *Files) Iterate(after string, fn func(Info) error) error {
+	top, err := dirsFrom(f.root, prefixOf(after, 0))
+	if err != nil {
+		return err
+	}
+	for _, d1 := range top {
+		// every directory below a later top level one comes after
+		from := ""
+		if d1 == prefixOf(after, 0) {
+			from = prefixOf(after, 2)
+		}
+		sub, err := dirsFrom(filepath.Join(f.root, d1), from)
+		if err != nil {
+			return err
+		}
+		for _, d2 := range sub {
+			dir := filepath.Join(f.root, d1, d2)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				name := e.Name()
+				// skips anything we didn't write, like meta files being
+				// replaced
+				if e.IsDir() || name <= after || !keys.ValidBlobName(name) {
+					continue
+				}
+				st, err := e.Info()
+				if os.IsNotExist(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := fn(fileInfo(name, st)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// prefixOf returns the directory name at offset i of a blob name, or ""
+// if name is too short to have one.
+func prefixOf(name string, i int) string {
+	if len(name) < i+2 {
+		return ""
+	}
+	return name[i : i+2]
+}
+
+// dirsFrom returns the blob directories in dir that sort at or after
+// from, in order.
+func dirsFrom(dir, from string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() && len(e.Name()) == 2 && e.Name() >= from {
+			dirs = append(dirs, e.Name())
+		}
+	}
+	return dirs, nil
+}
+
+func (f *Files) ReadMeta(name string) ([]byte, time.Time, error) {
+	file, err := os.Open(f.Path(name) + MetaSuffix)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	b, err := io.ReadAll(file)
+	return b, st.ModTime(), err
+}
+
+func (f *Files) WriteMeta(name string, meta []byte) error {
+	_, err := f.writeFile(f.Path(name)+MetaSuffix, bytes.NewReader(meta))
+	return err
+}
+
+func (f *Files) DeleteMeta(name string) error {
+	err := os.Remove(f.Path(name) + MetaSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *Files) Tombstones(fn func(name string, modTime time.Time) error) error {
+	return filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, ok := strings.CutSuffix(d.Name(), MetaSuffix)
+		if !ok || !keys.ValidBlobName(name) {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), name)); !os.IsNotExist(err) {
+			return nil
+		}
+		st, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(name, st.ModTime())
+	})
+}
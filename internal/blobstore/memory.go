@@ -0,0 +1,176 @@
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps blobs in RAM, for tests.
+type Memory struct {
+	mu    sync.Mutex
+	blobs map[string]memEntry
+	metas map[string]memEntry
+}
+
+type memEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{blobs: map[string]memEntry{}, metas: map[string]memEntry{}}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: ErrNotExist}
+}
+
+func (m *Memory) Put(name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[name] = memEntry{data, time.Now()}
+	return int64(len(data)), nil
+}
+
+// memBlob reads a blob as it was when it was opened, like a file that
+// is replaced by a rename.
+type memBlob struct {
+	*bytes.Reader
+	info Info
+}
+
+func (b memBlob) Info() Info   { return b.info }
+func (b memBlob) Close() error { return nil }
+
+func (m *Memory) Open(name string) (Blob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.blobs[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return memBlob{bytes.NewReader(e.data), e.info(name)}, nil
+}
+
+func (e memEntry) info(name string) Info {
+	return Info{Name: name, Size: int64(len(e.data)), ModTime: e.modTime}
+}
+
+func (m *Memory) Stat(name string) (Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.blobs[name]
+	if !ok {
+		return Info{}, notExist("stat", name)
+	}
+	return e.info(name), nil
+}
+
+func (m *Memory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blobs[name]; !ok {
+		return notExist("delete", name)
+	}
+	delete(m.blobs, name)
+	return nil
+}
+
+func (m *Memory) Rename(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.blobs[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	delete(m.blobs, from)
+	m.blobs[to] = memEntry{e.data, time.Now()}
+	return nil
+}
+
+// Iterate works on a copy, so fn may change the store.
+func (m *Memory) Iterate(after string, fn func(Info) error) error {
+	m.mu.Lock()
+	var infos []Info
+	for name, e := range m.blobs {
+		if name > after {
+			infos = append(infos, e.info(name))
+		}
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(infos, func(a, b Info) int { return strings.Compare(a.Name, b.Name) })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ReadMeta(name string) ([]byte, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.metas[name]
+	if !ok {
+		return nil, time.Time{}, notExist("read meta", name)
+	}
+	return bytes.Clone(e.data), e.modTime, nil
+}
+
+func (m *Memory) WriteMeta(name string, meta []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metas[name] = memEntry{bytes.Clone(meta), time.Now()}
+	return nil
+}
+
+func (m *Memory) DeleteMeta(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.metas, name)
+	return nil
+}
+
+func (m *Memory) Tombstones(fn func(name string, modTime time.Time) error) error {
+	m.mu.Lock()
+	var names []string
+	var times []time.Time
+	for name, e := range m.metas {
+		if _, ok := m.blobs[name]; !ok {
+			names, times = append(names, name), append(times, e.modTime)
+		}
+	}
+	m.mu.Unlock()
+
+	for i, name := range names {
+		if err := fn(name, times[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetModTime changes when a blob or its meta was last written, so tests
+// can make them old.
+func (m *Memory) SetModTime(name string, meta bool, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := m.blobs
+	if meta {
+		entries = m.metas
+	}
+	if e, ok := entries[name]; ok {
+		e.modTime = t
+		entries[name] = e
+	}
+}
@@ -0,0 +1,605 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multi spreads blobs over the stores of several disks. A blob and its
+// meta live on one disk, which new blobs are placed on by Placement. Reads
+// look on every disk, in the order hash placement prefers, so a blob is
+// found wherever it went.
+//
+// An error of a disk other than a missing blob marks it failed. A failed
+// disk is left alone until the process restarts: its blobs are missing and
+// new ones go to the other disks. When it comes back, Dedupe drops what
+// was rewritten or deleted elsewhere meanwhile.
+type Multi struct {
+	disks     []*disk
+	placement Placement
+}
+
+// Disk is a directory on a disk of its own and the store in it.
+type Disk struct {
+	Dir   string
+	Store Store
+	// Err is why the store couldn't be opened, if it couldn't. The disk
+	// starts out failed.
+	Err error
+}
+
+type Placement int
+
+const (
+	// PlaceByHash puts a blob on the disk its name hashes to, among those
+	// that haven't failed.
+	PlaceByHash Placement = iota
+	// PlaceByFreeSpace puts a blob on the disk with the most free space.
+	PlaceByFreeSpace
+)
+
+// ParsePlacement parses hash or free.
+func ParsePlacement(s string) (Placement, error) {
+	switch s {
+	case "hash":
+		return PlaceByHash, nil
+	case "free":
+		return PlaceByFreeSpace, nil
+	}
+	return 0, fmt.Errorf("blobstore: unknown placement %q, want hash or free", s)
+}
+
+type disk struct {
+	Disk
+
+	mu     sync.Mutex
+	failed error
+	since  time.Time
+}
+
+// DiskInfo describes a disk of a Multi store.
+type DiskInfo struct {
+	Dir    string    `json:"dir"`
+	Failed bool      `json:"failed"`
+	Error  string    `json:"error,omitempty"`
+	Since  time.Time `json:"since,omitzero"`
+	// Total and Free are the bytes of the file system, 0 where they can't
+	// be told.
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+// NewMulti returns a store over disks, which must not share directories.
+func NewMulti(disks []Disk, placement Placement) (*Multi, error) {
+	if len(disks) == 0 {
+		return nil, errors.New("blobstore: no disks")
+	}
+	m := &Multi{placement: placement}
+	seen := map[string]bool{}
+	for _, d := range disks {
+		dir := filepath.Clean(d.Dir)
+		if seen[dir] {
+			return nil, fmt.Errorf("blobstore: disk %s given twice", dir)
+		}
+		seen[dir] = true
+		if d.Err == nil && d.Store == nil {
+			return nil, fmt.Errorf("blobstore: disk %s has no store", dir)
+		}
+		nd := &disk{Disk: d}
+		if d.Err != nil {
+			nd.markFailed(d.Err)
+		}
+		m.disks = append(m.disks, nd)
+	}
+	return m, nil
+}
+
+// Healthy returns the disks that haven't failed.
+func (m *Multi) Healthy() []Disk {
+	var disks []Disk
+	for _, d := range m.disks {
+		if d.err() == nil {
+			disks = append(disks, d.Disk)
+		}
+	}
+	return disks
+}
+
+// Disks describes every disk, in the order they were given.
+func (m *Multi) Disks() []DiskInfo {
+	var infos []DiskInfo
+	for _, d := range m.disks {
+		info := DiskInfo{Dir: d.Dir}
+		if err := d.err(); err != nil {
+			info.Failed, info.Error = true, err.Error()
+			d.mu.Lock()
+			info.Since = d.since
+			d.mu.Unlock()
+		}
+		info.Total, info.Free = diskSpace(d.Dir)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// DiskFailed reports whether the i'th disk, in the order they were given,
+// has failed.
+func (m *Multi) DiskFailed(i int) bool {
+	return m.disks[i].err() != nil
+}
+
+// MarkFailed marks the i'th disk failed by err, for errors of what the
+// caller keeps on it besides the store.
+func (m *Multi) MarkFailed(i int, err error) {
+	m.disks[i].markFailed(err)
+}
+
+// DiskOf returns which disk, in the order they were given, holds the blob
+// called name.
+func (m *Multi) DiskOf(name string) (int, error) {
+	d, _, err := m.locate(name)
+	if err != nil {
+		return 0, err
+	}
+	return slices.Index(m.disks, d), nil
+}
+
+// Check writes a file to every disk that hasn't failed and marks those it
+// can't as failed, so a disk fails before a blob is lost to it.
+func (m *Multi) Check() {
+	for _, d := range m.disks {
+		if d.err() != nil {
+			continue
+		}
+		probe := filepath.Join(d.Dir, "probe"+tempSuffix)
+		err := os.WriteFile(probe, []byte("probe"), 0644)
+		if err == nil {
+			err = os.Remove(probe)
+		}
+		// even a missing directory
+		if err != nil {
+			d.markFailed(err)
+		}
+	}
+}
+
+func (d *disk) err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failed
+}
+
+// fail marks d failed by err, unless err is nil or about a missing blob.
+// It returns err.
+func (d *disk) fail(err error) error {
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		d.markFailed(err)
+	}
+	return err
+}
+
+func (d *disk) markFailed(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failed == nil {
+		log.Printf("Blobstore: Disk %s failed: %v", d.Dir, err)
+		d.failed, d.since = err, time.Now()
+	}
+}
+
+// order returns the disks that haven't failed, those that hash placement
+// prefers for name first.
+func (m *Multi) order(name string) []*disk {
+	type scored struct {
+		d     *disk
+		score uint64
+	}
+	var ds []scored
+	for _, d := range m.disks {
+		if d.err() != nil {
+			continue
+		}
+		h := fnv.New64a()
+		io.WriteString(h, d.Dir)
+		io.WriteString(h, "\x00"+name)
+		ds = append(ds, scored{d, h.Sum64()})
+	}
+	slices.SortFunc(ds, func(a, b scored) int {
+		if a.score > b.score {
+			return -1
+		}
+		if a.score < b.score {
+			return 1
+		}
+		return 0
+	})
+	var order []*disk
+	for _, s := range ds {
+		order = append(order, s.d)
+	}
+	return order
+}
+
+// locate returns the disk that holds the blob called name, or nil.
+func (m *Multi) locate(name string) (*disk, Info, error) {
+	for _, d := range m.order(name) {
+		info, err := d.Store.Stat(name)
+		if err == nil {
+			return d, info, nil
+		}
+		if !errors.Is(err, ErrNotExist) {
+			d.fail(err)
+		}
+	}
+	return nil, Info{}, notExist("stat", name)
+}
+
+// readerErr remembers the error of the reader, so a failed upload isn't
+// blamed on the disk.
+type readerErr struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readerErr) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (m *Multi) Put(name string, r io.Reader) (int64, error) {
+	order := m.order(name)
+	if len(order) == 0 {
+		return 0, errors.New("blobstore: every disk failed")
+	}
+	target := order[0]
+	if m.placement == PlaceByFreeSpace {
+		most := uint64(0)
+		for _, d := range order {
+			if _, free := diskSpace(d.Dir); free > most {
+				target, most = d, free
+			}
+		}
+	}
+	rr := &readerErr{r: r}
+	n, err := target.Store.Put(name, rr)
+	if err != nil {
+		if rr.err == nil {
+			target.fail(err)
+		}
+		return n, err
+	}
+	// the blob may have been on another disk before
+	for _, d := range order {
+		if d != target {
+			if err := d.Store.Delete(name); err != nil && !errors.Is(err, ErrNotExist) {
+				d.fail(err)
+			}
+		}
+	}
+	return n, nil
+}
+
+func (m *Multi) Open(name string) (Blob, error) {
+	for _, d := range m.order(name) {
+		b, err := d.Store.Open(name)
+		if err == nil {
+			return b, nil
+		}
+		if !errors.Is(err, ErrNotExist) {
+			d.fail(err)
+		}
+	}
+	return nil, notExist("open", name)
+}
+
+func (m *Multi) Stat(name string) (Info, error) {
+	_, info, err := m.locate(name)
+	return info, err
+}
+
+func (m *Multi) Delete(name string) error {
+	deleted := false
+	for _, d := range m.order(name) {
+		err := d.Store.Delete(name)
+		if err == nil {
+			deleted = true
+		} else if !errors.Is(err, ErrNotExist) {
+			return d.fail(err)
+		}
+	}
+	if !deleted {
+		return notExist("delete", name)
+	}
+	return nil
+}
+
+// Rename moves the blob within its disk.
+func (m *Multi) Rename(from, to string) error {
+	d, _, err := m.locate(from)
+	if err != nil {
+		return notExist("rename", from)
+	}
+	if err := d.Store.Rename(from, to); err != nil {
+		return d.fail(err)
+	}
+	for _, other := range m.order(to) {
+		if other != d {
+			if err := other.Store.Delete(to); err != nil && !errors.Is(err, ErrNotExist) {
+				other.fail(err)
+			}
+		}
+	}
+	return nil
+}
+
+// iteratePage is how many blobs Iterate reads from each disk at a time.
+const iteratePage = 1000
+
+// Iterate merges the disks' names a page at a time.
+func (m *Multi) Iterate(after string, fn func(Info) error) error {
+	return m.merge(after, func(info Info, _ []*disk) error { return fn(info) })
+}
+
+// merge calls fn for every name on the disks that sorts after after, in
+// name order, with the disks that hold it. info is that of the first.
+func (m *Multi) merge(after string, fn func(info Info, on []*disk) error) error {
+	type found struct {
+		info Info
+		d    *disk
+	}
+	for {
+		var all []found
+		// bound is the last name every disk with more to list has listed
+		bound, more := "", false
+		for _, d := range m.disks {
+			if d.err() != nil {
+				continue
+			}
+			page, full, err := listPage(d.Store, after)
+			if err != nil {
+				d.fail(err)
+				continue
+			}
+			for _, info := range page {
+				all = append(all, found{info, d})
+			}
+			if full && (!more || page[len(page)-1].Name < bound) {
+				bound, more = page[len(page)-1].Name, true
+			}
+		}
+		slices.SortStableFunc(all, func(a, b found) int { return strings.Compare(a.info.Name, b.info.Name) })
+		for i := 0; i < len(all); {
+			name := all[i].info.Name
+			if more && name > bound {
+				break
+			}
+			// a blob may be on two disks, for a moment or after a disk
+			// came back
+			var on []*disk
+			j := i
+			for ; j < len(all) && all[j].info.Name == name; j++ {
+				on = append(on, all[j].d)
+			}
+			if err := fn(all[i].info, on); err != nil {
+				return err
+			}
+			i = j
+		}
+		if !more {
+			return nil
+		}
+		after = bound
+	}
+}
+
+// Dedupe settles the blobs and metas that are on more than one disk, as a
+// disk that failed and came back may still hold what was since written or
+// deleted on another. The copy whose meta has the highest generation, as
+// told by generation, is kept and the others are deleted; a tie goes to
+// the newer meta. It returns how many copies it deleted from each disk.
+// Nothing else may use m meanwhile.
+func (m *Multi) Dedupe(generation func(meta []byte) uint64) []int {
+	removed := make([]int, len(m.disks))
+	m.merge("", func(info Info, on []*disk) error {
+		if len(on) > 1 {
+			m.settle(info.Name, generation, removed)
+		}
+		return nil
+	})
+	// a tombstone on one disk, the blob it deleted on another
+	for _, d := range m.disks {
+		if d.err() != nil {
+			continue
+		}
+		var names []string
+		err := d.Store.Tombstones(func(name string, _ time.Time) error {
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			d.fail(err)
+			continue
+		}
+		for _, name := range names {
+			m.settle(name, generation, removed)
+		}
+	}
+	return removed
+}
+
+// settle keeps the newest of the copies of name and deletes the others.
+func (m *Multi) settle(name string, generation func(meta []byte) uint64, removed []int) {
+	type held struct {
+		d       *disk
+		gen     uint64
+		modTime time.Time
+	}
+	var copies []held
+	for _, d := range m.order(name) {
+		_, statErr := d.Store.Stat(name)
+		meta, modTime, metaErr := d.Store.ReadMeta(name)
+		if statErr != nil && !errors.Is(statErr, ErrNotExist) {
+			d.fail(statErr)
+			continue
+		}
+		if metaErr != nil && !errors.Is(metaErr, ErrNotExist) {
+			d.fail(metaErr)
+			continue
+		}
+		if statErr != nil && metaErr != nil {
+			continue
+		}
+		c := held{d: d, modTime: modTime}
+		if metaErr == nil {
+			c.gen = generation(meta)
+		}
+		copies = append(copies, c)
+	}
+	if len(copies) < 2 {
+		return
+	}
+	keep := 0
+	for i, c := range copies {
+		if c.gen > copies[keep].gen || c.gen == copies[keep].gen && c.modTime.After(copies[keep].modTime) {
+			keep = i
+		}
+	}
+	for i, c := range copies {
+		if i == keep {
+			continue
+		}
+		if err := c.d.Store.Delete(name); err != nil && !errors.Is(err, ErrNotExist) {
+			c.d.fail(err)
+			continue
+		}
+		if err := c.d.Store.DeleteMeta(name); err != nil && !errors.Is(err, ErrNotExist) {
+			c.d.fail(err)
+			continue
+		}
+		log.Printf("Blobstore: Deleted %s of generation %d from %s, %s has generation %d", name, c.gen, c.d.Dir, copies[keep].d.Dir, copies[keep].gen)
+		removed[slices.Index(m.disks, c.d)]++
+	}
+}
+
+var errPageFull = errors.New("page full")
+
+// listPage returns up to iteratePage blobs of s after after, and whether
+// there may be more.
+func listPage(s Store, after string) ([]Info, bool, error) {
+	var page []Info
+	err := s.Iterate(after, func(info Info) error {
+		page = append(page, info)
+		if len(page) == iteratePage {
+			return errPageFull
+		}
+		return nil
+	})
+	if err == errPageFull {
+		return page, true, nil
+	}
+	return page, false, err
+}
+
+// metaDisk returns the disk that holds the meta of name, or nil.
+func (m *Multi) metaDisk(name string) (*disk, []byte, time.Time) {
+	for _, d := range m.order(name) {
+		b, modTime, err := d.Store.ReadMeta(name)
+		if err == nil {
+			return d, b, modTime
+		}
+		if !errors.Is(err, ErrNotExist) {
+			d.fail(err)
+		}
+	}
+	return nil, nil, time.Time{}
+}
+
+func (m *Multi) ReadMeta(name string) ([]byte, time.Time, error) {
+	d, b, modTime := m.metaDisk(name)
+	if d == nil {
+		return nil, time.Time{}, notExist("read meta", name)
+	}
+	return b, modTime, nil
+}
+
+// WriteMeta writes the meta next to the blob, or where the meta already
+// is if the blob is gone.
+func (m *Multi) WriteMeta(name string, meta []byte) error {
+	d, _, err := m.locate(name)
+	if err != nil {
+		d, _, _ = m.metaDisk(name)
+	}
+	if d == nil {
+		order := m.order(name)
+		if len(order) == 0 {
+			return errors.New("blobstore: every disk failed")
+		}
+		d = order[0]
+	}
+	if err := d.Store.WriteMeta(name, meta); err != nil {
+		return d.fail(err)
+	}
+	// a meta left on another disk would shadow this one
+	for _, other := range m.order(name) {
+		if other != d {
+			other.fail(other.Store.DeleteMeta(name))
+		}
+	}
+	return nil
+}
+
+func (m *Multi) DeleteMeta(name string) error {
+	for _, d := range m.order(name) {
+		if err := d.Store.DeleteMeta(name); err != nil {
+			return d.fail(err)
+		}
+	}
+	return nil
+}
+
+func (m *Multi) Tombstones(fn func(name string, modTime time.Time) error) error {
+	for _, d := range m.disks {
+		if d.err() != nil {
+			continue
+		}
+		var fnErr error
+		err := d.Store.Tombstones(func(name string, modTime time.Time) error {
+			// the blob may be on another disk
+			if _, err := m.Stat(name); err == nil {
+				return nil
+			}
+			fnErr = fn(name, modTime)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			return d.fail(err)
+		}
+	}
+	return nil
+}
+
+// Close closes the stores of the disks that can be closed.
+func (m *Multi) Close() error {
+	var errs []error
+	for _, d := range m.disks {
+		if c, ok := d.Store.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,223 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alvinliju/tinydb/internal/keys"
+)
+
+// brokenStore fails everything once broken, like a disk that died.
+type brokenStore struct {
+	*Memory
+	broken bool
+}
+
+var errIO = errors.New("input/output error")
+
+func (s *brokenStore) Put(name string, r io.Reader) (int64, error) {
+	if s.broken {
+		return 0, errIO
+	}
+	return s.Memory.Put(name, r)
+}
+
+func (s *brokenStore) Open(name string) (Blob, error) {
+	if s.broken {
+		return nil, errIO
+	}
+	return s.Memory.Open(name)
+}
+
+func (s *brokenStore) Stat(name string) (Info, error) {
+	if s.broken {
+		return Info{}, errIO
+	}
+	return s.Memory.Stat(name)
+}
+
+func multi(t *testing.T, placement Placement, stores ...Store) *Multi {
+	t.Helper()
+	var disks []Disk
+	for _, s := range stores {
+		disks = append(disks, Disk{Dir: t.TempDir(), Store: s})
+	}
+	m, err := NewMulti(disks, placement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMultiSpreadsByHash(t *testing.T) {
+	a, b := NewMemory(), NewMemory()
+	m := multi(t, PlaceByHash, a, b)
+	// more than a page of Iterate on each disk
+	for i := range 2500 {
+		put(t, m, keys.BlobName(fmt.Sprint(i), ""), "x")
+	}
+	if len(a.blobs) < 1000 || len(b.blobs) < 1000 {
+		t.Errorf("%d and %d blobs on the disks", len(a.blobs), len(b.blobs))
+	}
+
+	n, last := 0, ""
+	if err := m.Iterate("", func(info Info) error {
+		if info.Name <= last {
+			t.Fatalf("%s after %s", info.Name, last)
+		}
+		n, last = n+1, info.Name
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2500 {
+		t.Errorf("iterated %d blobs", n)
+	}
+
+	// an overwrite that lands elsewhere leaves no old copy
+	name := keys.BlobName("moved", "")
+	put(t, m, name, "old")
+	d, _, _ := m.locate(name)
+	other := m.disks[0]
+	if other == d {
+		other = m.disks[1]
+	}
+	other.Store.Put(name, strings.NewReader("stale"))
+	put(t, m, name, "new")
+	if _, err := other.Store.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("old copy left: %v", err)
+	}
+}
+
+func TestMultiByFreeSpace(t *testing.T) {
+	m := multi(t, PlaceByFreeSpace, NewMemory(), NewMemory())
+	for i := range 10 {
+		put(t, m, keys.BlobName(fmt.Sprint(i), ""), "x")
+	}
+	for i := range 10 {
+		if got := read(t, m, keys.BlobName(fmt.Sprint(i), "")); got != "x" {
+			t.Errorf("blob %d: %q", i, got)
+		}
+	}
+}
+
+func TestMultiDiskFailure(t *testing.T) {
+	good, bad := NewMemory(), &brokenStore{Memory: NewMemory()}
+	m := multi(t, PlaceByHash, good, bad)
+	var onBad string
+	for i := 0; onBad == ""; i++ {
+		name := keys.BlobName(fmt.Sprint(i), "")
+		put(t, m, name, "content")
+		if _, ok := bad.blobs[name]; ok {
+			onBad = name
+		}
+	}
+
+	// a failed upload is no disk failure
+	if _, err := m.Put(onBad, &failingReader{3}); err == nil {
+		t.Fatal("Put of a failing reader worked")
+	}
+	if disks := m.Disks(); disks[1].Failed {
+		t.Fatalf("disk failed by an upload: %+v", disks[1])
+	}
+
+	bad.broken = true
+	if _, err := m.Open(onBad); !os.IsNotExist(err) {
+		t.Errorf("Open of a blob on the failed disk: %v", err)
+	}
+	disks := m.Disks()
+	if disks[0].Failed || !disks[1].Failed || disks[1].Error != errIO.Error() || disks[1].Since.IsZero() {
+		t.Errorf("disks: %+v", disks)
+	}
+	// writes go on, to the disk that is left
+	put(t, m, onBad, "rewritten")
+	if got := read(t, m, onBad); got != "rewritten" {
+		t.Errorf("after rewriting: %q", got)
+	}
+	if _, ok := good.blobs[onBad]; !ok {
+		t.Error("rewritten blob isn't on the good disk")
+	}
+}
+
+func TestMultiCheck(t *testing.T) {
+	m := multi(t, PlaceByHash, NewMemory(), NewMemory())
+	m.Check()
+	os.RemoveAll(m.disks[1].Dir)
+	m.Check()
+	if disks := m.Disks(); disks[0].Failed || !disks[1].Failed {
+		t.Errorf("disks: %+v", disks)
+	}
+	if _, err := NewMulti([]Disk{{Dir: "a", Store: NewMemory()}, {Dir: "a/", Store: NewMemory()}}, PlaceByHash); err == nil {
+		t.Error("took a disk twice")
+	}
+
+	// a disk that can't be opened starts out failed
+	m, err := NewMulti([]Disk{{Dir: t.TempDir(), Store: NewMemory()}, {Dir: "gone", Err: errIO}}, PlaceByHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disks := m.Disks(); !disks[1].Failed || len(m.Healthy()) != 1 {
+		t.Errorf("disks: %+v", disks)
+	}
+	put(t, m, keys.BlobName("k", ""), "content")
+}
+
+func TestMultiDedupe(t *testing.T) {
+	good, bad := NewMemory(), &brokenStore{Memory: NewMemory()}
+	m := multi(t, PlaceByHash, good, bad)
+	// three blobs on the disk that fails: one rewritten while it is gone,
+	// one deleted and one left alone
+	var onBad []string
+	for i := 0; len(onBad) < 3; i++ {
+		name := keys.BlobName(fmt.Sprint(i), "")
+		put(t, m, name, "old")
+		if err := m.WriteMeta(name, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := bad.blobs[name]; ok {
+			onBad = append(onBad, name)
+		}
+	}
+	rewritten, deleted, kept := onBad[0], onBad[1], onBad[2]
+
+	bad.broken = true
+	m.Open(rewritten)
+	put(t, m, rewritten, "new")
+	if err := m.WriteMeta(rewritten, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteMeta(deleted, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the disk comes back after a restart
+	bad.broken = false
+	m = multi(t, PlaceByHash, good, bad)
+	generation := func(meta []byte) uint64 {
+		gen, _ := strconv.ParseUint(string(meta), 10, 64)
+		return gen
+	}
+	if removed := m.Dedupe(generation); removed[0] != 0 || removed[1] != 2 {
+		t.Errorf("removed %v, want 2 from the disk that came back", removed)
+	}
+	if got := read(t, m, rewritten); got != "new" {
+		t.Errorf("rewritten blob: %q", got)
+	}
+	if _, err := m.Stat(deleted); !os.IsNotExist(err) {
+		t.Errorf("deleted blob: %v", err)
+	}
+	if meta, _, err := m.ReadMeta(deleted); err != nil || string(meta) != "2" {
+		t.Errorf("tombstone of the deleted blob: %q, %v", meta, err)
+	}
+	if got := read(t, m, kept); got != "old" {
+		t.Errorf("blob left alone: %q", got)
+	}
+	if _, ok := bad.blobs[rewritten]; ok {
+		t.Error("old copy left on the disk that came back")
+	}
+}
@@ -0,0 +1,557 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Packed appends small blobs to large segment files, so millions of them
+// don't cost millions of inodes, and reads one with a single pread. Blobs
+// larger than MaxBlobSize get a file of their own, as in Files.
+//
+// A blob in a segment is a needle:
+//
+//	magic | crc32c of the rest | uint16 name length | uint32 data length | name | data
+//
+// The name lets a segment be read without the index. Where every blob is
+// lives in a leveldb under index/, together with all the metas, and in
+// memory. A blob that is overwritten, renamed or deleted leaves its needle
+// behind as dead space, which Compact reclaims.
+type Packed struct {
+	root string
+	opts PackedOptions
+	// files holds the blobs that are too large to pack
+	files *Files
+	index *leveldb.DB
+	// writeOpts syncs index writes if the durability asks for it
+	writeOpts *opt.WriteOptions
+
+	mu    sync.RWMutex
+	blobs map[string]location
+	segs  map[uint32]*os.File
+	// sizes and live are the bytes in every segment and the bytes of its
+	// needles that a name still points at
+	sizes  map[uint32]int64
+	live   map[uint32]int64
+	active uint32
+	// end is where the next needle goes in the active segment
+	end int64
+
+	compacting sync.Mutex
+}
+
+type PackedOptions struct {
+	// MaxBlobSize is the largest blob that goes into a segment.
+	MaxBlobSize int64
+	// SegmentSize is the size after which a new segment is started.
+	SegmentSize int64
+	// Durability applies to the segments and the index as well as to the
+	// blob files.
+	Durability Durability
+}
+
+var DefaultPackedOptions = PackedOptions{
+	MaxBlobSize: 64 << 10,
+	SegmentSize: 1 << 30,
+}
+
+// location is where a blob is. Segment 0 means it is in a file of its own.
+type location struct {
+	seg uint32
+	off int64
+	// n is the length of the needle
+	n       uint32
+	size    int64
+	modTime time.Time
+}
+
+const (
+	needleMagic  = 0x544e444c // "TNDL"
+	needleHeader = 4 + 4 + 2 + 4
+
+	// index keys: blobPrefix + name to its location, metaPrefix + name to
+	// the meta's mtime and the meta
+	blobPrefix = "b"
+	metaPrefix = "m"
+	// versionKey marks an index that has adopted what Files left in the
+	// root
+	versionKey = "\x00version"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorrupt = errors.New("blobstore: corrupt needle")
+
+// OpenPacked opens the packed store in root. Blobs that a Files store
+// left in root are taken over the first time.
+func OpenPacked(root string, opts PackedOptions) (*Packed, error) {
+	if opts.MaxBlobSize <= 0 || opts.MaxBlobSize > 1<<30 || opts.SegmentSize <= 0 {
+		return nil, fmt.Errorf("blobstore: blobs up to %d bytes in segments of %d make no sense", opts.MaxBlobSize, opts.SegmentSize)
+	}
+	files, err := NewFiles(root, opts.Durability)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(root, "segments"), 0755); err != nil {
+		return nil, err
+	}
+	index, err := leveldb.OpenFile(filepath.Join(root, "index"), nil)
+	if err != nil {
+		return nil, err
+	}
+	p := &Packed{
+		root:      root,
+		opts:      opts,
+		files:     files,
+		index:     index,
+		writeOpts: &opt.WriteOptions{Sync: opts.Durability >= DurabilityFile},
+		blobs:     map[string]location{},
+		segs:      map[uint32]*os.File{},
+		sizes:     map[uint32]int64{},
+		live:      map[uint32]int64{},
+	}
+	if err := p.load(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Packed) load() error {
+	if _, err := p.index.Get([]byte(versionKey), nil); err == leveldb.ErrNotFound {
+		if err := p.adopt(); err != nil {
+			return fmt.Errorf("taking over the blobs in %s: %v", p.root, err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	iter := p.index.NewIterator(util.BytesPrefix([]byte(blobPrefix)), nil)
+	for iter.Next() {
+		loc, err := decodeLocation(iter.Value())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		p.blobs[string(iter.Key()[len(blobPrefix):])] = loc
+		if loc.seg != 0 {
+			p.live[loc.seg] += int64(loc.n)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(p.root, "segments"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, ok := segmentID(e.Name())
+		if !ok {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(p.root, "segments", e.Name()), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		p.segs[id] = f
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		p.sizes[id] = st.Size()
+		p.active = max(p.active, id)
+	}
+	if p.active == 0 {
+		return p.startSegment()
+	}
+	p.end = p.sizes[p.active]
+	return nil
+}
+
+// adopt indexes the blobs and metas a Files store keeps in the root. The
+// blobs stay in their files.
+func (p *Packed) adopt() error {
+	batch := new(leveldb.Batch)
+	err := p.files.Iterate("", func(info Info) error {
+		batch.Put([]byte(blobPrefix+info.Name), location{size: info.Size, modTime: info.ModTime}.encode())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var metas []string
+	adoptMeta := func(name string) error {
+		meta, modTime, err := p.files.ReadMeta(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte(metaPrefix+name), encodeMeta(meta, modTime))
+		metas = append(metas, name)
+		return nil
+	}
+	err = p.files.Iterate("", func(info Info) error { return adoptMeta(info.Name) })
+	if err == nil {
+		err = p.files.Tombstones(func(name string, _ time.Time) error { return adoptMeta(name) })
+	}
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(versionKey), []byte("1"))
+	if err := p.index.Write(batch, p.writeOpts); err != nil {
+		return err
+	}
+	for _, name := range metas {
+		p.files.DeleteMeta(name)
+	}
+	if batch.Len() > 1 {
+		log.Printf("Blobstore: took over %d blobs and metas in %s", batch.Len()-1, p.root)
+	}
+	return nil
+}
+
+func segmentID(fileName string) (uint32, bool) {
+	s, ok := strings.CutSuffix(fileName, ".seg")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err == nil && id > 0
+}
+
+func (p *Packed) segmentPath(id uint32) string {
+	return filepath.Join(p.root, "segments", fmt.Sprintf("%08d.seg", id))
+}
+
+// startSegment makes a new, empty segment the active one. p.mu must be
+// held, or p not shared yet.
+func (p *Packed) startSegment() error {
+	id := p.active + 1
+	f, err := os.OpenFile(p.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if p.opts.Durability >= DurabilityDir {
+		if err := syncDir(filepath.Dir(f.Name())); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	p.segs[id] = f
+	p.sizes[id] = 0
+	p.active, p.end = id, 0
+	return nil
+}
+
+func (p *Packed) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range p.segs {
+		f.Close()
+	}
+	return p.index.Close()
+}
+
+func (l location) encode() []byte {
+	b := make([]byte, 0, 32)
+	b = binary.BigEndian.AppendUint32(b, l.seg)
+	b = binary.BigEndian.AppendUint64(b, uint64(l.off))
+	b = binary.BigEndian.AppendUint32(b, l.n)
+	b = binary.BigEndian.AppendUint64(b, uint64(l.size))
+	return binary.BigEndian.AppendUint64(b, uint64(l.modTime.UnixNano()))
+}
+
+func decodeLocation(b []byte) (location, error) {
+	if len(b) != 32 {
+		return location{}, fmt.Errorf("blobstore: bad index entry of %d bytes", len(b))
+	}
+	return location{
+		seg:     binary.BigEndian.Uint32(b),
+		off:     int64(binary.BigEndian.Uint64(b[4:])),
+		n:       binary.BigEndian.Uint32(b[12:]),
+		size:    int64(binary.BigEndian.Uint64(b[16:])),
+		modTime: time.Unix(0, int64(binary.BigEndian.Uint64(b[24:]))),
+	}, nil
+}
+
+func (l location) info(name string) Info {
+	return Info{Name: name, Size: l.size, ModTime: l.modTime}
+}
+
+func encodeMeta(meta []byte, modTime time.Time) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(modTime.UnixNano())), meta...)
+}
+
+func encodeNeedle(name string, data []byte) []byte {
+	b := make([]byte, needleHeader, needleHeader+len(name)+len(data))
+	binary.BigEndian.PutUint32(b, needleMagic)
+	binary.BigEndian.PutUint16(b[8:], uint16(len(name)))
+	binary.BigEndian.PutUint32(b[10:], uint32(len(data)))
+	b = append(append(b, name...), data...)
+	binary.BigEndian.PutUint32(b[4:], crc32.Checksum(b[8:], castagnoli))
+	return b
+}
+
+// decodeNeedle returns the name and data of the needle in b.
+func decodeNeedle(b []byte) (string, []byte, error) {
+	if len(b) < needleHeader || binary.BigEndian.Uint32(b) != needleMagic {
+		return "", nil, errCorrupt
+	}
+	nameLen := int(binary.BigEndian.Uint16(b[8:]))
+	dataLen := int(binary.BigEndian.Uint32(b[10:]))
+	if len(b) != needleHeader+nameLen+dataLen || crc32.Checksum(b[8:], castagnoli) != binary.BigEndian.Uint32(b[4:]) {
+		return "", nil, errCorrupt
+	}
+	return string(b[needleHeader : needleHeader+nameLen]), b[needleHeader+nameLen:], nil
+}
+
+func (p *Packed) Put(name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(io.LimitReader(r, p.opts.MaxBlobSize+1))
+	if err != nil {
+		return int64(len(data)), err
+	}
+	if int64(len(data)) > p.opts.MaxBlobSize {
+		n, err := p.files.Put(name, io.MultiReader(bytes.NewReader(data), r))
+		if err != nil {
+			return n, err
+		}
+		return n, p.commit(name, location{size: n, modTime: time.Now()})
+	}
+
+	needle := encodeNeedle(name, data)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, err := p.appendLocked(needle)
+	if err != nil {
+		return 0, err
+	}
+	loc.size, loc.modTime = int64(len(data)), time.Now()
+	return loc.size, p.commitLocked(name, loc)
+}
+
+// appendLocked writes a needle to the active segment, or a new one if it
+// is full, and returns where. p.mu must be held.
+func (p *Packed) appendLocked(needle []byte) (location, error) {
+	if p.end > 0 && p.end+int64(len(needle)) > p.opts.SegmentSize {
+		if err := p.startSegment(); err != nil {
+			return location{}, err
+		}
+	}
+	loc := location{seg: p.active, off: p.end, n: uint32(len(needle))}
+	if _, err := p.segs[p.active].WriteAt(needle, p.end); err != nil {
+		return location{}, err
+	}
+	// a needle the index doesn't point at yet is dead space after a crash
+	if p.opts.Durability >= DurabilityFile {
+		if err := p.segs[p.active].Sync(); err != nil {
+			return location{}, err
+		}
+	}
+	p.end += int64(len(needle))
+	p.sizes[p.active] = p.end
+	return loc, nil
+}
+
+func (p *Packed) commit(name string, loc location) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.commitLocked(name, loc)
+}
+
+// commitLocked points name at loc, in the index and in memory.
+func (p *Packed) commitLocked(name string, loc location) error {
+	if err := p.index.Put([]byte(blobPrefix+name), loc.encode(), p.writeOpts); err != nil {
+		return err
+	}
+	old, ok := p.blobs[name]
+	p.blobs[name] = loc
+	if loc.seg != 0 {
+		p.live[loc.seg] += int64(loc.n)
+	}
+	if ok {
+		p.forget(name, old, loc.seg == 0)
+	}
+	return nil
+}
+
+// forget is told of a blob that name no longer points at. Its file is
+// deleted unless it was replaced in place, a needle is left as dead space.
+func (p *Packed) forget(name string, old location, replaced bool) {
+	if old.seg != 0 {
+		p.live[old.seg] -= int64(old.n)
+		return
+	}
+	if !replaced {
+		if err := p.files.Delete(name); err != nil && !os.IsNotExist(err) {
+			log.Printf("Blobstore: Error removing %s: %v", name, err)
+		}
+	}
+}
+
+// remove drops name from the index. p.mu must be held.
+func (p *Packed) remove(name string, old location) error {
+	if err := p.index.Delete([]byte(blobPrefix+name), p.writeOpts); err != nil {
+		return err
+	}
+	delete(p.blobs, name)
+	p.forget(name, old, false)
+	return nil
+}
+
+// packedBlob is a needle's data, read in one go.
+type packedBlob struct {
+	*bytes.Reader
+	info Info
+}
+
+func (b packedBlob) Info() Info   { return b.info }
+func (b packedBlob) Close() error { return nil }
+
+func (p *Packed) Open(name string) (Blob, error) {
+	p.mu.RLock()
+	loc, ok := p.blobs[name]
+	if !ok {
+		p.mu.RUnlock()
+		return nil, notExist("open", name)
+	}
+	if loc.seg == 0 {
+		p.mu.RUnlock()
+		return p.files.Open(name)
+	}
+	buf := make([]byte, loc.n)
+	_, err := p.segs[loc.seg].ReadAt(buf, loc.off)
+	p.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := decodeNeedle(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s in segment %d at %d: %w", name, loc.seg, loc.off, err)
+	}
+	return packedBlob{bytes.NewReader(data), loc.info(name)}, nil
+}
+
+func (p *Packed) Stat(name string) (Info, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	loc, ok := p.blobs[name]
+	if !ok {
+		return Info{}, notExist("stat", name)
+	}
+	return loc.info(name), nil
+}
+
+func (p *Packed) Delete(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.blobs[name]
+	if !ok {
+		return notExist("delete", name)
+	}
+	return p.remove(name, loc)
+}
+
+func (p *Packed) Rename(from, to string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.blobs[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	if loc.seg == 0 {
+		if err := p.files.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	old, replaced := p.blobs[to]
+	loc.modTime = time.Now()
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(blobPrefix + from))
+	batch.Put([]byte(blobPrefix+to), loc.encode())
+	if err := p.index.Write(batch, p.writeOpts); err != nil {
+		return err
+	}
+	delete(p.blobs, from)
+	p.blobs[to] = loc
+	if replaced {
+		p.forget(to, old, loc.seg == 0)
+	}
+	return nil
+}
+
+// Iterate reads the index, so fn may change the store.
+func (p *Packed) Iterate(after string, fn func(Info) error) error {
+	iter := p.index.NewIterator(util.BytesPrefix([]byte(blobPrefix)), nil)
+	defer iter.Release()
+	ok := iter.Seek([]byte(blobPrefix + after))
+	if ok && string(iter.Key()) == blobPrefix+after {
+		ok = iter.Next()
+	}
+	for ; ok; ok = iter.Next() {
+		loc, err := decodeLocation(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(loc.info(string(iter.Key()[len(blobPrefix):]))); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (p *Packed) ReadMeta(name string) ([]byte, time.Time, error) {
+	v, err := p.index.Get([]byte(metaPrefix+name), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, time.Time{}, notExist("read meta", name)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(v) < 8 {
+		return nil, time.Time{}, fmt.Errorf("blobstore: bad meta of %s", name)
+	}
+	return v[8:], time.Unix(0, int64(binary.BigEndian.Uint64(v))), nil
+}
+
+func (p *Packed) WriteMeta(name string, meta []byte) error {
+	return p.index.Put([]byte(metaPrefix+name), encodeMeta(meta, time.Now()), p.writeOpts)
+}
+
+func (p *Packed) DeleteMeta(name string) error {
+	return p.index.Delete([]byte(metaPrefix+name), p.writeOpts)
+}
+
+func (p *Packed) Tombstones(fn func(name string, modTime time.Time) error) error {
+	iter := p.index.NewIterator(util.BytesPrefix([]byte(metaPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		name := string(iter.Key()[len(metaPrefix):])
+		if _, err := p.Stat(name); err == nil || len(iter.Value()) < 8 {
+			continue
+		}
+		if err := fn(name, time.Unix(0, int64(binary.BigEndian.Uint64(iter.Value())))); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
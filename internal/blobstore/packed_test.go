@@ -0,0 +1,193 @@
+package blobstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvinliju/tinydb/internal/keys"
+)
+
+func openPacked(t *testing.T, root string) *Packed {
+	t.Helper()
+	p, err := OpenPacked(root, PackedOptions{MaxBlobSize: 16, SegmentSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func segments(t *testing.T, root string) int {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(root, "segments"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestPackedLayout(t *testing.T) {
+	root := t.TempDir()
+	p := openPacked(t, root)
+	defer p.Close()
+
+	small, large := keys.BlobName("small", ""), keys.BlobName("large", "")
+	put(t, p, small, "tiny")
+	put(t, p, large, strings.Repeat("x", 17))
+	if _, err := os.Stat(p.files.Path(small)); !os.IsNotExist(err) {
+		t.Errorf("small blob has a file: %v", err)
+	}
+	if _, err := os.Stat(p.files.Path(large)); err != nil {
+		t.Errorf("large blob has no file: %v", err)
+	}
+	// shrinking a large blob packs it and drops its file
+	put(t, p, large, "now small")
+	if _, err := os.Stat(p.files.Path(large)); !os.IsNotExist(err) {
+		t.Errorf("file of a packed blob left behind: %v", err)
+	}
+
+	// every needle here is over 70 bytes, so each one starts a segment
+	for i := range 3 {
+		put(t, p, keys.BlobName("k", ""), strings.Repeat("y", i+1))
+	}
+	if n := segments(t, root); n < 3 {
+		t.Errorf("%d segments", n)
+	}
+}
+
+func TestPackedReopen(t *testing.T) {
+	root := t.TempDir()
+	p := openPacked(t, root)
+	a, b := keys.BlobName("a", ""), keys.BlobName("b", "")
+	put(t, p, a, "packed")
+	put(t, p, b, strings.Repeat("z", 40))
+	p.WriteMeta(a, []byte("{}"))
+	p.Close()
+
+	p = openPacked(t, root)
+	defer p.Close()
+	if got := read(t, p, a); got != "packed" {
+		t.Errorf("packed blob after reopening: %q", got)
+	}
+	if got := read(t, p, b); got != strings.Repeat("z", 40) {
+		t.Errorf("large blob after reopening: %q", got)
+	}
+	if meta, _, err := p.ReadMeta(a); err != nil || string(meta) != "{}" {
+		t.Errorf("meta after reopening: %s, %v", meta, err)
+	}
+	// appends go on after what is there
+	put(t, p, keys.BlobName("c", ""), "more")
+	if got := read(t, p, a); got != "packed" {
+		t.Errorf("packed blob after another put: %q", got)
+	}
+}
+
+func TestPackedAdoptsFiles(t *testing.T) {
+	root := t.TempDir()
+	files, err := NewFiles(root, DurabilityNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, gone := keys.BlobName("kept", ""), keys.BlobName("gone", "")
+	put(t, files, kept, "from before")
+	files.WriteMeta(kept, []byte(`{"generation":1}`))
+	files.WriteMeta(gone, []byte(`{"deleted":true}`))
+
+	p := openPacked(t, root)
+	defer p.Close()
+	if got := read(t, p, kept); got != "from before" {
+		t.Errorf("adopted blob: %q", got)
+	}
+	if meta, _, err := p.ReadMeta(kept); err != nil || string(meta) != `{"generation":1}` {
+		t.Errorf("adopted meta: %s, %v", meta, err)
+	}
+	var tombstones []string
+	p.Tombstones(func(name string, _ time.Time) error {
+		tombstones = append(tombstones, name)
+		return nil
+	})
+	if len(tombstones) != 1 || tombstones[0] != gone {
+		t.Errorf("adopted tombstones: %v", tombstones)
+	}
+	// the metas moved into the index
+	if _, _, err := files.ReadMeta(kept); !os.IsNotExist(err) {
+		t.Errorf("meta file left behind: %v", err)
+	}
+}
+
+func TestPackedCorruptNeedle(t *testing.T) {
+	root := t.TempDir()
+	p := openPacked(t, root)
+	defer p.Close()
+	name := keys.BlobName("k", "")
+	put(t, p, name, "content")
+
+	loc := p.blobs[name]
+	// flip the last byte of the data
+	f := p.segs[loc.seg]
+	b := make([]byte, 1)
+	f.ReadAt(b, loc.off+int64(loc.n)-1)
+	b[0] ^= 0xff
+	f.WriteAt(b, loc.off+int64(loc.n)-1)
+	if _, err := p.Open(name); err == nil {
+		t.Error("read a corrupt needle")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	root := t.TempDir()
+	opts := PackedOptions{MaxBlobSize: 16, SegmentSize: 200}
+	p, err := OpenPacked(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { p.Close() }()
+
+	// two needles to a segment
+	var names []string
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		names = append(names, keys.BlobName(k, ""))
+		put(t, p, names[len(names)-1], "content "+k)
+	}
+	p.Delete(names[0])
+	put(t, p, names[2], "new c")
+	renamed := keys.BlobName("b", "v1")
+	p.Rename(names[1], renamed)
+
+	segs := p.Segments()
+	if len(segs) != 4 || segs[0].Reclaimable != segs[0].Size/2 || segs[1].Reclaimable != segs[1].Size/2 || segs[2].Reclaimable != 0 || !segs[3].Active {
+		t.Fatalf("segments: %+v", segs)
+	}
+	report, err := p.Compact(CompactOptions{MinLiveRatio: 0.6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Segments) != 2 || report.Moved != 2 || report.Reclaimed != segs[0].Reclaimable+segs[1].Reclaimable {
+		t.Errorf("report: %+v", report)
+	}
+	if n := segments(t, root); n != len(p.Segments()) {
+		t.Errorf("%d segment files for %+v", n, p.Segments())
+	}
+	for _, s := range p.Segments() {
+		if s.ID <= 2 {
+			t.Errorf("segment %d left", s.ID)
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		for name, want := range map[string]string{renamed: "content b", names[2]: "new c", names[3]: "content d", names[5]: "content f"} {
+			if got := read(t, p, name); got != want {
+				t.Errorf("%s: %q", name, got)
+			}
+		}
+	}
+	check()
+	p.Close()
+	if p, err = OpenPacked(root, opts); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
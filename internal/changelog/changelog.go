@@ -0,0 +1,279 @@
+// Package changelog is an append-only log of the writes made to the
+// master's index, which lets a restored snapshot be rolled forward to any
+// point in time after it.
+//
+// Every write gets the next sequence number. The log is split into segment
+// files named after the first sequence number in them, so old segments can
+// be deleted once no snapshot needs them. An entry is
+//
+//	uvarint length | crc32 of the rest | uvarint seq | varint unix nanos | data
+//
+// where length counts everything after itself. A crash can leave a torn
+// entry at the end of the last segment, which Open cuts off.
+package changelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SegmentSize is the size after which the log starts a new segment.
+	SegmentSize = 64 << 20
+	// maxEntrySize guards against reading garbage as a huge length.
+	maxEntrySize = 1 << 30
+)
+
+const segmentSuffix = ".log"
+
+var ErrCorrupt = errors.New("changelog: corrupt entry")
+
+type Entry struct {
+	Seq  uint64
+	Time time.Time
+	Data []byte
+}
+
+// Log appends entries to the segments in a directory. It is safe for
+// concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	dir  string
+	f    *os.File
+	size int64
+	seq  uint64
+}
+
+// Open opens the log in dir, creating dir if needed, and continues after
+// its last entry.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir}
+	if len(segs) == 0 {
+		return l, nil
+	}
+
+	last := segs[len(segs)-1]
+	f, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.seq = last.first - 1
+	good, err := scan(f, func(e Entry) error {
+		l.seq = e.Seq
+		return nil
+	})
+	if err != nil && err != ErrCorrupt {
+		f.Close()
+		return nil, err
+	}
+	// drop a torn entry
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.size = f, good
+	return l, nil
+}
+
+// Seq is the sequence number of the last entry.
+func (l *Log) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Append adds an entry and returns its sequence number. The entry is
+// written to the file but not synced.
+func (l *Log) Append(t time.Time, data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil || l.size >= SegmentSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := l.seq + 1
+	body := binary.AppendUvarint(make([]byte, 4, 4+2*binary.MaxVarintLen64+len(data)), seq)
+	body = binary.AppendVarint(body, t.UnixNano())
+	body = append(body, data...)
+	binary.BigEndian.PutUint32(body, crc32.ChecksumIEEE(body[4:]))
+	entry := append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+
+	if _, err := l.f.Write(entry); err != nil {
+		// don't leave half an entry for the next one to follow
+		l.f.Truncate(l.size)
+		l.f.Seek(l.size, io.SeekStart)
+		return 0, err
+	}
+	l.size += int64(len(entry))
+	l.seq = seq
+	return seq, nil
+}
+
+func (l *Log) rotate() error {
+	if l.f != nil {
+		if err := l.f.Sync(); err != nil {
+			return err
+		}
+		if err := l.f.Close(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, segmentName(l.seq+1)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	l.f, l.size = f, 0
+	return nil
+}
+
+// Sync flushes the current segment to disk.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Sync()
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// Replay calls fn for every entry in dir with a sequence number above
+// after, in order. A torn entry at the end of the log is ignored.
+func Replay(dir string, after uint64, fn func(Entry) error) error {
+	segs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+	for i, seg := range segs {
+		// skip segments that end before after
+		if i+1 < len(segs) && segs[i+1].first <= after+1 {
+			continue
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return err
+		}
+		_, err = scan(f, func(e Entry) error {
+			if e.Seq <= after {
+				return nil
+			}
+			return fn(e)
+		})
+		f.Close()
+		if err == ErrCorrupt && i == len(segs)-1 {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", seg.path, err)
+		}
+	}
+	return nil
+}
+
+type segment struct {
+	path  string
+	first uint64
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentSuffix)
+}
+
+func segments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var segs []segment
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		first, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{filepath.Join(dir, e.Name()), first})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].first < segs[j].first })
+	return segs, nil
+}
+
+// scan reads entries from r and returns the offset after the last good one.
+// It fails with ErrCorrupt at a torn or damaged entry.
+func scan(r io.Reader, fn func(Entry) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var off int64
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil || n < 4 || n > maxEntrySize {
+			return off, ErrCorrupt
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return off, ErrCorrupt
+		}
+		if binary.BigEndian.Uint32(body) != crc32.ChecksumIEEE(body[4:]) {
+			return off, ErrCorrupt
+		}
+		rest := body[4:]
+		seq, k := binary.Uvarint(rest)
+		if k <= 0 {
+			return off, ErrCorrupt
+		}
+		rest = rest[k:]
+		nanos, k := binary.Varint(rest)
+		if k <= 0 {
+			return off, ErrCorrupt
+		}
+		if err := fn(Entry{Seq: seq, Time: time.Unix(0, nanos).UTC(), Data: rest[k:]}); err != nil {
+			return off, err
+		}
+		off += int64(len(binary.AppendUvarint(nil, n))) + int64(n)
+	}
+}
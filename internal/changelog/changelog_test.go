@@ -0,0 +1,88 @@
+package changelog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func replayAll(t *testing.T, dir string, after uint64) []Entry {
+	t.Helper()
+	var got []Entry
+	if err := Replay(dir, after, func(e Entry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0).UTC()
+	for i := 0; i < 10; i++ {
+		seq, err := l.Append(start.Add(time.Duration(i)*time.Second), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(i+1) {
+			t.Fatalf("append %d got seq %d", i, seq)
+		}
+	}
+	l.Close()
+
+	got := replayAll(t, dir, 4)
+	if len(got) != 6 || got[0].Seq != 5 || string(got[0].Data) != "4" || !got[0].Time.Equal(start.Add(4*time.Second)) {
+		t.Fatalf("replay after 4: got %+v", got)
+	}
+
+	// reopening continues the sequence
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq, err := l.Append(start, []byte("more")); err != nil || seq != 11 {
+		t.Fatalf("append after reopen: got seq %d, %v", seq, err)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(time.Now(), []byte("one"))
+	l.Append(time.Now(), []byte("two"))
+	l.Close()
+
+	// cut the last entry in half
+	path := filepath.Join(dir, segmentName(1))
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayAll(t, dir, 0); len(got) != 1 || string(got[0].Data) != "one" {
+		t.Fatalf("replay of a torn log: got %+v", got)
+	}
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := l.Append(time.Now(), []byte("three")); err != nil || seq != 2 {
+		t.Fatalf("append after a torn entry: got seq %d, %v", seq, err)
+	}
+	l.Close()
+	if got := replayAll(t, dir, 0); len(got) != 2 || string(got[1].Data) != "three" {
+		t.Fatalf("replay: got %+v", got)
+	}
+}
@@ -0,0 +1,66 @@
+// Package index describes how the master keeps keys in its leveldb, for
+// the master itself and the tools that read its index offline.
+//
+// Keys outside buckets are stored under their own name. Everything else
+// lives in namespaces starting with "\x00", which sort before any key.
+// Only the namespaces below hold records pointing at blobs, the master's
+// other namespaces are its own business.
+package index
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// ObjectPrefix + "<bucket>/<key>" is the current record of a key in a
+	// bucket.
+	ObjectPrefix = "\x00obj/"
+	// VersionPrefix + "<bucket>/<key>\x00<version>" is a version of a key
+	// in a versioned bucket.
+	VersionPrefix = "\x00ver/"
+	// TrashPrefix + "<index key>\x00<trash ID>" is a deleted key waiting
+	// in the trash.
+	TrashPrefix = "\x00trash/"
+)
+
+// ShardKey holds the key range of a sharded master, a JSON shardmap.Shard.
+// A master without it owns every key.
+const ShardKey = "\x00shard"
+
+// Record is what the master keeps for every key.
+// Blob is the file name the volume servers gave us back on PUT,
+// Replicas are the volume servers holding a copy of it.
+type Record struct {
+	Blob     string    `json:"blob"`
+	Replicas []string  `json:"replicas"`
+	Size     int64     `json:"size"`
+	Mtime    time.Time `json:"mtime"`
+	// ETag is the hex md5 of the content.
+	ETag string `json:"etag,omitempty"`
+	// Meta is user metadata, sent and returned as X-Tinydb-Meta-* headers.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Version is set for keys in versioned buckets. A delete marker is a
+	// version without a blob that hides the key.
+	Version      string `json:"version,omitempty"`
+	DeleteMarker bool   `json:"delete_marker,omitempty"`
+	// Generation is the generation number the blob was written with.
+	Generation uint64 `json:"generation,omitempty"`
+	// Expires is when the key goes away on its own, zero if it doesn't.
+	Expires time.Time `json:"expires,omitzero"`
+	// Class is the storage class of the volume group holding the blob.
+	Class string `json:"class,omitempty"`
+}
+
+// DecodeRecord also understands the old format where the value was just
+// the comma separated replica list and the leveldb key was the blob name.
+// Trash entries decode too, they are records with a few more fields.
+func DecodeRecord(key string, v []byte) (Record, error) {
+	if len(v) > 0 && v[0] == '{' {
+		var rec Record
+		err := json.Unmarshal(v, &rec)
+		return rec, err
+	}
+	return Record{Blob: key, Replicas: strings.Split(string(v), ",")}, nil
+}
@@ -0,0 +1,23 @@
+package index
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDecodeRecord(t *testing.T) {
+	rec, err := DecodeRecord("k", []byte(`{"blob":"b","replicas":["r1","r2"],"etag":"e","deleted":"2024-01-01T00:00:00Z"}`))
+	if err != nil || rec.Blob != "b" || !slices.Equal(rec.Replicas, []string{"r1", "r2"}) || rec.ETag != "e" {
+		t.Errorf("JSON record: %+v, %v", rec, err)
+	}
+
+	// the old format names the blob by the key
+	rec, err = DecodeRecord("old", []byte("r1,r2"))
+	if err != nil || rec.Blob != "old" || !slices.Equal(rec.Replicas, []string{"r1", "r2"}) {
+		t.Errorf("old record: %+v, %v", rec, err)
+	}
+
+	if _, err := DecodeRecord("k", []byte("{broken")); err == nil {
+		t.Error("a broken record decoded")
+	}
+}
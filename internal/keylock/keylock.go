@@ -0,0 +1,44 @@
+// Package keylock provides per-key mutexes.
+package keylock
+
+import "sync"
+
+// Locker hands out one mutex per key so work on the same key runs one
+// after the other while different keys don't wait on each other.
+// A key's mutex only exists while someone holds or waits for it.
+// The zero value is ready to use.
+type Locker struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function that unlocks it.
+func (l *Locker) Lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,43 @@
+package keylock
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLockSerializesSameKey(t *testing.T) {
+	var l Locker
+	var wg sync.WaitGroup
+	counter := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := l.Lock("k")
+			c := counter
+			counter = c + 1
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if counter != 100 {
+		t.Errorf("counter = %d, want 100", counter)
+	}
+	if len(l.locks) != 0 {
+		t.Errorf("%d locks left behind after everyone unlocked", len(l.locks))
+	}
+}
+
+func TestLockDifferentKeys(t *testing.T) {
+	var l Locker
+	unlockA := l.Lock("a")
+	defer unlockA()
+
+	done := make(chan struct{})
+	go func() {
+		l.Lock("b")()
+		close(done)
+	}()
+	<-done
+}
@@ -0,0 +1,177 @@
+// Package keys defines what a tinydb key may look like and how a key is
+// turned into a file name on a volume server.
+//
+// A key is 1 to MaxLen bytes of UTF-8 without control characters. Slashes
+// split it into segments, none of which may be empty, "." or "..".
+//
+// On disk a key becomes "<sha256 hex>_<base64url of key>", sharded into
+// aa/bb/ directories by the first four hex characters. The hash keeps the
+// name unique and the base64 part lets us get the key back from the name.
+// Neither part can contain a path separator, so a name never leaves the
+// data directory. When the name would not fit into a single file name,
+// with MaxSuffixLen to spare, the base64 part is dropped and only the hash
+// is used. A version of a key is stored as the same name followed by "."
+// and the version ID.
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxLen is the longest key we accept, in bytes.
+	MaxLen = 1024
+
+	// MaxNameLen is the file name limit of pretty much every filesystem.
+	MaxNameLen = 255
+
+	// MaxSuffixLen is the room BlobName leaves in a file name for what a
+	// volume appends to a blob name, like the extension of a file it keeps
+	// next to the blob.
+	MaxSuffixLen = 32
+
+	// MaxVersionLen is the longest version ID we accept.
+	MaxVersionLen = 32
+
+	hashLen = sha256.Size * 2
+)
+
+var (
+	ErrEmpty       = errors.New("key is empty")
+	ErrTooLong     = errors.New("key is longer than 1024 bytes")
+	ErrInvalidUTF8 = errors.New("key is not valid UTF-8")
+	ErrControlChar = errors.New("key contains a control character")
+	ErrBadSegment  = errors.New("key contains an empty, \".\" or \"..\" segment")
+)
+
+// Validate reports why key is not a valid tinydb key, or nil if it is.
+func Validate(key string) error {
+	if key == "" {
+		return ErrEmpty
+	}
+	if len(key) > MaxLen {
+		return ErrTooLong
+	}
+	if !utf8.ValidString(key) {
+		return ErrInvalidUTF8
+	}
+	for _, c := range key {
+		if unicode.IsControl(c) {
+			return ErrControlChar
+		}
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return ErrBadSegment
+		}
+	}
+	return nil
+}
+
+// ValidVersion reports whether v can be used as a version ID:
+// 1 to MaxVersionLen lowercase letters and digits.
+func ValidVersion(v string) bool {
+	if v == "" || len(v) > MaxVersionLen {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if !('0' <= v[i] && v[i] <= '9' || 'a' <= v[i] && v[i] <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// BlobName returns the file name a volume stores key under. version is
+// empty for unversioned keys and must be a valid version ID otherwise.
+func BlobName(key, version string) string {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	suffix := ""
+	if version != "" {
+		suffix = "." + version
+	}
+	name := hash + "_" + base64.RawURLEncoding.EncodeToString([]byte(key))
+	if len(name)+len(suffix) > MaxNameLen-MaxSuffixLen {
+		return hash + suffix
+	}
+	return name + suffix
+}
+
+// Key recovers the key from a blob name. ok is false when the name is
+// malformed or only carries the hash because the key was too long.
+func Key(name string) (key string, ok bool) {
+	if !ValidBlobName(name) {
+		return "", false
+	}
+	name, _, _ = strings.Cut(name, ".")
+	if len(name) == hashLen {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(name[hashLen+1:])
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// Version returns the version ID in a blob name, or "" if it has none.
+func Version(name string) string {
+	_, version, _ := strings.Cut(name, ".")
+	return version
+}
+
+// ValidBlobName reports whether name looks like something BlobName returns.
+func ValidBlobName(name string) bool {
+	if len(name) > MaxNameLen {
+		return false
+	}
+	if base, version, ok := strings.Cut(name, "."); ok {
+		if !ValidVersion(version) {
+			return false
+		}
+		name = base
+	}
+	if len(name) < hashLen {
+		return false
+	}
+	for i := 0; i < hashLen; i++ {
+		if !isHex(name[i]) {
+			return false
+		}
+	}
+	if len(name) == hashLen {
+		return true
+	}
+	if name[hashLen] != '_' || len(name) == hashLen+1 {
+		return false
+	}
+	for i := hashLen + 1; i < len(name); i++ {
+		if !isBase64URL(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// BlobPath returns where a blob lives under root: root/aa/bb/name.
+// name must be a valid blob name.
+func BlobPath(root, name string) string {
+	return filepath.Join(root, name[:2], name[2:4], name)
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+func isBase64URL(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+}
@@ -0,0 +1,125 @@
+package keys
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		key  string
+		want error
+	}{
+		{"a", nil},
+		{"photos/2024/cat.jpg", nil},
+		{"héllo wörld/日本語", nil},
+		{"..hidden", nil},
+		{strings.Repeat("x", MaxLen), nil},
+		{"", ErrEmpty},
+		{strings.Repeat("x", MaxLen+1), ErrTooLong},
+		{"bad\xffutf8", ErrInvalidUTF8},
+		{"tab\there", ErrControlChar},
+		{"nul\x00", ErrControlChar},
+		{"/leading", ErrBadSegment},
+		{"trailing/", ErrBadSegment},
+		{"a//b", ErrBadSegment},
+		{"a/./b", ErrBadSegment},
+		{"../etc/passwd", ErrBadSegment},
+		{"..", ErrBadSegment},
+	}
+
+	for _, tt := range tests {
+		if got := Validate(tt.key); got != tt.want {
+			t.Errorf("Validate(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestBlobNameRoundTrip(t *testing.T) {
+	for _, key := range []string{"a", "my_test_file.txt", "dir/sub/file", "../../etc", "日本語/ファイル"} {
+		name := BlobName(key, "")
+		if strings.ContainsAny(name, "/\\.") {
+			t.Errorf("BlobName(%q) = %q contains a path character", key, name)
+		}
+		if !ValidBlobName(name) {
+			t.Errorf("BlobName(%q) = %q is not a valid blob name", key, name)
+		}
+		got, ok := Key(name)
+		if !ok || got != key {
+			t.Errorf("Key(BlobName(%q)) = %q, %v", key, got, ok)
+		}
+	}
+}
+
+func TestBlobNameLongKey(t *testing.T) {
+	key := strings.Repeat("k", MaxLen)
+	name := BlobName(key, "")
+	if len(name) > MaxNameLen {
+		t.Fatalf("BlobName of a %d byte key is %d bytes long", len(key), len(name))
+	}
+	if !ValidBlobName(name) {
+		t.Errorf("%q is not a valid blob name", name)
+	}
+	if _, ok := Key(name); ok {
+		t.Errorf("Key(%q) should not recover a key from a hash-only name", name)
+	}
+	if BlobName(key+"x", "") == name {
+		t.Errorf("two different long keys map to the same blob name")
+	}
+}
+
+func TestBlobNameSuffixRoom(t *testing.T) {
+	for n := 100; n <= 200; n++ {
+		key := strings.Repeat("k", n)
+		for _, version := range []string{"", strings.Repeat("z", MaxVersionLen)} {
+			name := BlobName(key, version)
+			if len(name)+MaxSuffixLen > MaxNameLen {
+				t.Fatalf("BlobName of a %d byte key is %d bytes long, no room for a suffix", n, len(name))
+			}
+			suffix := 0
+			if version != "" {
+				suffix = 1 + len(version)
+			}
+			full := hashLen+1+base64.RawURLEncoding.EncodedLen(n)+suffix+MaxSuffixLen <= MaxNameLen
+			if got, ok := Key(name); ok != full || ok && got != key {
+				t.Errorf("Key(BlobName of a %d byte key, version %q) = %q, %v, want the key back: %v", n, version, got, ok, full)
+			}
+		}
+	}
+}
+
+func TestBlobNameVersion(t *testing.T) {
+	for _, key := range []string{"a", strings.Repeat("k", MaxLen)} {
+		name := BlobName(key, "0123abcdz")
+		if len(name) > MaxNameLen || !ValidBlobName(name) {
+			t.Fatalf("BlobName(%q, version) = %q is not a valid blob name", key, name)
+		}
+		if v := Version(name); v != "0123abcdz" {
+			t.Errorf("Version(%q) = %q", name, v)
+		}
+		if name == BlobName(key, "") || name == BlobName(key, "1") {
+			t.Errorf("versions of %q share the blob name %q", key, name)
+		}
+	}
+	if got, ok := Key(BlobName("dir/file", "v1")); !ok || got != "dir/file" {
+		t.Errorf("Key of a versioned name = %q, %v", got, ok)
+	}
+}
+
+func TestValidBlobName(t *testing.T) {
+	for _, name := range []string{"", "ab", "../x", "zz" + strings.Repeat("0", 62), BlobName("a", "") + "/x", BlobName("a", "") + "=", strings.Repeat("0", 64) + "_", BlobName("a", "") + ".", BlobName("a", "") + ".UPPER", BlobName("a", "") + ".a.b"} {
+		if ValidBlobName(name) {
+			t.Errorf("ValidBlobName(%q) = true", name)
+		}
+	}
+}
+
+func TestBlobPath(t *testing.T) {
+	name := BlobName("a", "")
+	want := filepath.Join("root", name[:2], name[2:4], name)
+	if got := BlobPath("root", name); got != want {
+		t.Errorf("BlobPath = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package metastore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB is a Store on a leveldb directory.
+type LevelDB struct {
+	db *leveldb.DB
+}
+
+// OpenLevelDB opens the leveldb in dir, creating it if it doesn't exist.
+func OpenLevelDB(dir string) (*LevelDB, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDB{db}, nil
+}
+
+func (l *LevelDB) Get(key []byte) ([]byte, error) {
+	return levelGet(l.db.Get(key, nil))
+}
+
+func (l *LevelDB) NewIterator(r *Range) Iterator {
+	return l.db.NewIterator(levelRange(r), nil)
+}
+
+func (l *LevelDB) Put(key, value []byte) error { return l.db.Put(key, value, nil) }
+func (l *LevelDB) Delete(key []byte) error     { return l.db.Delete(key, nil) }
+func (l *LevelDB) Write(b *Batch) error        { return l.db.Write(&b.b, nil) }
+func (l *LevelDB) Close() error                { return l.db.Close() }
+
+func (l *LevelDB) GetSnapshot() (Snapshot, error) {
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return levelSnapshot{snap}, nil
+}
+
+type levelSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s levelSnapshot) Get(key []byte) ([]byte, error) {
+	return levelGet(s.snap.Get(key, nil))
+}
+
+func (s levelSnapshot) NewIterator(r *Range) Iterator {
+	return s.snap.NewIterator(levelRange(r), nil)
+}
+
+func (s levelSnapshot) Release() { s.snap.Release() }
+
+func levelGet(v []byte, err error) ([]byte, error) {
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func levelRange(r *Range) *util.Range {
+	if r == nil {
+		return nil
+	}
+	return &util.Range{Start: r.Start, Limit: r.Limit}
+}
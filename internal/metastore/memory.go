@@ -0,0 +1,212 @@
+package metastore
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sync"
+)
+
+var errClosed = errors.New("metastore: closed")
+
+// Memory is a Store that lives in RAM and is gone when it is closed. It
+// copies to make snapshots and iterators, so it is meant for tests and
+// small indexes.
+type Memory struct {
+	mu     sync.RWMutex
+	keys   []string // sorted
+	values map[string][]byte
+	closed bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{values: map[string][]byte{}}
+}
+
+func (m *Memory) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	return memGet(m.values, key)
+}
+
+func (m *Memory) NewIterator(r *Range) Iterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return &memIterator{err: errClosed}
+	}
+	return newMemIterator(m.keys, m.values, r)
+}
+
+func (m *Memory) Put(key, value []byte) error {
+	var b Batch
+	b.Put(key, value)
+	return m.Write(&b)
+}
+
+func (m *Memory) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return m.Write(&b)
+}
+
+func (m *Memory) Write(b *Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	return b.Replay((*memReplay)(m))
+}
+
+// memReplay applies a batch to a Memory whose lock is held.
+type memReplay Memory
+
+func (m *memReplay) Put(key, value []byte) {
+	k := string(key)
+	if _, ok := m.values[k]; !ok {
+		i, _ := slices.BinarySearch(m.keys, k)
+		m.keys = slices.Insert(m.keys, i, k)
+	}
+	m.values[k] = bytes.Clone(value)
+}
+
+func (m *memReplay) Delete(key []byte) {
+	k := string(key)
+	if _, ok := m.values[k]; !ok {
+		return
+	}
+	i, _ := slices.BinarySearch(m.keys, k)
+	m.keys = slices.Delete(m.keys, i, i+1)
+	delete(m.values, k)
+}
+
+func (m *Memory) GetSnapshot() (Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	values := make(map[string][]byte, len(m.values))
+	for k, v := range m.values {
+		values[k] = v
+	}
+	return &memSnapshot{keys: slices.Clone(m.keys), values: values}, nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.keys, m.values = nil, nil
+	return nil
+}
+
+// memSnapshot is a copy of a Memory's keys. The values are shared, since
+// they are never changed in place.
+type memSnapshot struct {
+	keys   []string
+	values map[string][]byte
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) { return memGet(s.values, key) }
+func (s *memSnapshot) NewIterator(r *Range) Iterator  { return newMemIterator(s.keys, s.values, r) }
+func (s *memSnapshot) Release()                       {}
+
+func memGet(values map[string][]byte, key []byte) ([]byte, error) {
+	v, ok := values[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(v), nil
+}
+
+// memIterator walks a copy of the keys in its range. pos is -1 before the
+// first key and len(keys) after the last.
+type memIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+	fresh  bool
+	err    error
+}
+
+func newMemIterator(keys []string, values map[string][]byte, r *Range) *memIterator {
+	lo, hi := 0, len(keys)
+	if r != nil {
+		lo, _ = slices.BinarySearch(keys, string(r.Start))
+		if r.Limit != nil {
+			hi, _ = slices.BinarySearch(keys, string(r.Limit))
+			hi = max(hi, lo)
+		}
+	}
+	it := &memIterator{keys: slices.Clone(keys[lo:hi]), pos: -1, fresh: true}
+	it.values = make([][]byte, len(it.keys))
+	for i, k := range it.keys {
+		it.values[i] = values[k]
+	}
+	return it
+}
+
+func (it *memIterator) valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.keys)
+}
+
+func (it *memIterator) First() bool {
+	it.fresh, it.pos = false, 0
+	return it.valid()
+}
+
+func (it *memIterator) Last() bool {
+	it.fresh, it.pos = false, len(it.keys)-1
+	return it.valid()
+}
+
+func (it *memIterator) Seek(key []byte) bool {
+	it.fresh = false
+	it.pos, _ = slices.BinarySearch(it.keys, string(key))
+	return it.valid()
+}
+
+func (it *memIterator) Next() bool {
+	if it.fresh {
+		return it.First()
+	}
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.valid()
+}
+
+func (it *memIterator) Prev() bool {
+	if it.fresh {
+		return it.Last()
+	}
+	if it.pos >= 0 {
+		it.pos--
+	}
+	return it.valid()
+}
+
+func (it *memIterator) Key() []byte {
+	if !it.valid() {
+		return nil
+	}
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memIterator) Value() []byte {
+	if !it.valid() {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+func (it *memIterator) Error() error { return it.err }
+
+func (it *memIterator) Release() {
+	it.keys, it.values, it.pos = nil, nil, -1
+}
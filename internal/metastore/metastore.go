@@ -0,0 +1,110 @@
+// Package metastore is the key-value store the master keeps its index in.
+// Store is what the master needs of it: point reads and writes, atomic
+// batches, ordered iteration and consistent snapshots. LevelDB is the
+// store the master runs on, Memory keeps everything in RAM for tests.
+//
+// Batches are encoded like leveldb's, so the change log and the Raft log
+// read the same whatever store wrote them.
+package metastore
+
+import (
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// ErrNotFound is returned by Get for a key that isn't in the store.
+var ErrNotFound = errors.New("metastore: not found")
+
+// Reader is what a store and its snapshots have in common.
+type Reader interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	// NewIterator returns an iterator over the keys in r, in byte order,
+	// or over all keys if r is nil. It sees the store as of its creation
+	// and must be released.
+	NewIterator(r *Range) Iterator
+}
+
+// Store is a sorted key-value store.
+type Store interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Write applies all of b or none of it.
+	Write(b *Batch) error
+	// GetSnapshot returns a view of the store as of now, which must be
+	// released.
+	GetSnapshot() (Snapshot, error)
+	Close() error
+}
+
+// Snapshot is a consistent view of a store.
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// Iterator walks keys in order. Like leveldb's, a new iterator is before
+// the first key: Next moves to the first key and Prev to the last.
+type Iterator interface {
+	First() bool
+	Last() bool
+	// Seek moves to the first key at or after key.
+	Seek(key []byte) bool
+	Next() bool
+	Prev() bool
+	// Key and Value are only valid until the iterator moves.
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+// Range is the keys from Start up to but not including Limit. A nil Limit
+// has no end.
+type Range struct {
+	Start []byte
+	Limit []byte
+}
+
+// Prefix returns the range of keys that start with p.
+func Prefix(p []byte) *Range {
+	var limit []byte
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] != 0xff {
+			limit = append([]byte(nil), p[:i+1]...)
+			limit[i]++
+			break
+		}
+	}
+	return &Range{Start: p, Limit: limit}
+}
+
+// Batch is a list of puts and deletes that are applied together.
+type Batch struct {
+	b leveldb.Batch
+}
+
+func (b *Batch) Put(key, value []byte) { b.b.Put(key, value) }
+func (b *Batch) Delete(key []byte)     { b.b.Delete(key) }
+
+// Len is the number of puts and deletes in b.
+func (b *Batch) Len() int { return b.b.Len() }
+
+func (b *Batch) Reset() { b.b.Reset() }
+
+// Dump returns b encoded, to be logged or sent and read back with Load.
+func (b *Batch) Dump() []byte { return b.b.Dump() }
+
+// Load replaces the contents of b with a batch encoded by Dump.
+func (b *Batch) Load(data []byte) error { return b.b.Load(data) }
+
+// BatchReplay receives the puts and deletes of a batch, in order.
+type BatchReplay interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+}
+
+// Replay hands the puts and deletes of b to r, in order.
+func (b *Batch) Replay(r BatchReplay) error { return b.b.Replay(r) }
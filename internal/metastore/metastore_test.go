@@ -0,0 +1,147 @@
+package metastore
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// stores runs f against every Store implementation.
+func stores(t *testing.T, f func(t *testing.T, s Store)) {
+	t.Run("leveldb", func(t *testing.T) {
+		s, err := OpenLevelDB(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		f(t, s)
+	})
+	t.Run("memory", func(t *testing.T) {
+		s := NewMemory()
+		defer s.Close()
+		f(t, s)
+	})
+}
+
+func keysOf(it Iterator) string {
+	defer it.Release()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestGetPutDelete(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		if _, err := s.Get([]byte("a")); err != ErrNotFound {
+			t.Fatalf("Get of a missing key: %v", err)
+		}
+		s.Put([]byte("a"), []byte("1"))
+		s.Put([]byte("a"), []byte("2"))
+		if v, err := s.Get([]byte("a")); err != nil || string(v) != "2" {
+			t.Errorf("Get: got %q, %v", v, err)
+		}
+		s.Delete([]byte("a"))
+		s.Delete([]byte("never there"))
+		if _, err := s.Get([]byte("a")); err != ErrNotFound {
+			t.Errorf("Get after Delete: %v", err)
+		}
+	})
+}
+
+func TestBatch(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		s.Put([]byte("gone"), []byte("x"))
+		var b Batch
+		b.Put([]byte("b"), []byte("1"))
+		b.Put([]byte("a"), []byte("1"))
+		b.Delete([]byte("gone"))
+		b.Put([]byte("b"), []byte("2"))
+
+		// a batch read back from its dump does the same
+		var loaded Batch
+		if err := loaded.Load(b.Dump()); err != nil || loaded.Len() != 4 {
+			t.Fatalf("Load: %d entries, %v", loaded.Len(), err)
+		}
+		if err := s.Write(&loaded); err != nil {
+			t.Fatal(err)
+		}
+		if got := keysOf(s.NewIterator(nil)); got != "a,b" {
+			t.Errorf("keys: %s", got)
+		}
+		if v, _ := s.Get([]byte("b")); string(v) != "2" {
+			t.Errorf("the later put should win, got %q", v)
+		}
+	})
+}
+
+func TestIterator(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		for _, k := range []string{"a", "b/1", "b/2", "b/3", "b\xff", "c"} {
+			s.Put([]byte(k), []byte("v"+k))
+		}
+		if got := keysOf(s.NewIterator(Prefix([]byte("b/")))); got != "b/1,b/2,b/3" {
+			t.Errorf("prefix b/: %s", got)
+		}
+		if got := keysOf(s.NewIterator(&Range{Start: []byte("b/2")})); got != "b/2,b/3,b\xff,c" {
+			t.Errorf("from b/2: %q", got)
+		}
+		if got := keysOf(s.NewIterator(Prefix([]byte("b\xff")))); got != "b\xff" {
+			t.Errorf("prefix b\\xff: %q", got)
+		}
+
+		it := s.NewIterator(Prefix([]byte("b/")))
+		defer it.Release()
+		if !it.Seek([]byte("b/15")) || string(it.Key()) != "b/2" || string(it.Value()) != "vb/2" {
+			t.Errorf("Seek: at %q", it.Key())
+		}
+		if !it.Prev() || string(it.Key()) != "b/1" {
+			t.Errorf("Prev: at %q", it.Key())
+		}
+		if it.Prev() {
+			t.Errorf("Prev before the range: at %q", it.Key())
+		}
+		if !it.Last() || string(it.Key()) != "b/3" || it.Next() {
+			t.Errorf("Last: at %q", it.Key())
+		}
+		if it.Seek([]byte("b/4")) {
+			t.Errorf("Seek past the range: at %q", it.Key())
+		}
+		if it.Error() != nil {
+			t.Error(it.Error())
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	stores(t, func(t *testing.T, s Store) {
+		for i := 0; i < 3; i++ {
+			s.Put([]byte(fmt.Sprint(i)), []byte("old"))
+		}
+		snap, err := s.GetSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Release()
+		it := s.NewIterator(nil)
+
+		s.Put([]byte("0"), []byte("new"))
+		s.Delete([]byte("1"))
+		s.Put([]byte("3"), []byte("new"))
+
+		if v, _ := snap.Get([]byte("0")); !bytes.Equal(v, []byte("old")) {
+			t.Errorf("snapshot sees the later put: %q", v)
+		}
+		if got := keysOf(snap.NewIterator(nil)); got != "0,1,2" {
+			t.Errorf("snapshot keys: %s", got)
+		}
+		if got := keysOf(it); got != "0,1,2" {
+			t.Errorf("an iterator sees later writes: %s", got)
+		}
+		if got := keysOf(s.NewIterator(nil)); got != "0,2,3" {
+			t.Errorf("keys: %s", got)
+		}
+	})
+}
@@ -0,0 +1,740 @@
+// Package raft replicates a log of opaque entries between a fixed set of
+// nodes with the Raft consensus algorithm, so that every node applies the
+// same entries in the same order.
+//
+// It does the parts of Raft the master needs: leader election, log
+// replication and persistence of the log and of the vote. Membership is
+// fixed at start and the log is never compacted, so a node that joins late
+// or lost its disk catches up by replaying the whole log.
+//
+// Nodes talk JSON over HTTP: Handler serves POST /raft/vote and
+// /raft/append and peers are addressed by the base URL it is mounted under.
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrLeadershipLost = errors.New("raft: lost leadership before the entry committed")
+	ErrTimeout        = errors.New("raft: timed out waiting for the entry to commit, it may still do so")
+	ErrStopped        = errors.New("raft: node stopped")
+)
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// maxAppend is how many entries a leader sends in one append.
+const maxAppend = 256
+
+type Config struct {
+	// ID names this node among its peers.
+	ID string
+	// Peers maps the IDs of the other nodes to the base URL their Handler
+	// is served under.
+	Peers map[string]string
+	// Dir is where the log and the vote are kept.
+	Dir string
+	// Apply is called with every committed entry, in order and one at a
+	// time. It must remember the last index it applied durably and atomically
+	// with the entry; an error stops the node from applying until it succeeds.
+	Apply func(index uint64, data []byte) error
+	// Applied is the last index Apply applied before the node started.
+	Applied uint64
+	// OnLeader is called when the node has become leader and applied
+	// everything committed before, before it takes proposals.
+	OnLeader func()
+
+	// ElectionTimeout is the minimum time a follower waits to hear from a
+	// leader before it starts an election, the actual wait is random
+	// between it and twice it. HeartbeatInterval is how often a leader
+	// sends appends when it has nothing new. ProposeTimeout is how long
+	// Propose waits for its entry to commit.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	ProposeTimeout    time.Duration
+}
+
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type Status struct {
+	ID          string `json:"id"`
+	State       string `json:"state"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader"`
+	LastIndex   uint64 `json:"last_index"`
+	CommitIndex uint64 `json:"commit_index"`
+	Applied     uint64 `json:"applied"`
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+type Node struct {
+	cfg    Config
+	store  *leveldb.DB
+	client *http.Client
+
+	mu        sync.Mutex
+	applyCond *sync.Cond
+
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	// log[i] is the entry with index i, log[0] is a placeholder
+	log         []Entry
+	commitIndex uint64
+	lastApplied uint64
+	// ready is set once a leader has applied readyIndex, the first entry
+	// of its term, so its state machine has everything committed before it
+	ready      bool
+	readyIndex uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	waiters          map[uint64]waiter
+	stopped          bool
+	done             chan struct{}
+}
+
+// New opens the node's log in cfg.Dir. Call Start to take part in the
+// cluster.
+func New(cfg Config) (*Node, error) {
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = 500 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.ProposeTimeout == 0 {
+		cfg.ProposeTimeout = 10 * time.Second
+	}
+	store, err := leveldb.OpenFile(cfg.Dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:         cfg,
+		store:       store,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		log:         []Entry{{}},
+		lastApplied: cfg.Applied,
+		commitIndex: cfg.Applied,
+		nextIndex:   map[string]uint64{},
+		matchIndex:  map[string]uint64{},
+		inflight:    map[string]bool{},
+		waiters:     map[uint64]waiter{},
+		done:        make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	if err := n.load(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if n.lastApplied > n.lastIndex() {
+		store.Close()
+		return nil, fmt.Errorf("raft: applied up to %d but the log ends at %d", n.lastApplied, n.lastIndex())
+	}
+	return n, nil
+}
+
+// Start runs the node until Stop.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionTimerLocked()
+	n.mu.Unlock()
+	go n.ticker()
+	go n.applier()
+}
+
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.done)
+	n.applyCond.Broadcast()
+	for i, w := range n.waiters {
+		w.ch <- ErrStopped
+		delete(n.waiters, i)
+	}
+	n.mu.Unlock()
+	n.store.Close()
+}
+
+// IsLeader reports whether the node is the leader and ready for proposals.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == Leader && n.ready
+}
+
+// Leader returns the ID of the leader as far as this node knows, or "".
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:          n.cfg.ID,
+		State:       n.state.String(),
+		Term:        n.term,
+		Leader:      n.leader,
+		LastIndex:   n.lastIndex(),
+		CommitIndex: n.commitIndex,
+		Applied:     n.lastApplied,
+	}
+}
+
+// Propose appends data to the log and waits until this node has applied
+// it. Only the leader takes proposals.
+func (n *Node) Propose(data []byte) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.state != Leader || !n.ready {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.appendLocked([]Entry{e}); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	ch := make(chan error, 1)
+	n.waiters[e.Index] = waiter{e.Term, ch}
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	t := time.NewTimer(n.cfg.ProposeTimeout)
+	defer t.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-t.C:
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return ErrTimeout
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) clusterSize() int {
+	return len(n.cfg.Peers) + 1
+}
+
+func (n *Node) resetElectionTimerLocked() {
+	d := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(d)
+}
+
+func (n *Node) ticker() {
+	t := time.NewTicker(n.cfg.HeartbeatInterval / 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		now := time.Now()
+		switch {
+		case n.stopped:
+		case n.state == Leader:
+			if now.Sub(n.lastHeartbeat) >= n.cfg.HeartbeatInterval {
+				n.broadcastLocked()
+			}
+		case now.After(n.electionDeadline):
+			n.startElectionLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// stepDownLocked makes the node a follower, in a newer term if term is.
+func (n *Node) stepDownLocked(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		n.persistStateLocked()
+	}
+	if n.state == Leader {
+		n.leader = ""
+	}
+	n.state = Follower
+	n.ready = false
+	n.resetElectionTimerLocked()
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+func (n *Node) startElectionLocked() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.persistStateLocked()
+	n.resetElectionTimerLocked()
+
+	req := voteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.log[n.lastIndex()].Term}
+	votes := 1
+	if votes*2 > n.clusterSize() {
+		n.becomeLeaderLocked()
+		return
+	}
+	for peer := range n.cfg.Peers {
+		go func(peer string) {
+			var resp voteResponse
+			err := n.call(peer, "vote", req, &resp)
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if err != nil || n.stopped {
+				return
+			}
+			if resp.Term > n.term {
+				n.stepDownLocked(resp.Term)
+				return
+			}
+			if n.state != Candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes*2 > n.clusterSize() {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	n.state = Leader
+	n.leader = n.cfg.ID
+	n.ready = false
+	for peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	// entries of earlier terms only commit along with one of ours
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	if err := n.appendLocked([]Entry{e}); err != nil {
+		log.Printf("raft %s: %v", n.cfg.ID, err)
+		n.stepDownLocked(n.term)
+		return
+	}
+	n.readyIndex = e.Index
+	log.Printf("raft %s: leader of term %d", n.cfg.ID, n.term)
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+}
+
+func (n *Node) handleVote(req voteRequest) (voteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return voteResponse{}, ErrStopped
+	}
+	if req.Term > n.term {
+		n.stepDownLocked(req.Term)
+	}
+	resp := voteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	last := n.log[n.lastIndex()]
+	upToDate := req.LastTerm > last.Term || req.LastTerm == last.Term && req.LastIndex >= last.Index
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.persistStateLocked()
+		n.resetElectionTimerLocked()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+type appendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []Entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should go on from after a
+	// mismatch, so it doesn't have to back up one entry at a time.
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+func (n *Node) broadcastLocked() {
+	n.lastHeartbeat = time.Now()
+	for peer := range n.cfg.Peers {
+		if !n.inflight[peer] {
+			n.inflight[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+// replicate sends the entries peer is missing, or a heartbeat, and keeps
+// going while the peer is behind.
+func (n *Node) replicate(peer string) {
+	n.mu.Lock()
+	if n.state != Leader || n.stopped {
+		n.inflight[peer] = false
+		n.mu.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	end := min(n.lastIndex()+1, next+maxAppend)
+	req := appendRequest{
+		Term:      n.term,
+		Leader:    n.cfg.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  n.log[next-1].Term,
+		Entries:   append([]Entry(nil), n.log[next:end]...),
+		Commit:    n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	var resp appendResponse
+	err := n.call(peer, "append", req, &resp)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[peer] = false
+	if err != nil || n.stopped || n.state != Leader || n.term != req.Term {
+		return
+	}
+	if resp.Term > n.term {
+		n.stepDownLocked(resp.Term)
+		return
+	}
+	if resp.Success {
+		match := req.PrevIndex + uint64(len(req.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+		n.advanceCommitLocked()
+	} else if resp.ConflictIndex > 0 && resp.ConflictIndex < next {
+		n.nextIndex[peer] = resp.ConflictIndex
+	} else {
+		n.nextIndex[peer] = max(1, next-1)
+	}
+	if n.nextIndex[peer] <= n.lastIndex() {
+		n.inflight[peer] = true
+		go n.replicate(peer)
+	}
+}
+
+func (n *Node) advanceCommitLocked() {
+	for i := n.lastIndex(); i > n.commitIndex && n.log[i].Term == n.term; i-- {
+		count := 1
+		for peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= i {
+				count++
+			}
+		}
+		if count*2 > n.clusterSize() {
+			n.commitIndex = i
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) handleAppend(req appendRequest) (appendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return appendResponse{}, ErrStopped
+	}
+	resp := appendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	if req.Term > n.term || n.state != Follower {
+		n.stepDownLocked(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetElectionTimerLocked()
+	resp.Term = n.term
+
+	if req.PrevIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if t := n.log[req.PrevIndex].Term; t != req.PrevTerm {
+		i := req.PrevIndex
+		for i > 1 && n.log[i-1].Term == t {
+			i--
+		}
+		resp.ConflictIndex = i
+		return resp, nil
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= n.lastIndex() {
+			if n.log[e.Index].Term == e.Term {
+				continue
+			}
+			if e.Index <= n.commitIndex {
+				return resp, fmt.Errorf("raft: leader %s conflicts with committed entry %d", req.Leader, e.Index)
+			}
+			if err := n.truncateLocked(e.Index); err != nil {
+				return resp, err
+			}
+		}
+		if err := n.appendLocked(req.Entries[i:]); err != nil {
+			return resp, err
+		}
+		break
+	}
+
+	// a heartbeat that only vouches for an older prefix of the log must
+	// not take back what was committed
+	if last := req.PrevIndex + uint64(len(req.Entries)); req.Commit > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(req.Commit, last))
+		n.applyCond.Broadcast()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// applier hands committed entries to Apply.
+func (n *Node) applier() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		e := n.log[n.lastApplied+1]
+
+		n.mu.Unlock()
+		err := n.cfg.Apply(e.Index, e.Data)
+		n.mu.Lock()
+		if err != nil {
+			log.Printf("raft %s: applying %d: %v", n.cfg.ID, e.Index, err)
+			n.mu.Unlock()
+			time.Sleep(time.Second)
+			n.mu.Lock()
+			continue
+		}
+		n.lastApplied = e.Index
+
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.ch <- nil
+			} else {
+				w.ch <- ErrLeadershipLost
+			}
+		}
+		if n.state == Leader && !n.ready && e.Index == n.readyIndex && e.Term == n.term {
+			term := n.term
+			if n.cfg.OnLeader != nil {
+				n.mu.Unlock()
+				n.cfg.OnLeader()
+				n.mu.Lock()
+			}
+			n.ready = n.state == Leader && n.term == term
+		}
+	}
+}
+
+func (n *Node) call(peer, method string, req, resp any) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := n.client.Post(n.cfg.Peers[peer]+"/raft/"+method, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s answered %s with %s", peer, method, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// Handler serves the requests of the other nodes under /raft/.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var req voteRequest
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		resp, err := n.handleVote(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var req appendRequest
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		resp, err := n.handleAppend(req)
+		if err != nil {
+			log.Printf("raft %s: %v", n.cfg.ID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	return mux
+}
+
+// The store holds the vote under stateKey and every entry under
+// logPrefix + "<index, zero padded>".
+const (
+	stateKey  = "state"
+	logPrefix = "log/"
+)
+
+var syncWrite = &opt.WriteOptions{Sync: true}
+
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+func logKey(index uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", logPrefix, index))
+}
+
+func (n *Node) load() error {
+	v, err := n.store.Get([]byte(stateKey), nil)
+	if err == nil {
+		var s persistentState
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		n.term, n.votedFor = s.Term, s.VotedFor
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	iter := n.store.NewIterator(util.BytesPrefix([]byte(logPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var e Entry
+		if err := json.Unmarshal(iter.Value(), &e); err != nil {
+			return err
+		}
+		if e.Index != n.lastIndex()+1 {
+			return fmt.Errorf("raft: log has a gap before %d", e.Index)
+		}
+		n.log = append(n.log, e)
+	}
+	return iter.Error()
+}
+
+// persistStateLocked saves the term and vote. A node that can't remember
+// its vote could vote twice in a term, so failing to is fatal.
+func (n *Node) persistStateLocked() {
+	b, _ := json.Marshal(persistentState{n.term, n.votedFor})
+	if err := n.store.Put([]byte(stateKey), b, syncWrite); err != nil {
+		log.Fatalf("raft %s: saving the vote: %v", n.cfg.ID, err)
+	}
+}
+
+func (n *Node) appendLocked(entries []Entry) error {
+	batch := new(leveldb.Batch)
+	for _, e := range entries {
+		b, _ := json.Marshal(e)
+		batch.Put(logKey(e.Index), b)
+	}
+	if err := n.store.Write(batch, syncWrite); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+func (n *Node) truncateLocked(from uint64) error {
+	batch := new(leveldb.Batch)
+	for i := from; i <= n.lastIndex(); i++ {
+		batch.Delete(logKey(i))
+	}
+	if err := n.store.Write(batch, syncWrite); err != nil {
+		return err
+	}
+	n.log = n.log[:from]
+	return nil
+}
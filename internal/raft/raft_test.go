@@ -0,0 +1,260 @@
+package raft
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCluster runs nodes in process, each behind its own test server so a
+// stopped node looks like an unreachable one.
+type testCluster struct {
+	t     *testing.T
+	dir   string
+	urls  map[string]string
+	mu    sync.Mutex
+	nodes map[string]*Node
+	// applied is what each node's state machine has seen
+	applied map[string][]string
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	tc := &testCluster{
+		t:       t,
+		dir:     t.TempDir(),
+		urls:    map[string]string{},
+		nodes:   map[string]*Node{},
+		applied: map[string][]string{},
+	}
+	for _, id := range ids {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tc.mu.Lock()
+			n := tc.nodes[id]
+			tc.mu.Unlock()
+			if n == nil {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			n.Handler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		tc.urls[id] = srv.URL
+	}
+	for _, id := range ids {
+		tc.start(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range ids {
+			tc.stop(id)
+		}
+	})
+	return tc
+}
+
+// start starts id with an empty state machine, so it replays the whole log.
+func (tc *testCluster) start(id string) {
+	peers := map[string]string{}
+	for p, u := range tc.urls {
+		if p != id {
+			peers[p] = u
+		}
+	}
+	tc.mu.Lock()
+	tc.applied[id] = nil
+	tc.mu.Unlock()
+	n, err := New(Config{
+		ID:    id,
+		Peers: peers,
+		Dir:   filepath.Join(tc.dir, id),
+		Apply: func(index uint64, data []byte) error {
+			tc.mu.Lock()
+			defer tc.mu.Unlock()
+			if data != nil {
+				tc.applied[id] = append(tc.applied[id], string(data))
+			}
+			return nil
+		},
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		ProposeTimeout:    2 * time.Second,
+	})
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	tc.mu.Lock()
+	tc.nodes[id] = n
+	tc.mu.Unlock()
+	n.Start()
+}
+
+func (tc *testCluster) stop(id string) {
+	tc.mu.Lock()
+	n := tc.nodes[id]
+	delete(tc.nodes, id)
+	tc.mu.Unlock()
+	if n != nil {
+		n.Stop()
+	}
+}
+
+func (tc *testCluster) leader() *Node {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		tc.mu.Lock()
+		var leaders []*Node
+		for _, n := range tc.nodes {
+			if n.IsLeader() {
+				leaders = append(leaders, n)
+			}
+		}
+		tc.mu.Unlock()
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tc.t.Fatal("no leader elected")
+	return nil
+}
+
+func (tc *testCluster) waitApplied(id string, want []string) {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tc.mu.Lock()
+		got := fmt.Sprint(tc.applied[id])
+		tc.mu.Unlock()
+		if got == fmt.Sprint(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			tc.t.Fatalf("%s applied %s, want %v", id, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c")
+	l := tc.leader()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprint(i))
+		if err := l.Propose([]byte(want[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the leader has applied an entry by the time Propose returns
+	tc.mu.Lock()
+	got := fmt.Sprint(tc.applied[l.cfg.ID])
+	tc.mu.Unlock()
+	if got != fmt.Sprint(want) {
+		t.Fatalf("leader applied %s, want %v", got, want)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		tc.waitApplied(id, want)
+	}
+
+	for id, n := range tc.nodes {
+		if n != l {
+			if err := n.Propose([]byte("x")); err != ErrNotLeader {
+				t.Fatalf("propose on follower %s: got %v", id, err)
+			}
+			if n.Leader() != l.cfg.ID {
+				t.Fatalf("follower %s thinks the leader is %q", id, n.Leader())
+			}
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c")
+	l := tc.leader()
+	if err := l.Propose([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	old := l.cfg.ID
+	tc.stop(old)
+	l = tc.leader()
+	if l.cfg.ID == old {
+		t.Fatal("stopped node is still the leader")
+	}
+	if err := l.Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old leader comes back as a follower and catches up from its log
+	// and the new leader's
+	tc.start(old)
+	tc.waitApplied(old, []string{"before", "after"})
+	if n := tc.nodes[old]; n.IsLeader() {
+		t.Fatal("restarted node took over")
+	}
+}
+
+func TestNoQuorum(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c")
+	l := tc.leader()
+	for id := range tc.urls {
+		if id != l.cfg.ID {
+			tc.stop(id)
+		}
+	}
+	l.cfg.ProposeTimeout = 300 * time.Millisecond
+	if err := l.Propose([]byte("lost")); err != ErrTimeout && err != ErrNotLeader {
+		t.Fatalf("propose without a quorum: got %v", err)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if len(tc.applied[l.cfg.ID]) != 0 {
+		t.Fatalf("applied without a quorum: %v", tc.applied[l.cfg.ID])
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	tc := newTestCluster(t, "solo")
+	l := tc.leader()
+	if err := l.Propose([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	tc.waitApplied("solo", []string{"x"})
+
+	// a restart keeps the log and the term
+	term := l.Status().Term
+	tc.stop("solo")
+	tc.start("solo")
+	l = tc.leader()
+	if l.Status().Term <= term {
+		t.Fatalf("term went from %d to %d", term, l.Status().Term)
+	}
+	tc.waitApplied("solo", []string{"x"})
+}
+
+func TestCommitIndexNeverGoesBack(t *testing.T) {
+	n, err := New(Config{ID: "a", Peers: map[string]string{"b": "http://127.0.0.1:1"}, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+
+	entries := []Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	if resp, err := n.handleAppend(appendRequest{Term: 1, Leader: "b", Entries: entries, Commit: 3}); err != nil || !resp.Success {
+		t.Fatalf("append: %+v, %v", resp, err)
+	}
+	// a heartbeat that was sent before the others, with a newer commit
+	if resp, err := n.handleAppend(appendRequest{Term: 1, Leader: "b", PrevIndex: 1, PrevTerm: 1, Commit: 4}); err != nil || !resp.Success {
+		t.Fatalf("heartbeat: %+v, %v", resp, err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.commitIndex != 3 {
+		t.Errorf("commit index %d, want 3", n.commitIndex)
+	}
+}
@@ -0,0 +1,180 @@
+// Package shardmap splits the keyspace of a tinydb cluster between
+// several masters, each keeping the index of one key range.
+//
+// A key is routed by what a request addresses: its URL path without the
+// leading slash, so "photos/cat.jpg" for a plain key and
+// "b/<bucket>/<key>" for a key in a bucket. The shards' ranges are
+// contiguous and together cover every key; the first starts at "" and the
+// last has no end.
+package shardmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Shard is one master and the keys it owns, Start <= key < End. An empty
+// End means the shard goes up to the end of the keyspace.
+type Shard struct {
+	ID     string `json:"id"`
+	Start  string `json:"start"`
+	End    string `json:"end,omitempty"`
+	Master string `json:"master"`
+}
+
+func (s Shard) Contains(key string) bool {
+	return key >= s.Start && (s.End == "" || key < s.End)
+}
+
+// Overlaps reports whether the shard owns any key in [start, end), where
+// an empty end again means no end.
+func (s Shard) Overlaps(start, end string) bool {
+	return (end == "" || s.Start < end) && (s.End == "" || start < s.End)
+}
+
+// Map is the shards of a cluster in key order. Version goes up with every
+// change so routers can tell which of two maps is newer.
+type Map struct {
+	Version int     `json:"version"`
+	Shards  []Shard `json:"shards"`
+}
+
+// Validate checks that the shards cover the keyspace without gaps or
+// overlaps and have distinct IDs.
+func (m Map) Validate() error {
+	if len(m.Shards) == 0 {
+		return fmt.Errorf("no shards")
+	}
+	ids := map[string]bool{}
+	for i, s := range m.Shards {
+		if s.ID == "" || s.Master == "" {
+			return fmt.Errorf("shard %d needs an id and a master", i)
+		}
+		if ids[s.ID] {
+			return fmt.Errorf("shard %s listed twice", s.ID)
+		}
+		ids[s.ID] = true
+		if i == 0 && s.Start != "" {
+			return fmt.Errorf("shard %s: the first shard must start at \"\"", s.ID)
+		}
+		if i > 0 && s.Start != m.Shards[i-1].End {
+			return fmt.Errorf("shard %s starts at %q, not where %s ends", s.ID, s.Start, m.Shards[i-1].ID)
+		}
+		last := i == len(m.Shards)-1
+		if last != (s.End == "") {
+			return fmt.Errorf("shard %s: only the last shard has no end", s.ID)
+		}
+		if !last && s.End <= s.Start {
+			return fmt.Errorf("shard %s ends before it starts", s.ID)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the shard that owns key.
+func (m Map) Lookup(key string) Shard {
+	i := sort.Search(len(m.Shards), func(i int) bool {
+		return m.Shards[i].End == "" || key < m.Shards[i].End
+	})
+	return m.Shards[i]
+}
+
+// Overlapping returns the shards owning keys in [start, end), in order.
+func (m Map) Overlapping(start, end string) []Shard {
+	var shards []Shard
+	for _, s := range m.Shards {
+		if s.Overlaps(start, end) {
+			shards = append(shards, s)
+		}
+	}
+	return shards
+}
+
+// Get returns the shard with the given ID.
+func (m Map) Get(id string) (Shard, bool) {
+	for _, s := range m.Shards {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Shard{}, false
+}
+
+// Split returns the map with the keys of shard id from at on moved to a
+// new shard, newID on master. The original map is left alone.
+func (m Map) Split(id, at, newID, master string) (Map, error) {
+	if _, dup := m.Get(newID); dup {
+		return m, fmt.Errorf("shard %s already exists", newID)
+	}
+	for i, s := range m.Shards {
+		if s.ID != id {
+			continue
+		}
+		if at <= s.Start || !s.Contains(at) {
+			return m, fmt.Errorf("%q is not inside shard %s", at, id)
+		}
+		split := Map{Version: m.Version + 1}
+		split.Shards = append(split.Shards, m.Shards[:i]...)
+		split.Shards = append(split.Shards,
+			Shard{ID: s.ID, Start: s.Start, End: at, Master: s.Master},
+			Shard{ID: newID, Start: at, End: s.End, Master: master})
+		split.Shards = append(split.Shards, m.Shards[i+1:]...)
+		return split, split.Validate()
+	}
+	return m, fmt.Errorf("no shard %s", id)
+}
+
+// PrefixRange returns the range of keys starting with prefix, for
+// Overlapping.
+func PrefixRange(prefix string) (start, end string) {
+	// the end is the prefix with its last byte counted up, dropping
+	// trailing 0xff bytes that can't be
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return prefix, string(b[:i+1])
+		}
+	}
+	return prefix, ""
+}
+
+// Load reads a map from a JSON file and validates it.
+func Load(path string) (Map, error) {
+	var m Map
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return m, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Save writes m to path in one rename, so routers never read half a map.
+func (m Map) Save(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
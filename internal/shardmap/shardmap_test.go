@@ -0,0 +1,110 @@
+package shardmap
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitAndLookup(t *testing.T) {
+	m := Map{Shards: []Shard{{ID: "s1", Master: "http://m1"}}}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := m.Split("s1", "m", "s2", "http://m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = m.Split("s2", "t", "s3", "http://m3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 2 {
+		t.Errorf("version %d after two splits", m.Version)
+	}
+
+	for key, want := range map[string]string{
+		"":            "s1",
+		"apple":       "s1",
+		"b/bucket/k":  "s1",
+		"m":           "s2",
+		"photos/a":    "s2",
+		"t":           "s3",
+		"zebra":       "s3",
+		"\xff\xffend": "s3",
+	} {
+		if got := m.Lookup(key).ID; got != want {
+			t.Errorf("Lookup(%q) = %s, want %s", key, got, want)
+		}
+	}
+
+	var ids []string
+	for _, s := range m.Overlapping(PrefixRange("p")) {
+		ids = append(ids, s.ID)
+	}
+	if len(ids) != 1 || ids[0] != "s2" {
+		t.Errorf("shards with keys under p: %v", ids)
+	}
+	if got := m.Overlapping(PrefixRange("")); len(got) != 3 {
+		t.Errorf("shards with any key: %v", got)
+	}
+	if got := m.Overlapping("l", "n"); len(got) != 2 {
+		t.Errorf("shards with keys in [l, n): %v", got)
+	}
+
+	for _, bad := range []struct{ id, at string }{
+		{"s2", "m"},   // the shard's own start
+		{"s2", "zz"},  // outside the shard
+		{"nope", "x"}, // no such shard
+	} {
+		if _, err := m.Split(bad.id, bad.at, "s9", "http://m9"); err == nil {
+			t.Errorf("Split(%s, %q) succeeded", bad.id, bad.at)
+		}
+	}
+	if _, err := m.Split("s1", "c", "s2", "http://m9"); err == nil {
+		t.Error("Split reused a shard ID")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, m := range map[string]Map{
+		"gap":     {Shards: []Shard{{ID: "a", End: "m", Master: "x"}, {ID: "b", Start: "n", Master: "y"}}},
+		"bounded": {Shards: []Shard{{ID: "a", End: "m", Master: "x"}}},
+		"start":   {Shards: []Shard{{ID: "a", Start: "a", Master: "x"}}},
+		"master":  {Shards: []Shard{{ID: "a"}}},
+		"empty":   {},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("%s: valid", name)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shards.json")
+	m, _ := Map{Shards: []Shard{{ID: "s1", Master: "http://m1"}}}.Split("s1", "k", "s2", "http://m2")
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != m.Version || len(got.Shards) != 2 || got.Shards[1] != m.Shards[1] {
+		t.Errorf("loaded %+v, saved %+v", got, m)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	for prefix, want := range map[string][2]string{
+		"":         {"", ""},
+		"abc":      {"abc", "abd"},
+		"a\xff":    {"a\xff", "b"},
+		"\xff\xff": {"\xff\xff", ""},
+	} {
+		start, end := PrefixRange(prefix)
+		if start != want[0] || end != want[1] {
+			t.Errorf("PrefixRange(%q) = %q, %q", prefix, start, end)
+		}
+	}
+}
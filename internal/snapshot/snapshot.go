@@ -0,0 +1,157 @@
+// Package snapshot writes and reads archives of the master's index.
+//
+// An archive is a gzip stream holding a magic line, a JSON header and then
+// every key and value in key order:
+//
+//	"tinydb-snapshot 1\n" | uvarint len | header
+//	1 | uvarint len | key | uvarint len | value     for every entry
+//	0 | uvarint number of entries
+//
+// The trailer lets a reader tell a complete archive from a cut off one.
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const magic = "tinydb-snapshot 1\n"
+
+// maxFieldSize guards against reading garbage as a huge length.
+const maxFieldSize = 1 << 30
+
+var ErrFormat = errors.New("snapshot: not a tinydb snapshot or damaged")
+
+type Header struct {
+	Created time.Time `json:"created"`
+	// ChangelogSeq is the last change log entry the snapshot includes,
+	// 0 if the master doesn't keep a change log.
+	ChangelogSeq uint64 `json:"changelog_seq"`
+}
+
+// Iterator yields the entries to archive, leveldb's iterators are one.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+// Write writes an archive of everything iter yields to w and returns the
+// number of entries.
+func Write(w io.Writer, h Header, iter Iterator) (int, error) {
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+
+	hdr, err := json.Marshal(h)
+	if err != nil {
+		return 0, err
+	}
+	bw.WriteString(magic)
+	writeField(bw, hdr)
+
+	n := 0
+	for iter.Next() {
+		bw.WriteByte(1)
+		writeField(bw, iter.Key())
+		if err := writeField(bw, iter.Value()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return n, err
+	}
+	bw.WriteByte(0)
+	bw.Write(binary.AppendUvarint(nil, uint64(n)))
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	return n, zw.Close()
+}
+
+func writeField(w *bufio.Writer, b []byte) error {
+	w.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	_, err := w.Write(b)
+	return err
+}
+
+// Reader reads an archive.
+type Reader struct {
+	Header Header
+
+	r    *bufio.Reader
+	n    uint64
+	done bool
+}
+
+// NewReader reads the archive's header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	sr := &Reader{r: bufio.NewReader(zr)}
+
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(sr.r, m); err != nil || string(m) != magic {
+		return nil, ErrFormat
+	}
+	hdr, err := sr.field()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(hdr, &sr.Header); err != nil {
+		return nil, fmt.Errorf("snapshot: bad header: %v", err)
+	}
+	return sr, nil
+}
+
+// Next returns the next entry, or io.EOF after the last one.
+func (sr *Reader) Next() (key, value []byte, err error) {
+	if sr.done {
+		return nil, nil, io.EOF
+	}
+	tag, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, nil, ErrFormat
+	}
+	switch tag {
+	case 0:
+		n, err := binary.ReadUvarint(sr.r)
+		if err != nil || n != sr.n {
+			return nil, nil, ErrFormat
+		}
+		sr.done = true
+		return nil, nil, io.EOF
+	case 1:
+	default:
+		return nil, nil, ErrFormat
+	}
+	if key, err = sr.field(); err != nil {
+		return nil, nil, err
+	}
+	if value, err = sr.field(); err != nil {
+		return nil, nil, err
+	}
+	sr.n++
+	return key, value, nil
+}
+
+func (sr *Reader) field() ([]byte, error) {
+	n, err := binary.ReadUvarint(sr.r)
+	if err != nil || n > maxFieldSize {
+		return nil, ErrFormat
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return nil, ErrFormat
+	}
+	return b, nil
+}
@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRoundTrip(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i)), nil)
+	}
+	db.Put([]byte("\x00empty"), nil, nil)
+
+	var buf bytes.Buffer
+	h := Header{Created: time.Unix(1700000000, 0).UTC(), ChangelogSeq: 42}
+	iter := db.NewIterator(nil, nil)
+	n, err := Write(&buf, h, iter)
+	iter.Release()
+	if err != nil || n != 101 {
+		t.Fatalf("Write: got %d entries, %v", n, err)
+	}
+	archive := buf.Bytes()
+
+	sr, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Header != h {
+		t.Errorf("header: got %+v want %+v", sr.Header, h)
+	}
+	got := 0
+	for {
+		k, v, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := db.Get(k, nil); !bytes.Equal(v, want) {
+			t.Errorf("%q: got %q want %q", k, v, want)
+		}
+		got++
+	}
+	if got != 101 {
+		t.Errorf("read %d entries, want 101", got)
+	}
+
+	// a cut off archive is an error, not a shorter snapshot
+	sr, err = NewReader(bytes.NewReader(archive[:len(archive)/2]))
+	if err == nil {
+		for err == nil {
+			_, _, err = sr.Next()
+		}
+	}
+	if err == io.EOF {
+		t.Errorf("a truncated archive read to the end")
+	}
+}
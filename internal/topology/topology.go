@@ -0,0 +1,87 @@
+// Package topology describes the volume servers of a tinydb cluster and
+// decides which of them hold a key.
+//
+// Volume servers are grouped: every blob is written to all replicas of one
+// group. Each group has a storage class, or tier, such as "ssd" or "hdd",
+// and a key goes to the group its hash picks among the groups of its class.
+package topology
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DefaultClass is the storage class of keys outside buckets and of groups
+// that don't name one.
+const DefaultClass = "standard"
+
+type VolumeGroup struct {
+	Replicas []string `json:"replicas"`
+	// Class is the storage class, or tier, of the group: buckets pick
+	// their volume groups by it and lifecycle rules move keys between
+	// classes, e.g. from "ssd" to "hdd" groups.
+	Class string `json:"class"`
+}
+
+// Default is the cluster of twelve local volume servers that the master
+// uses unless it is told otherwise.
+var Default = []VolumeGroup{
+	{Class: DefaultClass, Replicas: []string{"http://localhost:3001", "http://localhost:3002", "http://localhost:3003"}},
+	{Class: DefaultClass, Replicas: []string{"http://localhost:3004", "http://localhost:3005", "http://localhost:3006"}},
+	{Class: DefaultClass, Replicas: []string{"http://localhost:3007", "http://localhost:3008", "http://localhost:3009"}},
+	{Class: DefaultClass, Replicas: []string{"http://localhost:3010", "http://localhost:3011", "http://localhost:3012"}},
+}
+
+// Load reads volume groups from a JSON file,
+// [{"class": "ssd", "replicas": ["http://host:3001", ...]}, ...].
+// Groups without a class are in the default one, which needs at least one
+// group because keys outside buckets go there.
+func Load(path string) ([]VolumeGroup, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []VolumeGroup
+	if err := json.Unmarshal(b, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	hasDefault := false
+	for i := range groups {
+		if len(groups[i].Replicas) == 0 {
+			return nil, fmt.Errorf("%s: volume group %d has no replicas", path, i)
+		}
+		if groups[i].Class == "" {
+			groups[i].Class = DefaultClass
+		}
+		hasDefault = hasDefault || groups[i].Class == DefaultClass
+	}
+	if !hasDefault {
+		return nil, fmt.Errorf("%s: no volume group has the %q storage class", path, DefaultClass)
+	}
+	return groups, nil
+}
+
+// OfClass returns the groups of the given storage class.
+func OfClass(groups []VolumeGroup, class string) []VolumeGroup {
+	var of []VolumeGroup
+	for _, g := range groups {
+		if g.Class == class {
+			of = append(of, g)
+		}
+	}
+	return of
+}
+
+// Pick returns the group key belongs in among the groups of the given
+// storage class, and its index among them. The class must have at least
+// one group.
+func Pick(groups []VolumeGroup, key string, class string) (VolumeGroup, int) {
+	of := OfClass(groups, class)
+	//hash the key
+	hash := md5.Sum([]byte(key))
+	//take the hash and calculate the volumeServer Index cool?
+	x := int(hash[0]) % len(of)
+	return of[x], x
+}
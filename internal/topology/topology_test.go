@@ -0,0 +1,55 @@
+package topology
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPickStaysInClass(t *testing.T) {
+	groups := []VolumeGroup{
+		{Class: DefaultClass, Replicas: []string{"a1", "a2"}},
+		{Class: "cold", Replicas: []string{"c1", "c2"}},
+		{Class: DefaultClass, Replicas: []string{"b1", "b2"}},
+	}
+	for _, key := range []string{"a", "b", "photos/cat.jpg", "b/bucket/key"} {
+		if g, _ := Pick(groups, key, "cold"); g.Replicas[0] != "c1" {
+			t.Errorf("Pick(%q, cold) = %v", key, g.Replicas)
+		}
+		g, _ := Pick(groups, key, DefaultClass)
+		if g.Class != DefaultClass {
+			t.Errorf("Pick(%q, standard) = a %s group", key, g.Class)
+		}
+		// the same key always lands on the same group
+		if again, _ := Pick(groups, key, DefaultClass); again.Replicas[0] != g.Replicas[0] {
+			t.Errorf("Pick(%q) is not stable", key)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "groups.json")
+		os.WriteFile(p, []byte(content), 0644)
+		return p
+	}
+
+	groups, err := Load(write(`[{"replicas": ["http://a:1"]}, {"class": "hdd", "replicas": ["http://b:1"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0].Class != DefaultClass || groups[1].Class != "hdd" {
+		t.Errorf("classes: got %q and %q", groups[0].Class, groups[1].Class)
+	}
+
+	for _, bad := range []string{
+		`[{"class": "hdd", "replicas": ["http://b:1"]}]`,
+		`[{"replicas": []}]`,
+		`{"replicas": ["http://a:1"]}`,
+	} {
+		if _, err := Load(write(bad)); err == nil {
+			t.Errorf("Load(%s) succeeded", bad)
+		}
+	}
+}